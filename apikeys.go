@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ====================================================================
+// CLAVES DE API (clientes máquina a máquina)
+// Escáneres de almacén y procesos batch se autentican con una clave en vez de
+// /login: X-API-Key: <clave> o Authorization: ApiKey <clave>. La clave tiene la
+// forma ak_<prefijo>_<secreto>; el prefijo la identifica (se guarda en claro y
+// se muestra en los listados) y del total solo se guarda el SHA-256. La clave
+// completa se devuelve una única vez, al crearla.
+// ====================================================================
+
+// Alcances de las claves
+const (
+	ScopeProductsRead  = "products:read"
+	ScopeProductsWrite = "products:write"
+	ScopeStockWrite    = "stock:write"
+	ScopeOrdersRead    = "orders:read"
+	ScopeOrdersWrite   = "orders:write"
+)
+
+var apiKeyScopes = []string{ScopeProductsRead, ScopeProductsWrite, ScopeStockWrite, ScopeOrdersRead, ScopeOrdersWrite}
+
+// apiKeyGroupScopes: Alcance que exige un grupo de rutas a las claves, según sea
+// lectura (GET/HEAD) o escritura. "" = las claves no tienen acceso.
+type apiKeyGroupScopes struct{ Read, Write string }
+
+func (g apiKeyGroupScopes) forMethod(method string) string {
+	if method == http.MethodGet || method == http.MethodHead {
+		return g.Read
+	}
+	return g.Write
+}
+
+// apiKeyRouteScopes: Grupos de rutas abiertos a las claves. Los que no figuran
+// (admin, webhooks, carrito, GraphQL) solo aceptan JWT.
+var apiKeyRouteScopes = map[string]apiKeyGroupScopes{
+	"/productos":    {ScopeProductsRead, ScopeProductsWrite},
+	"/skus":         {ScopeProductsRead, ScopeStockWrite},
+	"/orders":       {ScopeOrdersRead, ScopeOrdersWrite},
+	"/categorias":   {ScopeProductsRead, ""},
+	"/tipos-cambio": {ScopeProductsRead, ""},
+}
+
+// apiKeyScopeForRoute: Alcance que exige a las claves una ruta de apiOperations
+// ("/productos/{id}", sin prefijo de versión); "" si solo acepta JWT.
+func apiKeyScopeForRoute(method, path string) string {
+	group, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return apiKeyRouteScopes["/"+group].forMethod(method)
+}
+
+// ApiKeyHeader: Cabecera alternativa a Authorization: ApiKey <clave>.
+const ApiKeyHeader = "X-API-Key"
+
+const apiKeyPrefix = "ak_"
+
+// ContextKeyAPIKey: La clave con la que se autenticó la petición (nil con JWT).
+const ContextKeyAPIKey ContextKey = "apiKey"
+
+var (
+	ErrAPIKeyNotFound = errors.New("clave de API no encontrada")
+	ErrAPIKeyInvalid  = errors.New("clave de API inválida, vencida o revocada")
+	ErrAPIKeyOwner    = errors.New("el usuario indicado no existe")
+)
+
+// APIKey: Metadatos de una clave. Key solo se devuelve al crearla.
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Key        string     `json:"key,omitempty"`
+	UserID     int        `json:"user_id"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedBy  int        `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// HasScope: true si la clave tiene el alcance.
+func (k *APIKey) HasScope(scope string) bool {
+	return scope != "" && slices.Contains(k.Scopes, scope)
+}
+
+// validate revisa nombre, alcances y vencimiento de una clave nueva.
+func (k *APIKey) validate(now time.Time) error {
+	k.Name = strings.TrimSpace(k.Name)
+	if k.Name == "" {
+		return errors.New("name es requerido")
+	}
+	if len(k.Name) > 100 {
+		return errors.New("name no puede superar los 100 caracteres")
+	}
+	if len(k.Scopes) == 0 {
+		return errors.New("scopes no puede estar vacío")
+	}
+	for _, scope := range k.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			return fmt.Errorf("alcance desconocido %q (válidos: %v)", scope, apiKeyScopes)
+		}
+	}
+	slices.Sort(k.Scopes)
+	k.Scopes = slices.Compact(k.Scopes)
+	if k.ExpiresAt != nil && !k.ExpiresAt.After(now) {
+		return errors.New("expires_at debe ser una fecha futura")
+	}
+	return nil
+}
+
+// newAPIKeySecret genera la clave completa y su prefijo: 6 bytes aleatorios de
+// prefijo (legibles en los listados) y 32 de secreto.
+func newAPIKeySecret() (key, prefix string, err error) {
+	buf := make([]byte, 38)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("no se pudo generar la clave: %w", err)
+	}
+	prefix = apiKeyPrefix + hex.EncodeToString(buf[:6])
+	return prefix + "_" + hex.EncodeToString(buf[6:]), prefix, nil
+}
+
+// hashAPIKey: SHA-256 de la clave. Alcanza con un hash rápido (a diferencia de las
+// contraseñas): la clave tiene 256 bits aleatorios y no se puede adivinar.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseAPIKeyPrefix extrae "ak_<prefijo>" de la clave presentada.
+func parseAPIKeyPrefix(key string) (string, bool) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", false
+	}
+	prefix, secret, ok := strings.Cut(key[len(apiKeyPrefix):], "_")
+	if !ok || len(prefix) != 12 || len(secret) != 64 {
+		return "", false
+	}
+	return apiKeyPrefix + prefix, true
+}
+
+// ====================================================================
+// DAO
+// ====================================================================
+
+const apiKeyColumns = `id, name, prefix, user_id, scopes, expires_at, last_used_at, created_by, created_at`
+
+func scanAPIKey(scanner interface{ Scan(...any) error }, extra ...any) (APIKey, error) {
+	var k APIKey
+	var expiresAt, lastUsedAt sql.NullTime
+	dest := append([]any{&k.ID, &k.Name, &k.Prefix, &k.UserID, pq.Array(&k.Scopes), &expiresAt, &lastUsedAt, &k.CreatedBy, &k.CreatedAt}, extra...)
+	if err := scanner.Scan(dest...); err != nil {
+		return APIKey{}, err
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	return k, nil
+}
+
+// GetAPIKeys lista las claves (sin secretos), las más recientes primero.
+func GetAPIKeys(ctx context.Context, db *sql.DB) ([]APIKey, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys ORDER BY id DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar claves de API: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error al leer clave de API: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al leer claves de API: %w", queryError(ctx, err))
+	}
+	return keys, nil
+}
+
+// GetAPIKey devuelve una clave (sin secreto) o ErrAPIKeyNotFound.
+func GetAPIKey(ctx context.Context, db *sql.DB, id int) (APIKey, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	k, err := scanAPIKey(db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, fmt.Errorf("error al consultar clave de API: %w", queryError(ctx, err))
+	}
+	return k, nil
+}
+
+// CreateAPIKey genera la clave, guarda su hash y la devuelve completa en Key.
+func CreateAPIKey(ctx context.Context, db *sql.DB, k APIKey) (APIKey, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	key, prefix, err := newAPIKeySecret()
+	if err != nil {
+		return APIKey{}, err
+	}
+	k.Key, k.Prefix = key, prefix
+
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO api_keys (name, prefix, key_hash, user_id, scopes, expires_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`,
+		k.Name, k.Prefix, hashAPIKey(key), k.UserID, pq.Array(k.Scopes), k.ExpiresAt, k.CreatedBy,
+	).Scan(&k.ID, &k.CreatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+		return APIKey{}, ErrAPIKeyOwner
+	}
+	if err != nil {
+		return APIKey{}, fmt.Errorf("error al crear clave de API: %w", queryError(ctx, err))
+	}
+	return k, nil
+}
+
+// DeleteAPIKey revoca la clave: deja de autenticar en la siguiente petición.
+func DeleteAPIKey(ctx context.Context, db *sql.DB, id int) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error al revocar clave de API: %w", queryError(ctx, err))
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// FindAPIKey busca la clave por su prefijo y compara el hash en tiempo constante.
+// Una clave mal formada, desconocida o vencida devuelve ErrAPIKeyInvalid.
+func FindAPIKey(ctx context.Context, db *sql.DB, key string, now time.Time) (APIKey, error) {
+	prefix, ok := parseAPIKeyPrefix(key)
+	if !ok {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var keyHash string
+	k, err := scanAPIKey(db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+`, key_hash FROM api_keys WHERE prefix = $1`, prefix), &keyHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return APIKey{}, fmt.Errorf("error al consultar clave de API: %w", queryError(ctx, err))
+	}
+	if subtle.ConstantTimeCompare([]byte(keyHash), []byte(hashAPIKey(key))) != 1 {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+	if k.ExpiresAt != nil && !k.ExpiresAt.After(now) {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+	return k, nil
+}
+
+// TouchAPIKey registra el uso de la clave.
+func TouchAPIKey(ctx context.Context, db *sql.DB, id int) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, `UPDATE api_keys SET last_used_at = NOW() WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("error al registrar uso de clave de API: %w", queryError(ctx, err))
+	}
+	return nil
+}
+
+// ====================================================================
+// AUTENTICACIÓN
+// ====================================================================
+
+// APIKeyAuth valida las claves presentadas a AuthMiddleware. Un *APIKeyAuth nil
+// (API_KEYS_ENABLED=false) no acepta claves.
+type APIKeyAuth struct {
+	DB       *sql.DB
+	Resolver *ClientIPResolver
+	// LastUsedInterval: last_used_at se escribe como mucho una vez por intervalo y
+	// clave, para no hacer un UPDATE por petición.
+	LastUsedInterval time.Duration
+
+	mu       sync.Mutex
+	lastUsed map[int]time.Time
+	now      func() time.Time
+}
+
+func NewAPIKeyAuth(db *sql.DB, resolver *ClientIPResolver, cfg APIKeysConfig) *APIKeyAuth {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &APIKeyAuth{
+		DB:               db,
+		Resolver:         resolver,
+		LastUsedInterval: time.Duration(cfg.LastUsedInterval),
+		lastUsed:         make(map[int]time.Time),
+		now:              time.Now,
+	}
+}
+
+// requestAPIKey devuelve la clave de X-API-Key o de Authorization: ApiKey.
+func requestAPIKey(r *http.Request) (string, bool) {
+	if key := r.Header.Get(ApiKeyHeader); key != "" {
+		return key, true
+	}
+	scheme, key, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "ApiKey") {
+		return strings.TrimSpace(key), true
+	}
+	return "", false
+}
+
+// Authenticate valida la clave y devuelve el contexto con su identidad: el
+// usuario dueño de la clave, sin rol (lo que puede hacer lo deciden los alcances,
+// ver RequireScope) y la propia clave en ContextKeyAPIKey.
+func (a *APIKeyAuth) Authenticate(r *http.Request, key string) (context.Context, error) {
+	now := a.now()
+	k, err := FindAPIKey(r.Context(), a.DB, key, now)
+	if err != nil {
+		if errors.Is(err, ErrAPIKeyInvalid) {
+			LogSecurityEvent(r.Context(), SecurityEvent{Type: SecurityEventAPIKeyRejected, IP: a.clientIP(r), Detail: apiKeyDetail(key)})
+		}
+		return nil, err
+	}
+	a.touch(r.Context(), k.ID, now)
+
+	ctx := context.WithValue(r.Context(), ContextKeyUserID, k.UserID)
+	ctx = context.WithValue(ctx, ContextKeyRole, "")
+	return context.WithValue(ctx, ContextKeyAPIKey, &k), nil
+}
+
+// touch actualiza last_used_at si pasó LastUsedInterval desde la última vez. Un
+// error no rechaza la petición: es solo un dato de auditoría.
+func (a *APIKeyAuth) touch(ctx context.Context, id int, now time.Time) {
+	a.mu.Lock()
+	if last, ok := a.lastUsed[id]; ok && now.Sub(last) < a.LastUsedInterval {
+		a.mu.Unlock()
+		return
+	}
+	a.lastUsed[id] = now
+	a.mu.Unlock()
+
+	if err := TouchAPIKey(context.WithoutCancel(ctx), a.DB, id); err != nil {
+		slog.Warn("Error al registrar uso de la clave", "key_id", id, "err", err)
+	}
+}
+
+func (a *APIKeyAuth) clientIP(r *http.Request) string {
+	if a.Resolver == nil {
+		return r.RemoteAddr
+	}
+	return a.Resolver.ClientIP(r)
+}
+
+// apiKeyDetail: Solo el prefijo de la clave rechazada llega al log, nunca el secreto.
+func apiKeyDetail(key string) string {
+	if prefix, ok := parseAPIKeyPrefix(key); ok {
+		return prefix
+	}
+	return "formato inválido"
+}
+
+// GetAPIKeyFromContext devuelve la clave con la que se autenticó la petición (nil con JWT).
+func GetAPIKeyFromContext(r *http.Request) *APIKey {
+	k, _ := r.Context().Value(ContextKeyAPIKey).(*APIKey)
+	return k
+}
+
+// RequireScope exige a las peticiones con clave el alcance del grupo de rutas
+// (ver apiKeyRouteScopes): el de lectura en GET/HEAD y el de escritura en el
+// resto. Las peticiones con JWT pasan sin cambios. Debe montarse DESPUÉS de
+// AuthMiddleware.
+func RequireScope(group string) func(next http.Handler) http.Handler {
+	scopes, ok := apiKeyRouteScopes[group]
+	if !ok {
+		panic(fmt.Sprintf("RequireScope: grupo sin alcances %q", group))
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := GetAPIKeyFromContext(r)
+			if key == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !key.HasScope(scopes.forMethod(r.Method)) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ====================================================================
+// HANDLERS (solo admin)
+// ====================================================================
+
+func respondAPIKeyError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, ErrAPIKeyNotFound):
+		http.Error(w, "Clave de API no encontrada", http.StatusNotFound)
+	case errors.Is(err, ErrAPIKeyOwner):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		respondDBError(w, err, action)
+	}
+}
+
+// GET /admin/claves-api: Lista las claves (sin secretos)
+func ListAPIKeysHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := GetAPIKeys(r.Context(), db)
+		if err != nil {
+			respondDBError(w, err, "listar claves de API")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	}
+}
+
+// GET /admin/claves-api/{id}: Devuelve una clave (sin secreto)
+func GetAPIKeyHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+		key, err := GetAPIKey(r.Context(), db, id)
+		if err != nil {
+			respondAPIKeyError(w, err, "obtener clave de API")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(key)
+	}
+}
+
+// POST /admin/claves-api: Crea una clave. La respuesta es la única que la incluye.
+// user_id es el dueño (por defecto, el admin que la crea); sin expires_at vence
+// a los API_KEYS_DEFAULT_TTL (0 = sin vencimiento).
+func CreateAPIKeyHandler(db *sql.DB, cfg APIKeysConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// 1. Identidad del admin
+		adminID, err := GetUserIDFromContext(r)
+		if err != nil {
+			http.Error(w, "Sesión de usuario inválida o ausente", http.StatusUnauthorized)
+			return
+		}
+
+		// 2. Decodificar y validar
+		var key APIKey
+		if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+			http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		if err := key.validate(now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if key.UserID == 0 {
+			key.UserID = adminID
+		}
+		if key.ExpiresAt == nil && cfg.DefaultTTL > 0 {
+			expiresAt := now.Add(time.Duration(cfg.DefaultTTL)).Truncate(time.Second)
+			key.ExpiresAt = &expiresAt
+		}
+		key.CreatedBy = adminID
+
+		// 3. Crear
+		created, err := CreateAPIKey(r.Context(), db, key)
+		if err != nil {
+			respondAPIKeyError(w, err, "crear clave de API")
+			return
+		}
+		LogSecurityEvent(r.Context(), SecurityEvent{Type: SecurityEventAPIKeyCreated, UserID: adminID, Detail: created.Prefix})
+
+		// 4. Respuesta 201 Created con la clave completa
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+// DELETE /admin/claves-api/{id}: Revoca una clave
+func DeleteAPIKeyHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+		if err := DeleteAPIKey(r.Context(), db, id); err != nil {
+			respondAPIKeyError(w, err, "revocar clave de API")
+			return
+		}
+		adminID, _ := GetUserIDFromContext(r)
+		LogSecurityEvent(r.Context(), SecurityEvent{Type: SecurityEventAPIKeyRevoked, UserID: adminID, Detail: fmt.Sprint(id)})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test: La clave lleva su prefijo y solo ese prefijo se acepta como identificador
+func TestAPIKeyFormat(t *testing.T) {
+	key, prefix, err := newAPIKeySecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, prefix+"_") {
+		t.Fatalf("La clave %q no empieza por su prefijo %q", key, prefix)
+	}
+	if got, ok := parseAPIKeyPrefix(key); !ok || got != prefix {
+		t.Errorf("parseAPIKeyPrefix: got %q %v", got, ok)
+	}
+	if len(hashAPIKey(key)) != 64 || hashAPIKey(key) == hashAPIKey(key+"x") {
+		t.Error("hashAPIKey debe ser un SHA-256 en hex")
+	}
+	for _, invalid := range []string{"", "ak_", prefix, "sk_" + key[3:], key[:len(key)-1]} {
+		if _, ok := parseAPIKeyPrefix(invalid); ok {
+			t.Errorf("%q debía rechazarse", invalid)
+		}
+	}
+}
+
+// Test: Alcances conocidos, sin duplicados, y vencimiento futuro
+func TestAPIKeyValidate(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	invalid := []APIKey{
+		{Name: " ", Scopes: []string{ScopeProductsRead}},
+		{Name: "escáner", Scopes: nil},
+		{Name: "escáner", Scopes: []string{"products:delete"}},
+		{Name: "escáner", Scopes: []string{ScopeProductsRead}, ExpiresAt: &past},
+	}
+	for _, k := range invalid {
+		if err := k.validate(now); err == nil {
+			t.Errorf("%+v debía rechazarse", k)
+		}
+	}
+
+	k := APIKey{Name: " escáner ", Scopes: []string{ScopeStockWrite, ScopeProductsRead, ScopeStockWrite}}
+	if err := k.validate(now); err != nil {
+		t.Fatal(err)
+	}
+	if k.Name != "escáner" || len(k.Scopes) != 2 || k.Scopes[0] != ScopeProductsRead {
+		t.Errorf("got %+v", k)
+	}
+}
+
+// setAPIKeyRow: La fila que FindAPIKey leerá para cualquier prefijo.
+func setAPIKeyRow(server *fakeServer, key string, scopes string, expiresAt any) {
+	prefix, _ := parseAPIKeyPrefix(key)
+	server.SetRows(
+		[]string{"id", "name", "prefix", "user_id", "scopes", "expires_at", "last_used_at", "created_by", "created_at", "key_hash"},
+		[]driver.Value{int64(3), "escáner", prefix, int64(7), []byte(scopes), expiresAt, nil, int64(1), time.Now(), hashAPIKey(key)},
+	)
+}
+
+func countQueries(queries []string, prefix string) int {
+	n := 0
+	for _, q := range queries {
+		if strings.HasPrefix(strings.TrimSpace(q), prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// Test: AuthMiddleware acepta la clave en X-API-Key o Authorization: ApiKey con la
+// identidad de su dueño; el resto de las peticiones sigue usando el JWT
+func TestAuthMiddlewareAPIKey(t *testing.T) {
+	db, server := openFakeDB(t, "apikeys")
+	key, _, _ := newAPIKeySecret()
+	setAPIKeyRow(server, key, "{products:read}", nil)
+
+	cfg := DefaultConfig().APIKeys
+	apiKeys := NewAPIKeyAuth(db, nil, cfg)
+	handler := AuthMiddleware(testJWTSecret, apiKeys)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := GetUserIDFromContext(r)
+		scopes := ""
+		if k := GetAPIKeyFromContext(r); k != nil {
+			scopes = strings.Join(k.Scopes, ",")
+		}
+		fmt.Fprintf(w, "%d|%s|%s", userID, GetRoleFromContext(r), scopes)
+	}))
+	call := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/productos", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Identidad del dueño, sin rol: lo que puede hacer lo deciden los alcances
+	for _, headers := range []map[string]string{{ApiKeyHeader: key}, {"Authorization": "ApiKey " + key}} {
+		if rr := call(headers); rr.Code != http.StatusOK || rr.Body.String() != "7||products:read" {
+			t.Errorf("%v: got %d %q", headers, rr.Code, rr.Body.String())
+		}
+	}
+	// last_used_at se escribe una vez por intervalo
+	if n := countQueries(server.Queries(), "UPDATE api_keys"); n != 1 {
+		t.Errorf("Se esperaba un UPDATE de last_used_at: %d", n)
+	}
+
+	// Otro secreto con el mismo prefijo, formato inválido o clave vencida: 401
+	forged := key[:len(key)-4] + "0000"
+	if forged == key {
+		forged = key[:len(key)-4] + "1111"
+	}
+	for _, bad := range []string{forged, "no-es-una-clave"} {
+		if rr := call(map[string]string{ApiKeyHeader: bad}); rr.Code != http.StatusUnauthorized {
+			t.Errorf("%q: got %d", bad, rr.Code)
+		}
+	}
+	setAPIKeyRow(server, key, "{products:read}", time.Now().Add(-time.Minute))
+	if rr := call(map[string]string{ApiKeyHeader: key}); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Clave vencida: got %d", rr.Code)
+	}
+
+	// El JWT sigue funcionando
+	token, _ := GenerateToken(1, RoleAdmin, testJWTSecret, time.Hour)
+	if rr := call(map[string]string{"Authorization": "Bearer " + token}); rr.Body.String() != "1|admin|" {
+		t.Errorf("JWT: got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// Sin APIKeyAuth (API_KEYS_ENABLED=false o rutas solo JWT) la clave no vale
+	jwtOnly := AuthMiddleware(testJWTSecret, nil)(handler)
+	req := httptest.NewRequest("GET", "/productos", nil)
+	req.Header.Set(ApiKeyHeader, key)
+	rr := httptest.NewRecorder()
+	jwtOnly.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Solo JWT: got %d", rr.Code)
+	}
+}
+
+// Test: Por el router, la clave solo llega a las rutas y métodos de sus alcances
+func TestAPIKeyScopesInRouter(t *testing.T) {
+	db, server := openFakeDB(t, "apikeys")
+	cfg := DefaultConfig()
+	cfg.JWT.Secret = testJWTSecret
+	cfg.Cache.Backend = "none"
+	router := setupRouter(NewDBCluster(db, nil, time.Second), NewProductEventBroker(cfg.Stream), newTestBlobStore(t), cfg)
+
+	key, _, _ := newAPIKeySecret()
+	setAPIKeyRow(server, key, "{stock:write}", nil)
+	call := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(ApiKeyHeader, key)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Sin products:read ni products:write
+	if code := call("GET", "/api/v2/productos", ""); code != http.StatusForbidden {
+		t.Errorf("GET /productos: got %d", code)
+	}
+	if code := call("POST", "/api/v2/productos", `{"name":"x","price_cents":100,"stock":1}`); code != http.StatusForbidden {
+		t.Errorf("POST /productos: got %d", code)
+	}
+	// stock:write llega al handler del ajuste de stock
+	if code := call("POST", "/api/v2/skus/TS-ROJO-M/stock", `{"delta":-1}`); code == http.StatusUnauthorized || code == http.StatusForbidden {
+		t.Errorf("POST /skus/{sku}/stock: got %d", code)
+	}
+	// Las rutas de administración y GraphQL solo aceptan JWT
+	if code := call("GET", "/api/v2/admin/claves-api", ""); code != http.StatusUnauthorized {
+		t.Errorf("GET /admin/claves-api: got %d", code)
+	}
+	if code := call("GET", "/graphql?query={__typename}", ""); code != http.StatusUnauthorized {
+		t.Errorf("GET /graphql: got %d", code)
+	}
+}
+
+// Test: El admin crea la clave y la recibe completa una sola vez
+func TestCreateAPIKeyHandler(t *testing.T) {
+	db, server := openFakeDB(t, "apikeys")
+	cfg := DefaultConfig()
+	cfg.JWT.Secret = testJWTSecret
+	cfg.API.StrictResponses = true
+	cfg.Idempotency.Backend = "memory"
+	router := setupRouter(NewDBCluster(db, nil, time.Second), NewProductEventBroker(cfg.Stream), newTestBlobStore(t), cfg)
+	server.SetRows([]string{"id", "created_at"}, []driver.Value{int64(3), time.Now()})
+
+	admin, _ := GenerateToken(1, RoleAdmin, testJWTSecret, time.Hour)
+	rr := postWithToken(router, "/api/v2/admin/claves-api", `{"name":"Escáner almacén 1","scopes":["products:read","stock:write"]}`, admin)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got %d %s", rr.Code, rr.Body.String())
+	}
+	var created APIKey
+	if err := json.NewDecoder(rr.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if prefix, ok := parseAPIKeyPrefix(created.Key); !ok || prefix != created.Prefix {
+		t.Errorf("Clave %q con prefijo %q", created.Key, created.Prefix)
+	}
+	if created.UserID != 1 || created.CreatedBy != 1 || created.ExpiresAt == nil {
+		t.Errorf("Dueño y vencimiento por defecto: %+v", created)
+	}
+	if rr.Header().Get("Cache-Control") != "no-store" {
+		t.Error("La respuesta con la clave no debe guardarse en caché")
+	}
+
+	// Con Idempotency-Key el reintento no crea otra clave ni repite la clave en claro:
+	// recibe 409 con el id de la ya creada
+	inserts := countQueries(server.Queries(), "INSERT INTO api_keys")
+	var keys []string
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/api/v2/admin/claves-api", strings.NewReader(`{"name":"Escáner","scopes":["products:read"]}`))
+		req.Header.Set("Authorization", "Bearer "+admin)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(IdempotencyKeyHeader, "clave-api-1")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		keys = append(keys, rr.Body.String())
+		if i == 0 && rr.Code != http.StatusCreated {
+			t.Fatalf("Primer intento: got %d %s", rr.Code, rr.Body.String())
+		}
+		if i == 1 && (rr.Code != http.StatusConflict || rr.Header().Get(IdempotencyReplayedHeader) != "true" || !strings.Contains(rr.Body.String(), "id=3")) {
+			t.Errorf("Reintento: got %d, repetida %q: %s", rr.Code, rr.Header().Get(IdempotencyReplayedHeader), rr.Body.String())
+		}
+	}
+	if n := countQueries(server.Queries(), "INSERT INTO api_keys") - inserts; n != 1 {
+		t.Errorf("El reintento no debe crear otra clave: %d INSERT", n)
+	}
+	var first APIKey
+	json.Unmarshal([]byte(keys[0]), &first)
+	if first.Key == "" || strings.Contains(keys[1], first.Key) {
+		t.Errorf("El reintento no debe repetir la clave en claro: %s", keys[1])
+	}
+
+	// Solo administradores
+	user, _ := GenerateToken(2, "user", testJWTSecret, time.Hour)
+	if rr := postWithToken(router, "/api/v2/admin/claves-api", `{"name":"x","scopes":["products:read"]}`, user); rr.Code != http.StatusForbidden {
+		t.Errorf("Usuario sin rol admin: got %d", rr.Code)
+	}
+	if rr := postWithToken(router, "/api/v2/admin/claves-api", `{"name":"x","scopes":["admin"]}`, admin); rr.Code != http.StatusBadRequest {
+		t.Errorf("Alcance desconocido: got %d", rr.Code)
+	}
+}
@@ -1,12 +1,29 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"sync"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrInvalidCredentials: Usuario inexistente o contraseña incorrecta (indistinguibles a propósito).
+var ErrInvalidCredentials = errors.New("credenciales inválidas")
+
+// dummyPasswordHash: Hash con el mismo costo que los reales. Se compara contra él
+// cuando el usuario no existe, para que la respuesta tarde lo mismo y no se
+// puedan enumerar usuarios midiendo el tiempo.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("contraseña-inexistente"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(fmt.Sprintf("no se pudo generar el hash de relleno: %v", err))
+	}
+	return hash
+})
+
 type User struct {
 	ID           int    `json:"id"`
 	Username     string `json:"username"`
@@ -14,23 +31,29 @@ type User struct {
 	Role         string `json:"role"`
 }
 
-func AuthenticateUser(db *sql.DB, username, password string) (*User, error) {
+func AuthenticateUser(ctx context.Context, db *sql.DB, username, password string) (*User, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	user := &User{}
-	err := db.QueryRow(
+	err := db.QueryRowContext(
+		ctx,
 		"SELECT id, username, password_hash, role FROM users WHERE username = $1",
 		username,
 	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role)
 
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("credenciales inválidas")
+		// Mismo trabajo que con un usuario real (tiempo constante)
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return nil, ErrInvalidCredentials
 	}
 	if err != nil {
-		return nil, fmt.Errorf("error consultando usuario: %w", err)
+		return nil, fmt.Errorf("error consultando usuario: %w", queryError(ctx, err))
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
 	if err != nil {
-		return nil, fmt.Errorf("credenciales inválidas")
+		return nil, ErrInvalidCredentials
 	}
 
 	return user, nil
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ====================================================================
+// ALMACENAMIENTO DE ARCHIVOS (BLOBS)
+// Las imágenes se guardan a través de BlobStore; la DB solo guarda la clave.
+// - LocalBlobStore: disco local, servido por la propia API en /imagenes/.
+// - S3BlobStore: cualquier servicio compatible con S3 (AWS S3, MinIO...).
+// ====================================================================
+
+// ErrBlobNotFound: La clave no existe en el almacenamiento.
+var ErrBlobNotFound = errors.New("blob no encontrado")
+
+// BlobStore: Almacenamiento de archivos por clave ("productos/1/abc.jpg").
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// URL devuelve la dirección pública desde la que se sirve la clave.
+	URL(key string) string
+}
+
+// NewBlobStore crea el almacenamiento configurado en STORAGE_BACKEND.
+func NewBlobStore(ctx context.Context, cfg StorageConfig) (BlobStore, error) {
+	switch cfg.Backend {
+	case "local":
+		return NewLocalBlobStore(cfg.LocalDir, cfg.PublicURL)
+	case "s3":
+		return NewS3BlobStore(ctx, cfg)
+	}
+	return nil, fmt.Errorf("backend de almacenamiento desconocido %q", cfg.Backend)
+}
+
+// validBlobKey rechaza claves que podrían escapar del directorio o del bucket.
+func validBlobKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// ====================================================================
+// DISCO LOCAL
+// ====================================================================
+
+// LocalBlobStore guarda los blobs bajo Dir. También es un http.Handler que los
+// sirve (sin listados de directorios) para montarlo en PublicURL.
+type LocalBlobStore struct {
+	Dir       string
+	PublicURL string
+}
+
+func NewLocalBlobStore(dir, publicURL string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("no se pudo crear el directorio de blobs %s: %w", dir, err)
+	}
+	return &LocalBlobStore{Dir: dir, PublicURL: strings.TrimRight(publicURL, "/")}, nil
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("clave de blob inválida %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put escribe en un archivo temporal y lo renombra, así nunca se sirve un archivo a medias.
+func (s *LocalBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("error al crear directorio: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("error al crear archivo temporal: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op si el rename tuvo éxito
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error al escribir blob %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error al cerrar blob %s: %w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error al guardar blob %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+// Delete no falla si el blob ya no existe.
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error al eliminar blob %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) URL(key string) string {
+	return s.PublicURL + "/" + key
+}
+
+// ServeHTTP sirve el blob indicado por la ruta (ya sin el prefijo PublicURL).
+func (s *LocalBlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, err := s.path(strings.TrimPrefix(r.URL.Path, "/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable") // Las claves nunca se reutilizan
+	http.ServeFile(w, r, path)
+}
+
+// ====================================================================
+// S3 / MINIO
+// ====================================================================
+
+// S3BlobStore guarda los blobs en un bucket compatible con S3.
+type S3BlobStore struct {
+	client    *minio.Client
+	bucket    string
+	publicURL string
+}
+
+func NewS3BlobStore(ctx context.Context, cfg StorageConfig) (*S3BlobStore, error) {
+	client, err := minio.New(cfg.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		Secure: cfg.S3UseSSL,
+		Region: cfg.S3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error al crear cliente S3: %w", err)
+	}
+
+	// Falla al arrancar si el bucket no existe o las credenciales son incorrectas
+	exists, err := client.BucketExists(ctx, cfg.S3Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("error al verificar el bucket %s: %w", cfg.S3Bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("el bucket %s no existe", cfg.S3Bucket)
+	}
+
+	publicURL := strings.TrimRight(cfg.PublicURL, "/")
+	if publicURL == "" {
+		publicURL = client.EndpointURL().String() + "/" + cfg.S3Bucket
+	}
+	return &S3BlobStore{client: client, bucket: cfg.S3Bucket, publicURL: publicURL}, nil
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if !validBlobKey(key) {
+		return fmt.Errorf("clave de blob inválida %q", key)
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType:  contentType,
+		CacheControl: "public, max-age=31536000, immutable",
+	})
+	if err != nil {
+		return fmt.Errorf("error al subir blob %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error al leer blob %s: %w", key, err)
+	}
+	// GetObject es perezoso: Stat confirma que existe
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrBlobNotFound
+		}
+		return nil, fmt.Errorf("error al leer blob %s: %w", key, err)
+	}
+	return object, nil
+}
+
+// Delete no falla si el blob ya no existe (S3 responde 204 igualmente).
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("error al eliminar blob %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) URL(key string) string {
+	return s.publicURL + "/" + key
+}
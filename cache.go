@@ -0,0 +1,451 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// ====================================================================
+// CACHÉ DE LECTURA DEL CATÁLOGO
+// GET /productos y GET /productos/{id} leen a través de ProductCache: un acierto
+// no toca PostgreSQL y los fallos simultáneos de una misma clave se resuelven con
+// una sola consulta (singleflight). Los handlers de escritura invalidan la caché
+// local al terminar; las demás instancias se enteran por el NOTIFY de
+// product_changes (ver productstream.go), que también emiten GraphQL y gRPC.
+// ====================================================================
+
+// Cache: Almacén clave/valor con vencimiento. Los valores son bytes para que
+// el mismo código sirva en memoria y en Redis.
+type Cache interface {
+	// Get devuelve ok=false si la clave no existe o venció.
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+	// DeletePrefix borra todas las claves que empiezan por prefix.
+	DeletePrefix(ctx context.Context, prefix string) error
+}
+
+// ====================================================================
+// LRU EN MEMORIA (por instancia)
+// ====================================================================
+
+// MemoryCache: LRU acotado a maxEntries; las entradas vencidas se descartan al leerlas.
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List // Del más reciente al menos usado
+	items      map[string]*list.Element
+	now        func() time.Time
+}
+
+type memoryCacheEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+		now:        time.Now,
+	}
+}
+
+func (c *MemoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := elem.Value.(*memoryCacheEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.remove(elem)
+		return nil, false, nil
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true, nil
+}
+
+func (c *MemoryCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := c.now().Add(ttl)
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*memoryCacheEntry)
+		entry.value, entry.expiresAt = value, expiresAt
+		c.order.MoveToFront(elem)
+		return nil
+	}
+	c.items[key] = c.order.PushFront(&memoryCacheEntry{key: key, value: value, expiresAt: expiresAt})
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+	return nil
+}
+
+func (c *MemoryCache) Delete(_ context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if elem, ok := c.items[key]; ok {
+			c.remove(elem)
+		}
+	}
+	return nil
+}
+
+func (c *MemoryCache) DeletePrefix(_ context.Context, prefix string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(elem)
+		}
+	}
+	return nil
+}
+
+// remove requiere c.mu tomado.
+func (c *MemoryCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*memoryCacheEntry).key)
+}
+
+// ====================================================================
+// REDIS (compartida entre instancias; sirve cualquier servidor compatible)
+// ====================================================================
+
+// redisKeyPrefix separa las claves de la API de otras que compartan la base de Redis.
+const redisKeyPrefix = "api-chi:cache:"
+
+// redisScanBatch: Claves por iteración de SCAN (y por UNLINK) en DeletePrefix.
+const redisScanBatch = 500
+
+type RedisCache struct {
+	client *redis.Client
+}
+
+// NewRedisCache no abre la conexión: go-redis conecta en la primera orden.
+func NewRedisCache(redisURL string) (*RedisCache, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("CACHE_REDIS_URL inválida: %w", err)
+	}
+	return &RedisCache{client: redis.NewClient(opts)}, nil
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := c.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (c *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.client.Set(ctx, redisKeyPrefix+key, value, ttl).Err()
+}
+
+func (c *RedisCache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = redisKeyPrefix + key
+	}
+	return c.client.Del(ctx, prefixed...).Err()
+}
+
+// DeletePrefix recorre las claves con SCAN (no bloquea Redis como KEYS) y las
+// borra con UNLINK por lotes.
+func (c *RedisCache) DeletePrefix(ctx context.Context, prefix string) error {
+	iter := c.client.Scan(ctx, 0, redisKeyPrefix+prefix+"*", redisScanBatch).Iterator()
+	var batch []string
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == redisScanBatch {
+			if err := c.client.Unlink(ctx, batch...).Err(); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return c.client.Unlink(ctx, batch...).Err()
+	}
+	return nil
+}
+
+func (c *RedisCache) Close() error {
+	return c.client.Close()
+}
+
+// ====================================================================
+// PRODUCT CACHE: lectura a través de la caché e invalidación
+// ====================================================================
+
+// Claves: un producto por ID y una lista por combinación de filtros.
+const (
+	productCachePrefix     = "productos:"
+	productListCachePrefix = productCachePrefix + "lista:"
+)
+
+func productCacheKey(id int) string {
+	return fmt.Sprintf("%sid:%d", productCachePrefix, id)
+}
+
+func productListCacheKey(filter ProductFilter) string {
+	return fmt.Sprintf("%scategoria=%d:descendientes=%t", productListCachePrefix, filter.CategoryID, filter.IncludeDescendants)
+}
+
+// ProductCache: Lecturas de productos a través de una Cache. Un *ProductCache nil
+// (CACHE_BACKEND=none) consulta siempre la DB.
+type ProductCache struct {
+	cache Cache
+	ttl   time.Duration
+	// primary rellena la caché: una réplica atrasada guardaría la fila anterior
+	// a una escritura ya invalidada, y con la generación nueva.
+	primary *sql.DB
+	group   singleflight.Group
+	// generation aumenta con cada invalidación: una consulta iniciada antes no
+	// guarda su resultado (ya puede estar viejo) ni se comparte con las posteriores.
+	generation atomic.Uint64
+}
+
+// NewProductCache crea la caché según CACHE_BACKEND (ya validado en LoadConfig).
+// Los fallos se consultan en primary, no en la réplica de la petición.
+func NewProductCache(cfg CacheConfig, primary *sql.DB) *ProductCache {
+	var cache Cache
+	switch cfg.Backend {
+	case "memory":
+		cache = NewMemoryCache(cfg.MaxEntries)
+	case "redis":
+		redisCache, err := NewRedisCache(cfg.RedisURL)
+		if err != nil {
+			slog.Error("Caché: se desactiva", "err", err)
+			return nil
+		}
+		cache = redisCache
+	default:
+		return nil
+	}
+	return &ProductCache{cache: cache, ttl: time.Duration(cfg.TTL), primary: primary}
+}
+
+// For devuelve la caché a usar en r: ninguna (nil) si la petición debe leer del
+// primario (X-Read-Consistency: strong o escritura reciente), igual que DBCluster.
+func (c *ProductCache) For(r *http.Request) *ProductCache {
+	if mustReadPrimary(r) {
+		return nil
+	}
+	return c
+}
+
+// Product: GetProductByID a través de la caché. Los "no encontrado" no se guardan.
+// db (el lector de la petición) solo se consulta sin caché; los fallos van al primario.
+func (c *ProductCache) Product(ctx context.Context, db *sql.DB, id int) (Product, error) {
+	if c == nil {
+		return GetProductByID(ctx, db, id)
+	}
+	products, err := c.load(ctx, "producto", productCacheKey(id), func(ctx context.Context) ([]Product, error) {
+		product, err := GetProductByID(ctx, c.primary, id)
+		if err != nil {
+			return nil, err
+		}
+		return []Product{product}, nil
+	})
+	if err != nil {
+		return Product{}, err
+	}
+	return products[0], nil
+}
+
+// Products: GetProducts a través de la caché. Solo se guardan las listas completas
+// por categoría; las páginas (IDs, AfterID, Limit) van directo a db y los fallos
+// de las listas, al primario.
+func (c *ProductCache) Products(ctx context.Context, db *sql.DB, filter ProductFilter) ([]Product, error) {
+	if c == nil || len(filter.IDs) > 0 || filter.AfterID != 0 || filter.Limit != 0 {
+		return GetProducts(ctx, db, filter)
+	}
+	return c.load(ctx, "lista", productListCacheKey(filter), func(ctx context.Context) ([]Product, error) {
+		return GetProducts(ctx, c.primary, filter)
+	})
+}
+
+// load devuelve la entrada de la caché o la consulta con fetch. Cada llamador
+// decodifica su propia copia: los handlers modifican los productos (moneda, URLs).
+// Si la caché falla se sirve desde la DB; la caché nunca tumba una lectura.
+func (c *ProductCache) load(ctx context.Context, entry, key string, fetch func(context.Context) ([]Product, error)) ([]Product, error) {
+	data, ok, err := c.cache.Get(ctx, key)
+	switch {
+	case err != nil:
+		cacheRequestsTotal.WithLabelValues(entry, "error").Inc()
+		slog.Warn("Caché: error al leer", "key", key, "err", err)
+	case ok:
+		if products, err := decodeCachedProducts(data); err == nil {
+			cacheRequestsTotal.WithLabelValues(entry, "hit").Inc()
+			return products, nil
+		}
+		slog.Warn("Caché: entrada ilegible, se vuelve a consultar", "key", key)
+	}
+	cacheRequestsTotal.WithLabelValues(entry, "miss").Inc()
+
+	// Sin cancelación: la consulta compartida no debe fallar para todos si se
+	// va el primer cliente. withQueryTimeout (en el DAO) sigue acotándola.
+	generation := c.generation.Load()
+	result := c.group.DoChan(fmt.Sprintf("%s@%d", key, generation), func() (any, error) {
+		ctx := context.WithoutCancel(ctx)
+		products, err := fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		data, err := encodeCachedProducts(products)
+		if err != nil {
+			return nil, err
+		}
+		if c.generation.Load() == generation {
+			if err := c.cache.Set(ctx, key, data, c.ttl); err != nil {
+				slog.Warn("Caché: error al guardar", "key", key, "err", err)
+			}
+			// Una invalidación entre la comprobación y Set ya borró la clave
+			// antes de que se guardara: se quita aquí lo que acaba de guardarse.
+			if c.generation.Load() != generation {
+				if err := c.cache.Delete(ctx, key); err != nil {
+					slog.Warn("Caché: error al invalidar", "key", key, "err", err)
+				}
+			}
+		}
+		return data, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, queryError(ctx, ctx.Err())
+	case res := <-result:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return decodeCachedProducts(res.Val.([]byte))
+	}
+}
+
+// Invalidate borra los productos indicados y todas las listas (cualquier cambio
+// puede afectarlas). Los errores solo se registran: la entrada vence con el TTL.
+func (c *ProductCache) Invalidate(ctx context.Context, ids ...int) {
+	if c == nil {
+		return
+	}
+	c.generation.Add(1)
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = productCacheKey(id)
+	}
+	if err := c.cache.Delete(ctx, keys...); err != nil {
+		slog.Warn("Caché: error al invalidar productos", "ids", ids, "err", err)
+	}
+	if err := c.cache.DeletePrefix(ctx, productListCachePrefix); err != nil {
+		slog.Warn("Caché: error al invalidar las listas", "err", err)
+	}
+}
+
+// HandleEvent invalida el producto de un evento de product_changes, o solo las
+// listas si es un cambio de categorías (ProductChangeObserver).
+func (c *ProductCache) HandleEvent(event ProductEvent) {
+	if event.Type == CatalogChangedEvent {
+		c.Invalidate(context.Background())
+		return
+	}
+	c.Invalidate(context.Background(), event.Product.ID)
+}
+
+// Reset vacía la caché de productos: tras reconectar LISTEN pudieron perderse
+// invalidaciones (ProductChangeObserver).
+func (c *ProductCache) Reset() {
+	if c == nil {
+		return
+	}
+	c.generation.Add(1)
+	if err := c.cache.DeletePrefix(context.Background(), productCachePrefix); err != nil {
+		slog.Warn("Caché: error al vaciar los productos", "err", err)
+	}
+}
+
+// ====================================================================
+// SERIALIZACIÓN
+// ====================================================================
+
+// cachedProduct: Product tal como se guarda. Además del JSON de la API lleva lo
+// que este omite: las claves de las imágenes y si el producto tiene variantes.
+type cachedProduct struct {
+	Product
+	ImageKeys   []cachedImageKeys `json:"image_keys,omitempty"`
+	HasVariants bool              `json:"has_variants,omitempty"`
+}
+
+type cachedImageKeys struct {
+	Key          string `json:"key"`
+	ThumbnailKey string `json:"thumbnail_key"`
+}
+
+func encodeCachedProducts(products []Product) ([]byte, error) {
+	cached := make([]cachedProduct, len(products))
+	for i, p := range products {
+		cached[i] = cachedProduct{Product: p, HasVariants: p.hasVariants}
+		for _, img := range p.Images {
+			cached[i].ImageKeys = append(cached[i].ImageKeys, cachedImageKeys{img.Key, img.ThumbnailKey})
+		}
+	}
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return nil, fmt.Errorf("error al serializar productos para la caché: %w", err)
+	}
+	return data, nil
+}
+
+func decodeCachedProducts(data []byte) ([]Product, error) {
+	var cached []cachedProduct
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, err
+	}
+	if cached == nil {
+		return nil, errors.New("entrada de caché vacía")
+	}
+	products := make([]Product, len(cached))
+	for i, c := range cached {
+		products[i] = c.Product
+		products[i].hasVariants = c.HasVariants
+		for j := range products[i].Images {
+			if j < len(c.ImageKeys) {
+				products[i].Images[j].Key = c.ImageKeys[j].Key
+				products[i].Images[j].ThumbnailKey = c.ImageKeys[j].ThumbnailKey
+			}
+		}
+	}
+	return products, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Test: El LRU descarta la entrada menos usada y las vencidas
+func TestMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	cache := NewMemoryCache(2)
+	cache.now = func() time.Time { return now }
+
+	cache.Set(ctx, "a", []byte("1"), time.Minute)
+	cache.Set(ctx, "b", []byte("2"), time.Minute)
+	cache.Get(ctx, "a") // "b" pasa a ser la menos usada
+	cache.Set(ctx, "c", []byte("3"), time.Minute)
+	if _, ok, _ := cache.Get(ctx, "b"); ok {
+		t.Error("b debía descartarse por LRU")
+	}
+	if v, ok, _ := cache.Get(ctx, "a"); !ok || string(v) != "1" {
+		t.Errorf("a: got %q %v", v, ok)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok, _ := cache.Get(ctx, "a"); ok {
+		t.Error("a debía vencer con el TTL")
+	}
+
+	cache.Set(ctx, "productos:lista:1", []byte("x"), time.Minute)
+	cache.Set(ctx, "productos:id:1", []byte("y"), time.Minute)
+	cache.DeletePrefix(ctx, "productos:lista:")
+	if _, ok, _ := cache.Get(ctx, "productos:lista:1"); ok {
+		t.Error("DeletePrefix no borró la lista")
+	}
+	if _, ok, _ := cache.Get(ctx, "productos:id:1"); !ok {
+		t.Error("DeletePrefix borró una clave sin el prefijo")
+	}
+}
+
+func newTestProductCache(primary *sql.DB) *ProductCache {
+	return NewProductCache(CacheConfig{Backend: "memory", TTL: Duration(time.Minute), MaxEntries: 100}, primary)
+}
+
+// Test: La segunda lectura no consulta la DB; invalidar y leer del primario sí
+func TestProductCacheReadThrough(t *testing.T) {
+	ctx := context.Background()
+	db, server := openFakeDB(t, "cache")
+	server.SetRows(
+		[]string{"id", "name", "description", "price_minor", "currency", "stock", "images", "variant_count", "variant_stock", "min_price", "max_price"},
+		[]driver.Value{int64(1), "Laptop", "Portátil", int64(1999), "USD", int64(3), []byte("[]"), int64(2), int64(5), int64(1500), int64(2500)},
+	)
+	cache := newTestProductCache(db)
+
+	for range 2 {
+		if _, err := cache.Products(ctx, db, ProductFilter{}); err != nil {
+			t.Fatal(err)
+		}
+		product, err := cache.Product(ctx, db, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !product.hasVariants || *product.TotalStock != 5 || product.PriceRange.Max.Amount != 2500 {
+			t.Errorf("El producto de la caché perdió el resumen de variantes: %+v", product)
+		}
+	}
+	if queries := server.Queries(); len(queries) != 2 {
+		t.Errorf("Se esperaba una consulta por clave: %q", queries)
+	}
+
+	// Las páginas no se guardan
+	cache.Products(ctx, db, ProductFilter{Limit: 10})
+	cache.Products(ctx, db, ProductFilter{Limit: 10})
+	if queries := server.Queries(); len(queries) != 4 {
+		t.Errorf("Las páginas deben ir a la DB: %q", queries)
+	}
+
+	// Invalidar un producto borra su entrada y todas las listas
+	cache.Invalidate(ctx, 1)
+	cache.Product(ctx, db, 1)
+	cache.Products(ctx, db, ProductFilter{})
+	if queries := server.Queries(); len(queries) != 6 {
+		t.Errorf("Tras invalidar se debía volver a consultar: %q", queries)
+	}
+
+	// Con X-Read-Consistency: strong no se usa la caché
+	req := httptest.NewRequest("GET", "/productos/1", nil)
+	req.Header.Set(ReadConsistencyHeader, "strong")
+	cache.For(req).Product(ctx, db, 1)
+	if queries := server.Queries(); len(queries) != 7 {
+		t.Errorf("La lectura fuerte debía ir a la DB: %q", queries)
+	}
+
+	// Sin caché (CACHE_BACKEND=none) siempre se consulta
+	var none *ProductCache
+	none.Product(ctx, db, 1)
+	none.Invalidate(ctx, 1)
+	if queries := server.Queries(); len(queries) != 8 {
+		t.Errorf("Sin caché se debía consultar la DB: %q", queries)
+	}
+}
+
+// Test: Los fallos simultáneos de una clave se resuelven con una sola consulta
+func TestProductCacheSingleflight(t *testing.T) {
+	cache := newTestProductCache(nil)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	fetches := 0
+	fetch := func(context.Context) ([]Product, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		<-release
+		return []Product{{ID: 1, Price: Money{Amount: 100, Currency: "USD"}}}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]Product, 5)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = cache.load(context.Background(), "producto", "k", fetch)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Errorf("Se esperaba una sola consulta: %d", fetches)
+	}
+	// Cada llamador recibe su propia copia
+	results[0][0].Name = "modificado"
+	if results[1][0].Name != "" {
+		t.Error("Los llamadores comparten los productos")
+	}
+}
+
+// Test: Una consulta iniciada antes de invalidar no guarda su resultado
+func TestProductCacheInvalidateDuringFetch(t *testing.T) {
+	ctx := context.Background()
+	cache := newTestProductCache(nil)
+	started, release := make(chan struct{}), make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.load(ctx, "producto", productCacheKey(1), func(context.Context) ([]Product, error) {
+			close(started)
+			<-release
+			return []Product{{ID: 1, Name: "viejo"}}, nil
+		})
+	}()
+	<-started
+	cache.Invalidate(ctx, 1)
+	close(release)
+	<-done
+
+	if _, ok, _ := cache.cache.Get(ctx, productCacheKey(1)); ok {
+		t.Error("El resultado anterior a la invalidación no debe guardarse")
+	}
+}
+
+// invalidatingCache invalida la caché justo antes de cada Set: simula una
+// escritura que llega entre la comprobación de la generación y el guardado.
+type invalidatingCache struct {
+	Cache
+	products *ProductCache
+}
+
+func (c invalidatingCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.products.Invalidate(ctx, 1)
+	return c.Cache.Set(ctx, key, value, ttl)
+}
+
+// Test: Una invalidación entre la comprobación y Set no deja la entrada vieja
+func TestProductCacheInvalidateBeforeSet(t *testing.T) {
+	ctx := context.Background()
+	cache := newTestProductCache(nil)
+	memory := cache.cache
+	cache.cache = invalidatingCache{Cache: memory, products: cache}
+
+	products, err := cache.load(ctx, "producto", productCacheKey(1), func(context.Context) ([]Product, error) {
+		return []Product{{ID: 1, Name: "viejo", Price: Money{Amount: 100, Currency: "USD"}}}, nil
+	})
+	if err != nil || products[0].Name != "viejo" {
+		t.Fatalf("got %+v, %v", products, err)
+	}
+	if _, ok, _ := memory.Get(ctx, productCacheKey(1)); ok {
+		t.Error("El resultado anterior a la invalidación no debe quedar guardado")
+	}
+}
+
+// Test: Los fallos se rellenan desde el primario aunque la petición lea de una réplica
+func TestProductCacheFillsFromPrimary(t *testing.T) {
+	ctx := context.Background()
+	columns := []string{"id", "name", "description", "price_minor", "currency", "stock", "images", "variant_count", "variant_stock", "min_price", "max_price"}
+	primary, primaryServer := openFakeDB(t, "cache-primary")
+	primaryServer.SetRows(columns, []driver.Value{int64(1), "Nuevo", "", int64(1999), "USD", int64(3), []byte("[]"), int64(0), int64(0), int64(1999), int64(1999)})
+	replica, replicaServer := openFakeDB(t, "cache-replica")
+	replicaServer.SetRows(columns, []driver.Value{int64(1), "Viejo", "", int64(1999), "USD", int64(3), []byte("[]"), int64(0), int64(0), int64(1999), int64(1999)})
+	cache := newTestProductCache(primary)
+
+	product, err := cache.Product(ctx, replica, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Products(ctx, replica, ProductFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if product.Name != "Nuevo" {
+		t.Errorf("Se esperaba la fila del primario: %+v", product)
+	}
+	if queries := replicaServer.Queries(); len(queries) != 0 {
+		t.Errorf("La réplica no debe rellenar la caché: %q", queries)
+	}
+	if queries := primaryServer.Queries(); len(queries) != 2 {
+		t.Errorf("Se esperaba una consulta al primario por clave: %q", queries)
+	}
+
+	// Las páginas no pasan por la caché: siguen yendo a la réplica
+	cache.Products(ctx, replica, ProductFilter{Limit: 10})
+	if queries := replicaServer.Queries(); len(queries) != 1 {
+		t.Errorf("Las páginas deben leerse de la réplica: %q", queries)
+	}
+}
+
+// Test: La serialización conserva lo que el JSON de la API omite
+func TestCachedProductsRoundTrip(t *testing.T) {
+	products := []Product{{
+		ID: 1, Name: "Camiseta", Price: Money{Amount: 1999, Currency: "USD"},
+		Images:      []ProductImage{{ID: 4, Key: "products/1/a.jpg", ThumbnailKey: "products/1/a_thumb.jpg"}},
+		hasVariants: true,
+	}}
+	data, err := encodeCachedProducts(products)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeCachedProducts(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decoded[0]
+	if got.Price != products[0].Price || !got.hasVariants || got.Images[0].Key != "products/1/a.jpg" || got.Images[0].ThumbnailKey != "products/1/a_thumb.jpg" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+type recordingObserver struct {
+	events chan ProductEvent
+	resets chan struct{}
+}
+
+func (o recordingObserver) HandleEvent(event ProductEvent) { o.events <- event }
+func (o recordingObserver) Reset()                         { o.resets <- struct{}{} }
+
+// Test: Los observadores reciben cada notificación y un Reset al reconectar
+func TestProductEventBrokerObservers(t *testing.T) {
+	broker := newTestBroker(10, 10)
+	observer := recordingObserver{make(chan ProductEvent, 1), make(chan struct{}, 1)}
+	broker.Observe(observer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notifications := make(chan *pq.Notification, 1)
+	go broker.Listen(ctx, notifications)
+
+	notifications <- &pq.Notification{Channel: ProductChangesChannel, Extra: fmt.Sprintf(`{"id":1,"type":%q,"product":{"id":7}}`, WebhookEventProductUpdated)}
+	if event := <-observer.events; event.Product.ID != 7 {
+		t.Errorf("got %+v", event)
+	}
+	notifications <- nil
+	select {
+	case <-observer.resets:
+	case <-time.After(time.Second):
+		t.Error("Tras reconectar se esperaba Reset")
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ====================================================================
+// CARRITO
+// Un carrito por usuario autenticado; los invitados se identifican con la
+// cabecera X-Cart-Token, que la API genera al agregar el primer ítem. Al hacer
+// login con esa cabecera el carrito invitado se fusiona con el del usuario.
+// Las líneas muestran precio y stock actuales del catálogo (no son una reserva).
+// ====================================================================
+
+// CartTokenHeader: Cabecera con la que los invitados identifican su carrito.
+const CartTokenHeader = "X-Cart-Token"
+
+var (
+	ErrCartNotFound        = errors.New("carrito no encontrado")
+	ErrCartItemNotFound    = errors.New("ítem no encontrado en el carrito")
+	ErrCartProductNotFound = errors.New("producto o variante no encontrado (los productos con variantes requieren variant_id)")
+)
+
+// Cart: Contenido del carrito con el total en Total.Currency.
+// ExpiresAt es nil si todavía no existe un carrito.
+type Cart struct {
+	Items     []CartLine `json:"items"`
+	Total     Money      `json:"total"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CartLine: Ítem del carrito con precio y disponibilidad en vivo.
+type CartLine struct {
+	ID        int       `json:"id"`
+	ProductID int       `json:"product_id"`
+	VariantID *int      `json:"variant_id,omitempty"`
+	SKU       string    `json:"sku,omitempty"`
+	Name      string    `json:"name"`
+	Quantity  int       `json:"quantity"`
+	UnitPrice Money     `json:"unit_price"`
+	LineTotal Money     `json:"line_total"`
+	Available int       `json:"available"` // Stock actual del producto o variante
+	InStock   bool      `json:"in_stock"`  // available >= quantity
+	AddedAt   time.Time `json:"added_at"`
+}
+
+// CartItemRequest: Cuerpo de POST /cart/items y PUT /cart/items/{itemID} (solo quantity).
+type CartItemRequest struct {
+	ProductID int `json:"product_id"`
+	VariantID int `json:"variant_id"` // 0 = producto sin variantes
+	Quantity  int `json:"quantity"`
+}
+
+// cartOwner: Usuario autenticado (UserID) o invitado (Token).
+type cartOwner struct {
+	UserID int
+	Token  string
+}
+
+func cartOwnerFrom(r *http.Request) cartOwner {
+	if userID, err := GetUserIDFromContext(r); err == nil {
+		return cartOwner{UserID: userID}
+	}
+	return cartOwner{Token: r.Header.Get(CartTokenHeader)}
+}
+
+// ttlFor: Vigencia del carrito según sea de un usuario o de un invitado.
+func (c CartConfig) ttlFor(owner cartOwner) time.Duration {
+	if owner.UserID == 0 {
+		return time.Duration(c.GuestTTL)
+	}
+	return time.Duration(c.TTL)
+}
+
+// newCartToken genera el identificador de un carrito invitado.
+func newCartToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("no se pudo generar el token del carrito: %w", err)
+	}
+	return "cart_" + hex.EncodeToString(buf), nil
+}
+
+// ====================================================================
+// DAO
+// ====================================================================
+
+// findCart devuelve el carrito vigente del dueño o ErrCartNotFound.
+func findCart(ctx context.Context, q dbExecutor, owner cartOwner) (int, time.Time, error) {
+	var id int
+	var expiresAt time.Time
+	var err error
+	switch {
+	case owner.UserID != 0:
+		err = q.QueryRowContext(ctx,
+			`SELECT id, expires_at FROM carts WHERE user_id = $1 AND expires_at > NOW()`, owner.UserID,
+		).Scan(&id, &expiresAt)
+	case owner.Token != "":
+		err = q.QueryRowContext(ctx,
+			`SELECT id, expires_at FROM carts WHERE guest_token = $1 AND expires_at > NOW()`, owner.Token,
+		).Scan(&id, &expiresAt)
+	default:
+		return 0, time.Time{}, ErrCartNotFound
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, time.Time{}, ErrCartNotFound
+	}
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("error al consultar carrito: %w", queryError(ctx, err))
+	}
+	return id, expiresAt, nil
+}
+
+// ensureCart devuelve el carrito del dueño renovando su expiración, o crea uno.
+// Un carrito expirado se descarta con sus ítems. Para invitados sin token (o con
+// un token vencido) se genera uno nuevo, que se devuelve en owner.Token.
+func ensureCart(ctx context.Context, q dbExecutor, owner *cartOwner, ttl time.Duration) (int, time.Time, error) {
+	var id int
+	expiresAt := time.Now().Add(ttl)
+
+	if owner.UserID != 0 {
+		if _, err := q.ExecContext(ctx, `DELETE FROM carts WHERE user_id = $1 AND expires_at <= NOW()`, owner.UserID); err != nil {
+			return 0, time.Time{}, fmt.Errorf("error al descartar carrito expirado: %w", queryError(ctx, err))
+		}
+		err := q.QueryRowContext(ctx, `
+			INSERT INTO carts (user_id, expires_at) VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET expires_at = EXCLUDED.expires_at, updated_at = NOW()
+			RETURNING id`, owner.UserID, expiresAt,
+		).Scan(&id)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("error al crear carrito: %w", queryError(ctx, err))
+		}
+		return id, expiresAt, nil
+	}
+
+	if owner.Token != "" {
+		err := q.QueryRowContext(ctx, `
+			UPDATE carts SET expires_at = $2, updated_at = NOW()
+			WHERE guest_token = $1 AND expires_at > NOW()
+			RETURNING id`, owner.Token, expiresAt,
+		).Scan(&id)
+		if err == nil {
+			return id, expiresAt, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, time.Time{}, fmt.Errorf("error al renovar carrito: %w", queryError(ctx, err))
+		}
+	}
+
+	token, err := newCartToken()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	err = q.QueryRowContext(ctx,
+		`INSERT INTO carts (guest_token, expires_at) VALUES ($1, $2) RETURNING id`, token, expiresAt,
+	).Scan(&id)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("error al crear carrito: %w", queryError(ctx, err))
+	}
+	owner.Token = token
+	return id, expiresAt, nil
+}
+
+// GetCart devuelve el carrito del dueño con precios en currency. Sin carrito vigente
+// devuelve uno vacío.
+func GetCart(ctx context.Context, db *sql.DB, owner cartOwner, currency string) (Cart, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	id, expiresAt, err := findCart(ctx, db, owner)
+	if errors.Is(err, ErrCartNotFound) {
+		return Cart{Items: []CartLine{}, Total: Money{Currency: currency}}, nil
+	}
+	if err != nil {
+		return Cart{}, err
+	}
+	return loadCart(ctx, db, id, expiresAt, currency)
+}
+
+// loadCart lee las líneas con el precio y el stock actuales del catálogo.
+func loadCart(ctx context.Context, db *sql.DB, cartID int, expiresAt time.Time, currency string) (Cart, error) {
+	type row struct {
+		line             CartLine
+		catalog          Money
+		usesProductPrice bool
+	}
+	var rowsRead []row
+	err := func() error {
+		rows, err := db.QueryContext(ctx, `
+			SELECT ci.id, ci.product_id, ci.variant_id, COALESCE(v.sku, ''), p.name, ci.quantity,
+				COALESCE(v.price_minor, p.price_minor), p.currency, v.price_minor IS NULL,
+				COALESCE(v.stock, p.stock), ci.added_at
+			FROM cart_items ci
+			JOIN products p ON p.id = ci.product_id
+			LEFT JOIN product_variants v ON v.id = ci.variant_id
+			WHERE ci.cart_id = $1
+			ORDER BY ci.added_at, ci.id`, cartID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var r row
+			var variantID sql.NullInt64
+			err := rows.Scan(&r.line.ID, &r.line.ProductID, &variantID, &r.line.SKU, &r.line.Name, &r.line.Quantity,
+				&r.catalog.Amount, &r.catalog.Currency, &r.usesProductPrice, &r.line.Available, &r.line.AddedAt)
+			if err != nil {
+				return err
+			}
+			if variantID.Valid {
+				id := int(variantID.Int64)
+				r.line.VariantID = &id
+			}
+			rowsRead = append(rowsRead, r)
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return Cart{}, fmt.Errorf("error al leer el carrito: %w", queryError(ctx, err))
+	}
+
+	cart := Cart{Items: []CartLine{}, Total: Money{Currency: currency}, ExpiresAt: &expiresAt}
+	pricer := &catalogPricer{db: db, q: db, currency: currency}
+	for _, r := range rowsRead {
+		line := r.line
+		if line.UnitPrice, err = pricer.price(ctx, line.ProductID, r.catalog, r.usesProductPrice); err != nil {
+			return Cart{}, err
+		}
+		line.LineTotal = Money{Amount: line.UnitPrice.Amount * int64(line.Quantity), Currency: currency}
+		line.InStock = line.Available >= line.Quantity
+		cart.Total.Amount += line.LineTotal.Amount
+		cart.Items = append(cart.Items, line)
+	}
+	return cart, nil
+}
+
+// AddCartItem suma quantity al ítem (o lo crea) en el carrito del dueño, creándolo si
+// hace falta. La cantidad de cada ítem se limita a maxOrderQuantity.
+func AddCartItem(ctx context.Context, db *sql.DB, owner *cartOwner, item CartItemRequest, ttl time.Duration) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	cartID, _, err := ensureCart(ctx, tx, owner, ttl)
+	if err != nil {
+		return err
+	}
+
+	// El producto debe existir; la variante, pertenecer a él. Un producto con
+	// variantes no se puede agregar sin indicar cuál.
+	var variantID sql.NullInt64
+	if item.VariantID != 0 {
+		variantID = sql.NullInt64{Int64: int64(item.VariantID), Valid: true}
+	}
+	var id int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO cart_items (cart_id, product_id, variant_id, quantity)
+		SELECT $1, p.id, v.id, $4
+		FROM products p
+		LEFT JOIN product_variants v ON v.id = $3 AND v.product_id = p.id
+		WHERE p.id = $2
+			AND ($3::int IS NULL OR v.id IS NOT NULL)
+			AND ($3::int IS NOT NULL OR NOT EXISTS (SELECT 1 FROM product_variants WHERE product_id = p.id))
+		ON CONFLICT (cart_id, product_id, COALESCE(variant_id, 0))
+		DO UPDATE SET quantity = LEAST(cart_items.quantity + EXCLUDED.quantity, $5)
+		RETURNING id`,
+		cartID, item.ProductID, variantID, item.Quantity, maxOrderQuantity,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrCartProductNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error al agregar al carrito: %w", queryError(ctx, err))
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error al confirmar carrito: %w", queryError(ctx, err))
+	}
+	return nil
+}
+
+// UpdateCartItem fija la cantidad de un ítem del carrito del dueño; 0 lo elimina.
+func UpdateCartItem(ctx context.Context, db *sql.DB, owner *cartOwner, itemID, quantity int, ttl time.Duration) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	cartID, _, err := findCart(ctx, db, *owner)
+	if err != nil {
+		if errors.Is(err, ErrCartNotFound) {
+			return ErrCartItemNotFound
+		}
+		return err
+	}
+
+	var result sql.Result
+	if quantity == 0 {
+		result, err = db.ExecContext(ctx, `DELETE FROM cart_items WHERE id = $1 AND cart_id = $2`, itemID, cartID)
+	} else {
+		result, err = db.ExecContext(ctx, `UPDATE cart_items SET quantity = $3 WHERE id = $1 AND cart_id = $2`, itemID, cartID, quantity)
+	}
+	if err != nil {
+		return fmt.Errorf("error al actualizar el carrito: %w", queryError(ctx, err))
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrCartItemNotFound
+	}
+
+	// Cada cambio renueva la expiración
+	_, _, err = ensureCart(ctx, db, owner, ttl)
+	return err
+}
+
+// ClearCart elimina el carrito del dueño (si existe).
+func ClearCart(ctx context.Context, db *sql.DB, owner cartOwner) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var err error
+	switch {
+	case owner.UserID != 0:
+		_, err = db.ExecContext(ctx, `DELETE FROM carts WHERE user_id = $1`, owner.UserID)
+	case owner.Token != "":
+		_, err = db.ExecContext(ctx, `DELETE FROM carts WHERE guest_token = $1`, owner.Token)
+	}
+	if err != nil {
+		return fmt.Errorf("error al vaciar el carrito: %w", queryError(ctx, err))
+	}
+	return nil
+}
+
+// MergeGuestCart mueve los ítems del carrito invitado al del usuario (sumando
+// cantidades de los ítems repetidos) y borra el carrito invitado.
+func MergeGuestCart(ctx context.Context, db *sql.DB, token string, userID int, ttl time.Duration) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	var guestID int
+	err = tx.QueryRowContext(ctx, `
+		SELECT id FROM carts WHERE guest_token = $1 AND expires_at > NOW()
+		FOR UPDATE`, token,
+	).Scan(&guestID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil // Token desconocido o vencido: no hay nada que fusionar
+	}
+	if err != nil {
+		return fmt.Errorf("error al consultar carrito invitado: %w", queryError(ctx, err))
+	}
+
+	owner := cartOwner{UserID: userID}
+	userCartID, _, err := ensureCart(ctx, tx, &owner, ttl)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO cart_items (cart_id, product_id, variant_id, quantity, added_at)
+		SELECT $1, product_id, variant_id, quantity, added_at FROM cart_items WHERE cart_id = $2
+		ON CONFLICT (cart_id, product_id, COALESCE(variant_id, 0))
+		DO UPDATE SET quantity = LEAST(cart_items.quantity + EXCLUDED.quantity, $3)`,
+		userCartID, guestID, maxOrderQuantity,
+	)
+	if err != nil {
+		return fmt.Errorf("error al fusionar carritos: %w", queryError(ctx, err))
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM carts WHERE id = $1`, guestID); err != nil {
+		return fmt.Errorf("error al borrar carrito invitado: %w", queryError(ctx, err))
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error al confirmar fusión de carritos: %w", queryError(ctx, err))
+	}
+	return nil
+}
+
+// PurgeExpiredCarts borra los carritos vencidos (y sus ítems) y devuelve cuántos.
+func PurgeExpiredCarts(ctx context.Context, db *sql.DB) (int64, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM carts WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("error al purgar carritos: %w", queryError(ctx, err))
+	}
+	return result.RowsAffected()
+}
+
+// RunCartPurger purga los carritos vencidos cada interval hasta que ctx se cancele.
+func RunCartPurger(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n, err := PurgeExpiredCarts(ctx, db); err != nil && ctx.Err() == nil {
+			slog.Error("Carritos: error al purgar expirados", "err", err)
+		} else if n > 0 {
+			slog.Debug("Carritos: expirados eliminados", "count", n)
+		}
+	}
+}
+
+// ====================================================================
+// HANDLERS DEL CARRITO
+// Funcionan con y sin autenticación (OptionalAuthMiddleware).
+// ====================================================================
+
+// respondCartError traduce los errores de dominio; el resto va a respondDBError.
+func respondCartError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, ErrCartItemNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrCartProductNotFound), errors.Is(err, ErrNoExchangeRate):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		respondDBError(w, err, action)
+	}
+}
+
+// cartCurrency: ?currency= o DEFAULT_CURRENCY.
+func cartCurrency(w http.ResponseWriter, r *http.Request) (string, bool) {
+	currency, ok := requestedCurrency(w, r)
+	if ok && currency == "" {
+		currency = defaultCurrency
+	}
+	return currency, ok
+}
+
+// writeCart responde con el carrito actual del dueño. Para invitados incluye
+// X-Cart-Token, que deben reenviar en las siguientes peticiones y en /login.
+func writeCart(w http.ResponseWriter, r *http.Request, db *sql.DB, owner cartOwner, currency string) {
+	cart, err := GetCart(r.Context(), db, owner, currency)
+	if err != nil {
+		respondCartError(w, err, "obtener carrito")
+		return
+	}
+	if owner.UserID == 0 && owner.Token != "" {
+		w.Header().Set(CartTokenHeader, owner.Token)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cart)
+}
+
+// GET /cart: Carrito actual (vacío si no existe)
+func GetCartHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currency, ok := cartCurrency(w, r)
+		if !ok {
+			return
+		}
+		writeCart(w, r, db, cartOwnerFrom(r), currency)
+	}
+}
+
+// POST /cart/items: Agrega un producto o variante ({"product_id": 1, "quantity": 2})
+func AddCartItemHandler(db *sql.DB, cfg CartConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currency, ok := cartCurrency(w, r)
+		if !ok {
+			return
+		}
+
+		var request CartItemRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
+			return
+		}
+		if request.ProductID <= 0 || request.VariantID < 0 {
+			http.Error(w, "Se requiere un product_id válido", http.StatusBadRequest)
+			return
+		}
+		if request.Quantity <= 0 || request.Quantity > maxOrderQuantity {
+			http.Error(w, fmt.Sprintf("quantity debe estar entre 1 y %d", maxOrderQuantity), http.StatusBadRequest)
+			return
+		}
+
+		owner := cartOwnerFrom(r)
+		if err := AddCartItem(r.Context(), db, &owner, request, cfg.ttlFor(owner)); err != nil {
+			respondCartError(w, err, "agregar al carrito")
+			return
+		}
+		writeCart(w, r, db, owner, currency)
+	}
+}
+
+// parseCartItemID lee {itemID}; responde 400 si no es un entero.
+func parseCartItemID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "itemID"))
+	if err != nil {
+		http.Error(w, "El ID del ítem debe ser un número entero válido.", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// PUT /cart/items/{itemID}: Cambia la cantidad ({"quantity": 3}; 0 elimina el ítem)
+func UpdateCartItemHandler(db *sql.DB, cfg CartConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, ok := parseCartItemID(w, r)
+		if !ok {
+			return
+		}
+		currency, ok := cartCurrency(w, r)
+		if !ok {
+			return
+		}
+
+		var request CartItemRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
+			return
+		}
+		if request.Quantity < 0 || request.Quantity > maxOrderQuantity {
+			http.Error(w, fmt.Sprintf("quantity debe estar entre 0 y %d", maxOrderQuantity), http.StatusBadRequest)
+			return
+		}
+
+		owner := cartOwnerFrom(r)
+		if err := UpdateCartItem(r.Context(), db, &owner, itemID, request.Quantity, cfg.ttlFor(owner)); err != nil {
+			respondCartError(w, err, "actualizar carrito")
+			return
+		}
+		writeCart(w, r, db, owner, currency)
+	}
+}
+
+// DELETE /cart/items/{itemID}: Quita un ítem
+func DeleteCartItemHandler(db *sql.DB, cfg CartConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, ok := parseCartItemID(w, r)
+		if !ok {
+			return
+		}
+
+		owner := cartOwnerFrom(r)
+		if err := UpdateCartItem(r.Context(), db, &owner, itemID, 0, cfg.ttlFor(owner)); err != nil {
+			respondCartError(w, err, "quitar del carrito")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DELETE /cart: Vacía el carrito
+func ClearCartHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := ClearCart(r.Context(), db, cartOwnerFrom(r)); err != nil {
+			respondCartError(w, err, "vaciar carrito")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sendCartRequest(router http.Handler, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// Test: Sin carrito se devuelve uno vacío, con o sin autenticación
+func TestGetEmptyCart(t *testing.T) {
+	router, token, server := newProductTestRouter(t)
+	server.SetRows(nil)
+
+	for name, headers := range map[string]map[string]string{
+		"invitado":         nil,
+		"invitado + token": {CartTokenHeader: "cart_desconocido"},
+		"usuario":          {"Authorization": "Bearer " + token},
+	} {
+		rr := sendCartRequest(router, "GET", "/api/v1/cart?currency=eur", "", headers)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s", name, rr.Code, rr.Body.String())
+		}
+		var cart Cart
+		if err := json.Unmarshal(rr.Body.Bytes(), &cart); err != nil {
+			t.Fatal(err)
+		}
+		if len(cart.Items) != 0 || cart.Total != (Money{Currency: "EUR"}) || cart.ExpiresAt != nil {
+			t.Errorf("%s: carrito vacío incorrecto: %+v", name, cart)
+		}
+		if got := rr.Header().Get(CartTokenHeader); name != "invitado + token" && got != "" {
+			t.Errorf("%s: no debe generarse un token al leer: %q", name, got)
+		}
+	}
+
+	// Un token JWT inválido sigue siendo 401 aunque la ruta admita invitados
+	rr := sendCartRequest(router, "GET", "/api/v1/cart", "", map[string]string{"Authorization": "Bearer x"})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("JWT inválido: got %d want 401", rr.Code)
+	}
+}
+
+// Test: Validaciones de los endpoints del carrito
+func TestCartValidation(t *testing.T) {
+	router, _, server := newProductTestRouter(t)
+	server.SetRows(nil)
+
+	cases := []struct {
+		name, method, path, body string
+		want                     int
+	}{
+		{"sin producto", "POST", "/api/v1/cart/items", `{"quantity":1}`, http.StatusBadRequest},
+		{"cantidad cero", "POST", "/api/v1/cart/items", `{"product_id":1,"quantity":0}`, http.StatusBadRequest},
+		{"cantidad excesiva", "POST", "/api/v1/cart/items", `{"product_id":1,"quantity":1001}`, http.StatusBadRequest},
+		{"moneda desconocida", "POST", "/api/v1/cart/items?currency=XYZ", `{"product_id":1,"quantity":1}`, http.StatusBadRequest},
+		{"ítem no numérico", "PUT", "/api/v1/cart/items/abc", `{"quantity":1}`, http.StatusBadRequest},
+		{"cantidad negativa", "PUT", "/api/v1/cart/items/1", `{"quantity":-1}`, http.StatusBadRequest},
+		{"ítem sin carrito", "PUT", "/api/v1/cart/items/1", `{"quantity":2}`, http.StatusNotFound},
+		{"borrar sin carrito", "DELETE", "/api/v1/cart/items/1", ``, http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		if rr := sendCartRequest(router, tc.method, tc.path, tc.body, nil); rr.Code != tc.want {
+			t.Errorf("%s: got %d want %d (%s)", tc.name, rr.Code, tc.want, rr.Body.String())
+		}
+	}
+}
+
+// Test: Un token invitado desconocido o vencido no modifica nada al hacer login
+func TestMergeGuestCartUnknownToken(t *testing.T) {
+	db, server := openFakeDB(t, "cart-merge")
+
+	if err := MergeGuestCart(context.Background(), db, "cart_vencido", 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range server.Queries() {
+		if strings.Contains(q, "INSERT") || strings.Contains(q, "DELETE") {
+			t.Errorf("No debe escribirse nada: %s", q)
+		}
+	}
+}
+
+// Test: Los invitados tienen su propia vigencia
+func TestCartTTL(t *testing.T) {
+	cfg := CartConfig{TTL: Duration(30 * 24 * time.Hour), GuestTTL: Duration(time.Hour)}
+	if got := cfg.ttlFor(cartOwner{UserID: 1}); got != 30*24*time.Hour {
+		t.Errorf("TTL de usuario: got %v", got)
+	}
+	if got := cfg.ttlFor(cartOwner{Token: "cart_x"}); got != time.Hour {
+		t.Errorf("TTL de invitado: got %v", got)
+	}
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// ====================================================================
+// CATEGORÍAS DE PRODUCTOS
+// Árbol de categorías (parent_id) con relación muchos-a-muchos con productos
+// (tabla product_categories). Las lecturas van a réplicas; las escrituras
+// de categorías solo las hace un admin.
+// ====================================================================
+
+// Errores de dominio que los handlers traducen a 404/409/400
+var (
+	ErrCategoryNotFound    = errors.New("categoría no encontrada")
+	ErrCategoryHasChildren = errors.New("la categoría tiene subcategorías")
+	ErrCategoryCycle       = errors.New("una categoría no puede colgar de sí misma ni de una subcategoría suya")
+	ErrCategorySlugTaken   = errors.New("ya existe una categoría con ese slug")
+	ErrCategoryParent      = errors.New("la categoría padre no existe")
+)
+
+// Category: Nodo del árbol. ParentID es nil en las categorías raíz.
+type Category struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`
+	ParentID *int   `json:"parent_id"`
+}
+
+// CategoryNode: Categoría con sus hijas, para devolver el árbol completo.
+type CategoryNode struct {
+	Category
+	Children []*CategoryNode `json:"children"`
+}
+
+// CategoryCount: Conteo de productos de un nodo. ProductCount cuenta solo los
+// asignados directamente; TotalProductCount incluye los de sus descendientes
+// (un producto en varias subcategorías cuenta una sola vez).
+type CategoryCount struct {
+	Category
+	Depth             int `json:"depth"`
+	ProductCount      int `json:"product_count"`
+	TotalProductCount int `json:"total_product_count"`
+}
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// slugify genera un slug a partir del nombre: "Electrónica y Audio" -> "electronica-y-audio".
+func slugify(name string) string {
+	replacer := strings.NewReplacer("á", "a", "é", "e", "í", "i", "ó", "o", "ú", "u", "ü", "u", "ñ", "n")
+	name = replacer.Replace(strings.ToLower(strings.TrimSpace(name)))
+
+	var b strings.Builder
+	dash := false
+	for _, c := range name {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(c)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	return b.String()
+}
+
+// normalize completa el slug y valida los campos obligatorios.
+func (c *Category) normalize() error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		return errors.New("el nombre es obligatorio")
+	}
+	if c.Slug == "" {
+		c.Slug = slugify(c.Name)
+	}
+	if !slugPattern.MatchString(c.Slug) {
+		return fmt.Errorf("slug inválido %q: solo minúsculas, dígitos y guiones", c.Slug)
+	}
+	return nil
+}
+
+// buildCategoryTree arma el árbol a partir de una lista plana. Las categorías
+// cuyo padre no está en la lista se consideran raíces (sirve también para subárboles).
+func buildCategoryTree(categories []Category) []*CategoryNode {
+	nodes := make(map[int]*CategoryNode, len(categories))
+	for _, c := range categories {
+		nodes[c.ID] = &CategoryNode{Category: c, Children: []*CategoryNode{}}
+	}
+
+	roots := []*CategoryNode{}
+	for _, c := range categories {
+		node := nodes[c.ID]
+		if c.ParentID != nil {
+			if parent, ok := nodes[*c.ParentID]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+	return roots
+}
+
+// countCategoryProducts recorre el árbol en profundidad y calcula los conteos de
+// cada nodo. productsByCategory contiene los IDs de productos asignados a cada categoría.
+func countCategoryProducts(roots []*CategoryNode, productsByCategory map[int][]int) []CategoryCount {
+	counts := []CategoryCount{}
+
+	var walk func(node *CategoryNode, depth int) map[int]bool
+	walk = func(node *CategoryNode, depth int) map[int]bool {
+		index := len(counts)
+		counts = append(counts, CategoryCount{
+			Category:     node.Category,
+			Depth:        depth,
+			ProductCount: len(productsByCategory[node.ID]),
+		})
+
+		subtree := make(map[int]bool)
+		for _, id := range productsByCategory[node.ID] {
+			subtree[id] = true
+		}
+		for _, child := range node.Children {
+			for id := range walk(child, depth+1) {
+				subtree[id] = true
+			}
+		}
+		counts[index].TotalProductCount = len(subtree)
+		return subtree
+	}
+
+	for _, root := range roots {
+		walk(root, 0)
+	}
+	return counts
+}
+
+// categoryDBError traduce violaciones de constraints de PostgreSQL a errores de dominio.
+func categoryDBError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505": // unique_violation
+			return ErrCategorySlugTaken
+		case "23503": // foreign_key_violation
+			if pqErr.Constraint == "categories_parent_id_fkey" {
+				return ErrCategoryParent
+			}
+			return ErrCategoryNotFound
+		}
+	}
+	return err
+}
+
+// ====================================================================
+// DAO DE CATEGORÍAS
+// ====================================================================
+
+// subtreeCTE selecciona los IDs de la categoría $1 y todas sus descendientes.
+const subtreeCTE = `
+	WITH RECURSIVE subtree AS (
+		SELECT id FROM categories WHERE id = $1
+		UNION ALL
+		SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+	)`
+
+func scanCategories(rows *sql.Rows) ([]Category, error) {
+	categories := []Category{}
+	for rows.Next() {
+		var c Category
+		var parentID sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.Name, &c.Slug, &parentID); err != nil {
+			return nil, err
+		}
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			c.ParentID = &id
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// GetCategories devuelve todas las categorías ordenadas por nombre.
+func GetCategories(ctx context.Context, db *sql.DB) ([]Category, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `SELECT id, name, slug, parent_id FROM categories ORDER BY name, id`)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar categorías: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	categories, err := scanCategories(rows)
+	if err != nil {
+		return nil, fmt.Errorf("error al leer categorías: %w", queryError(ctx, err))
+	}
+	return categories, nil
+}
+
+func getCategory(ctx context.Context, db *sql.DB, where string, arg any) (Category, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var c Category
+	var parentID sql.NullInt64
+	err := db.QueryRowContext(ctx, `SELECT id, name, slug, parent_id FROM categories WHERE `+where, arg).
+		Scan(&c.ID, &c.Name, &c.Slug, &parentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Category{}, ErrCategoryNotFound
+	}
+	if err != nil {
+		return Category{}, fmt.Errorf("error al consultar categoría: %w", queryError(ctx, err))
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		c.ParentID = &id
+	}
+	return c, nil
+}
+
+// GetCategoryByID devuelve una categoría o ErrCategoryNotFound.
+func GetCategoryByID(ctx context.Context, db *sql.DB, id int) (Category, error) {
+	return getCategory(ctx, db, "id = $1", id)
+}
+
+// GetCategoryBySlug devuelve una categoría o ErrCategoryNotFound.
+func GetCategoryBySlug(ctx context.Context, db *sql.DB, slug string) (Category, error) {
+	return getCategory(ctx, db, "slug = $1", slug)
+}
+
+// CreateCategory inserta la categoría y devuelve su ID asignado.
+func CreateCategory(ctx context.Context, db *sql.DB, c Category) (Category, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	err := db.QueryRowContext(ctx,
+		`INSERT INTO categories (name, slug, parent_id) VALUES ($1, $2, $3) RETURNING id`,
+		c.Name, c.Slug, c.ParentID,
+	).Scan(&c.ID)
+	if err != nil {
+		return Category{}, fmt.Errorf("error al crear categoría: %w", categoryDBError(queryError(ctx, err)))
+	}
+	return c, nil
+}
+
+// UpdateCategory actualiza nombre, slug y padre. Rechaza mover una categoría
+// debajo de sí misma o de una de sus descendientes (crearía un ciclo). Mover una
+// categoría cambia las listas con descendientes: se publica catalog.changed.
+func UpdateCategory(ctx context.Context, db *sql.DB, c Category) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	if c.ParentID != nil {
+		// Bloquear la jerarquía antes de buscar ciclos: dos movimientos concurrentes
+		// (A bajo B y B bajo A) pasarían cada uno la comprobación sin ver al otro. Así
+		// el segundo espera al COMMIT del primero y su consulta (READ COMMITTED) ya lo ve.
+		// NO KEY UPDATE no bloquea los vínculos nuevos de product_categories (KEY SHARE).
+		if _, err := tx.ExecContext(ctx, `SELECT id FROM categories ORDER BY id FOR NO KEY UPDATE`); err != nil {
+			return fmt.Errorf("error al bloquear categorías: %w", queryError(ctx, err))
+		}
+
+		var cycle bool
+		err := tx.QueryRowContext(ctx,
+			subtreeCTE+` SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)`,
+			c.ID, *c.ParentID,
+		).Scan(&cycle)
+		if err != nil {
+			return fmt.Errorf("error al validar jerarquía: %w", queryError(ctx, err))
+		}
+		if cycle {
+			return ErrCategoryCycle
+		}
+	}
+
+	result, err := tx.ExecContext(ctx,
+		`UPDATE categories SET name = $2, slug = $3, parent_id = $4 WHERE id = $1`,
+		c.ID, c.Name, c.Slug, c.ParentID,
+	)
+	if err != nil {
+		return fmt.Errorf("error al actualizar categoría: %w", categoryDBError(queryError(ctx, err)))
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrCategoryNotFound
+	}
+	return commitCatalogChange(ctx, tx)
+}
+
+// DeleteCategory elimina una categoría sin hijas (sus vínculos con productos se borran en cascada).
+func DeleteCategory(ctx context.Context, db *sql.DB, id int) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	var hasChildren bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM categories WHERE parent_id = $1)`, id).Scan(&hasChildren)
+	if err != nil {
+		return fmt.Errorf("error al consultar subcategorías: %w", queryError(ctx, err))
+	}
+	if hasChildren {
+		return ErrCategoryHasChildren
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM categories WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error al eliminar categoría: %w", categoryDBError(queryError(ctx, err)))
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrCategoryNotFound
+	}
+	return commitCatalogChange(ctx, tx)
+}
+
+// commitCatalogChange publica catalog.changed (las listas por categoría de todas
+// las instancias quedan viejas) y confirma tx.
+func commitCatalogChange(ctx context.Context, tx *sql.Tx) error {
+	if err := NotifyCatalogChange(ctx, tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error al confirmar transacción: %w", queryError(ctx, err))
+	}
+	return nil
+}
+
+// GetCategoryProductCounts devuelve el subárbol de id con el conteo de productos de cada nodo.
+func GetCategoryProductCounts(ctx context.Context, db *sql.DB, id int) ([]CategoryCount, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, subtreeCTE+`
+		SELECT c.id, c.name, c.slug, c.parent_id, pc.product_id
+		FROM subtree s
+		JOIN categories c ON c.id = s.id
+		LEFT JOIN product_categories pc ON pc.category_id = c.id
+		ORDER BY c.name, c.id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("error al contar productos por categoría: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	categories := []Category{}
+	seen := make(map[int]bool)
+	productsByCategory := make(map[int][]int)
+	for rows.Next() {
+		var c Category
+		var parentID, productID sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.Name, &c.Slug, &parentID, &productID); err != nil {
+			return nil, fmt.Errorf("error al leer conteos: %w", err)
+		}
+		if !seen[c.ID] {
+			seen[c.ID] = true
+			if parentID.Valid {
+				parent := int(parentID.Int64)
+				c.ParentID = &parent
+			}
+			categories = append(categories, c)
+		}
+		if productID.Valid {
+			productsByCategory[c.ID] = append(productsByCategory[c.ID], int(productID.Int64))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al leer conteos: %w", queryError(ctx, err))
+	}
+	if len(categories) == 0 {
+		return nil, ErrCategoryNotFound
+	}
+
+	return countCategoryProducts(buildCategoryTree(categories), productsByCategory), nil
+}
+
+// GetProductCategories devuelve las categorías asignadas a un producto.
+func GetProductCategories(ctx context.Context, db *sql.DB, productID int) ([]Category, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.id, c.name, c.slug, c.parent_id
+		FROM categories c
+		JOIN product_categories pc ON pc.category_id = c.id
+		WHERE pc.product_id = $1
+		ORDER BY c.name, c.id`, productID)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar categorías del producto: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	categories, err := scanCategories(rows)
+	if err != nil {
+		return nil, fmt.Errorf("error al leer categorías del producto: %w", queryError(ctx, err))
+	}
+	return categories, nil
+}
+
+// GetCategoriesByProductIDs devuelve en una sola consulta las categorías de
+// varios productos, agrupadas por producto (los que no tienen quedan fuera).
+func GetCategoriesByProductIDs(ctx context.Context, db *sql.DB, productIDs []int) (map[int][]Category, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	ids := make([]int64, len(productIDs))
+	for i, id := range productIDs {
+		ids[i] = int64(id)
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT pc.product_id, c.id, c.name, c.slug, c.parent_id
+		FROM categories c
+		JOIN product_categories pc ON pc.category_id = c.id
+		WHERE pc.product_id = ANY($1)
+		ORDER BY c.name, c.id`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar categorías de productos: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	categories := make(map[int][]Category, len(productIDs))
+	for rows.Next() {
+		var productID int
+		var c Category
+		var parentID sql.NullInt64
+		if err := rows.Scan(&productID, &c.ID, &c.Name, &c.Slug, &parentID); err != nil {
+			return nil, fmt.Errorf("error al leer categorías de productos: %w", err)
+		}
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			c.ParentID = &id
+		}
+		categories[productID] = append(categories[productID], c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al leer categorías de productos: %w", queryError(ctx, err))
+	}
+	return categories, nil
+}
+
+// SetProductCategories reemplaza las categorías de un producto en una transacción.
+func SetProductCategories(ctx context.Context, db *sql.DB, productID int, categoryIDs []int) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)`, productID).Scan(&exists); err != nil {
+		return fmt.Errorf("error al consultar producto: %w", queryError(ctx, err))
+	}
+	if !exists {
+		return fmt.Errorf("producto con ID %d no encontrado", productID)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM product_categories WHERE product_id = $1`, productID); err != nil {
+		return fmt.Errorf("error al limpiar categorías del producto: %w", queryError(ctx, err))
+	}
+	for _, categoryID := range categoryIDs {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO product_categories (product_id, category_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+			productID, categoryID,
+		)
+		if err != nil {
+			return fmt.Errorf("error al asignar categoría %d: %w", categoryID, categoryDBError(queryError(ctx, err)))
+		}
+	}
+	return commitCatalogChange(ctx, tx)
+}
+
+// ====================================================================
+// HANDLERS DE CATEGORÍAS
+// ====================================================================
+
+// respondCategoryError traduce los errores de dominio; el resto va a respondDBError.
+func respondCategoryError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, ErrCategoryNotFound):
+		http.Error(w, "Categoría no encontrada", http.StatusNotFound)
+	case errors.Is(err, ErrCategoryHasChildren), errors.Is(err, ErrCategorySlugTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrCategoryCycle), errors.Is(err, ErrCategoryParent):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		respondDBError(w, err, action)
+	}
+}
+
+// parseIDParam lee el parámetro {id} de la ruta; responde 400 si no es un entero.
+func parseIDParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "El ID debe ser un número entero válido.", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// decodeCategory lee y valida el cuerpo JSON de una categoría.
+func decodeCategory(w http.ResponseWriter, r *http.Request) (Category, bool) {
+	var category Category
+	if err := json.NewDecoder(r.Body).Decode(&category); err != nil {
+		http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
+		return Category{}, false
+	}
+	if err := category.normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return Category{}, false
+	}
+	return category, true
+}
+
+// GET /categorias: Devuelve el árbol completo de categorías
+func GetCategoriesHandler(cluster *DBCluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		categories, err := GetCategories(r.Context(), cluster.Reader(r))
+		if err != nil {
+			respondDBError(w, err, "obtener categorías")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buildCategoryTree(categories))
+	}
+}
+
+// GET /categorias/{id}: Devuelve una categoría
+func GetCategoryHandler(cluster *DBCluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		category, err := GetCategoryByID(r.Context(), cluster.Reader(r), id)
+		if err != nil {
+			respondCategoryError(w, err, "obtener categoría")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(category)
+	}
+}
+
+// GET /categorias/{id}/productos: Conteo de productos de la categoría y de cada descendiente
+func GetCategoryProductCountsHandler(cluster *DBCluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		counts, err := GetCategoryProductCounts(r.Context(), cluster.Reader(r), id)
+		if err != nil {
+			respondCategoryError(w, err, "contar productos por categoría")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(counts)
+	}
+}
+
+// POST /categorias: Crea una categoría (solo admin)
+func CreateCategoryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		category, ok := decodeCategory(w, r)
+		if !ok {
+			return
+		}
+
+		created, err := CreateCategory(r.Context(), db, category)
+		if err != nil {
+			respondCategoryError(w, err, "crear categoría")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+// PUT /categorias/{id}: Actualiza nombre, slug o padre (solo admin)
+func UpdateCategoryHandler(db *sql.DB, products *ProductCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+		category, ok := decodeCategory(w, r)
+		if !ok {
+			return
+		}
+		category.ID = id
+
+		if err := UpdateCategory(r.Context(), db, category); err != nil {
+			respondCategoryError(w, err, "actualizar categoría")
+			return
+		}
+		products.Invalidate(context.WithoutCancel(r.Context()))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(category)
+	}
+}
+
+// DELETE /categorias/{id}: Elimina una categoría sin subcategorías (solo admin)
+func DeleteCategoryHandler(db *sql.DB, products *ProductCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		if err := DeleteCategory(r.Context(), db, id); err != nil {
+			respondCategoryError(w, err, "eliminar categoría")
+			return
+		}
+		products.Invalidate(context.WithoutCancel(r.Context()))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ProductCategoriesRequest: Cuerpo de PUT /productos/{id}/categorias
+type ProductCategoriesRequest struct {
+	CategoryIDs []int `json:"category_ids"`
+}
+
+// GET /productos/{id}/categorias: Categorías asignadas a un producto
+func GetProductCategoriesHandler(cluster *DBCluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		categories, err := GetProductCategories(r.Context(), cluster.Reader(r), id)
+		if err != nil {
+			respondDBError(w, err, "obtener categorías del producto")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(categories)
+	}
+}
+
+// PUT /productos/{id}/categorias: Reemplaza las categorías de un producto
+func SetProductCategoriesHandler(db *sql.DB, products *ProductCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		var request ProductCategoriesRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
+			return
+		}
+
+		err := SetProductCategories(r.Context(), db, id, request.CategoryIDs)
+		if err != nil {
+			if strings.Contains(err.Error(), "no encontrado") {
+				http.Error(w, "Producto no encontrado.", http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, ErrCategoryNotFound) {
+				http.Error(w, "Alguna de las categorías no existe", http.StatusBadRequest)
+				return
+			}
+			respondDBError(w, err, "asignar categorías")
+			return
+		}
+		products.Invalidate(context.WithoutCancel(r.Context()))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
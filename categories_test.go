@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func intPtr(v int) *int { return &v }
+
+// Test: El slug se genera sin acentos ni símbolos
+func TestSlugify(t *testing.T) {
+	tests := map[string]string{
+		"Electrónica":              "electronica",
+		"  Audio & Vídeo  ":        "audio-video",
+		"Niños / Juguetes 3+ años": "ninos-juguetes-3-anos",
+	}
+	for name, want := range tests {
+		if got := slugify(name); got != want {
+			t.Errorf("slugify(%q): got %q want %q", name, got, want)
+		}
+	}
+}
+
+// Test: El árbol anida las hijas y los conteos no duplican productos del subárbol
+func TestCategoryTreeCounts(t *testing.T) {
+	categories := []Category{
+		{ID: 1, Name: "Electrónica", Slug: "electronica"},
+		{ID: 2, Name: "Audio", Slug: "audio", ParentID: intPtr(1)},
+		{ID: 3, Name: "Auriculares", Slug: "auriculares", ParentID: intPtr(2)},
+		{ID: 4, Name: "Hogar", Slug: "hogar"},
+	}
+
+	roots := buildCategoryTree(categories)
+	if len(roots) != 2 || len(roots[0].Children) != 1 || len(roots[0].Children[0].Children) != 1 {
+		t.Fatalf("Árbol mal construido: %+v", roots)
+	}
+
+	// El producto 10 está en Audio y en Auriculares: cuenta una sola vez en el total
+	counts := countCategoryProducts(roots, map[int][]int{
+		1: {20},
+		2: {10},
+		3: {10, 11},
+	})
+
+	want := []struct{ id, depth, direct, total int }{
+		{1, 0, 1, 3},
+		{2, 1, 1, 2},
+		{3, 2, 2, 2},
+		{4, 0, 0, 0},
+	}
+	if len(counts) != len(want) {
+		t.Fatalf("Se esperaban %d nodos: got %d", len(want), len(counts))
+	}
+	for i, w := range want {
+		c := counts[i]
+		if c.ID != w.id || c.Depth != w.depth || c.ProductCount != w.direct || c.TotalProductCount != w.total {
+			t.Errorf("Nodo %d: got id=%d depth=%d direct=%d total=%d, want %+v",
+				i, c.ID, c.Depth, c.ProductCount, c.TotalProductCount, w)
+		}
+	}
+}
+
+// Test: Solo un admin puede crear categorías
+func TestCategoryWritesRequireAdmin(t *testing.T) {
+	db, _ := openFakeDB(t, "categories")
+	cfg := DefaultConfig()
+	cfg.JWT.Secret = testJWTSecret
+	cfg.API.StrictResponses = true
+	router := setupRouter(NewDBCluster(db, nil, time.Second), NewProductEventBroker(cfg.Stream), newTestBlobStore(t), cfg)
+
+	token, _ := GenerateToken(1, "user", testJWTSecret, time.Hour)
+	req := httptest.NewRequest("POST", "/api/v1/categorias", strings.NewReader(`{"name":"Hogar"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Un usuario sin rol admin debe recibir 403: got %d", rr.Code)
+	}
+}
+
+// Test: Filtrar por una categoría inexistente devuelve 404
+func TestGetProductsUnknownCategory(t *testing.T) {
+	cluster, _, _ := newTestCluster(t)
+
+	rr := httptest.NewRecorder()
+	GetProductsHandler(cluster, nil, nil, newTestBlobStore(t)).ServeHTTP(rr, httptest.NewRequest("GET", "/productos?categoria=no-existe", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Se esperaba 404: got %d", rr.Code)
+	}
+}
+
+// Test: Mover una categoría bloquea la jerarquía antes de buscar ciclos, para que dos
+// movimientos concurrentes no puedan crear uno entre los dos
+func TestUpdateCategoryLocksHierarchy(t *testing.T) {
+	db, server := openFakeDB(t, "categories")
+	server.SetQueryRows("SELECT EXISTS", []string{"exists"}, []driver.Value{false})
+
+	if err := UpdateCategory(context.Background(), db, Category{ID: 2, Name: "Ropa", Slug: "ropa", ParentID: intPtr(3)}); err != nil {
+		t.Fatal(err)
+	}
+	lock, check := -1, -1
+	for i, q := range server.Queries() {
+		switch {
+		case strings.Contains(q, "FOR NO KEY UPDATE"):
+			lock = i
+		case strings.Contains(q, "WITH RECURSIVE subtree"):
+			check = i
+		}
+	}
+	if lock < 0 || check < lock {
+		t.Errorf("El bloqueo debe preceder a la búsqueda de ciclos: lock=%d check=%d", lock, check)
+	}
+
+	db, server = openFakeDB(t, "categories-cycle")
+	server.SetQueryRows("SELECT EXISTS", []string{"exists"}, []driver.Value{true})
+	if err := UpdateCategory(context.Background(), db, Category{ID: 2, Name: "Ropa", Slug: "ropa", ParentID: intPtr(3)}); !errors.Is(err, ErrCategoryCycle) {
+		t.Errorf("Colgar de una descendiente: got %v want ErrCategoryCycle", err)
+	}
+}
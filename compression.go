@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ====================================================================
+// COMPRESIÓN Y NEGOCIACIÓN DE CONTENIDO
+// Las respuestas de texto (JSON, NDJSON, CSV...) se comprimen con zstd, brotli o
+// gzip según Accept-Encoding, a partir de CompressionConfig.MinSize bytes. Los
+// cuerpos de petición con Content-Encoding se descomprimen antes de validarlos,
+// con un límite para el tamaño ya descomprimido.
+// ====================================================================
+
+// ====================================================================
+// LISTAS CON CALIDAD (Accept, Accept-Encoding)
+// ====================================================================
+
+type qualityItem struct {
+	value string
+	q     float64
+}
+
+// parseQualityList interpreta "gzip;q=0.8, br" en orden de preferencia del
+// cliente (q descendente; ante empate, el orden en la cabecera).
+func parseQualityList(header string) []qualityItem {
+	var items []qualityItem
+	for _, part := range strings.Split(header, ",") {
+		value, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, raw, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(raw, 64); err == nil && parsed >= 0 && parsed <= 1 {
+					q = parsed
+				}
+			}
+		}
+		items = append(items, qualityItem{value, q})
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].q > items[j].q })
+	return items
+}
+
+// negotiateContentType elige entre offers (la primera es la de por defecto) según
+// Accept. La calidad de cada oferta la da la regla más específica que la cubre
+// ("text/csv;q=0, */*" excluye CSV); ante calidades iguales gana la oferta nombrada
+// explícitamente y después el orden de offers. Sin Accept gana la primera; "" si
+// ninguna es aceptable (406).
+func negotiateContentType(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	items := parseQualityList(accept)
+	best, bestQ, bestSpecificity := "", 0.0, -1
+	for _, offer := range offers {
+		offerType, _, _ := strings.Cut(offer, "/")
+		q, specificity := 0.0, -1
+		for _, item := range items {
+			s := -1
+			switch item.value {
+			case offer:
+				s = 2
+			case offerType + "/*":
+				s = 1
+			case "*/*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = item.q, s
+			}
+		}
+		if q > 0 && (q > bestQ || (q == bestQ && specificity > bestSpecificity)) {
+			best, bestQ, bestSpecificity = offer, q, specificity
+		}
+	}
+	return best
+}
+
+// negotiateEncoding elige la codificación de la respuesta. Ante calidades iguales
+// manda el orden del servidor (supported); "" si no conviene comprimir.
+func negotiateEncoding(acceptEncoding string, supported []string) string {
+	items := parseQualityList(acceptEncoding)
+	qualities := make(map[string]float64, len(items))
+	wildcard, hasWildcard := 0.0, false
+	for _, item := range items {
+		if item.value == "*" {
+			wildcard, hasWildcard = item.q, true
+			continue
+		}
+		if _, seen := qualities[item.value]; !seen {
+			qualities[item.value] = item.q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range supported {
+		q, ok := qualities[encoding]
+		if !ok && hasWildcard {
+			q, ok = wildcard, true
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// ====================================================================
+// COMPRESORES (reutilizados con sync.Pool: zstd y brotli son caros de crear)
+// ====================================================================
+
+// flushWriteCloser: Compresor que además puede vaciar lo pendiente (streaming).
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+type encoderPool struct {
+	pool  sync.Pool
+	reset func(encoder flushWriteCloser, w io.Writer)
+}
+
+var encoderPools = map[string]*encoderPool{
+	"gzip": {
+		pool:  sync.Pool{New: func() any { w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression); return w }},
+		reset: func(e flushWriteCloser, w io.Writer) { e.(*gzip.Writer).Reset(w) },
+	},
+	"br": {
+		// Nivel 4: buena relación tamaño/CPU para respuestas dinámicas
+		pool:  sync.Pool{New: func() any { return brotli.NewWriterLevel(nil, 4) }},
+		reset: func(e flushWriteCloser, w io.Writer) { e.(*brotli.Writer).Reset(w) },
+	},
+	"zstd": {
+		pool: sync.Pool{New: func() any {
+			w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedDefault))
+			return w
+		}},
+		reset: func(e flushWriteCloser, w io.Writer) { e.(*zstd.Encoder).Reset(w) },
+	},
+}
+
+func (p *encoderPool) get(w io.Writer) flushWriteCloser {
+	encoder := p.pool.Get().(flushWriteCloser)
+	p.reset(encoder, w)
+	return encoder
+}
+
+func (p *encoderPool) put(encoder flushWriteCloser) {
+	p.reset(encoder, io.Discard) // No retener el ResponseWriter en el pool
+	p.pool.Put(encoder)
+}
+
+// isCompressible: Las imágenes y el stream SSE (ya comprimidas o que necesitan
+// cada evento al instante) se envían tal cual.
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "application/x-ndjson",
+		mediaType == "application/javascript", mediaType == "application/xml",
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	return false
+}
+
+// ====================================================================
+// RESPUESTAS
+// ====================================================================
+
+// CompressResponses comprime las respuestas según Accept-Encoding. Las más chicas
+// que cfg.MinSize se envían sin comprimir: se retienen hasta saber su tamaño, salvo
+// que el handler haga Flush (streaming), que decide en ese momento.
+func CompressResponses(cfg CompressionConfig) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !cfg.Enabled || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.Encodings)
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: cfg.MinSize}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string // "" si el cliente no acepta ninguna
+	minSize  int
+
+	status  int
+	buf     []byte
+	decided bool
+	encoder flushWriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if status < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(status) // 1xx informativos: no son la respuesta final
+		return
+	}
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	cw.status = status
+	// Sin cuerpo no hay nada que comprimir
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide envía las cabeceras, comprimiendo si bigEnough y el tipo lo permite, y
+// escribe lo retenido.
+func (cw *compressWriter) decide(bigEnough bool) error {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	h := cw.Header()
+	compressible := h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type"))
+	if compressible {
+		// La representación depende de Accept-Encoding aunque esta vez no se comprima
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if compressible && bigEnough && cw.encoding != "" {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		cw.encoder = encoderPools[cw.encoding].get(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush: El handler quiere que el cliente reciba lo escrito (NDJSON, SSE).
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if cw.encoder != nil {
+		cw.encoder.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close termina la respuesta: envía lo retenido (sin comprimir si no llegó al
+// mínimo) y cierra el compresor.
+func (cw *compressWriter) Close() {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			return // El handler no escribió nada (p. ej. panic(http.ErrAbortHandler))
+		}
+		cw.decide(false)
+	}
+	if cw.encoder != nil {
+		cw.encoder.Close()
+		encoderPools[cw.encoding].put(cw.encoder)
+		cw.encoder = nil
+	}
+}
+
+// Unwrap permite a http.ResponseController llegar al writer original (deadlines).
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// ====================================================================
+// PETICIONES
+// ====================================================================
+
+// DecompressRequests descomprime los cuerpos con Content-Encoding gzip, zstd o br.
+// cfg.MaxRequestBytes limita el tamaño descomprimido (una "bomba" de pocos KB puede
+// expandirse a GB). Una codificación desconocida responde 415.
+func DecompressRequests(cfg CompressionConfig) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			if encoding == "" || encoding == "identity" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := decompressBody(encoding, r.Body)
+			if err != nil {
+				w.Header().Set("Accept-Encoding", "gzip, zstd, br")
+				http.Error(w, "Content-Encoding no soportado o cuerpo inválido", http.StatusUnsupportedMediaType)
+				return
+			}
+			defer body.Close()
+
+			r.Body = http.MaxBytesReader(w, body, int64(cfg.MaxRequestBytes))
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+var errUnsupportedEncoding = errors.New("content-encoding no soportado")
+
+func decompressBody(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "br":
+		return io.NopCloser(brotli.NewReader(body)), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, errUnsupportedEncoding
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", mediaTypeJSON},
+		{"*/*", mediaTypeJSON},
+		{"text/csv", mediaTypeCSV},
+		{"application/x-ndjson, application/json;q=0.5", mediaTypeNDJSON},
+		{"application/*;q=0.8, text/csv;q=0.9", mediaTypeCSV},
+		{"application/*", mediaTypeJSON},
+		{"*/*;q=0.1, application/json;q=0", mediaTypeNDJSON}, // La regla más específica manda
+		{"TEXT/CSV; charset=utf-8", mediaTypeCSV},
+		{"text/html", ""},
+		{"application/json;q=0", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateContentType(tt.accept, productListFormats); got != tt.want {
+			t.Errorf("Accept %q: got %q want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []string{"zstd", "br", "gzip"}
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"}, // Empate: preferencia del servidor
+		{"gzip;q=1, br;q=0.5", "gzip"},
+		{"*", "zstd"},
+		{"*, zstd;q=0", "br"},
+		{"identity", ""},
+		{"gzip;q=0", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.acceptEncoding, supported); got != tt.want {
+			t.Errorf("Accept-Encoding %q: got %q want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func decodeBody(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var reader io.Reader
+	switch encoding {
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = gz
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		decoder, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+		reader = decoder
+	default:
+		return string(body)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("%s: %v", encoding, err)
+	}
+	return string(data)
+}
+
+// Test: Se comprime con la codificación negociada desde el tamaño mínimo
+func TestCompressResponses(t *testing.T) {
+	cfg := DefaultConfig().Compression
+	cfg.MinSize = 100
+	large := strings.Repeat(`{"name":"Laptop"}`, 20)
+	handler := CompressResponses(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("tipo"))
+		io.WriteString(w, r.URL.Query().Get("cuerpo"))
+	}))
+	get := func(acceptEncoding, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/?tipo="+contentType+"&cuerpo="+body, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, encoding := range []string{"gzip", "br", "zstd"} {
+		rr := get(encoding, "application/json", large)
+		if got := rr.Header().Get("Content-Encoding"); got != encoding {
+			t.Fatalf("Content-Encoding: got %q want %q", got, encoding)
+		}
+		if body := decodeBody(t, encoding, rr.Body.Bytes()); body != large {
+			t.Errorf("%s: el cuerpo no coincide: %q", encoding, body)
+		}
+		if !slices.Contains(rr.Header().Values("Vary"), "Accept-Encoding") {
+			t.Errorf("%s: falta Vary: Accept-Encoding", encoding)
+		}
+	}
+
+	// Chica, ya comprimida por naturaleza o sin Accept-Encoding: sin comprimir
+	if rr := get("gzip", "application/json", `{"ok":true}`); rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != `{"ok":true}` {
+		t.Errorf("Respuesta chica: got %q %q", rr.Header().Get("Content-Encoding"), rr.Body.String())
+	} else if !slices.Contains(rr.Header().Values("Vary"), "Accept-Encoding") {
+		t.Error("Respuesta chica: la representación igual depende de Accept-Encoding")
+	}
+	if rr := get("gzip", "image/png", large); rr.Header().Get("Content-Encoding") != "" {
+		t.Error("Las imágenes no se comprimen")
+	}
+	if rr := get("", "application/json", large); rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != large {
+		t.Error("Sin Accept-Encoding no se comprime")
+	}
+}
+
+// Test: Los cuerpos comprimidos llegan descomprimidos; codificación desconocida, 415
+func TestDecompressRequests(t *testing.T) {
+	cfg := DefaultConfig().Compression
+	cfg.MaxRequestBytes = 64
+	handler := DecompressRequests(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.Write(body)
+	}))
+	post := func(encoding string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", encoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		io.WriteString(gz, s)
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	if rr := post("gzip", gzipped(`{"name":"Laptop"}`)); rr.Code != http.StatusOK || rr.Body.String() != `{"name":"Laptop"}` {
+		t.Errorf("gzip: got %d %q", rr.Code, rr.Body.String())
+	}
+	var buf bytes.Buffer
+	encoder, _ := zstd.NewWriter(&buf)
+	encoder.Write([]byte(`{"name":"Mouse"}`))
+	encoder.Close()
+	if rr := post("zstd", buf.Bytes()); rr.Body.String() != `{"name":"Mouse"}` {
+		t.Errorf("zstd: got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// Límite sobre el tamaño descomprimido
+	if rr := post("gzip", gzipped(strings.Repeat("a", 1000))); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Límite: got %d", rr.Code)
+	}
+	if rr := post("deflate", []byte("x")); rr.Code != http.StatusUnsupportedMediaType || rr.Header().Get("Accept-Encoding") == "" {
+		t.Errorf("deflate: got %d", rr.Code)
+	}
+}
+
+func setProductRows(server *fakeServer, names ...string) {
+	rows := make([][]driver.Value, len(names))
+	for i, name := range names {
+		rows[i] = []driver.Value{int64(i + 1), name, "Descripción", int64(1999), "USD", int64(3), []byte("[]"), int64(0), int64(0), nil, nil}
+	}
+	server.SetRows([]string{"id", "name", "description", "price_minor", "currency", "stock", "images", "variant_count", "variant_stock", "min_price", "max_price"}, rows...)
+}
+
+// Test: GET /productos en NDJSON y CSV según Accept; un formato no ofrecido es 406
+func TestProductListFormats(t *testing.T) {
+	router, token, server := newConditionalTestRouter(t)
+	setProductRows(server, "Laptop", "=HYPERLINK(\"http://x\")")
+
+	// NDJSON: un producto por línea, con la representación de la versión
+	rr := conditionalGet(router, "/api/v2/productos", token, map[string]string{"Accept": mediaTypeNDJSON})
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != mediaTypeNDJSON {
+		t.Fatalf("NDJSON: got %d %q %s", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+	var names []string
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var product struct {
+			Name       string `json:"name"`
+			PriceCents int64  `json:"price_cents"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &product); err != nil {
+			t.Fatalf("Línea inválida %q: %v", scanner.Text(), err)
+		}
+		if product.PriceCents != 1999 {
+			t.Errorf("v2 debe llevar price_cents: %q", scanner.Text())
+		}
+		names = append(names, product.Name)
+	}
+	if len(names) != 2 {
+		t.Errorf("Se esperaban 2 líneas: %q", names)
+	}
+	if !slices.Contains(rr.Header().Values("Vary"), "Accept") || rr.Header().Get("ETag") != "" {
+		t.Errorf("NDJSON: Vary %q, ETag %q", rr.Header().Values("Vary"), rr.Header().Get("ETag"))
+	}
+
+	// CSV v1: importes en decimal y texto a salvo de fórmulas
+	rr = conditionalGet(router, "/api/v1/productos", token, map[string]string{"Accept": "text/csv"})
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), mediaTypeCSV) {
+		t.Fatalf("CSV: got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0][3] != "price" || records[1][3] != "19.99" {
+		t.Fatalf("CSV: got %q", records)
+	}
+	if got := records[2][1]; !strings.HasPrefix(got, "'=") {
+		t.Errorf("Fórmula sin neutralizar: %q", got)
+	}
+
+	// Catálogo vacío: solo los encabezados
+	server.SetRows(nil)
+	rr = conditionalGet(router, "/api/v2/productos", token, map[string]string{"Accept": "text/csv"})
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Body.String(), "id,name,description,price_cents,") || strings.Count(rr.Body.String(), "\n") != 1 {
+		t.Errorf("CSV vacío: got %d %q", rr.Code, rr.Body.String())
+	}
+
+	if rr := conditionalGet(router, "/api/v2/productos", token, map[string]string{"Accept": "text/html"}); rr.Code != http.StatusNotAcceptable {
+		t.Errorf("Accept text/html: got %d", rr.Code)
+	}
+}
+
+// slowResponseWriter simula un cliente lento: cada escritura tarda delay.
+type slowResponseWriter struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+}
+
+func (w slowResponseWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseRecorder.Write(b)
+}
+
+// Test: Una exportación a un cliente lento se acota con DB_EXPORT_TIMEOUT, no con
+// DB_QUERY_TIMEOUT (que cuenta también la espera al cliente)
+func TestProductExportSlowClient(t *testing.T) {
+	previousQuery, previousExport := defaultQueryTimeout, exportQueryTimeout
+	t.Cleanup(func() { defaultQueryTimeout, exportQueryTimeout = previousQuery, previousExport })
+
+	db, server := openFakeDB(t, "export")
+	names := make([]string, 20)
+	for i := range names {
+		names[i] = "Producto"
+	}
+	setProductRows(server, names...)
+
+	export := func() (rr *httptest.ResponseRecorder, aborted bool) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v != http.ErrAbortHandler {
+					panic(v)
+				}
+				aborted = true
+			}
+		}()
+		rr = httptest.NewRecorder()
+		w := slowResponseWriter{rr, 10 * time.Millisecond}
+		streamProducts(w, httptest.NewRequest("GET", "/api/v1/productos", nil), db, ProductFilter{}, "", newTestBlobStore(t), mediaTypeNDJSON)
+		return rr, false
+	}
+
+	// Escribir todas las filas tarda más que DB_QUERY_TIMEOUT y la exportación termina igual
+	defaultQueryTimeout, exportQueryTimeout = 20*time.Millisecond, 5*time.Second
+	rr, aborted := export()
+	if aborted || strings.Count(rr.Body.String(), "\n") != len(names) {
+		t.Fatalf("La exportación debe completarse: aborted=%v, %d líneas", aborted, strings.Count(rr.Body.String(), "\n"))
+	}
+
+	// Si se agota DB_EXPORT_TIMEOUT la conexión se corta (no queda un archivo truncado)
+	exportQueryTimeout = 50 * time.Millisecond
+	if _, aborted := export(); !aborted {
+		t.Error("Al agotar DB_EXPORT_TIMEOUT la exportación debe cortarse")
+	}
+}
+
+// Test: El router comprime las listas grandes cuando el cliente lo acepta
+func TestProductListCompressed(t *testing.T) {
+	router, token, server := newConditionalTestRouter(t)
+	names := make([]string, 50)
+	for i := range names {
+		names[i] = "Producto"
+	}
+	setProductRows(server, names...)
+
+	rr := conditionalGet(router, "/api/v2/productos", token, map[string]string{"Accept-Encoding": "gzip", "Accept": mediaTypeNDJSON})
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got %d %q", rr.Code, rr.Header().Get("Content-Encoding"))
+	}
+	if body := decodeBody(t, "gzip", rr.Body.Bytes()); strings.Count(body, "\n") != len(names) {
+		t.Errorf("Se esperaban %d líneas: %q", len(names), body)
+	}
+}
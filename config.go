@@ -0,0 +1,1206 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.yaml.in/yaml/v2"
+)
+
+// ====================================================================
+// CONFIGURACIÓN CENTRALIZADA
+// Orden de prioridad: valores por defecto < archivo YAML < variables de entorno < flags.
+// ====================================================================
+
+// Config: Toda la configuración de la aplicación en un solo lugar.
+type Config struct {
+	ListenAddr  string            `yaml:"listen_addr"`
+	LogLevel    string            `yaml:"log_level"`
+	Database    DatabaseConfig    `yaml:"database"`
+	HTTP        HTTPConfig        `yaml:"http"`
+	JWT         JWTConfig         `yaml:"jwt"`
+	CORS        CORSConfig        `yaml:"cors"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit"`
+	Login       LoginConfig       `yaml:"login"`
+	API         APIConfig         `yaml:"api"`
+	Webhooks    WebhookConfig     `yaml:"webhooks"`
+	Stream      StreamConfig      `yaml:"stream"`
+	Storage     StorageConfig     `yaml:"storage"`
+	Money       MoneyConfig       `yaml:"money"`
+	Cart        CartConfig        `yaml:"cart"`
+	Idempotency IdempotencyConfig `yaml:"idempotency"`
+	GraphQL     GraphQLConfig     `yaml:"graphql"`
+	GRPC        GRPCConfig        `yaml:"grpc"`
+	Cache       CacheConfig       `yaml:"cache"`
+	HTTPCache   HTTPCacheConfig   `yaml:"http_cache"`
+	Compression CompressionConfig `yaml:"compression"`
+	APIKeys     APIKeysConfig     `yaml:"api_keys"`
+}
+
+// DatabaseConfig: Conexión y pool de PostgreSQL.
+// Si URL está definida (DATABASE_URL), tiene prioridad sobre host/port/user/password/name.
+type DatabaseConfig struct {
+	URL             string   `yaml:"url"`
+	Host            string   `yaml:"host"`
+	Port            int      `yaml:"port"`
+	User            string   `yaml:"user"`
+	Password        string   `yaml:"password"`
+	Name            string   `yaml:"name"`
+	SSLMode         string   `yaml:"sslmode"`
+	SSLRootCert     string   `yaml:"sslrootcert"`
+	SSLCert         string   `yaml:"sslcert"`
+	SSLKey          string   `yaml:"sslkey"`
+	MaxOpenConns    int      `yaml:"max_open_conns"`
+	MaxIdleConns    int      `yaml:"max_idle_conns"`
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime Duration `yaml:"conn_max_idle_time"`
+	QueryTimeout    Duration `yaml:"query_timeout"`
+	ExportTimeout   Duration `yaml:"export_timeout"` // Exportaciones NDJSON/CSV, incluida la escritura al cliente
+	ConnectRetries  int      `yaml:"connect_retries"`
+	ConnectBackoff  Duration `yaml:"connect_backoff"`
+	MaxBackoff      Duration `yaml:"max_backoff"`
+
+	// Réplicas de lectura (opcionales)
+	ReplicaURLs           []string `yaml:"replica_urls"`
+	ReplicaHealthInterval Duration `yaml:"replica_health_interval"`
+	ReadAfterWriteWindow  Duration `yaml:"read_after_write_window"`
+}
+
+// HTTPConfig: Timeouts del http.Server y plazo del apagado ordenado.
+type HTTPConfig struct {
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout"`
+	ReadTimeout       Duration `yaml:"read_timeout"`
+	WriteTimeout      Duration `yaml:"write_timeout"`
+	IdleTimeout       Duration `yaml:"idle_timeout"`
+	ShutdownTimeout   Duration `yaml:"shutdown_timeout"`
+}
+
+// JWTConfig: Firma y vigencia de los tokens.
+type JWTConfig struct {
+	Secret         string   `yaml:"secret"`
+	AccessTokenTTL Duration `yaml:"access_token_ttl"`
+}
+
+// CORSConfig: Orígenes permitidos por el middleware de CORS.
+type CORSConfig struct {
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+// RateLimitConfig: Políticas por grupo de rutas en formato "<peticiones>/<periodo>".
+type RateLimitConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	Login          string   `yaml:"login"`
+	Products       string   `yaml:"products"`
+}
+
+// LoginConfig: Protección contra fuerza bruta en /login.
+type LoginConfig struct {
+	MaxFailures      int      `yaml:"max_failures"`
+	MaxFailuresPerIP int      `yaml:"max_failures_per_ip"`
+	LockoutDuration  Duration `yaml:"lockout_duration"`
+	BaseDelay        Duration `yaml:"base_delay"`
+	MaxDelay         Duration `yaml:"max_delay"`
+}
+
+// APIConfig: Calendario de retiro de las rutas legacy sin prefijo de versión (fechas YYYY-MM-DD)
+// y validación contra la especificación OpenAPI.
+type APIConfig struct {
+	LegacyDeprecatedAt string `yaml:"legacy_deprecated_at"`
+	LegacySunset       string `yaml:"legacy_sunset"`
+	ValidateRequests   bool   `yaml:"validate_requests"` // Ruta, query y cuerpo según /openapi.json
+	StrictResponses    bool   `yaml:"strict_responses"`  // También las respuestas 2xx (tests/CI)
+	MaxBodyBytes       int    `yaml:"max_body_bytes"`    // Cuerpo JSON máximo que se lee para validarlo
+}
+
+// WebhookConfig: Despachador de webhooks salientes.
+type WebhookConfig struct {
+	Enabled      bool     `yaml:"enabled"`       // false: los eventos se encolan pero no se envían
+	PollInterval Duration `yaml:"poll_interval"` // Cada cuánto se revisa el outbox
+	Timeout      Duration `yaml:"timeout"`       // Timeout de cada POST al receptor
+	MaxAttempts  int      `yaml:"max_attempts"`  // Intentos antes de pasar a dead-letter
+	BaseBackoff  Duration `yaml:"base_backoff"`
+	MaxBackoff   Duration `yaml:"max_backoff"`
+	BatchSize    int      `yaml:"batch_size"`
+}
+
+// StreamConfig: GET /productos/stream (Server-Sent Events).
+type StreamConfig struct {
+	BufferSize        int      `yaml:"buffer_size"`        // Eventos guardados para reanudar con Last-Event-ID
+	ClientBuffer      int      `yaml:"client_buffer"`      // Eventos en cola por cliente antes de desconectarlo
+	HeartbeatInterval Duration `yaml:"heartbeat_interval"` // Comentario periódico para que los proxies no corten
+}
+
+// StorageConfig: Almacenamiento de imágenes de productos.
+type StorageConfig struct {
+	Backend   string `yaml:"backend"`    // local | s3
+	LocalDir  string `yaml:"local_dir"`  // Solo backend local
+	PublicURL string `yaml:"public_url"` // Base de las URLs de imágenes (local: ruta donde la API las sirve)
+
+	S3Endpoint  string `yaml:"s3_endpoint"` // host:puerto, sin esquema (ej. s3.amazonaws.com, minio:9000)
+	S3Region    string `yaml:"s3_region"`
+	S3Bucket    string `yaml:"s3_bucket"`
+	S3AccessKey string `yaml:"s3_access_key"`
+	S3SecretKey string `yaml:"s3_secret_key"`
+	S3UseSSL    bool   `yaml:"s3_use_ssl"`
+
+	MaxUploadBytes int `yaml:"max_upload_bytes"` // Tamaño máximo de cada imagen subida
+	MaxDimension   int `yaml:"max_dimension"`    // Ancho/alto máximo en píxeles (evita "bombas" de descompresión)
+	ThumbnailSize  int `yaml:"thumbnail_size"`   // Lado mayor de la miniatura en píxeles
+}
+
+// MoneyConfig: Precios y monedas.
+type MoneyConfig struct {
+	DefaultCurrency string `yaml:"default_currency"` // Moneda de los productos creados sin "currency" (ISO-4217)
+}
+
+// CartConfig: Carritos persistentes. Cada modificación renueva la expiración.
+type CartConfig struct {
+	TTL           Duration `yaml:"ttl"`            // Carritos de usuarios autenticados
+	GuestTTL      Duration `yaml:"guest_ttl"`      // Carritos de invitados (X-Cart-Token)
+	PurgeInterval Duration `yaml:"purge_interval"` // Cada cuánto se borran los carritos expirados
+}
+
+// IdempotencyConfig: Respuestas guardadas para los reintentos con Idempotency-Key.
+type IdempotencyConfig struct {
+	Backend       string   `yaml:"backend"`        // postgres (compartido entre réplicas) o memory
+	TTL           Duration `yaml:"ttl"`            // Tiempo durante el que se repite la respuesta
+	LockTimeout   Duration `yaml:"lock_timeout"`   // Una petición en curso más antigua se considera abandonada
+	PurgeInterval Duration `yaml:"purge_interval"` // Cada cuánto se borran las claves vencidas (postgres)
+	MaxBodyBytes  int      `yaml:"max_body_bytes"` // Cuerpo máximo de una petición con Idempotency-Key
+}
+
+// GraphQLConfig: Límites de las consultas a /graphql (se revisan antes de ejecutarlas).
+type GraphQLConfig struct {
+	MaxDepth      int `yaml:"max_depth"`      // Niveles de campos anidados
+	MaxComplexity int `yaml:"max_complexity"` // Campos a resolver, multiplicados por "first" en las listas
+	MaxPageSize   int `yaml:"max_page_size"`  // Valor máximo de "first" en products
+}
+
+// GRPCConfig: ProductService (proto/product.proto) en un puerto distinto del HTTP.
+type GRPCConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	ListenAddr string `yaml:"listen_addr"`
+}
+
+// CacheConfig: Caché de lectura de GET /productos y GET /productos/{id}.
+type CacheConfig struct {
+	Backend    string   `yaml:"backend"`     // memory (LRU por instancia), redis (compartida) o none
+	TTL        Duration `yaml:"ttl"`         // Vencimiento de cada entrada (acota lo que no se invalida)
+	MaxEntries int      `yaml:"max_entries"` // Tamaño del LRU en memoria
+	RedisURL   string   `yaml:"redis_url"`   // redis://[:password@]host:6379/0 (backend redis)
+}
+
+// HTTPCacheConfig: Cache-Control de las lecturas del catálogo ("" = sin cabecera).
+// ETag y Last-Modified se envían siempre (ver httpcache.go).
+type HTTPCacheConfig struct {
+	Products string `yaml:"products"` // GET /productos
+	Product  string `yaml:"product"`  // GET /productos/{id}
+}
+
+// CompressionConfig: Compresión de respuestas (Accept-Encoding) y cuerpos de petición
+// comprimidos (Content-Encoding).
+type CompressionConfig struct {
+	Enabled         bool     `yaml:"enabled"`
+	Encodings       []string `yaml:"encodings"`         // Preferencia del servidor ante empates (zstd, br, gzip)
+	MinSize         int      `yaml:"min_size"`          // Respuestas más chicas (bytes) van sin comprimir
+	MaxRequestBytes int      `yaml:"max_request_bytes"` // Límite del cuerpo de petición ya descomprimido
+}
+
+// APIKeysConfig: Claves de API para clientes máquina a máquina (ver apikeys.go).
+type APIKeysConfig struct {
+	Enabled          bool     `yaml:"enabled"`
+	DefaultTTL       Duration `yaml:"default_ttl"`        // Vencimiento si la clave no trae expires_at (0 = sin vencimiento)
+	LastUsedInterval Duration `yaml:"last_used_interval"` // Resolución de last_used_at (un UPDATE por clave e intervalo)
+}
+
+// Duration permite escribir duraciones legibles ("15s", "1h") en YAML y en la salida de --print-config.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// configFlags: Flags de línea de comandos. Solo los flags indicados explícitamente
+// sobrescriben la configuración.
+type configFlags struct {
+	configFile  string
+	printConfig bool
+	listenAddr  string
+	logLevel    string
+	set         map[string]bool
+}
+
+// DefaultConfig devuelve la configuración base (equivalente al comportamiento histórico).
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr: ":8080",
+		LogLevel:   "info",
+		Database: DatabaseConfig{
+			Port:            5432,
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxLifetime: Duration(5 * time.Minute),
+			ConnMaxIdleTime: Duration(time.Minute),
+			QueryTimeout:    Duration(5 * time.Second),
+			ExportTimeout:   Duration(10 * time.Minute),
+			ConnectRetries:  10,
+			ConnectBackoff:  Duration(500 * time.Millisecond),
+			MaxBackoff:      Duration(10 * time.Second),
+
+			ReplicaHealthInterval: Duration(5 * time.Second),
+			ReadAfterWriteWindow:  Duration(5 * time.Second),
+		},
+		HTTP: HTTPConfig{
+			ReadHeaderTimeout: Duration(5 * time.Second),
+			ReadTimeout:       Duration(15 * time.Second),
+			WriteTimeout:      Duration(30 * time.Second),
+			IdleTimeout:       Duration(60 * time.Second),
+			ShutdownTimeout:   Duration(20 * time.Second),
+		},
+		JWT: JWTConfig{
+			AccessTokenTTL: Duration(time.Hour),
+		},
+		CORS: CORSConfig{
+			AllowedOrigins: []string{"http://*", "https://*"},
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:  true,
+			Login:    "10/1m",
+			Products: "100/1m",
+		},
+		Login: LoginConfig{
+			MaxFailures:      5,
+			MaxFailuresPerIP: 20,
+			LockoutDuration:  Duration(15 * time.Minute),
+			BaseDelay:        Duration(time.Second),
+			MaxDelay:         Duration(30 * time.Second),
+		},
+		API: APIConfig{
+			LegacyDeprecatedAt: "2026-10-18",
+			LegacySunset:       "2027-04-30",
+			ValidateRequests:   true,
+			MaxBodyBytes:       1 << 20,
+		},
+		Webhooks: WebhookConfig{
+			Enabled:      true,
+			PollInterval: Duration(5 * time.Second),
+			Timeout:      Duration(10 * time.Second),
+			MaxAttempts:  8,
+			BaseBackoff:  Duration(30 * time.Second),
+			MaxBackoff:   Duration(time.Hour),
+			BatchSize:    50,
+		},
+		Stream: StreamConfig{
+			BufferSize:        1000,
+			ClientBuffer:      64,
+			HeartbeatInterval: Duration(15 * time.Second),
+		},
+		Storage: StorageConfig{
+			Backend:        "local",
+			LocalDir:       "./uploads",
+			PublicURL:      "/imagenes",
+			S3Region:       "us-east-1",
+			S3UseSSL:       true,
+			MaxUploadBytes: 5 << 20, // 5 MiB
+			MaxDimension:   8000,
+			ThumbnailSize:  256,
+		},
+		Money: MoneyConfig{
+			DefaultCurrency: "USD",
+		},
+		Cart: CartConfig{
+			TTL:           Duration(30 * 24 * time.Hour),
+			GuestTTL:      Duration(7 * 24 * time.Hour),
+			PurgeInterval: Duration(time.Hour),
+		},
+		Idempotency: IdempotencyConfig{
+			Backend:       "postgres",
+			TTL:           Duration(24 * time.Hour),
+			LockTimeout:   Duration(time.Minute),
+			PurgeInterval: Duration(time.Hour),
+			MaxBodyBytes:  10 << 20,
+		},
+		GraphQL: GraphQLConfig{
+			MaxDepth:      8,
+			MaxComplexity: 1000,
+			MaxPageSize:   100,
+		},
+		GRPC: GRPCConfig{
+			Enabled:    true,
+			ListenAddr: ":9090",
+		},
+		Cache: CacheConfig{
+			Backend:    "memory",
+			TTL:        Duration(30 * time.Second),
+			MaxEntries: 1000,
+		},
+		HTTPCache: HTTPCacheConfig{
+			Products: "public, max-age=0, s-maxage=30, stale-while-revalidate=30",
+			Product:  "public, max-age=0, s-maxage=60, stale-while-revalidate=30",
+		},
+		Compression: CompressionConfig{
+			Enabled:         true,
+			Encodings:       []string{"zstd", "br", "gzip"},
+			MinSize:         1024,
+			MaxRequestBytes: 10 << 20,
+		},
+		APIKeys: APIKeysConfig{
+			Enabled:          true,
+			DefaultTTL:       Duration(90 * 24 * time.Hour),
+			LastUsedInterval: Duration(time.Minute),
+		},
+	}
+}
+
+// parseFlags interpreta los argumentos de línea de comandos.
+func parseFlags(args []string) (configFlags, error) {
+	var flags configFlags
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+	fs.StringVar(&flags.configFile, "config", "", "Ruta a un archivo de configuración YAML (también CONFIG_FILE)")
+	fs.BoolVar(&flags.printConfig, "print-config", false, "Imprime la configuración efectiva (secretos ocultos) y termina")
+	fs.StringVar(&flags.listenAddr, "listen-addr", "", "Dirección de escucha, ej. :8080")
+	fs.StringVar(&flags.logLevel, "log-level", "", "Nivel de log: debug, info, warn, error")
+
+	if err := fs.Parse(args); err != nil {
+		return configFlags{}, err
+	}
+
+	flags.set = map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { flags.set[f.Name] = true })
+	return flags, nil
+}
+
+// LoadConfig construye la configuración combinando todas las fuentes y la valida.
+// Devuelve TODOS los errores encontrados a la vez (errors.Join), no solo el primero.
+func LoadConfig(flags configFlags) (Config, error) {
+	cfg := DefaultConfig()
+	var errs []error
+
+	// 1. Archivo opcional
+	configFile := flags.configFile
+	if configFile == "" {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
+	if configFile != "" {
+		if err := loadConfigFile(configFile, &cfg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// 2. Variables de entorno
+	errs = append(errs, applyEnv(&cfg)...)
+
+	// 3. Flags
+	if flags.set["listen-addr"] {
+		cfg.ListenAddr = flags.listenAddr
+	}
+	if flags.set["log-level"] {
+		cfg.LogLevel = flags.logLevel
+	}
+
+	// 4. Validación
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return cfg, errors.Join(errs...)
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("no se pudo leer el archivo de configuración: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("archivo de configuración %s inválido: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv sobrescribe cfg con las variables de entorno definidas.
+func applyEnv(cfg *Config) []error {
+	var errs []error
+
+	envString(&cfg.ListenAddr, "LISTEN_ADDR")
+	if port := os.Getenv("API_PORT"); port != "" && os.Getenv("LISTEN_ADDR") == "" {
+		cfg.ListenAddr = ":" + port
+	}
+	envString(&cfg.LogLevel, "LOG_LEVEL")
+
+	envString(&cfg.Database.URL, "DATABASE_URL")
+	envString(&cfg.Database.Host, "POSTGRES_HOST")
+	errs = envInt(&cfg.Database.Port, "POSTGRES_PORT", errs)
+	envString(&cfg.Database.User, "POSTGRES_USER")
+	envString(&cfg.Database.Password, "POSTGRES_PASSWORD")
+	envString(&cfg.Database.Name, "POSTGRES_DB")
+	envString(&cfg.Database.SSLMode, "POSTGRES_SSLMODE")
+	envString(&cfg.Database.SSLRootCert, "POSTGRES_SSLROOTCERT")
+	envString(&cfg.Database.SSLCert, "POSTGRES_SSLCERT")
+	envString(&cfg.Database.SSLKey, "POSTGRES_SSLKEY")
+	errs = envInt(&cfg.Database.MaxOpenConns, "DB_MAX_OPEN_CONNS", errs)
+	errs = envInt(&cfg.Database.MaxIdleConns, "DB_MAX_IDLE_CONNS", errs)
+	errs = envDuration(&cfg.Database.ConnMaxLifetime, "DB_CONN_MAX_LIFETIME", errs)
+	errs = envDuration(&cfg.Database.ConnMaxIdleTime, "DB_CONN_MAX_IDLE_TIME", errs)
+	errs = envDuration(&cfg.Database.QueryTimeout, "DB_QUERY_TIMEOUT", errs)
+	errs = envDuration(&cfg.Database.ExportTimeout, "DB_EXPORT_TIMEOUT", errs)
+	errs = envInt(&cfg.Database.ConnectRetries, "DB_CONNECT_RETRIES", errs)
+	errs = envDuration(&cfg.Database.ConnectBackoff, "DB_CONNECT_BACKOFF", errs)
+	errs = envDuration(&cfg.Database.MaxBackoff, "DB_CONNECT_MAX_BACKOFF", errs)
+	if replicas := os.Getenv("DATABASE_REPLICA_URLS"); replicas != "" {
+		cfg.Database.ReplicaURLs = splitList(replicas)
+	}
+	errs = envDuration(&cfg.Database.ReplicaHealthInterval, "DB_REPLICA_HEALTH_INTERVAL", errs)
+	errs = envDuration(&cfg.Database.ReadAfterWriteWindow, "DB_READ_AFTER_WRITE_WINDOW", errs)
+
+	errs = envDuration(&cfg.HTTP.ReadHeaderTimeout, "HTTP_READ_HEADER_TIMEOUT", errs)
+	errs = envDuration(&cfg.HTTP.ReadTimeout, "HTTP_READ_TIMEOUT", errs)
+	errs = envDuration(&cfg.HTTP.WriteTimeout, "HTTP_WRITE_TIMEOUT", errs)
+	errs = envDuration(&cfg.HTTP.IdleTimeout, "HTTP_IDLE_TIMEOUT", errs)
+	errs = envDuration(&cfg.HTTP.ShutdownTimeout, "SHUTDOWN_TIMEOUT", errs)
+
+	envString(&cfg.JWT.Secret, "JWT_SECRET")
+	errs = envDuration(&cfg.JWT.AccessTokenTTL, "JWT_ACCESS_TOKEN_TTL", errs)
+
+	if origins := os.Getenv("CORS_ALLOWED_ORIGINS"); origins != "" {
+		cfg.CORS.AllowedOrigins = splitList(origins)
+	}
+
+	errs = envBool(&cfg.RateLimit.Enabled, "RATE_LIMIT_ENABLED", errs)
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		cfg.RateLimit.TrustedProxies = splitList(proxies)
+	}
+	envString(&cfg.RateLimit.Login, "RATE_LIMIT_LOGIN")
+	envString(&cfg.RateLimit.Products, "RATE_LIMIT_PRODUCTS")
+
+	errs = envInt(&cfg.Login.MaxFailures, "LOGIN_MAX_FAILURES", errs)
+	errs = envInt(&cfg.Login.MaxFailuresPerIP, "LOGIN_MAX_FAILURES_PER_IP", errs)
+	errs = envDuration(&cfg.Login.LockoutDuration, "LOGIN_LOCKOUT_DURATION", errs)
+	errs = envDuration(&cfg.Login.BaseDelay, "LOGIN_BASE_DELAY", errs)
+	errs = envDuration(&cfg.Login.MaxDelay, "LOGIN_MAX_DELAY", errs)
+
+	envString(&cfg.API.LegacyDeprecatedAt, "LEGACY_ROUTES_DEPRECATED_AT")
+	envString(&cfg.API.LegacySunset, "LEGACY_ROUTES_SUNSET")
+	errs = envBool(&cfg.API.ValidateRequests, "API_VALIDATE_REQUESTS", errs)
+	errs = envBool(&cfg.API.StrictResponses, "API_STRICT_RESPONSES", errs)
+	errs = envInt(&cfg.API.MaxBodyBytes, "API_MAX_BODY_BYTES", errs)
+
+	errs = envBool(&cfg.Webhooks.Enabled, "WEBHOOKS_ENABLED", errs)
+	errs = envDuration(&cfg.Webhooks.PollInterval, "WEBHOOKS_POLL_INTERVAL", errs)
+	errs = envDuration(&cfg.Webhooks.Timeout, "WEBHOOKS_TIMEOUT", errs)
+	errs = envInt(&cfg.Webhooks.MaxAttempts, "WEBHOOKS_MAX_ATTEMPTS", errs)
+	errs = envDuration(&cfg.Webhooks.BaseBackoff, "WEBHOOKS_BASE_BACKOFF", errs)
+	errs = envDuration(&cfg.Webhooks.MaxBackoff, "WEBHOOKS_MAX_BACKOFF", errs)
+	errs = envInt(&cfg.Webhooks.BatchSize, "WEBHOOKS_BATCH_SIZE", errs)
+
+	errs = envInt(&cfg.Stream.BufferSize, "STREAM_BUFFER_SIZE", errs)
+	errs = envInt(&cfg.Stream.ClientBuffer, "STREAM_CLIENT_BUFFER", errs)
+	errs = envDuration(&cfg.Stream.HeartbeatInterval, "STREAM_HEARTBEAT_INTERVAL", errs)
+
+	envString(&cfg.Storage.Backend, "STORAGE_BACKEND")
+	envString(&cfg.Storage.LocalDir, "STORAGE_LOCAL_DIR")
+	envString(&cfg.Storage.PublicURL, "STORAGE_PUBLIC_URL")
+	envString(&cfg.Storage.S3Endpoint, "S3_ENDPOINT")
+	envString(&cfg.Storage.S3Region, "S3_REGION")
+	envString(&cfg.Storage.S3Bucket, "S3_BUCKET")
+	envString(&cfg.Storage.S3AccessKey, "S3_ACCESS_KEY")
+	envString(&cfg.Storage.S3SecretKey, "S3_SECRET_KEY")
+	errs = envBool(&cfg.Storage.S3UseSSL, "S3_USE_SSL", errs)
+	errs = envInt(&cfg.Storage.MaxUploadBytes, "IMAGE_MAX_UPLOAD_BYTES", errs)
+	errs = envInt(&cfg.Storage.MaxDimension, "IMAGE_MAX_DIMENSION", errs)
+	errs = envInt(&cfg.Storage.ThumbnailSize, "IMAGE_THUMBNAIL_SIZE", errs)
+
+	envString(&cfg.Money.DefaultCurrency, "DEFAULT_CURRENCY")
+
+	errs = envDuration(&cfg.Cart.TTL, "CART_TTL", errs)
+	errs = envDuration(&cfg.Cart.GuestTTL, "CART_GUEST_TTL", errs)
+	errs = envDuration(&cfg.Cart.PurgeInterval, "CART_PURGE_INTERVAL", errs)
+
+	envString(&cfg.Idempotency.Backend, "IDEMPOTENCY_BACKEND")
+	errs = envDuration(&cfg.Idempotency.TTL, "IDEMPOTENCY_TTL", errs)
+	errs = envDuration(&cfg.Idempotency.LockTimeout, "IDEMPOTENCY_LOCK_TIMEOUT", errs)
+	errs = envDuration(&cfg.Idempotency.PurgeInterval, "IDEMPOTENCY_PURGE_INTERVAL", errs)
+	errs = envInt(&cfg.Idempotency.MaxBodyBytes, "IDEMPOTENCY_MAX_BODY_BYTES", errs)
+
+	errs = envInt(&cfg.GraphQL.MaxDepth, "GRAPHQL_MAX_DEPTH", errs)
+	errs = envInt(&cfg.GraphQL.MaxComplexity, "GRAPHQL_MAX_COMPLEXITY", errs)
+	errs = envInt(&cfg.GraphQL.MaxPageSize, "GRAPHQL_MAX_PAGE_SIZE", errs)
+
+	errs = envBool(&cfg.GRPC.Enabled, "GRPC_ENABLED", errs)
+	envString(&cfg.GRPC.ListenAddr, "GRPC_LISTEN_ADDR")
+
+	envString(&cfg.Cache.Backend, "CACHE_BACKEND")
+	errs = envDuration(&cfg.Cache.TTL, "CACHE_TTL", errs)
+	errs = envInt(&cfg.Cache.MaxEntries, "CACHE_MAX_ENTRIES", errs)
+	envString(&cfg.Cache.RedisURL, "CACHE_REDIS_URL")
+
+	envString(&cfg.HTTPCache.Products, "HTTP_CACHE_PRODUCTS")
+	envString(&cfg.HTTPCache.Product, "HTTP_CACHE_PRODUCT")
+
+	errs = envBool(&cfg.Compression.Enabled, "COMPRESSION_ENABLED", errs)
+	if encodings := os.Getenv("COMPRESSION_ENCODINGS"); encodings != "" {
+		cfg.Compression.Encodings = splitList(encodings)
+	}
+	errs = envInt(&cfg.Compression.MinSize, "COMPRESSION_MIN_SIZE", errs)
+	errs = envInt(&cfg.Compression.MaxRequestBytes, "COMPRESSION_MAX_REQUEST_BYTES", errs)
+
+	errs = envBool(&cfg.APIKeys.Enabled, "API_KEYS_ENABLED", errs)
+	errs = envDuration(&cfg.APIKeys.DefaultTTL, "API_KEYS_DEFAULT_TTL", errs)
+	errs = envDuration(&cfg.APIKeys.LastUsedInterval, "API_KEYS_LAST_USED_INTERVAL", errs)
+
+	return errs
+}
+
+// Las variables vacías se tratan como no definidas (docker-compose las exporta así).
+func envString(target *string, key string) {
+	if value := os.Getenv(key); value != "" {
+		*target = value
+	}
+}
+
+func envInt(target *int, key string, errs []error) []error {
+	value := os.Getenv(key)
+	if value == "" {
+		return errs
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return append(errs, fmt.Errorf("%s debe ser un entero, se recibió %q", key, value))
+	}
+	*target = parsed
+	return errs
+}
+
+func envBool(target *bool, key string, errs []error) []error {
+	value := os.Getenv(key)
+	if value == "" {
+		return errs
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return append(errs, fmt.Errorf("%s debe ser true o false, se recibió %q", key, value))
+	}
+	*target = parsed
+	return errs
+}
+
+func envDuration(target *Duration, key string, errs []error) []error {
+	value := os.Getenv(key)
+	if value == "" {
+		return errs
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return append(errs, fmt.Errorf("%s debe ser una duración (ej. 15s), se recibió %q", key, value))
+	}
+	*target = Duration(parsed)
+	return errs
+}
+
+// splitList separa una lista por comas, ignorando espacios y elementos vacíos.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Validate revisa la configuración completa y reporta todos los problemas juntos.
+func (c Config) Validate() error {
+	var errs []error
+
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("listen_addr es requerido"))
+	}
+	if _, err := c.SlogLevel(); err != nil {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, c.Database.validate()...)
+
+	if c.HTTP.ReadHeaderTimeout <= 0 || c.HTTP.ReadTimeout <= 0 || c.HTTP.WriteTimeout <= 0 || c.HTTP.IdleTimeout <= 0 {
+		errs = append(errs, errors.New("los timeouts HTTP deben ser mayores a 0"))
+	}
+	if c.HTTP.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("SHUTDOWN_TIMEOUT debe ser mayor a 0"))
+	}
+
+	if c.JWT.Secret == "" {
+		errs = append(errs, errors.New("JWT_SECRET es requerido"))
+	}
+	if c.JWT.AccessTokenTTL <= 0 {
+		errs = append(errs, errors.New("JWT_ACCESS_TOKEN_TTL debe ser mayor a 0"))
+	}
+
+	if len(c.CORS.AllowedOrigins) == 0 {
+		errs = append(errs, errors.New("CORS_ALLOWED_ORIGINS no puede estar vacío"))
+	}
+
+	if _, err := NewClientIPResolver(c.RateLimit.TrustedProxies); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := ParseRateLimitPolicy("login", c.RateLimit.Login); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := ParseRateLimitPolicy("productos", c.RateLimit.Products); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.Login.MaxFailures < 1 || c.Login.MaxFailuresPerIP < 1 {
+		errs = append(errs, errors.New("LOGIN_MAX_FAILURES y LOGIN_MAX_FAILURES_PER_IP deben ser al menos 1"))
+	}
+	if c.Login.LockoutDuration <= 0 {
+		errs = append(errs, errors.New("LOGIN_LOCKOUT_DURATION debe ser mayor a 0"))
+	}
+	if c.Login.BaseDelay < 0 || c.Login.MaxDelay < c.Login.BaseDelay {
+		errs = append(errs, errors.New("LOGIN_BASE_DELAY no puede ser negativo ni exceder LOGIN_MAX_DELAY"))
+	}
+
+	deprecatedAt, err := time.Parse(time.DateOnly, c.API.LegacyDeprecatedAt)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("LEGACY_ROUTES_DEPRECATED_AT debe tener formato YYYY-MM-DD: %q", c.API.LegacyDeprecatedAt))
+	}
+	sunset, err := time.Parse(time.DateOnly, c.API.LegacySunset)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("LEGACY_ROUTES_SUNSET debe tener formato YYYY-MM-DD: %q", c.API.LegacySunset))
+	} else if sunset.Before(deprecatedAt) {
+		errs = append(errs, errors.New("LEGACY_ROUTES_SUNSET no puede ser anterior a LEGACY_ROUTES_DEPRECATED_AT"))
+	}
+	if c.API.MaxBodyBytes < 1 {
+		errs = append(errs, errors.New("API_MAX_BODY_BYTES debe ser al menos 1"))
+	}
+
+	if c.Webhooks.PollInterval <= 0 || c.Webhooks.Timeout <= 0 {
+		errs = append(errs, errors.New("WEBHOOKS_POLL_INTERVAL y WEBHOOKS_TIMEOUT deben ser mayores a 0"))
+	}
+	if c.Webhooks.MaxAttempts < 1 || c.Webhooks.BatchSize < 1 {
+		errs = append(errs, errors.New("WEBHOOKS_MAX_ATTEMPTS y WEBHOOKS_BATCH_SIZE deben ser al menos 1"))
+	}
+	if c.Webhooks.BaseBackoff <= 0 || c.Webhooks.MaxBackoff < c.Webhooks.BaseBackoff {
+		errs = append(errs, errors.New("WEBHOOKS_BASE_BACKOFF debe ser mayor a 0 y no exceder WEBHOOKS_MAX_BACKOFF"))
+	}
+
+	if c.Stream.BufferSize < 1 || c.Stream.ClientBuffer < 1 {
+		errs = append(errs, errors.New("STREAM_BUFFER_SIZE y STREAM_CLIENT_BUFFER deben ser al menos 1"))
+	}
+	if c.Stream.HeartbeatInterval <= 0 {
+		errs = append(errs, errors.New("STREAM_HEARTBEAT_INTERVAL debe ser mayor a 0"))
+	}
+
+	switch c.Storage.Backend {
+	case "local":
+		if c.Storage.LocalDir == "" {
+			errs = append(errs, errors.New("STORAGE_LOCAL_DIR es obligatorio con STORAGE_BACKEND=local"))
+		}
+	case "s3":
+		if c.Storage.S3Endpoint == "" || c.Storage.S3Bucket == "" || c.Storage.S3AccessKey == "" || c.Storage.S3SecretKey == "" {
+			errs = append(errs, errors.New("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY y S3_SECRET_KEY son obligatorios con STORAGE_BACKEND=s3"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("STORAGE_BACKEND inválido %q (usa local o s3)", c.Storage.Backend))
+	}
+	if c.Storage.MaxUploadBytes < 1 || c.Storage.MaxDimension < 1 {
+		errs = append(errs, errors.New("IMAGE_MAX_UPLOAD_BYTES e IMAGE_MAX_DIMENSION deben ser al menos 1"))
+	}
+	if c.Storage.ThumbnailSize < 16 || c.Storage.ThumbnailSize > 2048 {
+		errs = append(errs, errors.New("IMAGE_THUMBNAIL_SIZE debe estar entre 16 y 2048"))
+	}
+
+	if _, err := normalizeCurrency(c.Money.DefaultCurrency); err != nil {
+		errs = append(errs, fmt.Errorf("DEFAULT_CURRENCY: %w", err))
+	}
+
+	if c.Cart.TTL <= 0 || c.Cart.GuestTTL <= 0 || c.Cart.PurgeInterval <= 0 {
+		errs = append(errs, errors.New("CART_TTL, CART_GUEST_TTL y CART_PURGE_INTERVAL deben ser mayores a 0"))
+	}
+
+	switch c.Idempotency.Backend {
+	case "postgres", "memory":
+	default:
+		errs = append(errs, fmt.Errorf("IDEMPOTENCY_BACKEND inválido %q (usa postgres o memory)", c.Idempotency.Backend))
+	}
+	if c.Idempotency.TTL <= 0 || c.Idempotency.LockTimeout <= 0 || c.Idempotency.PurgeInterval <= 0 {
+		errs = append(errs, errors.New("IDEMPOTENCY_TTL, IDEMPOTENCY_LOCK_TIMEOUT e IDEMPOTENCY_PURGE_INTERVAL deben ser mayores a 0"))
+	}
+	if c.Idempotency.MaxBodyBytes <= c.Storage.MaxUploadBytes {
+		errs = append(errs, errors.New("IDEMPOTENCY_MAX_BODY_BYTES debe ser mayor que IMAGE_MAX_UPLOAD_BYTES (las subidas de imágenes también pasan por la idempotencia)"))
+	}
+
+	if c.GraphQL.MaxDepth < 1 || c.GraphQL.MaxComplexity < 1 || c.GraphQL.MaxPageSize < 1 {
+		errs = append(errs, errors.New("GRAPHQL_MAX_DEPTH, GRAPHQL_MAX_COMPLEXITY y GRAPHQL_MAX_PAGE_SIZE deben ser al menos 1"))
+	}
+
+	if c.GRPC.Enabled && (c.GRPC.ListenAddr == "" || c.GRPC.ListenAddr == c.ListenAddr) {
+		errs = append(errs, errors.New("GRPC_LISTEN_ADDR es obligatorio y distinto de LISTEN_ADDR con GRPC_ENABLED=true"))
+	}
+
+	switch c.Cache.Backend {
+	case "none":
+	case "memory":
+		if c.Cache.MaxEntries < 1 {
+			errs = append(errs, errors.New("CACHE_MAX_ENTRIES debe ser al menos 1"))
+		}
+	case "redis":
+		if _, err := redis.ParseURL(c.Cache.RedisURL); err != nil {
+			errs = append(errs, fmt.Errorf("CACHE_REDIS_URL inválida: %w", err))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("CACHE_BACKEND inválido %q (usa memory, redis o none)", c.Cache.Backend))
+	}
+	if c.Cache.Backend != "none" && c.Cache.TTL <= 0 {
+		errs = append(errs, errors.New("CACHE_TTL debe ser mayor a 0"))
+	}
+
+	for _, encoding := range c.Compression.Encodings {
+		if _, ok := encoderPools[encoding]; !ok {
+			errs = append(errs, fmt.Errorf("COMPRESSION_ENCODINGS: codificación desconocida %q (usa zstd, br o gzip)", encoding))
+		}
+	}
+	if c.Compression.Enabled && len(c.Compression.Encodings) == 0 {
+		errs = append(errs, errors.New("COMPRESSION_ENCODINGS no puede estar vacío con COMPRESSION_ENABLED=true"))
+	}
+	if c.Compression.MinSize < 0 || c.Compression.MaxRequestBytes < 1 {
+		errs = append(errs, errors.New("COMPRESSION_MIN_SIZE no puede ser negativo y COMPRESSION_MAX_REQUEST_BYTES debe ser al menos 1"))
+	}
+
+	if c.APIKeys.DefaultTTL < 0 || c.APIKeys.LastUsedInterval < 0 {
+		errs = append(errs, errors.New("API_KEYS_DEFAULT_TTL y API_KEYS_LAST_USED_INTERVAL no pueden ser negativos"))
+	}
+
+	for key, policy := range map[string]string{"HTTP_CACHE_PRODUCTS": c.HTTPCache.Products, "HTTP_CACHE_PRODUCT": c.HTTPCache.Product} {
+		if err := ValidateCacheControl(policy); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate revisa la conexión, TLS y pool de la DB.
+func (c DatabaseConfig) validate() []error {
+	var errs []error
+
+	if c.URL != "" {
+		if err := validateDSN(c.URL); err != nil {
+			errs = append(errs, fmt.Errorf("DATABASE_URL: %w", err))
+		}
+	} else {
+		if c.Host == "" {
+			errs = append(errs, errors.New("POSTGRES_HOST es requerido (o DATABASE_URL)"))
+		}
+		if c.Port <= 0 || c.Port > 65535 {
+			errs = append(errs, fmt.Errorf("POSTGRES_PORT fuera de rango: %d", c.Port))
+		}
+		if c.User == "" {
+			errs = append(errs, errors.New("POSTGRES_USER es requerido (o DATABASE_URL)"))
+		}
+		if c.Name == "" {
+			errs = append(errs, errors.New("POSTGRES_DB es requerido (o DATABASE_URL)"))
+		}
+		if err := validateSSLMode(c.SSLMode); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Certificados TLS: deben existir, y cert/key van siempre juntos
+	if (c.SSLCert == "") != (c.SSLKey == "") {
+		errs = append(errs, errors.New("POSTGRES_SSLCERT y POSTGRES_SSLKEY deben definirse juntos"))
+	}
+	for key, path := range map[string]string{
+		"POSTGRES_SSLROOTCERT": c.SSLRootCert,
+		"POSTGRES_SSLCERT":     c.SSLCert,
+		"POSTGRES_SSLKEY":      c.SSLKey,
+	} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+
+	if c.MaxOpenConns < 0 || c.MaxIdleConns < 0 {
+		errs = append(errs, errors.New("los límites del pool no pueden ser negativos"))
+	}
+	if c.MaxOpenConns > 0 && c.MaxIdleConns > c.MaxOpenConns {
+		errs = append(errs, fmt.Errorf("max_idle_conns (%d) no puede exceder max_open_conns (%d)", c.MaxIdleConns, c.MaxOpenConns))
+	}
+	if c.ConnMaxLifetime < 0 || c.ConnMaxIdleTime < 0 {
+		errs = append(errs, errors.New("DB_CONN_MAX_LIFETIME y DB_CONN_MAX_IDLE_TIME no pueden ser negativos"))
+	}
+	if c.QueryTimeout <= 0 {
+		errs = append(errs, errors.New("DB_QUERY_TIMEOUT debe ser mayor a 0"))
+	}
+	if c.ExportTimeout <= 0 {
+		errs = append(errs, errors.New("DB_EXPORT_TIMEOUT debe ser mayor a 0"))
+	}
+	if c.ConnectRetries < 1 {
+		errs = append(errs, errors.New("DB_CONNECT_RETRIES debe ser al menos 1"))
+	}
+	if c.ConnectBackoff <= 0 || c.MaxBackoff < c.ConnectBackoff {
+		errs = append(errs, errors.New("DB_CONNECT_BACKOFF debe ser mayor a 0 y no exceder DB_CONNECT_MAX_BACKOFF"))
+	}
+
+	for i, replica := range c.ReplicaURLs {
+		if err := validateDSN(replica); err != nil {
+			errs = append(errs, fmt.Errorf("DATABASE_REPLICA_URLS[%d]: %w", i, err))
+		}
+	}
+	if len(c.ReplicaURLs) > 0 && (c.ReplicaHealthInterval <= 0 || c.ReadAfterWriteWindow <= 0) {
+		errs = append(errs, errors.New("DB_REPLICA_HEALTH_INTERVAL y DB_READ_AFTER_WRITE_WINDOW deben ser mayores a 0"))
+	}
+
+	return errs
+}
+
+// validateSSLMode acepta los sslmode que soporta lib/pq.
+func validateSSLMode(mode string) error {
+	switch mode {
+	case "disable", "require", "verify-ca", "verify-full":
+		return nil
+	}
+	return fmt.Errorf("sslmode inválido %q (disable, require, verify-ca, verify-full)", mode)
+}
+
+// validateDSN revisa una cadena de conexión de lib/pq (URL o clave=valor) y su sslmode.
+func validateDSN(dsn string) error {
+	params, err := dsnParams(dsn)
+	if err != nil {
+		return fmt.Errorf("cadena de conexión inválida: %w", err)
+	}
+	if mode := params.Get("sslmode"); mode != "" {
+		return validateSSLMode(mode)
+	}
+	return nil
+}
+
+// ====================================================================
+// CADENAS DE CONEXIÓN: lib/pq acepta URLs postgres:// y el formato
+// clave=valor de libpq ("host=db user=api password='mi pass'").
+// ====================================================================
+
+// isURLDSN sigue el criterio de lib/pq: URL solo con esquema postgres(ql)://.
+func isURLDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+type dsnParam struct{ key, value string }
+
+// parseKeyValueDSN lee el formato clave=valor con las reglas de escape de libpq
+// (valores entre comillas simples, \ y \' escapados).
+func parseKeyValueDSN(dsn string) ([]dsnParam, error) {
+	var params []dsnParam
+	isSpace := func(b byte) bool { return b == ' ' || b == '\t' || b == '\n' || b == '\r' }
+	i := 0
+	skipSpaces := func() {
+		for i < len(dsn) && isSpace(dsn[i]) {
+			i++
+		}
+	}
+	for {
+		skipSpaces()
+		if i == len(dsn) {
+			return params, nil
+		}
+
+		start := i
+		for i < len(dsn) && dsn[i] != '=' && !isSpace(dsn[i]) {
+			i++
+		}
+		key := dsn[start:i]
+		skipSpaces()
+		if i == len(dsn) || dsn[i] != '=' {
+			return nil, fmt.Errorf("falta \"=\" tras %q", key)
+		}
+		i++
+		skipSpaces()
+
+		var value strings.Builder
+		if i < len(dsn) && dsn[i] == '\'' {
+			for i++; ; i++ {
+				if i == len(dsn) {
+					return nil, fmt.Errorf("comilla sin cerrar en %q", key)
+				}
+				if dsn[i] == '\'' {
+					i++
+					break
+				}
+				if dsn[i] == '\\' && i+1 < len(dsn) {
+					i++
+				}
+				value.WriteByte(dsn[i])
+			}
+		} else {
+			for ; i < len(dsn) && !isSpace(dsn[i]); i++ {
+				if dsn[i] == '\\' && i+1 < len(dsn) {
+					i++
+				}
+				value.WriteByte(dsn[i])
+			}
+		}
+		params = append(params, dsnParam{key: key, value: value.String()})
+	}
+}
+
+// formatKeyValueDSN es la inversa de parseKeyValueDSN.
+func formatKeyValueDSN(params []dsnParam) string {
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.key + "=" + quoteDSNValue(p.value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// dsnParams devuelve los parámetros de una cadena de conexión: la query de la URL
+// o los pares clave=valor.
+func dsnParams(dsn string) (url.Values, error) {
+	if isURLDSN(dsn) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return u.Query(), nil
+	}
+	pairs, err := parseKeyValueDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	for _, p := range pairs {
+		params.Set(p.key, p.value)
+	}
+	return params, nil
+}
+
+// redactDSN oculta la contraseña de una cadena de conexión (usuario:clave@ de la
+// URL, ?password= o password=).
+func redactDSN(dsn string) string {
+	if isURLDSN(dsn) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "[REDACTED]"
+		}
+		if query := u.Query(); query.Has("password") {
+			query.Set("password", "[REDACTED]")
+			u.RawQuery = query.Encode()
+		}
+		return u.Redacted()
+	}
+	pairs, err := parseKeyValueDSN(dsn)
+	if err != nil {
+		return "[REDACTED]"
+	}
+	for i := range pairs {
+		if pairs[i].key == "password" {
+			pairs[i].value = "[REDACTED]"
+		}
+	}
+	return formatKeyValueDSN(pairs)
+}
+
+// primaryTLS devuelve los parámetros TLS del primario: sslmode de DATABASE_URL (o
+// POSTGRES_SSLMODE sin ella) y los certificados de la URL o de POSTGRES_SSL*.
+func (c DatabaseConfig) primaryTLS() url.Values {
+	params := url.Values{}
+	set := func(key, value string) {
+		if value != "" && params.Get(key) == "" {
+			params.Set(key, value)
+		}
+	}
+	if c.URL != "" {
+		if query, err := dsnParams(c.URL); err == nil {
+			for _, key := range []string{"sslmode", "sslrootcert", "sslcert", "sslkey"} {
+				set(key, query.Get(key))
+			}
+		}
+	} else {
+		set("sslmode", c.SSLMode)
+	}
+	set("sslrootcert", c.SSLRootCert)
+	set("sslcert", c.SSLCert)
+	set("sslkey", c.SSLKey)
+	return params
+}
+
+// withDefaultParams agrega a una cadena de conexión (URL o clave=valor) los
+// parámetros de params que no define. Si no se puede leer se devuelve tal cual
+// (validate ya la rechazó).
+func withDefaultParams(rawURL string, params url.Values) string {
+	if !isURLDSN(rawURL) {
+		pairs, err := parseKeyValueDSN(rawURL)
+		if err != nil {
+			return rawURL
+		}
+		defined := map[string]bool{}
+		for _, p := range pairs {
+			defined[p.key] = p.value != ""
+		}
+		changed := false
+		for _, key := range slices.Sorted(maps.Keys(params)) {
+			if !defined[key] {
+				pairs = append(pairs, dsnParam{key: key, value: params.Get(key)})
+				changed = true
+			}
+		}
+		if !changed {
+			return rawURL
+		}
+		return formatKeyValueDSN(pairs)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	changed := false
+	for key := range params {
+		if query.Get(key) == "" {
+			query.Set(key, params.Get(key))
+			changed = true
+		}
+	}
+	if !changed {
+		return rawURL
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// ReplicaDSNs devuelve las URLs de las réplicas con el TLS del primario en los
+// parámetros que no definen: una réplica no se conecta sin TLS por omisión.
+func (c DatabaseConfig) ReplicaDSNs() []string {
+	tls := c.primaryTLS()
+	dsns := make([]string, len(c.ReplicaURLs))
+	for i, replica := range c.ReplicaURLs {
+		dsns[i] = withDefaultParams(replica, tls)
+	}
+	return dsns
+}
+
+// DSN construye la cadena de conexión para lib/pq.
+// Los valores se escapan para soportar contraseñas con espacios o comillas.
+// Con DATABASE_URL, los certificados de POSTGRES_SSL* se agregan si la URL no los define.
+func (c DatabaseConfig) DSN() string {
+	if c.URL != "" {
+		return withDefaultParams(c.URL, c.primaryTLS())
+	}
+
+	params := []struct{ key, value string }{
+		{"host", c.Host},
+		{"port", strconv.Itoa(c.Port)},
+		{"user", c.User},
+		{"password", c.Password},
+		{"dbname", c.Name},
+		{"sslmode", c.SSLMode},
+		{"sslrootcert", c.SSLRootCert},
+		{"sslcert", c.SSLCert},
+		{"sslkey", c.SSLKey},
+	}
+
+	var parts []string
+	for _, p := range params {
+		if p.value == "" {
+			continue
+		}
+		parts = append(parts, p.key+"="+quoteDSNValue(p.value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteDSNValue aplica las reglas de escape del formato clave=valor de libpq.
+func quoteDSNValue(value string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+	if escaped == value && !strings.ContainsAny(value, " \t\n") {
+		return value
+	}
+	return "'" + escaped + "'"
+}
+
+// SlogLevel convierte LogLevel al nivel de log/slog.
+func (c Config) SlogLevel() (slog.Level, error) {
+	switch strings.ToLower(c.LogLevel) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("log_level inválido %q (debug, info, warn, error)", c.LogLevel)
+}
+
+// Redacted devuelve una copia con los secretos ocultos, segura para imprimir.
+func (c Config) Redacted() Config {
+	redacted := c
+	if redacted.Database.Password != "" {
+		redacted.Database.Password = "[REDACTED]"
+	}
+	if redacted.Database.URL != "" {
+		redacted.Database.URL = redactDSN(redacted.Database.URL)
+	}
+	redacted.Database.ReplicaURLs = nil
+	for _, replica := range c.Database.ReplicaURLs {
+		redacted.Database.ReplicaURLs = append(redacted.Database.ReplicaURLs, redactDSN(replica))
+	}
+	if redacted.JWT.Secret != "" {
+		redacted.JWT.Secret = "[REDACTED]"
+	}
+	if redacted.Storage.S3AccessKey != "" {
+		redacted.Storage.S3AccessKey = "[REDACTED]"
+	}
+	if redacted.Storage.S3SecretKey != "" {
+		redacted.Storage.S3SecretKey = "[REDACTED]"
+	}
+	redacted.Cache.RedisURL = redactURL(redacted.Cache.RedisURL)
+	return redacted
+}
+
+// redactURL oculta la contraseña de una URL de conexión.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[REDACTED]"
+	}
+	return u.Redacted()
+}
+
+// PrintConfig escribe en w la configuración efectiva (sin secretos) en formato YAML.
+func PrintConfig(w io.Writer, cfg Config) error {
+	data, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return fmt.Errorf("error al serializar la configuración: %w", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -1,110 +1,306 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 // Nota: La estructura 'Product' (producto) se define en handlers.go.
 
+// ====================================================================
+// TIMEOUTS Y CANCELACIÓN DE CONSULTAS
+// ====================================================================
+
+// defaultQueryTimeout es el tiempo máximo de cada consulta (configurable con DB_QUERY_TIMEOUT).
+var defaultQueryTimeout = 5 * time.Second
+
+// exportQueryTimeout acota las exportaciones NDJSON/CSV (DB_EXPORT_TIMEOUT). Es
+// aparte porque incluye el tiempo que se espera a que el cliente lea cada fila.
+var exportQueryTimeout = 10 * time.Minute
+
+// Errores específicos para que los handlers distingan un timeout (504)
+// de un cliente que cerró la conexión (499).
+var (
+	ErrQueryTimeout  = errors.New("la consulta excedió el tiempo límite")
+	ErrQueryCanceled = errors.New("la consulta fue cancelada")
+)
+
+// withQueryTimeout deriva del contexto de la petición uno con el timeout por defecto.
+func withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, defaultQueryTimeout)
+}
+
+// queryError envuelve err con ErrQueryTimeout o ErrQueryCanceled si la consulta
+// falló porque el contexto expiró o se canceló. Otros errores se devuelven intactos.
+//
+// Se revisa ctx.Err() porque el driver (lib/pq) no siempre devuelve el error del
+// contexto, sino "pq: canceling statement due to user request".
+func queryError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%w: %v", ErrQueryTimeout, err)
+	case errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled):
+		return fmt.Errorf("%w: %v", ErrQueryCanceled, err)
+	}
+	return err
+}
+
 // ====================================================================
 // DAO (Data Access Object)
 // Lógica que interactúa directamente con la base de datos (PostgreSQL).
 // ====================================================================
 
 // CreateProduct (Crear Producto): Inserta un nuevo producto y devuelve el producto con el ID asignado.
-func CreateProduct(db *sql.DB, product Product, userID int) (Product, error) {
+// El evento product.created se guarda en el outbox de webhooks dentro de la misma transacción.
+func CreateProduct(ctx context.Context, db *sql.DB, product Product, userID int) (Product, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Product{}, fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
 
 	// ⬇️ CAMBIO 2: Incluir la nueva columna (creator_id) y el nuevo placeholder ($5)
 	sqlStatement := `
-		INSERT INTO products (name, description, price, stock, creator_id) 
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO products (name, description, price_minor, currency, stock, creator_id) 
+		VALUES ($1, $2, $3, $4, $5, $6)
 		RETURNING id`
 
 	var id int
-	err := db.QueryRow(
+	err = tx.QueryRowContext(
+		ctx,
 		sqlStatement,
 		product.Name,
 		product.Description,
-		product.Price,
+		product.Price.Amount,
+		product.Price.Currency,
 		product.Stock,
-		userID, // ⬅️ CAMBIO 3: Pasar el userID como quinto argumento de la consulta
+		userID, // ⬅️ CAMBIO 3: Pasar el userID como argumento de la consulta
 	).Scan(&id)
 
 	if err != nil {
-		return Product{}, fmt.Errorf("error al ejecutar INSERT en DB: %w", err)
+		return Product{}, fmt.Errorf("error al ejecutar INSERT en DB: %w", queryError(ctx, err))
 	}
 
 	product.ID = id
 	// Nota: Si quieres devolver el UserID, debes añadirlo al struct Product.
 	// product.CreatorID = userID
 
+	if err := EnqueueWebhookEvent(ctx, tx, WebhookEventProductCreated, product); err != nil {
+		return Product{}, err
+	}
+	if err := NotifyProductChange(ctx, tx, WebhookEventProductCreated, product); err != nil {
+		return Product{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Product{}, fmt.Errorf("error al confirmar INSERT: %w", queryError(ctx, err))
+	}
+
 	return product, nil
 }
 
-// GetProducts (Obtener Todos): Consulta y devuelve todos los productos.
-func GetProducts(db *sql.DB) ([]Product, error) {
-	sqlStatement := `SELECT id, name, description, price, stock FROM products ORDER BY id`
+// ProductFilter: Filtros opcionales de GET /productos. CategoryID 0 = sin filtro.
+type ProductFilter struct {
+	CategoryID         int
+	IncludeDescendants bool  // También productos de las subcategorías
+	IDs                []int // Solo estos productos (nil = todos)
+	AfterID            int   // Paginación por cursor: productos con ID mayor
+	Limit              int   // 0 = sin límite
+}
+
+// productSelect lee productos (alias p) con sus imágenes y el resumen de sus
+// variantes. Las filas se leen con scanProduct.
+const productSelect = `
+	SELECT p.id, p.name, p.description, p.price_minor, p.currency, p.stock, ` + productImagesColumn + `,
+		vs.variant_count, vs.variant_stock, vs.min_price, vs.max_price
+	FROM products p
+	LEFT JOIN LATERAL (` + variantSummarySubquery + `) vs ON true`
 
-	rows, err := db.Query(sqlStatement)
+// rowScanner: *sql.Row o *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// dbExecutor: *sql.DB o *sql.Tx.
+type dbExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// scanProduct escanea una fila de productSelect.
+func scanProduct(row rowScanner) (Product, error) {
+	var p Product
+	var images []byte
+	var summary variantSummary
+	err := row.Scan(&p.ID, &p.Name, &p.Description, &p.Price.Amount, &p.Price.Currency, &p.Stock, &images,
+		&summary.Count, &summary.Stock, &summary.MinPrice, &summary.MaxPrice)
 	if err != nil {
-		return nil, fmt.Errorf("error al ejecutar SELECT ALL en DB: %w", err)
+		return Product{}, err
 	}
-	defer rows.Close()
+	if p.Images, err = decodeProductImages(images); err != nil {
+		return Product{}, err
+	}
+	summary.apply(&p)
+	return p, nil
+}
 
+// GetProducts (Obtener Todos): Consulta y devuelve los productos que cumplen el filtro.
+func GetProducts(ctx context.Context, db *sql.DB, filter ProductFilter) ([]Product, error) {
 	products := []Product{}
+	err := EachProduct(ctx, db, filter, defaultQueryTimeout, func(p Product) error {
+		products = append(products, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// EachProduct llama a fn con cada producto que cumple el filtro a medida que llegan
+// las filas (rows.Next), sin juntarlos en memoria. Un error de fn corta la consulta
+// y se devuelve tal cual. timeout acota toda la iteración, también el tiempo de fn.
+func EachProduct(ctx context.Context, db *sql.DB, filter ProductFilter, timeout time.Duration, fn func(Product) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Las condiciones se combinan con AND; subtreeCTE usa $1, así que la categoría va primero
+	sqlStatement := productSelect
+	var where []string
+	var args []any
+
+	if filter.CategoryID != 0 {
+		args = append(args, filter.CategoryID)
+		if filter.IncludeDescendants {
+			sqlStatement = subtreeCTE + productSelect
+			where = append(where, `EXISTS (
+				SELECT 1 FROM product_categories pc
+				WHERE pc.product_id = p.id AND pc.category_id IN (SELECT id FROM subtree)
+			)`)
+		} else {
+			where = append(where, `EXISTS (
+				SELECT 1 FROM product_categories pc
+				WHERE pc.product_id = p.id AND pc.category_id = $1
+			)`)
+		}
+	}
+	if filter.IDs != nil {
+		ids := make([]int64, len(filter.IDs))
+		for i, id := range filter.IDs {
+			ids[i] = int64(id)
+		}
+		args = append(args, pq.Array(ids))
+		where = append(where, fmt.Sprintf("p.id = ANY($%d)", len(args)))
+	}
+	if filter.AfterID != 0 {
+		args = append(args, filter.AfterID)
+		where = append(where, fmt.Sprintf("p.id > $%d", len(args)))
+	}
+
+	if len(where) > 0 {
+		sqlStatement += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	sqlStatement += ` ORDER BY p.id`
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		sqlStatement += fmt.Sprintf(` LIMIT $%d`, len(args))
+	}
+
+	rows, err := db.QueryContext(ctx, sqlStatement, args...)
+	if err != nil {
+		return fmt.Errorf("error al ejecutar SELECT ALL en DB: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
 	for rows.Next() {
-		var p Product
 		// Escanea los resultados de la fila actual
-		err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock)
+		p, err := scanProduct(rows)
 		if err != nil {
-			log.Printf("Error al escanear fila de producto: %v", err)
+			slog.Error("Error al escanear fila de producto", "err", err)
 			continue
 		}
-		products = append(products, p)
+		if err := fn(p); err != nil {
+			return err
+		}
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("error después de iterar filas: %w", err)
+		return fmt.Errorf("error después de iterar filas: %w", queryError(ctx, err))
 	}
 
-	return products, nil
+	return nil
 }
 
 // GetProductByID (Obtener por ID): Consulta y devuelve un producto específico por su ID.
-func GetProductByID(db *sql.DB, id int) (Product, error) {
-	sqlStatement := `SELECT id, name, description, price, stock FROM products WHERE id = $1`
-	var p Product
+func GetProductByID(ctx context.Context, db *sql.DB, id int) (Product, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	sqlStatement := productSelect + ` WHERE p.id = $1`
 
 	// QueryRow se usa para cuando se espera una sola fila.
-	err := db.QueryRow(sqlStatement, id).Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock)
+	p, err := scanProduct(db.QueryRowContext(ctx, sqlStatement, id))
 
 	if err != nil {
 		// sql.ErrNoRows es manejado directamente por el handler para devolver 404
-		return Product{}, err
+		return Product{}, queryError(ctx, err)
 	}
 
 	return p, nil
 }
 
 // UpdateProduct (Actualizar Producto): Actualiza un producto existente.
-func UpdateProduct(db *sql.DB, product Product) error {
+// Encola product.updated y, si el stock acaba de llegar a cero, product.out_of_stock.
+func UpdateProduct(ctx context.Context, db *sql.DB, product Product) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	// Stock anterior (con bloqueo de fila) para detectar la transición a cero
+	var previousStock int
+	err = tx.QueryRowContext(ctx, `SELECT stock FROM products WHERE id = $1 FOR UPDATE`, product.ID).Scan(&previousStock)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("producto con ID %d no encontrado", product.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("error al leer producto: %w", queryError(ctx, err))
+	}
+
 	sqlStatement := `
 		UPDATE products
-		SET name = $2, description = $3, price = $4, stock = $5
+		SET name = $2, description = $3, price_minor = $4, currency = $5, stock = $6
 		WHERE id = $1`
 
-	result, err := db.Exec(
+	result, err := tx.ExecContext(
+		ctx,
 		sqlStatement,
 		product.ID,
 		product.Name,
 		product.Description,
-		product.Price,
+		product.Price.Amount,
+		product.Price.Currency,
 		product.Stock,
 	)
 	if err != nil {
-		return fmt.Errorf("error al ejecutar UPDATE en DB: %w", err)
+		return fmt.Errorf("error al ejecutar UPDATE en DB: %w", queryError(ctx, err))
 	}
 
 	// LÓGICA DE 404: Verificar si se afectó alguna fila
@@ -117,30 +313,96 @@ func UpdateProduct(db *sql.DB, product Product) error {
 		return fmt.Errorf("producto con ID %d no encontrado", product.ID)
 	}
 
+	if err := EnqueueWebhookEvent(ctx, tx, WebhookEventProductUpdated, product); err != nil {
+		return err
+	}
+	if err := NotifyProductChange(ctx, tx, WebhookEventProductUpdated, product); err != nil {
+		return err
+	}
+	if previousStock > 0 && product.Stock <= 0 {
+		if err := EnqueueWebhookEvent(ctx, tx, WebhookEventProductOutOfStock, product); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error al confirmar UPDATE: %w", queryError(ctx, err))
+	}
 	return nil
 }
 
 // DeleteProduct (Eliminar Producto): Elimina un producto por su ID.
-func DeleteProduct(db *sql.DB, id int) error {
+// El payload de product.deleted lleva el producto tal como estaba antes de borrarse.
+// Devuelve las claves de sus imágenes para que el handler borre los blobs tras el COMMIT.
+func DeleteProduct(ctx context.Context, db *sql.DB, id int) ([]string, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	var product Product
+	err = tx.QueryRowContext(ctx,
+		`SELECT id, name, description, price_minor, currency, stock FROM products WHERE id = $1 FOR UPDATE`, id,
+	).Scan(&product.ID, &product.Name, &product.Description, &product.Price.Amount, &product.Price.Currency, &product.Stock)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("producto con ID %d no encontrado", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al leer producto: %w", queryError(ctx, err))
+	}
+
+	// Las filas de product_images se borran explícitamente para conocer sus claves
+	var blobKeys []string
+	rows, err := tx.QueryContext(ctx, `DELETE FROM product_images WHERE product_id = $1 RETURNING key, thumbnail_key`, id)
+	if err != nil {
+		return nil, fmt.Errorf("error al eliminar imágenes: %w", queryError(ctx, err))
+	}
+	for rows.Next() {
+		var key, thumbnailKey string
+		if err := rows.Scan(&key, &thumbnailKey); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error al leer imágenes: %w", err)
+		}
+		blobKeys = append(blobKeys, key, thumbnailKey)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al eliminar imágenes: %w", queryError(ctx, err))
+	}
+
 	sqlStatement := `DELETE FROM products WHERE id = $1`
 
-	result, err := db.Exec(sqlStatement, id)
+	result, err := tx.ExecContext(ctx, sqlStatement, id)
 	if err != nil {
-		return fmt.Errorf("error al ejecutar DELETE en DB: %w", err)
+		return nil, fmt.Errorf("error al ejecutar DELETE en DB: %w", queryError(ctx, err))
 	}
 
 	// LÓGICA DE 404: Verificar si se afectó alguna fila
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("error al leer filas afectadas: %w", err)
+		return nil, fmt.Errorf("error al leer filas afectadas: %w", err)
 	}
 
 	if rowsAffected == 0 {
 		// Devolvemos un error específico para que el handler lo mapee a 404
-		return fmt.Errorf("producto con ID %d no encontrado", id)
+		return nil, fmt.Errorf("producto con ID %d no encontrado", id)
 	}
 
-	return nil
+	if err := EnqueueWebhookEvent(ctx, tx, WebhookEventProductDeleted, product); err != nil {
+		return nil, err
+	}
+	if err := NotifyProductChange(ctx, tx, WebhookEventProductDeleted, product); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error al confirmar DELETE: %w", queryError(ctx, err))
+	}
+
+	return blobKeys, nil
 }
 
 /*
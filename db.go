@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// ====================================================================
+// CONEXIÓN A POSTGRESQL (Pool + TLS + Reintentos)
+// ====================================================================
+
+// setupDB abre el pool de conexiones y espera a que Postgres acepte conexiones.
+// En lugar de abortar al primer fallo, reintenta con backoff exponencial: en
+// docker-compose o Kubernetes la DB puede arrancar después de la API.
+func setupDB(ctx context.Context, cfg DatabaseConfig) (*sql.DB, error) {
+	db, err := openPool(cfg, cfg.DSN())
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := time.Duration(cfg.ConnectBackoff)
+	for attempt := 1; ; attempt++ {
+		err = db.PingContext(ctx)
+		if err == nil {
+			slog.Info("Conexión a la base de datos establecida")
+			return db, nil
+		}
+
+		if attempt >= cfg.ConnectRetries {
+			db.Close()
+			return nil, fmt.Errorf("ping a la DB falló tras %d intentos: %w", attempt, err)
+		}
+
+		slog.Warn("DB no disponible, reintentando", "attempt", attempt, "max_attempts", cfg.ConnectRetries, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			db.Close()
+			return nil, fmt.Errorf("conexión a la DB cancelada: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, time.Duration(cfg.MaxBackoff))
+	}
+}
+
+// openPool abre un pool (sin conectar todavía) con los límites de la configuración.
+func openPool(cfg DatabaseConfig, dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir la conexión a la DB: %w", err)
+	}
+
+	// Límites del pool de conexiones
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime))
+	db.SetConnMaxIdleTime(time.Duration(cfg.ConnMaxIdleTime))
+	return db, nil
+}
+
+// setupReplicas abre un pool por cada réplica configurada. No espera a que
+// respondan: una réplica caída al arrancar no debe impedir el inicio, el
+// chequeo de salud la sacará de rotación hasta que vuelva.
+func setupReplicas(cfg DatabaseConfig) ([]ReplicaDB, error) {
+	var replicas []ReplicaDB
+	for i, dsn := range cfg.ReplicaDSNs() {
+		db, err := openPool(cfg, dsn)
+		if err != nil {
+			for _, replica := range replicas {
+				replica.DB.Close()
+			}
+			return nil, fmt.Errorf("réplica %d: %w", i+1, err)
+		}
+		replicas = append(replicas, ReplicaDB{Name: fmt.Sprintf("replica-%d", i+1), DB: db})
+	}
+	return replicas, nil
+}
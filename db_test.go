@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test: setupDB reintenta y se rinde tras DB_CONNECT_RETRIES intentos
+func TestSetupDBRetriesWithBackoff(t *testing.T) {
+	cfg := DefaultConfig().Database
+	// Puerto sin servicio: la conexión se rechaza de inmediato
+	cfg.URL = "postgres://api@127.0.0.1:1/ecom_db?sslmode=disable&connect_timeout=1"
+	cfg.ConnectRetries = 3
+	cfg.ConnectBackoff = Duration(time.Millisecond)
+	cfg.MaxBackoff = Duration(2 * time.Millisecond)
+
+	db, err := setupDB(context.Background(), cfg)
+	if err == nil {
+		db.Close()
+		t.Fatal("Se esperaba error al conectar a un puerto sin servicio")
+	}
+	if !strings.Contains(err.Error(), "3 intentos") {
+		t.Errorf("El error debe indicar el número de intentos: %v", err)
+	}
+}
+
+// Test: La señal de apagado interrumpe la espera entre reintentos
+func TestSetupDBStopsOnCancel(t *testing.T) {
+	cfg := DefaultConfig().Database
+	cfg.URL = "postgres://api@127.0.0.1:1/ecom_db?sslmode=disable&connect_timeout=1"
+	cfg.ConnectRetries = 100
+	cfg.ConnectBackoff = Duration(time.Hour)
+	cfg.MaxBackoff = Duration(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := setupDB(ctx, cfg); err == nil {
+		t.Fatal("Se esperaba error por cancelación")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("setupDB no respetó la cancelación del contexto")
+	}
+}
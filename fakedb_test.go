@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ====================================================================
+// DRIVER FALSO EN MEMORIA (solo para tests)
+// Cada DSN es un "servidor" independiente que registra las consultas
+// recibidas, devuelve filas predefinidas y puede simular estar caído.
+// ====================================================================
+
+type fakeServer struct {
+	mu      sync.Mutex
+	queries []string
+	args    [][]driver.Value
+	down    bool
+	columns []string
+	rows    [][]driver.Value
+	byQuery []fakeQueryRows
+}
+
+// fakeQueryRows: Filas para las consultas que contienen match (ver SetQueryRows).
+type fakeQueryRows struct {
+	match   string
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (s *fakeServer) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+func (s *fakeServer) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// Args devuelve los argumentos de cada consulta recibida que contiene match.
+func (s *fakeServer) Args(match string) [][]driver.Value {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var args [][]driver.Value
+	for i, query := range s.queries {
+		if strings.Contains(query, match) {
+			args = append(args, s.args[i])
+		}
+	}
+	return args
+}
+
+// SetRows define las filas que devolverá cualquier SELECT.
+func (s *fakeServer) SetRows(columns []string, rows ...[]driver.Value) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.columns = columns
+	s.rows = rows
+}
+
+// SetQueryRows define las filas de las consultas que contienen match; tienen
+// prioridad sobre SetRows (p. ej. un INSERT ... RETURNING seguido de un SELECT).
+func (s *fakeServer) SetQueryRows(match string, columns []string, rows ...[]driver.Value) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byQuery = append(s.byQuery, fakeQueryRows{match: match, columns: columns, rows: rows})
+}
+
+var errFakeDown = errors.New("fakedb: servidor caído")
+
+var fakeServers sync.Map // dsn -> *fakeServer
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// openFakeDB abre un *sql.DB contra un servidor falso nuevo identificado por name.
+func openFakeDB(t *testing.T, name string) (*sql.DB, *fakeServer) {
+	t.Helper()
+
+	dsn := t.Name() + "/" + name
+	server := &fakeServer{}
+	fakeServers.Store(dsn, server)
+
+	db, err := sql.Open("fakedb", dsn)
+	if err != nil {
+		t.Fatalf("No se pudo abrir fakedb: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fakeServers.Delete(dsn)
+	})
+	return db, server
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	value, ok := fakeServers.Load(dsn)
+	if !ok {
+		return nil, errors.New("fakedb: DSN desconocido " + dsn)
+	}
+	return &fakeConn{server: value.(*fakeServer)}, nil
+}
+
+type fakeConn struct {
+	server *fakeServer
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fakedb: Prepare no soportado")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.server.down {
+		return errFakeDown
+	}
+	return nil
+}
+
+func (c *fakeConn) record(query string, args []driver.NamedValue) error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.server.down {
+		return errFakeDown
+	}
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	c.server.queries = append(c.server.queries, query)
+	c.server.args = append(c.server.args, values)
+	return nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.record(query, args); err != nil {
+		return nil, err
+	}
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	for _, q := range c.server.byQuery {
+		if strings.Contains(query, q.match) {
+			return &fakeRows{columns: q.columns, rows: q.rows}, nil
+		}
+	}
+	return &fakeRows{columns: c.server.columns, rows: c.server.rows}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.record(query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	pos     int
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
@@ -0,0 +1,786 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// ====================================================================
+// GRAPHQL: /graphql sobre el catálogo de productos
+// ====================================================================
+
+// Las consultas y mutaciones reutilizan el DAO de productos, categorías y
+// variantes; la identidad viene de AuthMiddleware igual que en REST.
+// Los campos anidados (categories, variants) se cargan por lotes: el
+// ejecutor resuelve los thunks nivel por nivel, así que todas las filas de
+// una lista se piden en una sola consulta en vez de una por producto.
+
+// graphQLDefaultPageSize: Valor de "first" cuando la consulta no lo indica.
+const graphQLDefaultPageSize = 20
+
+// maxGraphQLBodyBytes: Tamaño máximo del cuerpo de una petición a /graphql.
+const maxGraphQLBodyBytes = 1 << 20
+
+// Errores de las consultas que no llegan a ejecutarse (400)
+var (
+	ErrGraphQLTooDeep    = errors.New("la consulta excede la profundidad máxima")
+	ErrGraphQLTooComplex = errors.New("la consulta excede la complejidad máxima")
+)
+
+// graphQLParams: Cuerpo de POST /graphql (o query string de GET).
+type graphQLParams struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// ====================================================================
+// CARGA POR LOTES (DataLoader)
+// ====================================================================
+
+// batchLoader agrupa las claves pedidas durante un nivel de la ejecución y las
+// carga con una sola llamada a fetch. Vive lo que dura una petición, así que
+// también sirve de caché: una clave ya cargada no vuelve a consultarse.
+type batchLoader[K comparable, V any] struct {
+	fetch func(keys []K) (map[K]V, error)
+
+	mu      sync.Mutex
+	pending []K
+	queued  map[K]bool
+	values  map[K]V
+	errs    map[K]error
+	batches int // Consultas realizadas (para tests)
+}
+
+func newBatchLoader[K comparable, V any](fetch func(keys []K) (map[K]V, error)) *batchLoader[K, V] {
+	return &batchLoader[K, V]{
+		fetch:  fetch,
+		queued: map[K]bool{},
+		values: map[K]V{},
+		errs:   map[K]error{},
+	}
+}
+
+// Load encola key y devuelve la función que obtiene su valor. La primera que
+// se evalúa carga todas las claves encoladas hasta ese momento.
+func (l *batchLoader[K, V]) Load(key K) func() (V, error) {
+	l.mu.Lock()
+	_, loaded := l.values[key]
+	if !loaded && l.errs[key] == nil && !l.queued[key] {
+		l.pending = append(l.pending, key)
+		l.queued[key] = true
+	}
+	l.mu.Unlock()
+
+	return func() (V, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.queued[key] {
+			l.dispatch()
+		}
+		return l.values[key], l.errs[key]
+	}
+}
+
+// dispatch carga las claves pendientes; las que fetch no devuelve quedan con el valor cero.
+func (l *batchLoader[K, V]) dispatch() {
+	keys := l.pending
+	l.pending = nil
+	l.batches++
+
+	values, err := l.fetch(keys)
+	for _, key := range keys {
+		delete(l.queued, key)
+		if err != nil {
+			l.errs[key] = err
+			continue
+		}
+		l.values[key] = values[key]
+	}
+}
+
+// graphQLRequest: Estado de una petición, disponible para los resolvers vía contexto.
+type graphQLRequest struct {
+	db          *sql.DB
+	store       BlobStore
+	userID      int
+	maxPageSize int
+
+	products   *batchLoader[int, *Product]
+	categories *batchLoader[int, []Category]
+	variants   *batchLoader[int, []ProductVariant]
+}
+
+type graphQLContextKey struct{}
+
+func newGraphQLRequest(ctx context.Context, db *sql.DB, store BlobStore, userID int, cfg GraphQLConfig) *graphQLRequest {
+	return &graphQLRequest{
+		db:          db,
+		store:       store,
+		userID:      userID,
+		maxPageSize: cfg.MaxPageSize,
+		products: newBatchLoader(func(ids []int) (map[int]*Product, error) {
+			products, err := GetProducts(ctx, db, ProductFilter{IDs: ids})
+			if err != nil {
+				return nil, err
+			}
+			byID := make(map[int]*Product, len(products))
+			for i := range products {
+				withImageURLs(store, &products[i])
+				byID[products[i].ID] = &products[i]
+			}
+			return byID, nil
+		}),
+		categories: newBatchLoader(func(ids []int) (map[int][]Category, error) {
+			return GetCategoriesByProductIDs(ctx, db, ids)
+		}),
+		variants: newBatchLoader(func(ids []int) (map[int][]ProductVariant, error) {
+			return GetVariantsByProductIDs(ctx, db, ids)
+		}),
+	}
+}
+
+func graphQLRequestFrom(ctx context.Context) *graphQLRequest {
+	return ctx.Value(graphQLContextKey{}).(*graphQLRequest)
+}
+
+// graphQLError traduce los errores del DAO a mensajes para el cliente; los
+// detalles internos solo van al log, como en respondDBError.
+func graphQLError(err error, action string) error {
+	switch {
+	case errors.Is(err, ErrCategoryNotFound), errors.Is(err, ErrNoExchangeRate),
+		errors.Is(err, ErrInvalidAmount), errors.Is(err, ErrUnknownCurrency):
+		return err
+	case errors.Is(err, sql.ErrNoRows), strings.Contains(err.Error(), "no encontrado"):
+		return errors.New("producto no encontrado")
+	case errors.Is(err, ErrQueryTimeout):
+		slog.Warn("Timeout de DB", "action", action, "err", err)
+		return errors.New("la base de datos tardó demasiado en responder")
+	case errors.Is(err, ErrQueryCanceled):
+		slog.Debug("Consulta cancelada", "action", action, "err", err)
+		return errors.New("petición cancelada por el cliente")
+	default:
+		slog.Error("DB error", "action", action, "err", err)
+		return errors.New("error interno del servidor")
+	}
+}
+
+// ====================================================================
+// ESQUEMA
+// ====================================================================
+
+// field declara un campo que se lee con get de la fuente (T o *T).
+func field[T any](typ graphql.Output, get func(T) any) *graphql.Field {
+	return &graphql.Field{
+		Type: typ,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if ptr, ok := p.Source.(*T); ok {
+				return get(*ptr), nil
+			}
+			return get(p.Source.(T)), nil
+		},
+	}
+}
+
+var nonNullString = graphql.NewNonNull(graphql.String)
+var nonNullInt = graphql.NewNonNull(graphql.Int)
+
+// variantAttribute: Los atributos de una variante como pares ordenados por nombre.
+type variantAttribute struct {
+	Name, Value string
+}
+
+func newGraphQLSchema() (graphql.Schema, error) {
+	moneyType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Money",
+		Description: "Importe decimal exacto (\"19.99\") y moneda ISO-4217",
+		Fields: graphql.Fields{
+			"amount":   field(nonNullString, func(m Money) any { return m.String() }),
+			"currency": field(nonNullString, func(m Money) any { return m.Currency }),
+		},
+	})
+
+	priceRangeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PriceRange",
+		Fields: graphql.Fields{
+			"min": field(graphql.NewNonNull(moneyType), func(r PriceRange) any { return r.Min }),
+			"max": field(graphql.NewNonNull(moneyType), func(r PriceRange) any { return r.Max }),
+		},
+	})
+
+	imageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Image",
+		Fields: graphql.Fields{
+			"id":           field(nonNullInt, func(i ProductImage) any { return i.ID }),
+			"url":          field(nonNullString, func(i ProductImage) any { return i.URL }),
+			"thumbnailUrl": field(nonNullString, func(i ProductImage) any { return i.ThumbnailURL }),
+			"contentType":  field(nonNullString, func(i ProductImage) any { return i.ContentType }),
+			"width":        field(nonNullInt, func(i ProductImage) any { return i.Width }),
+			"height":       field(nonNullInt, func(i ProductImage) any { return i.Height }),
+			"sizeBytes":    field(nonNullInt, func(i ProductImage) any { return i.SizeBytes }),
+		},
+	})
+
+	categoryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Category",
+		Fields: graphql.Fields{
+			"id":       field(nonNullInt, func(c Category) any { return c.ID }),
+			"name":     field(nonNullString, func(c Category) any { return c.Name }),
+			"slug":     field(nonNullString, func(c Category) any { return c.Slug }),
+			"parentId": field(graphql.Int, func(c Category) any { return c.ParentID }),
+		},
+	})
+
+	attributeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "VariantAttribute",
+		Fields: graphql.Fields{
+			"name":  field(nonNullString, func(a variantAttribute) any { return a.Name }),
+			"value": field(nonNullString, func(a variantAttribute) any { return a.Value }),
+		},
+	})
+
+	variantType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Variant",
+		Fields: graphql.Fields{
+			"id":  field(nonNullInt, func(v ProductVariant) any { return v.ID }),
+			"sku": field(nonNullString, func(v ProductVariant) any { return v.SKU }),
+			"attributes": field(graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(attributeType))), func(v ProductVariant) any {
+				attributes := make([]variantAttribute, 0, len(v.Attributes))
+				for name, value := range v.Attributes {
+					attributes = append(attributes, variantAttribute{name, value})
+				}
+				sort.Slice(attributes, func(i, j int) bool { return attributes[i].Name < attributes[j].Name })
+				return attributes
+			}),
+			"price":          field(moneyType, func(v ProductVariant) any { return v.Price }),
+			"effectivePrice": field(graphql.NewNonNull(moneyType), func(v ProductVariant) any { return v.EffectivePrice }),
+			"stock":          field(nonNullInt, func(v ProductVariant) any { return v.Stock }),
+		},
+	})
+
+	productType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Product",
+		Fields: graphql.Fields{
+			"id":          field(nonNullInt, func(p Product) any { return p.ID }),
+			"name":        field(nonNullString, func(p Product) any { return p.Name }),
+			"description": field(nonNullString, func(p Product) any { return p.Description }),
+			"price":       field(graphql.NewNonNull(moneyType), func(p Product) any { return p.Price }),
+			"stock":       field(nonNullInt, func(p Product) any { return p.Stock }),
+			"totalStock":  field(graphql.Int, func(p Product) any { return p.TotalStock }),
+			"priceRange":  field(priceRangeType, func(p Product) any { return p.PriceRange }),
+			"images": field(graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(imageType))), func(p Product) any {
+				return p.Images
+			}),
+			"categories": {
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(categoryType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					req := graphQLRequestFrom(p.Context)
+					load := req.categories.Load(p.Source.(Product).ID)
+					return func() (interface{}, error) {
+						categories, err := load()
+						if err != nil {
+							return nil, graphQLError(err, "obtener categorías del producto")
+						}
+						if categories == nil {
+							categories = []Category{}
+						}
+						return categories, nil
+					}, nil
+				},
+			},
+			"variants": {
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(variantType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					req := graphQLRequestFrom(p.Context)
+					load := req.variants.Load(p.Source.(Product).ID)
+					return func() (interface{}, error) {
+						variants, err := load()
+						if err != nil {
+							return nil, graphQLError(err, "obtener variantes")
+						}
+						if variants == nil {
+							variants = []ProductVariant{}
+						}
+						return variants, nil
+					}, nil
+				},
+			},
+		},
+	})
+
+	connectionType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "ProductConnection",
+		Description: "Página de productos ordenados por id; endCursor se pasa como after para la siguiente",
+		Fields: graphql.Fields{
+			"items":       field(graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(productType))), func(c productConnection) any { return c.Items }),
+			"hasNextPage": field(graphql.NewNonNull(graphql.Boolean), func(c productConnection) any { return c.HasNextPage }),
+			"endCursor":   field(graphql.Int, func(c productConnection) any { return c.EndCursor }),
+		},
+	})
+
+	productInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "ProductInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":        {Type: nonNullString},
+			"description": {Type: graphql.String, DefaultValue: ""},
+			"price":       {Type: nonNullString, Description: "Decimal exacto, p. ej. \"19.99\""},
+			"currency":    {Type: graphql.String, Description: "ISO-4217; por defecto la moneda configurada"},
+			"stock":       {Type: nonNullInt},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"product": {
+				Type: productType,
+				Args: graphql.FieldConfigArgument{
+					"id":       {Type: nonNullInt},
+					"currency": {Type: graphql.String},
+				},
+				Resolve: resolveProduct,
+			},
+			"products": {
+				Type: graphql.NewNonNull(connectionType),
+				Args: graphql.FieldConfigArgument{
+					"first":              {Type: graphql.Int, DefaultValue: graphQLDefaultPageSize},
+					"after":              {Type: graphql.Int},
+					"category":           {Type: graphql.String, Description: "Slug de la categoría"},
+					"includeDescendants": {Type: graphql.Boolean, DefaultValue: false},
+					"currency":           {Type: graphql.String},
+				},
+				Resolve: resolveProducts,
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createProduct": {
+				Type:    graphql.NewNonNull(productType),
+				Args:    graphql.FieldConfigArgument{"input": {Type: graphql.NewNonNull(productInputType)}},
+				Resolve: resolveCreateProduct,
+			},
+			"updateProduct": {
+				Type: graphql.NewNonNull(productType),
+				Args: graphql.FieldConfigArgument{
+					"id":    {Type: nonNullInt},
+					"input": {Type: graphql.NewNonNull(productInputType)},
+				},
+				Resolve: resolveUpdateProduct,
+			},
+			"deleteProduct": {
+				Type:    graphql.NewNonNull(graphql.Boolean),
+				Args:    graphql.FieldConfigArgument{"id": {Type: nonNullInt}},
+				Resolve: resolveDeleteProduct,
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+// ====================================================================
+// RESOLVERS
+// ====================================================================
+
+// productConnection: Resultado paginado de products.
+type productConnection struct {
+	Items       []Product
+	HasNextPage bool
+	EndCursor   *int
+}
+
+// currencyArg normaliza el argumento "currency" (vacío = moneda propia de cada producto).
+func currencyArg(args map[string]any) (string, error) {
+	value, _ := args["currency"].(string)
+	if value == "" {
+		return "", nil
+	}
+	return normalizeCurrency(value)
+}
+
+func localizeProducts(ctx context.Context, req *graphQLRequest, products []Product, currency string) error {
+	if currency == "" {
+		return nil
+	}
+	if err := LocalizeProducts(ctx, req.db, products, currency); err != nil {
+		return graphQLError(err, "convertir precios")
+	}
+	return nil
+}
+
+// product(id, currency): Varios product(...) con alias se cargan en una sola consulta.
+func resolveProduct(p graphql.ResolveParams) (interface{}, error) {
+	req := graphQLRequestFrom(p.Context)
+	currency, err := currencyArg(p.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	load := req.products.Load(p.Args["id"].(int))
+	return func() (interface{}, error) {
+		product, err := load()
+		if err != nil {
+			return nil, graphQLError(err, "obtener producto")
+		}
+		if product == nil {
+			return nil, nil
+		}
+		products := []Product{*product}
+		if err := localizeProducts(p.Context, req, products, currency); err != nil {
+			return nil, err
+		}
+		return products[0], nil
+	}, nil
+}
+
+// products(first, after, category, includeDescendants, currency)
+func resolveProducts(p graphql.ResolveParams) (interface{}, error) {
+	req := graphQLRequestFrom(p.Context)
+
+	// 1. Validar los argumentos
+	first := p.Args["first"].(int)
+	if first < 1 || first > req.maxPageSize {
+		return nil, fmt.Errorf("first debe estar entre 1 y %d", req.maxPageSize)
+	}
+	currency, err := currencyArg(p.Args)
+	if err != nil {
+		return nil, err
+	}
+	filter := ProductFilter{Limit: first + 1} // Una fila extra indica si hay otra página
+	if after, ok := p.Args["after"].(int); ok {
+		filter.AfterID = after
+	}
+	if slug, _ := p.Args["category"].(string); slug != "" {
+		category, err := GetCategoryBySlug(p.Context, req.db, slug)
+		if err != nil {
+			return nil, graphQLError(err, "obtener categoría")
+		}
+		filter.CategoryID = category.ID
+		filter.IncludeDescendants, _ = p.Args["includeDescendants"].(bool)
+	}
+
+	// 2. Llamada al DAO
+	products, err := GetProducts(p.Context, req.db, filter)
+	if err != nil {
+		return nil, graphQLError(err, "obtener productos")
+	}
+	connection := productConnection{Items: products}
+	if len(products) > first {
+		connection.Items, connection.HasNextPage = products[:first], true
+	}
+	if n := len(connection.Items); n > 0 {
+		connection.EndCursor = &connection.Items[n-1].ID
+	}
+	if err := localizeProducts(p.Context, req, connection.Items, currency); err != nil {
+		return nil, err
+	}
+	for i := range connection.Items {
+		withImageURLs(req.store, &connection.Items[i])
+	}
+	return connection, nil
+}
+
+// productFromInput construye el producto de ProductInput (mismas reglas que decodeProduct en v1).
+func productFromInput(input map[string]any) (Product, error) {
+	currency, _ := input["currency"].(string)
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	price, err := ParseMoney(input["price"].(string), currency)
+	if err != nil {
+		return Product{}, err
+	}
+	if err := checkProductPrice(price); err != nil {
+		return Product{}, err
+	}
+	description, _ := input["description"].(string)
+	return Product{
+		Name:        input["name"].(string),
+		Description: description,
+		Price:       price,
+		Stock:       input["stock"].(int),
+	}, nil
+}
+
+// reloadProduct vuelve a leer el producto para devolverlo con imágenes y resumen de variantes.
+func reloadProduct(ctx context.Context, req *graphQLRequest, id int) (Product, error) {
+	product, err := GetProductByID(ctx, req.db, id)
+	if err != nil {
+		return Product{}, graphQLError(err, "obtener producto")
+	}
+	withImageURLs(req.store, &product)
+	return product, nil
+}
+
+// createProduct(input): Igual que POST /productos, con el usuario del JWT como creador.
+func resolveCreateProduct(p graphql.ResolveParams) (interface{}, error) {
+	req := graphQLRequestFrom(p.Context)
+	product, err := productFromInput(p.Args["input"].(map[string]any))
+	if err != nil {
+		return nil, err
+	}
+	created, err := CreateProduct(p.Context, req.db, product, req.userID)
+	if err != nil {
+		return nil, graphQLError(err, fmt.Sprintf("crear producto (UserID %d)", req.userID))
+	}
+	return created, nil
+}
+
+// updateProduct(id, input): Igual que PUT /productos/{id}.
+func resolveUpdateProduct(p graphql.ResolveParams) (interface{}, error) {
+	req := graphQLRequestFrom(p.Context)
+	product, err := productFromInput(p.Args["input"].(map[string]any))
+	if err != nil {
+		return nil, err
+	}
+	product.ID = p.Args["id"].(int)
+	if err := UpdateProduct(p.Context, req.db, product); err != nil {
+		return nil, graphQLError(err, "actualizar producto")
+	}
+	return reloadProduct(p.Context, req, product.ID)
+}
+
+// deleteProduct(id): Igual que DELETE /productos/{id}; los blobs se borran tras el COMMIT.
+func resolveDeleteProduct(p graphql.ResolveParams) (interface{}, error) {
+	req := graphQLRequestFrom(p.Context)
+	blobKeys, err := DeleteProduct(p.Context, req.db, p.Args["id"].(int))
+	if err != nil {
+		return nil, graphQLError(err, "eliminar producto")
+	}
+	deleteBlobs(context.WithoutCancel(p.Context), req.store, blobKeys)
+	return true, nil
+}
+
+// ====================================================================
+// LÍMITES DE PROFUNDIDAD Y COMPLEJIDAD
+// ====================================================================
+
+// findOperation devuelve la operación a ejecutar (la única o la de operationName).
+func findOperation(doc *ast.Document, operationName string) *ast.OperationDefinition {
+	var found *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName == "" || (op.Name != nil && op.Name.Value == operationName) {
+			if found != nil && operationName == "" {
+				return nil // Varias operaciones sin operationName: lo rechaza Execute
+			}
+			found = op
+		}
+	}
+	return found
+}
+
+// queryCost mide una operación ya validada (sin ciclos de fragmentos).
+type queryCost struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]any
+}
+
+// measure devuelve la profundidad y la complejidad de set. Cada campo cuesta 1
+// por cada objeto en el que se resuelve: un campo con "first" multiplica el
+// costo de su selección por la cantidad de elementos pedidos. Los campos de
+// introspección (__schema, __type) no cuentan.
+func (c *queryCost) measure(set *ast.SelectionSet, depth, multiplier int) (maxDepth, complexity int) {
+	if set == nil {
+		return depth - 1, 0
+	}
+	maxDepth = depth
+	add := func(d, cx int) {
+		maxDepth = max(maxDepth, d)
+		complexity += cx
+	}
+
+	for _, selection := range set.Selections {
+		switch s := selection.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(s.Name.Value, "__") {
+				continue
+			}
+			complexity += multiplier
+			if s.SelectionSet != nil {
+				add(c.measure(s.SelectionSet, depth+1, multiplier*c.listSize(s)))
+			}
+		case *ast.InlineFragment:
+			add(c.measure(s.SelectionSet, depth, multiplier))
+		case *ast.FragmentSpread:
+			if fragment, ok := c.fragments[s.Name.Value]; ok {
+				add(c.measure(fragment.SelectionSet, depth, multiplier))
+			}
+		}
+	}
+	return maxDepth, complexity
+}
+
+// listSize: Valor de "first" (literal o variable) del campo; 1 si no lo tiene.
+func (c *queryCost) listSize(f *ast.Field) int {
+	for _, arg := range f.Arguments {
+		if arg.Name.Value != "first" {
+			continue
+		}
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			if n, err := strconv.Atoi(v.Value); err == nil && n > 0 {
+				return n
+			}
+		case *ast.Variable:
+			if n, ok := c.variables[v.Name.Value].(float64); ok && n > 0 {
+				return int(n)
+			}
+			if _, ok := c.variables[v.Name.Value]; !ok {
+				return graphQLDefaultPageSize
+			}
+		}
+		return 1
+	}
+	if f.Name.Value == "products" {
+		return graphQLDefaultPageSize
+	}
+	return 1
+}
+
+// checkGraphQLLimits rechaza la operación antes de ejecutarla si excede los límites.
+func checkGraphQLLimits(doc *ast.Document, op *ast.OperationDefinition, variables map[string]any, cfg GraphQLConfig) error {
+	cost := queryCost{fragments: map[string]*ast.FragmentDefinition{}, variables: variables}
+	for _, def := range doc.Definitions {
+		if fragment, ok := def.(*ast.FragmentDefinition); ok {
+			cost.fragments[fragment.Name.Value] = fragment
+		}
+	}
+
+	depth, complexity := cost.measure(op.SelectionSet, 1, 1)
+	if depth > cfg.MaxDepth {
+		return fmt.Errorf("%w (%d > %d)", ErrGraphQLTooDeep, depth, cfg.MaxDepth)
+	}
+	if complexity > cfg.MaxComplexity {
+		return fmt.Errorf("%w (%d > %d)", ErrGraphQLTooComplex, complexity, cfg.MaxComplexity)
+	}
+	return nil
+}
+
+// ====================================================================
+// HANDLER
+// ====================================================================
+
+// writeGraphQLErrors responde con el formato de errores de GraphQL.
+func writeGraphQLErrors(w http.ResponseWriter, status int, errs []gqlerrors.FormattedError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&graphql.Result{Errors: errs})
+}
+
+// decodeGraphQLParams lee la operación del cuerpo JSON (POST) o de la query string (GET).
+func decodeGraphQLParams(r *http.Request) (graphQLParams, error) {
+	var params graphQLParams
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		params.Query, params.OperationName = q.Get("query"), q.Get("operationName")
+		if raw := q.Get("variables"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &params.Variables); err != nil {
+				return params, fmt.Errorf("variables inválidas: %w", err)
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return params, fmt.Errorf("JSON inválido: %w", err)
+	}
+	if params.Query == "" {
+		return params, errors.New("falta query")
+	}
+	return params, nil
+}
+
+// GET|POST /graphql: Consultas y mutaciones sobre productos.
+// Las consultas leen de una réplica; las mutaciones van al primario y lo fijan.
+func GraphQLHandler(cluster *DBCluster, store BlobStore, cfg GraphQLConfig) http.HandlerFunc {
+	schema, err := newGraphQLSchema()
+	if err != nil {
+		panic(fmt.Sprintf("esquema GraphQL inválido: %v", err))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// 1. Obtener la Identidad del Contexto (UserID)
+		userID, err := GetUserIDFromContext(r)
+		if err != nil {
+			http.Error(w, "Sesión de usuario inválida o ausente", http.StatusUnauthorized)
+			return
+		}
+
+		// 2. Decodificar y analizar la operación
+		r.Body = http.MaxBytesReader(w, r.Body, maxGraphQLBodyBytes)
+		params, err := decodeGraphQLParams(r)
+		if err != nil {
+			writeGraphQLErrors(w, http.StatusBadRequest, gqlerrors.FormatErrors(err))
+			return
+		}
+		doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{
+			Body: []byte(params.Query),
+			Name: "GraphQL request",
+		})})
+		if err != nil {
+			writeGraphQLErrors(w, http.StatusBadRequest, []gqlerrors.FormattedError{gqlerrors.FormatError(err)})
+			return
+		}
+		if result := graphql.ValidateDocument(&schema, doc, nil); !result.IsValid {
+			writeGraphQLErrors(w, http.StatusBadRequest, result.Errors)
+			return
+		}
+
+		// 3. Límites de profundidad y complejidad (antes de tocar la DB)
+		op := findOperation(doc, params.OperationName)
+		if op == nil {
+			writeGraphQLErrors(w, http.StatusBadRequest, gqlerrors.FormatErrors(errors.New("operación no encontrada (indica operationName)")))
+			return
+		}
+		if err := checkGraphQLLimits(doc, op, params.Variables, cfg); err != nil {
+			writeGraphQLErrors(w, http.StatusBadRequest, gqlerrors.FormatErrors(err))
+			return
+		}
+
+		// 4. Elegir la base: las mutaciones escriben en el primario
+		db := cluster.Reader(r)
+		if op.Operation == ast.OperationTypeMutation {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "Las mutaciones solo se admiten por POST", http.StatusMethodNotAllowed)
+				return
+			}
+			db = cluster.Primary()
+			cluster.PinPrimary(w)
+		}
+
+		// 5. Ejecutar con los loaders de esta petición
+		req := newGraphQLRequest(r.Context(), db, store, userID, cfg)
+		result := graphql.Execute(graphql.ExecuteParams{
+			Schema:        schema,
+			AST:           doc,
+			OperationName: params.OperationName,
+			Args:          params.Variables,
+			Context:       context.WithValue(r.Context(), graphQLContextKey{}, req),
+		})
+
+		// 6. Los errores de ejecución viajan en "errors" con 200, junto a los datos parciales
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
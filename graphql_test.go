@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+func newGraphQLTestRouter(t *testing.T, limits GraphQLConfig) (http.Handler, string, *fakeServer) {
+	t.Helper()
+	db, server := openFakeDB(t, "graphql")
+	server.SetRows(
+		[]string{"id", "name", "description", "price_minor", "currency", "stock", "images", "variant_count", "variant_stock", "min_price", "max_price"},
+		[]driver.Value{int64(1), "Laptop", "Portátil", int64(1999), "USD", int64(3), []byte("[]"), int64(0), int64(0), nil, nil},
+	)
+	cfg := DefaultConfig()
+	cfg.JWT.Secret = testJWTSecret
+	cfg.GraphQL = limits
+	router := setupRouter(NewDBCluster(db, nil, time.Second), NewProductEventBroker(cfg.Stream), newTestBlobStore(t), cfg)
+	token, err := GenerateToken(1, "user", testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router, token, server
+}
+
+func postGraphQL(router http.Handler, token, query string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(graphQLParams{Query: query})
+	return postWithToken(router, "/graphql", string(body), token)
+}
+
+// Test: products pagina con LIMIT first+1 y devuelve el cursor del último producto
+func TestGraphQLProductsQuery(t *testing.T) {
+	router, token, server := newGraphQLTestRouter(t, DefaultConfig().GraphQL)
+
+	rr := postGraphQL(router, token, `{ products(first: 5) { items { id name price { amount currency } } hasNextPage endCursor } }`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rr.Code, rr.Body.String())
+	}
+	want := `{"data":{"products":{"endCursor":1,"hasNextPage":false,"items":[{"id":1,"name":"Laptop","price":{"amount":"19.99","currency":"USD"}}]}}}`
+	if got := strings.TrimSpace(rr.Body.String()); got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+
+	queries := server.Queries()
+	if len(queries) != 1 || !strings.Contains(queries[0], "LIMIT $1") {
+		t.Errorf("Se esperaba una consulta con LIMIT: %q", queries)
+	}
+
+	// Sin token: 401, igual que en REST
+	if rr := postGraphQL(router, "", `{ products { hasNextPage } }`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Sin token: got %d want 401", rr.Code)
+	}
+}
+
+// Test: Las consultas demasiado profundas o complejas se rechazan sin tocar la DB
+func TestGraphQLLimits(t *testing.T) {
+	router, token, server := newGraphQLTestRouter(t, GraphQLConfig{MaxDepth: 4, MaxComplexity: 50, MaxPageSize: 100})
+
+	cases := []struct {
+		name, query, want string
+	}{
+		{"profundidad", `{ products(first: 1) { items { variants { attributes { name } } } } }`, "profundidad máxima (5"},
+		{"complejidad", `{ products(first: 30) { items { id name } } }`, "complejidad máxima (91"},
+		{"fragmentos", `{ products(first: 1) { ...p } } fragment p on ProductConnection { items { variants { attributes { name } } } }`, "profundidad máxima"},
+		{"sintaxis", `{ products( }`, "Syntax Error"},
+		{"campo inexistente", `{ products { total } }`, "Cannot query field"},
+	}
+	for _, tc := range cases {
+		rr := postGraphQL(router, token, tc.query)
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), tc.want) {
+			t.Errorf("%s: got %d %s, want 400 con %q", tc.name, rr.Code, rr.Body.String(), tc.want)
+		}
+	}
+	if queries := server.Queries(); len(queries) != 0 {
+		t.Errorf("Las consultas rechazadas no deben llegar a la DB: %q", queries)
+	}
+
+	// first por variable también cuenta para la complejidad
+	body, _ := json.Marshal(graphQLParams{Query: `query($n: Int) { products(first: $n) { items { id } } }`, Variables: map[string]any{"n": 60}})
+	if rr := postWithToken(router, "/graphql", string(body), token); rr.Code != http.StatusBadRequest {
+		t.Errorf("first por variable: got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// La introspección no cuenta para los límites
+	if rr := postGraphQL(router, token, `{ __schema { types { name fields { name type { name ofType { name } } } } } }`); rr.Code != http.StatusOK {
+		t.Errorf("Introspección: got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+// Test: Las mutaciones solo por POST; los errores del DAO viajan en "errors" con 200
+func TestGraphQLMutation(t *testing.T) {
+	router, token, server := newGraphQLTestRouter(t, DefaultConfig().GraphQL)
+	server.SetRows(nil)
+
+	query := url.QueryEscape(`mutation { deleteProduct(id: 1) }`)
+	if rr := getWithToken(router, "/graphql?query="+query, token); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Mutación por GET: got %d want 405", rr.Code)
+	}
+	rr := postGraphQL(router, token, `mutation { deleteProduct(id: 1) }`)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"message":"producto no encontrado"`) {
+		t.Errorf("Mutación por POST: got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+// Test: batchLoader junta las claves pendientes en una llamada y recuerda los resultados
+func TestBatchLoader(t *testing.T) {
+	var calls [][]int
+	loader := newBatchLoader(func(keys []int) (map[int]string, error) {
+		calls = append(calls, keys)
+		values := map[int]string{}
+		for _, k := range keys {
+			if k != 3 {
+				values[k] = strings.Repeat("x", k)
+			}
+		}
+		return values, nil
+	})
+
+	a, b, c, again := loader.Load(1), loader.Load(2), loader.Load(3), loader.Load(1)
+	for _, load := range []func() (string, error){a, b, c, again} {
+		if _, err := load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, _ := b(); v != "xx" {
+		t.Errorf("Valor de la clave 2: got %q", v)
+	}
+	if len(calls) != 1 || len(calls[0]) != 3 {
+		t.Errorf("Se esperaba un solo lote con 3 claves: %v", calls)
+	}
+
+	// Las claves ya cargadas no vuelven a consultarse
+	loader.Load(2)()
+	loader.Load(4)()
+	if len(calls) != 2 || len(calls[1]) != 1 || calls[1][0] != 4 {
+		t.Errorf("Segundo lote: %v", calls)
+	}
+}
+
+// Test: Las categorías de todos los productos de una página se cargan en un solo lote
+func TestGraphQLBatchesNestedFields(t *testing.T) {
+	schema, err := newGraphQLSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var batches [][]int
+	req := &graphQLRequest{
+		products: newBatchLoader(func(ids []int) (map[int]*Product, error) {
+			products := map[int]*Product{}
+			for _, id := range ids {
+				products[id] = &Product{ID: id, Name: "P", Price: Money{Amount: 100, Currency: "USD"}}
+			}
+			return products, nil
+		}),
+		categories: newBatchLoader(func(ids []int) (map[int][]Category, error) {
+			batches = append(batches, ids)
+			return map[int][]Category{1: {{ID: 7, Name: "Ropa", Slug: "ropa"}}}, nil
+		}),
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:        schema,
+		RequestString: `{ a: product(id: 1) { categories { slug } } b: product(id: 2) { categories { slug } } c: product(id: 3) { categories { slug } } }`,
+		Context:       context.WithValue(context.Background(), graphQLContextKey{}, req),
+	})
+	if result.HasErrors() {
+		t.Fatal(result.Errors)
+	}
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Errorf("Se esperaba un solo lote con los 3 productos: %v", batches)
+	}
+	if req.products.batches != 1 {
+		t.Errorf("Los productos también deben cargarse en un lote: %d", req.products.batches)
+	}
+	data, _ := json.Marshal(result.Data)
+	if !strings.Contains(string(data), `"b":{"categories":[]}`) {
+		t.Errorf("Un producto sin categorías debe tener lista vacía: %s", data)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=module=api-chi --go-grpc_out=. --go-grpc_opt=module=api-chi proto/product.proto
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"api-chi/productpb"
+)
+
+// ====================================================================
+// gRPC: ProductService (proto/product.proto) en un puerto aparte
+// ====================================================================
+
+// Los métodos comparten el DAO con los handlers REST: mismas consultas,
+// mismos eventos de webhooks y del stream. La identidad viene del mismo JWT,
+// enviado en la metadata "authorization: Bearer <token>".
+
+// NewGRPCServer crea el servidor con la recuperación de panics, la autenticación
+// JWT y ProductService registrado.
+func NewGRPCServer(cluster *DBCluster, store BlobStore, secretKey string) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(RecoveryUnaryInterceptor(), AuthUnaryInterceptor(secretKey)),
+		grpc.ChainStreamInterceptor(RecoveryStreamInterceptor(), AuthStreamInterceptor(secretKey)),
+	)
+	productpb.RegisterProductServiceServer(server, &productGRPCServer{cluster: cluster, store: store})
+	return server
+}
+
+// runGRPCServer atiende llamadas hasta que ctx se cancela; entonces espera a las
+// que están en curso (GracefulStop) como máximo shutdownTimeout.
+func runGRPCServer(ctx context.Context, server *grpc.Server, listener net.Listener, shutdownTimeout time.Duration) error {
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		slog.Info("Servidor gRPC detenido correctamente")
+	case <-time.After(shutdownTimeout):
+		slog.Warn("Las llamadas gRPC no terminaron a tiempo, cerrando conexiones")
+		server.Stop()
+	}
+	return nil
+}
+
+// ====================================================================
+// RECUPERACIÓN DE PANICS (equivalente a middleware.Recoverer)
+// ====================================================================
+
+// recoverGRPC convierte un panic del handler en codes.Internal; el valor y la
+// traza solo van al log. Sin esto un panic tumba el proceso entero.
+func recoverGRPC(method string, err *error) {
+	if v := recover(); v != nil {
+		slog.Error("panic en handler gRPC", "method", method, "panic", v, "stack", string(debug.Stack()))
+		*err = status.Error(codes.Internal, "Error interno del servidor")
+	}
+}
+
+// RecoveryUnaryInterceptor recupera los panics de las llamadas unarias.
+func RecoveryUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		defer recoverGRPC(info.FullMethod, &err)
+		return handler(ctx, req)
+	}
+}
+
+// RecoveryStreamInterceptor recupera los panics de los streams.
+func RecoveryStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer recoverGRPC(info.FullMethod, &err)
+		return handler(srv, ss)
+	}
+}
+
+// ====================================================================
+// AUTENTICACIÓN (equivalente a AuthMiddleware)
+// ====================================================================
+
+// authenticateGRPC valida el Bearer de la metadata y guarda la identidad en el contexto.
+func authenticateGRPC(ctx context.Context, secretKey string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 || !strings.HasPrefix(values[0], "Bearer ") {
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	claims, err := ParseAccessToken(strings.TrimPrefix(values[0], "Bearer "), secretKey)
+	if err != nil {
+		slog.Info("Error de verificación JWT (gRPC)", "err", err)
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	return WithIdentity(ctx, claims), nil
+}
+
+// AuthUnaryInterceptor exige un JWT válido en las llamadas unarias.
+func AuthUnaryInterceptor(secretKey string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authenticateGRPC(ctx, secretKey)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// AuthStreamInterceptor exige un JWT válido al abrir un stream.
+func AuthStreamInterceptor(secretKey string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticateGRPC(ss.Context(), secretKey)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authenticatedStream sustituye el contexto del stream por el que lleva la identidad.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// userIDFromContext: Equivalente a GetUserIDFromContext para gRPC.
+func userIDFromContext(ctx context.Context) (int, error) {
+	userID, ok := ctx.Value(ContextKeyUserID).(int)
+	if !ok {
+		return 0, status.Error(codes.Unauthenticated, "Sesión de usuario inválida o ausente")
+	}
+	return userID, nil
+}
+
+// ====================================================================
+// ERRORES Y CONVERSIONES
+// ====================================================================
+
+// grpcError traduce los errores del DAO a códigos de gRPC; los detalles
+// internos solo van al log, como en respondDBError.
+func grpcError(err error, action string) error {
+	switch {
+	case errors.Is(err, ErrVariantInsufficientStock), errors.Is(err, ErrNoExchangeRate):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrInvalidAmount), errors.Is(err, ErrUnknownCurrency):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrVariantNotFound), errors.Is(err, ErrCategoryNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, sql.ErrNoRows), strings.Contains(err.Error(), "no encontrado"):
+		return status.Error(codes.NotFound, "Producto no encontrado")
+	case errors.Is(err, ErrQueryTimeout):
+		slog.Warn("Timeout de DB", "action", action, "err", err)
+		return status.Error(codes.DeadlineExceeded, "La base de datos tardó demasiado en responder")
+	case errors.Is(err, ErrQueryCanceled):
+		slog.Debug("Consulta cancelada", "action", action, "err", err)
+		return status.Error(codes.Canceled, "Petición cancelada por el cliente")
+	default:
+		slog.Error("DB error", "action", action, "err", err)
+		return status.Error(codes.Internal, "Error interno del servidor")
+	}
+}
+
+func moneyToProto(m Money) *productpb.Money {
+	return &productpb.Money{AmountMinor: m.Amount, Currency: m.Currency}
+}
+
+// moneyFromProto: Sin moneda se usa la configurada por defecto.
+func moneyFromProto(m *productpb.Money) (Money, error) {
+	if m == nil {
+		return Money{}, status.Error(codes.InvalidArgument, "falta price")
+	}
+	currency := m.GetCurrency()
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	currency, err := normalizeCurrency(currency)
+	if err != nil {
+		return Money{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return Money{Amount: m.GetAmountMinor(), Currency: currency}, nil
+}
+
+func productToProto(p Product) *productpb.Product {
+	out := &productpb.Product{
+		Id:          int32(p.ID),
+		Name:        p.Name,
+		Description: p.Description,
+		Price:       moneyToProto(p.Price),
+		Stock:       int32(p.Stock),
+	}
+	for _, img := range p.Images {
+		out.Images = append(out.Images, &productpb.Image{
+			Id:           int32(img.ID),
+			Url:          img.URL,
+			ThumbnailUrl: img.ThumbnailURL,
+			ContentType:  img.ContentType,
+			Width:        int32(img.Width),
+			Height:       int32(img.Height),
+			SizeBytes:    int32(img.SizeBytes),
+		})
+	}
+	if p.TotalStock != nil {
+		totalStock := int32(*p.TotalStock)
+		out.TotalStock = &totalStock
+	}
+	if p.PriceRange != nil {
+		out.PriceRange = &productpb.PriceRange{Min: moneyToProto(p.PriceRange.Min), Max: moneyToProto(p.PriceRange.Max)}
+	}
+	return out
+}
+
+func variantToProto(v ProductVariant) *productpb.Variant {
+	out := &productpb.Variant{
+		Id:             int32(v.ID),
+		ProductId:      int32(v.ProductID),
+		Sku:            v.SKU,
+		Attributes:     v.Attributes,
+		Stock:          int32(v.Stock),
+		EffectivePrice: moneyToProto(v.EffectivePrice),
+	}
+	if v.Price != nil {
+		out.Price = moneyToProto(*v.Price)
+	}
+	return out
+}
+
+// productFromProto valida los campos comunes de Create y Update.
+func productFromProto(name, description string, price *productpb.Money, stock int32) (Product, error) {
+	if strings.TrimSpace(name) == "" {
+		return Product{}, status.Error(codes.InvalidArgument, "falta name")
+	}
+	money, err := moneyFromProto(price)
+	if err != nil {
+		return Product{}, err
+	}
+	if err := checkProductPrice(money); err != nil {
+		return Product{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return Product{Name: name, Description: description, Price: money, Stock: int(stock)}, nil
+}
+
+// requestedCurrencyGRPC normaliza el campo currency (vacío = moneda del producto).
+func requestedCurrencyGRPC(currency string) (string, error) {
+	if currency == "" {
+		return "", nil
+	}
+	currency, err := normalizeCurrency(currency)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	return currency, nil
+}
+
+// ====================================================================
+// PRODUCTSERVICE
+// ====================================================================
+
+type productGRPCServer struct {
+	productpb.UnimplementedProductServiceServer
+
+	cluster *DBCluster
+	store   BlobStore
+}
+
+// reader: Réplica, salvo con la metadata "x-read-consistency: strong" (como la cabecera REST).
+func (s *productGRPCServer) reader(ctx context.Context) *sql.DB {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(ReadConsistencyHeader)
+	return s.cluster.ReaderFor(len(values) > 0 && values[0] == "strong")
+}
+
+// Get: Igual que GET /productos/{id}.
+func (s *productGRPCServer) Get(ctx context.Context, req *productpb.GetProductRequest) (*productpb.Product, error) {
+	currency, err := requestedCurrencyGRPC(req.GetCurrency())
+	if err != nil {
+		return nil, err
+	}
+
+	db := s.reader(ctx)
+	product, err := GetProductByID(ctx, db, int(req.GetId()))
+	if err != nil {
+		return nil, grpcError(err, "obtener producto")
+	}
+	if currency != "" {
+		products := []Product{product}
+		if err := LocalizeProducts(ctx, db, products, currency); err != nil {
+			return nil, grpcError(err, "convertir precios")
+		}
+		product = products[0]
+	}
+	withImageURLs(s.store, &product)
+	return productToProto(product), nil
+}
+
+// List: Igual que GET /productos, con un mensaje por producto.
+func (s *productGRPCServer) List(req *productpb.ListProductsRequest, stream grpc.ServerStreamingServer[productpb.Product]) error {
+	ctx := stream.Context()
+	currency, err := requestedCurrencyGRPC(req.GetCurrency())
+	if err != nil {
+		return err
+	}
+	if req.GetLimit() < 0 || req.GetAfterId() < 0 {
+		return status.Error(codes.InvalidArgument, "limit y after_id no pueden ser negativos")
+	}
+
+	// 1. Resolver el filtro
+	db := s.reader(ctx)
+	filter := ProductFilter{AfterID: int(req.GetAfterId()), Limit: int(req.GetLimit())}
+	if slug := req.GetCategory(); slug != "" {
+		category, err := GetCategoryBySlug(ctx, db, slug)
+		if err != nil {
+			return grpcError(err, "obtener categoría")
+		}
+		filter.CategoryID = category.ID
+		filter.IncludeDescendants = req.GetIncludeDescendants()
+	}
+
+	// 2. Llamada al DAO
+	products, err := GetProducts(ctx, db, filter)
+	if err != nil {
+		return grpcError(err, "obtener productos")
+	}
+	if currency != "" {
+		if err := LocalizeProducts(ctx, db, products, currency); err != nil {
+			return grpcError(err, "convertir precios")
+		}
+	}
+
+	// 3. Un mensaje por producto
+	for i := range products {
+		withImageURLs(s.store, &products[i])
+		if err := stream.Send(productToProto(products[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create: Igual que POST /productos, con el usuario del JWT como creador.
+func (s *productGRPCServer) Create(ctx context.Context, req *productpb.CreateProductRequest) (*productpb.Product, error) {
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	product, err := productFromProto(req.GetName(), req.GetDescription(), req.GetPrice(), req.GetStock())
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := CreateProduct(ctx, s.cluster.Primary(), product, userID)
+	if err != nil {
+		return nil, grpcError(err, "crear producto")
+	}
+	return productToProto(created), nil
+}
+
+// Update: Igual que PUT /productos/{id}; devuelve la fila releída del primario.
+func (s *productGRPCServer) Update(ctx context.Context, req *productpb.UpdateProductRequest) (*productpb.Product, error) {
+	product, err := productFromProto(req.GetName(), req.GetDescription(), req.GetPrice(), req.GetStock())
+	if err != nil {
+		return nil, err
+	}
+	product.ID = int(req.GetId())
+
+	db := s.cluster.Primary()
+	if err := UpdateProduct(ctx, db, product); err != nil {
+		return nil, grpcError(err, "actualizar producto")
+	}
+
+	// Releer la fila: imágenes, stock total y rango de precios no vienen en la petición
+	updated, err := GetProductByID(ctx, db, product.ID)
+	if err != nil {
+		return nil, grpcError(err, "obtener producto")
+	}
+	withImageURLs(s.store, &updated)
+	return productToProto(updated), nil
+}
+
+// Delete: Igual que DELETE /productos/{id}; los blobs se borran tras el COMMIT.
+func (s *productGRPCServer) Delete(ctx context.Context, req *productpb.DeleteProductRequest) (*productpb.DeleteProductResponse, error) {
+	blobKeys, err := DeleteProduct(ctx, s.cluster.Primary(), int(req.GetId()))
+	if err != nil {
+		return nil, grpcError(err, "eliminar producto")
+	}
+	deleteBlobs(context.WithoutCancel(ctx), s.store, blobKeys)
+	return &productpb.DeleteProductResponse{}, nil
+}
+
+// AdjustStock: Igual que POST /skus/{sku}/stock.
+func (s *productGRPCServer) AdjustStock(ctx context.Context, req *productpb.AdjustStockRequest) (*productpb.Variant, error) {
+	if req.GetDelta() == 0 {
+		return nil, status.Error(codes.InvalidArgument, "delta debe ser distinto de 0")
+	}
+	variant, err := AdjustVariantStock(ctx, s.cluster.Primary(), req.GetSku(), int(req.GetDelta()))
+	if err != nil {
+		return nil, grpcError(err, "ajustar stock")
+	}
+	return variantToProto(variant), nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"api-chi/productpb"
+)
+
+// newGRPCTestClient levanta ProductService sobre un listener en memoria (bufconn).
+func newGRPCTestClient(t *testing.T) (productpb.ProductServiceClient, *fakeServer) {
+	t.Helper()
+	db, server := openFakeDB(t, "grpc")
+	server.SetRows(
+		[]string{"id", "name", "description", "price_minor", "currency", "stock", "images", "variant_count", "variant_stock", "min_price", "max_price"},
+		[]driver.Value{int64(1), "Laptop", "Portátil", int64(1999), "USD", int64(3), []byte("[]"), int64(0), int64(0), nil, nil},
+	)
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := NewGRPCServer(NewDBCluster(db, nil, time.Second), newTestBlobStore(t), testJWTSecret)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return productpb.NewProductServiceClient(conn), server
+}
+
+// withToken agrega "authorization: Bearer <JWT>" a la metadata de salida.
+func withToken(t *testing.T, userID int) context.Context {
+	t.Helper()
+	token, err := GenerateToken(userID, "user", testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+// Test: Sin JWT válido las llamadas unarias y los streams responden Unauthenticated
+func TestGRPCAuth(t *testing.T) {
+	client, _ := newGRPCTestClient(t)
+
+	if _, err := client.Get(context.Background(), &productpb.GetProductRequest{Id: 1}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Get sin token: got %v", err)
+	}
+	bad := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer no-es-un-jwt")
+	if _, err := client.Get(bad, &productpb.GetProductRequest{Id: 1}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Get con token inválido: got %v", err)
+	}
+
+	stream, err := client.List(context.Background(), &productpb.ListProductsRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("List sin token: got %v", err)
+	}
+}
+
+// Test: Get y List devuelven los productos del DAO con el precio en unidades menores
+func TestGRPCGetAndList(t *testing.T) {
+	client, server := newGRPCTestClient(t)
+	ctx := withToken(t, 1)
+
+	product, err := client.Get(ctx, &productpb.GetProductRequest{Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.GetName() != "Laptop" || product.GetPrice().GetAmountMinor() != 1999 || product.GetPrice().GetCurrency() != "USD" {
+		t.Errorf("Get: got %v", product)
+	}
+	if product.GetTotalStock() != 3 || product.GetPriceRange().GetMin().GetAmountMinor() != 1999 {
+		t.Errorf("Resumen de variantes: got %v %v", product.TotalStock, product.GetPriceRange())
+	}
+
+	stream, err := client.List(ctx, &productpb.ListProductsRequest{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int32
+	for {
+		p, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, p.GetId())
+	}
+	if fmt.Sprint(ids) != "[1]" {
+		t.Errorf("List: got %v", ids)
+	}
+
+	// Producto inexistente: NotFound
+	server.SetRows(nil)
+	if _, err := client.Get(ctx, &productpb.GetProductRequest{Id: 99}); status.Code(err) != codes.NotFound {
+		t.Errorf("Get inexistente: got %v", err)
+	}
+}
+
+// Test: Los argumentos inválidos se rechazan antes de llegar a la DB
+func TestGRPCInvalidArguments(t *testing.T) {
+	client, server := newGRPCTestClient(t)
+	ctx := withToken(t, 1)
+
+	calls := []struct {
+		name string
+		call func() error
+	}{
+		{"Create sin nombre", func() error {
+			_, err := client.Create(ctx, &productpb.CreateProductRequest{Price: &productpb.Money{AmountMinor: 100}})
+			return err
+		}},
+		{"Create sin precio", func() error {
+			_, err := client.Create(ctx, &productpb.CreateProductRequest{Name: "Mouse"})
+			return err
+		}},
+		{"Update con moneda desconocida", func() error {
+			_, err := client.Update(ctx, &productpb.UpdateProductRequest{Id: 1, Name: "Mouse", Price: &productpb.Money{AmountMinor: 100, Currency: "XXX"}})
+			return err
+		}},
+		{"AdjustStock con delta 0", func() error {
+			_, err := client.AdjustStock(ctx, &productpb.AdjustStockRequest{Sku: "TS-1"})
+			return err
+		}},
+	}
+	for _, c := range calls {
+		if err := c.call(); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: got %v want InvalidArgument", c.name, err)
+		}
+	}
+	if queries := server.Queries(); len(queries) != 0 {
+		t.Errorf("No debía consultarse la DB: %q", queries)
+	}
+}
+
+// Test: Los errores del DAO se traducen a códigos de gRPC sin filtrar detalles internos
+func TestGRPCErrorCodes(t *testing.T) {
+	cases := []struct {
+		err  error
+		want codes.Code
+	}{
+		{ErrVariantInsufficientStock, codes.FailedPrecondition},
+		{ErrVariantNotFound, codes.NotFound},
+		{fmt.Errorf("producto con ID %d no encontrado", 3), codes.NotFound},
+		{fmt.Errorf("x: %w", ErrQueryTimeout), codes.DeadlineExceeded},
+		{fmt.Errorf("x: %w", ErrUnknownCurrency), codes.InvalidArgument},
+		{fmt.Errorf("pq: conexión rechazada"), codes.Internal},
+	}
+	for _, tc := range cases {
+		err := grpcError(tc.err, "probar")
+		if status.Code(err) != tc.want {
+			t.Errorf("%v: got %v want %v", tc.err, status.Code(err), tc.want)
+		}
+	}
+	if msg := status.Convert(grpcError(fmt.Errorf("pq: conexión rechazada"), "probar")).Message(); msg != "Error interno del servidor" {
+		t.Errorf("Internal no debe exponer el error original: %q", msg)
+	}
+}
+
+// Test: Update devuelve la fila releída (con stock total y rango de precios), no la petición
+func TestGRPCUpdateRereadsProduct(t *testing.T) {
+	client, server := newGRPCTestClient(t)
+	server.SetQueryRows("SELECT stock FROM products", []string{"stock"}, []driver.Value{int64(3)})
+	server.SetQueryRows("INSERT INTO webhook_events", []string{"id"}, []driver.Value{int64(1)})
+
+	product, err := client.Update(withToken(t, 1), &productpb.UpdateProductRequest{
+		Id: 1, Name: "Laptop", Description: "Portátil", Price: &productpb.Money{AmountMinor: 1999}, Stock: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.GetId() != 1 || product.GetTotalStock() != 3 || product.GetPriceRange().GetMax().GetAmountMinor() != 1999 {
+		t.Errorf("Update debe devolver la fila releída: got %v", product)
+	}
+}
+
+// Test: Un panic en un handler se responde con Internal sin filtrar el valor del panic
+func TestGRPCRecovery(t *testing.T) {
+	_, err := RecoveryUnaryInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test/Unary"},
+		func(context.Context, any) (any, error) { panic("secreto") })
+	if status.Code(err) != codes.Internal || status.Convert(err).Message() != "Error interno del servidor" {
+		t.Errorf("Unario: got %v", err)
+	}
+
+	err = RecoveryStreamInterceptor()(nil, nil, &grpc.StreamServerInfo{FullMethod: "/test/Stream"},
+		func(any, grpc.ServerStream) error { panic("secreto") })
+	if status.Code(err) != codes.Internal || status.Convert(err).Message() != "Error interno del servidor" {
+		t.Errorf("Stream: got %v", err)
+	}
+
+	// Sin panic el resultado del handler no cambia
+	resp, err := RecoveryUnaryInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test/Unary"},
+		func(context.Context, any) (any, error) { return "ok", nil })
+	if resp != "ok" || err != nil {
+		t.Errorf("Sin panic: got %v %v", resp, err)
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings" // Necesario para strings.Contains en Delete/Update
+	"time"
 
 	// Necesario para fmt.Errorf o logging
 	"github.com/go-chi/chi/v5"
@@ -14,11 +18,18 @@ import (
 
 // Product: Estructura de datos del producto
 type Product struct {
-	ID          int     `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Stock       int     `json:"stock"`
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Price       Money  `json:"price"` // Unidades menores + moneda (ver money.go)
+	Stock       int    `json:"stock"`
+	// Images: Solo en lecturas; se suben con POST /productos/{id}/imagenes
+	Images []ProductImage `json:"images,omitempty"`
+	// Resumen de variantes (solo en lecturas, ver variants.go)
+	TotalStock *int        `json:"total_stock,omitempty"`
+	PriceRange *PriceRange `json:"price_range,omitempty"`
+
+	hasVariants bool
 }
 
 type LoginRequest struct {
@@ -30,12 +41,33 @@ type LogingResponse struct {
 	Token string `json:"token"`
 }
 
+// StatusClientClosedRequest: código no estándar (popularizado por nginx) para
+// registrar que el cliente cerró la conexión antes de recibir la respuesta.
+const StatusClientClosedRequest = 499
+
+// respondDBError traduce un error del DAO a la respuesta HTTP correspondiente:
+// 504 si la consulta excedió el timeout, 499 si el cliente canceló, 500 en otro caso.
+func respondDBError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, ErrQueryTimeout):
+		slog.Warn("Timeout de DB", "action", action, "err", err)
+		http.Error(w, "La base de datos tardó demasiado en responder", http.StatusGatewayTimeout)
+	case errors.Is(err, ErrQueryCanceled):
+		// El cliente ya no espera la respuesta; el código queda en logs y métricas
+		slog.Debug("Consulta cancelada", "action", action, "err", err)
+		http.Error(w, "Petición cancelada por el cliente", StatusClientClosedRequest)
+	default:
+		slog.Error("DB error", "action", action, "err", err)
+		http.Error(w, "Error interno del servidor", http.StatusInternalServerError)
+	}
+}
+
 // ====================================================================
 // Handlers (Manejadores de Peticiones HTTP)
 // ====================================================================
 
 // POST /productos: Crea un nuevo producto
-func CreateProductHandler(db *sql.DB) http.HandlerFunc {
+func CreateProductHandler(db *sql.DB, products *ProductCache) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		// 1. Obtener la Identidad del Contexto (UserID)
@@ -46,11 +78,8 @@ func CreateProductHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var product Product
-
-		// 2. Decodificar el cuerpo JSON
-		// ⬇️ CORRECCIÓN DE SINTAXIS: Usar '=' en lugar de ':='
-		err = json.NewDecoder(r.Body).Decode(&product)
+		// 2. Decodificar el cuerpo JSON (representación según la versión de la API)
+		product, err := decodeProduct(r)
 		if err != nil {
 			http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
 			return
@@ -58,39 +87,90 @@ func CreateProductHandler(db *sql.DB) http.HandlerFunc {
 
 		// 3. Llamada al DAO para crear el producto (¡LÓGICA CORREGIDA!)
 		// ⬇️ PASAMOS EL USERID al DAO para que sepa quién lo creó.
-		createdProduct, err := CreateProduct(db, product, userID)
+		createdProduct, err := CreateProduct(r.Context(), db, product, userID)
 		if err != nil {
-			log.Printf("DB error al crear producto (UserID %d): %v", userID, err)
-			http.Error(w, "Error interno del servidor", http.StatusInternalServerError)
+			respondDBError(w, err, fmt.Sprintf("crear producto (UserID %d)", userID))
 			return
 		}
+		// Las listas ya no incluyen el producto nuevo (las demás instancias, por NOTIFY)
+		products.Invalidate(context.WithoutCancel(r.Context()), createdProduct.ID)
 
 		// 4. Respuesta de éxito 201 Created
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(createdProduct)
+		json.NewEncoder(w).Encode(versionedProduct(r, createdProduct))
 	}
 }
 
-// GET /productos: Obtiene la lista de todos los productos
-func GetProductsHandler(db *sql.DB) http.HandlerFunc {
+// GET /productos: Obtiene la lista de productos (caché o réplica si hay).
+// Filtros opcionales: ?categoria=<slug>&include_descendants=true
+func GetProductsHandler(cluster *DBCluster, cache *ProductCache, clock *CatalogClock, store BlobStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// 1. Llamada al DAO para obtener todos los productos
-		products, err := GetProducts(db)
+		db := cluster.Reader(r)
+
+		currency, ok := requestedCurrency(w, r)
+		if !ok {
+			return
+		}
+
+		// 1. Resolver el filtro por categoría
+		var filter ProductFilter
+		if slug := r.URL.Query().Get("categoria"); slug != "" {
+			category, err := GetCategoryBySlug(r.Context(), db, slug)
+			if err != nil {
+				respondCategoryError(w, err, "obtener categoría")
+				return
+			}
+			filter.CategoryID = category.ID
+
+			if value := r.URL.Query().Get("include_descendants"); value != "" {
+				filter.IncludeDescendants, err = strconv.ParseBool(value)
+				if err != nil {
+					http.Error(w, "include_descendants debe ser true o false", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		// 2. Formato según Accept: NDJSON y CSV se escriben fila a fila desde la DB
+		w.Header().Add("Vary", "Accept")
+		format := negotiateContentType(r.Header.Get("Accept"), productListFormats)
+		if format == "" {
+			http.Error(w, "Formatos disponibles: "+strings.Join(productListFormats, ", "), http.StatusNotAcceptable)
+			return
+		}
+		if format != mediaTypeJSON {
+			streamProducts(w, r, db, filter, currency, store, format)
+			return
+		}
+
+		// 3. Obtener los productos (la caché consulta el DAO si no los tiene)
+		products, err := cache.For(r).Products(r.Context(), db, filter)
 		if err != nil {
-			log.Printf("DB error al obtener productos: %v", err)
-			http.Error(w, "Error interno del servidor", http.StatusInternalServerError)
+			respondDBError(w, err, "obtener productos")
 			return
 		}
+		if currency != "" {
+			if err := LocalizeProducts(r.Context(), db, products, currency); err != nil {
+				respondLocalizeError(w, err)
+				return
+			}
+		}
 
-		// 2. Respuesta de éxito 200 OK
+		// 4. Respuesta de éxito 200 OK (304 si el cliente ya tiene esta versión)
+		for i := range products {
+			withImageURLs(store, &products[i])
+		}
+		if checkNotModified(w, r, productsETag(r, products...), clock.LastModified()) {
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(products)
+		json.NewEncoder(w).Encode(versionedProducts(r, products))
 	}
 }
 
-// GET /productos/{id}: Obtiene un producto específico
-func GetProductByIDHandler(db *sql.DB) http.HandlerFunc {
+// GET /productos/{id}: Obtiene un producto específico (caché o réplica si hay)
+func GetProductByIDHandler(cluster *DBCluster, cache *ProductCache, clock *CatalogClock, store BlobStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		// 🌟 CLAVE CHI: Extracción del parámetro ID sin strings.Split
@@ -102,30 +182,46 @@ func GetProductByIDHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "El ID debe ser un número entero válido.", http.StatusBadRequest)
 			return
 		}
+		currency, ok := requestedCurrency(w, r)
+		if !ok {
+			return
+		}
 
-		// 2. Llamada al DAO para obtener el producto
-		product, err := GetProductByID(db, id)
+		// 2. Obtener el producto (la caché consulta el DAO si no lo tiene)
+		db := cluster.Reader(r)
+		product, err := cache.For(r).Product(r.Context(), db, id)
 
 		if err != nil {
 			// Manejar 404 Not Found (cuando el DAO devuelve sql.ErrNoRows)
-			if err == sql.ErrNoRows {
+			if errors.Is(err, sql.ErrNoRows) {
 				http.Error(w, "Producto no encontrado", http.StatusNotFound)
 				return
 			}
-			// Manejar 500 Internal Server Error
-			log.Printf("DB error al obtener producto: %v", err)
-			http.Error(w, "Error interno del servidor", http.StatusInternalServerError)
+			// Manejar 504/499/500
+			respondDBError(w, err, "obtener producto")
 			return
 		}
+		if currency != "" {
+			products := []Product{product}
+			if err := LocalizeProducts(r.Context(), db, products, currency); err != nil {
+				respondLocalizeError(w, err)
+				return
+			}
+			product = products[0]
+		}
 
-		// 3. Respuesta de éxito 200 OK
+		// 3. Respuesta de éxito 200 OK (304 si el cliente ya tiene esta versión)
+		withImageURLs(store, &product)
+		if checkNotModified(w, r, productsETag(r, product), clock.LastModified()) {
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(product)
+		json.NewEncoder(w).Encode(versionedProduct(r, product))
 	}
 }
 
 // PUT /productos/{id}: Actualiza un producto existente
-func UpdateProductHandler(db *sql.DB) http.HandlerFunc {
+func UpdateProductHandler(db *sql.DB, products *ProductCache) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		// 🌟 CLAVE CHI: Extracción del parámetro ID
@@ -138,9 +234,8 @@ func UpdateProductHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var product Product
-		// 2. Decodificar el cuerpo JSON
-		err = json.NewDecoder(r.Body).Decode(&product)
+		// 2. Decodificar el cuerpo JSON (representación según la versión de la API)
+		product, err := decodeProduct(r)
 		if err != nil {
 			http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
 			return
@@ -150,26 +245,26 @@ func UpdateProductHandler(db *sql.DB) http.HandlerFunc {
 		product.ID = id
 
 		// 3. Llamada al DAO para actualizar
-		err = UpdateProduct(db, product)
+		err = UpdateProduct(r.Context(), db, product)
 		if err != nil {
 			// Usamos la lógica de 404 si el DAO devuelve el error específico
 			if strings.Contains(err.Error(), "no encontrado") {
 				http.Error(w, "Producto no encontrado.", http.StatusNotFound)
 				return
 			}
-			log.Printf("DB error al actualizar producto: %v", err)
-			http.Error(w, "Error interno del servidor", http.StatusInternalServerError)
+			respondDBError(w, err, "actualizar producto")
 			return
 		}
+		products.Invalidate(context.WithoutCancel(r.Context()), id)
 
 		// 4. Respuesta de éxito 200 OK (Devolver el producto actualizado)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(product)
+		json.NewEncoder(w).Encode(versionedProduct(r, product))
 	}
 }
 
-// DELETE /productos/{id}: Elimina un producto
-func DeleteProductHandler(db *sql.DB) http.HandlerFunc {
+// DELETE /productos/{id}: Elimina un producto y, tras confirmar, sus imágenes
+func DeleteProductHandler(db *sql.DB, products *ProductCache, store BlobStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		// 🌟 CLAVE CHI: Extracción del parámetro ID
@@ -183,24 +278,29 @@ func DeleteProductHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// 2. Llamada al DAO para eliminar
-		err = DeleteProduct(db, id)
+		blobKeys, err := DeleteProduct(r.Context(), db, id)
 		if err != nil {
 			// Usamos la lógica de 404 si el DAO devuelve el error específico
 			if strings.Contains(err.Error(), "no encontrado") {
 				http.Error(w, "Producto no encontrado.", http.StatusNotFound)
 				return
 			}
-			log.Printf("DB error al eliminar producto: %v", err)
-			http.Error(w, "Error interno del servidor", http.StatusInternalServerError)
+			respondDBError(w, err, "eliminar producto")
 			return
 		}
 
-		// 3. Respuesta de éxito 204 No Content
+		// 3. Los blobs se borran solo tras el COMMIT (un rollback no deja imágenes rotas)
+		products.Invalidate(context.WithoutCancel(r.Context()), id)
+		deleteBlobs(context.WithoutCancel(r.Context()), store, blobKeys)
+
+		// 4. Respuesta de éxito 204 No Content
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-func LoginHandler(db *sql.DB, secretKey string) http.HandlerFunc {
+// POST /login: Autentica al usuario y devuelve un JWT.
+// Protegido contra fuerza bruta por guard (esperas progresivas y bloqueo temporal).
+func LoginHandler(db *sql.DB, secretKey string, tokenTTL time.Duration, guard *LoginGuard, carts CartConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var request LoginRequest
 
@@ -210,18 +310,58 @@ func LoginHandler(db *sql.DB, secretKey string) http.HandlerFunc {
 			return
 		}
 
-		user, err := AuthenticateUser(db, request.Username, request.Password)
-		if err != nil {
+		// 1. ¿El usuario o la IP deben esperar o están bloqueados?
+		// Begin además reserva el intento: hasta cerrarlo, otro del mismo par espera
+		ip := guard.Resolver.ClientIP(r)
+		event := SecurityEvent{Username: request.Username, IP: ip}
+
+		attempt, wait, locked := guard.Begin(time.Now(), request.Username, ip)
+		if wait > 0 {
+			event.Type = SecurityEventLoginBlocked
+			if locked {
+				event.Detail = "bloqueado"
+			}
+			LogSecurityEvent(r.Context(), event)
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+			http.Error(w, "Demasiados intentos fallidos, intenta más tarde", http.StatusTooManyRequests)
+			return
+		}
+		defer guard.Release(time.Now(), attempt) // Sin efecto si ya se cerró con Fail o Succeed
+
+		// 2. Verificar credenciales (tiempo constante exista o no el usuario)
+		user, err := AuthenticateUser(r.Context(), db, request.Username, request.Password)
+		if errors.Is(err, ErrInvalidCredentials) {
+			event.Type = SecurityEventLoginFailure
+			LogSecurityEvent(r.Context(), event)
+			for _, key := range guard.Fail(time.Now(), attempt) {
+				LogSecurityEvent(r.Context(), SecurityEvent{Type: SecurityEventLockout, Username: request.Username, IP: ip, Detail: key})
+			}
 			http.Error(w, "Credenciales inválidas", http.StatusUnauthorized)
 			return
 		}
+		if err != nil {
+			respondDBError(w, err, "autenticar usuario")
+			return
+		}
+
+		// 3. Éxito: se limpia el historial del usuario (no el de la IP, para que una
+		// cuenta propia no sirva para "resetear" los intentos contra otras)
+		guard.Succeed(time.Now(), attempt)
+		LogSecurityEvent(r.Context(), SecurityEvent{Type: SecurityEventLoginSuccess, Username: user.Username, UserID: user.ID, IP: ip})
 
-		tokenString, err := GenerateToken(user.ID, user.Role, secretKey)
+		tokenString, err := GenerateToken(user.ID, user.Role, secretKey, tokenTTL)
 		if err != nil {
 			http.Error(w, "Error generating token", http.StatusInternalServerError)
 			return
 		}
 
+		// 4. Fusionar el carrito invitado, si lo hay. Un fallo no impide el login.
+		if cartToken := r.Header.Get(CartTokenHeader); cartToken != "" {
+			if err := MergeGuestCart(r.Context(), db, cartToken, user.ID, time.Duration(carts.TTL)); err != nil {
+				slog.Warn("No se pudo fusionar el carrito invitado", "user_id", user.ID, "err", err)
+			}
+		}
+
 		response := LogingResponse{Token: tokenString}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -2,47 +2,95 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
+const testJWTSecret = "test-secret"
+
+// newTestLoginGuard crea un LoginGuard con la configuración por defecto.
+func newTestLoginGuard() *LoginGuard {
+	resolver, _ := NewClientIPResolver(nil)
+	return NewLoginGuard(DefaultConfig().Login, resolver)
+}
+
+// setupTestDB abre la DB de pruebas indicada en TEST_DATABASE_URL y garantiza que
+// exista el usuario testuser/testpass. Si la variable no está definida, el test se omite.
+func setupTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL no definido, se omite el test de integración")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("No se pudo abrir la DB de pruebas: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("No se pudo generar el hash: %v", err)
+	}
+	_, err = db.Exec(`
+		INSERT INTO users (username, password_hash, role) VALUES ('testuser', $1, 'user')
+		ON CONFLICT (username) DO UPDATE SET password_hash = EXCLUDED.password_hash`, string(hash))
+	if err != nil {
+		t.Fatalf("No se pudo preparar el usuario de pruebas: %v", err)
+	}
+
+	return db
+}
+
 // Test 1: Login Handler debe retornar un token
 func TestLoginHandler(t *testing.T) {
+	db := setupTestDB(t)
+
 	// Preparar request
 	loginReq := LoginRequest{
 		Username: "testuser",
 		Password: "testpass",
 	}
 	body, _ := json.Marshal(loginReq)
-	
+
 	req := httptest.NewRequest("POST", "/login", bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
-	
+
 	// Preparar response recorder
 	rr := httptest.NewRecorder()
-	
+
 	// Ejecutar handler
-	handler := http.HandlerFunc(LogingHandler)
+	handler := LoginHandler(db, testJWTSecret, time.Hour, newTestLoginGuard(), DefaultConfig().Cart)
 	handler.ServeHTTP(rr, req)
-	
+
 	// Verificar status code
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("Handler retornó status incorrecto: got %v want %v", status, http.StatusOK)
 	}
-	
+
 	// Verificar que retorna un token
 	var response LogingResponse
 	err := json.NewDecoder(rr.Body).Decode(&response)
 	if err != nil {
 		t.Fatalf("No se pudo decodear respuesta JSON: %v", err)
 	}
-	
+
 	if response.Token == "" {
 		t.Error("El token no puede estar vacío")
 	}
-	
+
 	t.Logf("✅ Test pasó - Token generado correctamente")
 }
 
@@ -51,17 +99,18 @@ func TestLoginHandlerInvalidJSON(t *testing.T) {
 	// Request con JSON inválido
 	req := httptest.NewRequest("POST", "/login", bytes.NewBufferString("{invalid json"))
 	req.Header.Set("Content-Type", "application/json")
-	
+
 	rr := httptest.NewRecorder()
-	
-	handler := http.HandlerFunc(LogingHandler)
+
+	// El body inválido se rechaza antes de consultar la DB
+	handler := LoginHandler(nil, testJWTSecret, time.Hour, newTestLoginGuard(), DefaultConfig().Cart)
 	handler.ServeHTTP(rr, req)
-	
+
 	// Debe retornar 400 Bad Request
 	if status := rr.Code; status != http.StatusBadRequest {
 		t.Errorf("Handler retornó status incorrecto: got %v want %v", status, http.StatusBadRequest)
 	}
-	
+
 	t.Log("✅ Test pasó - JSON inválido rechazado correctamente")
 }
 
@@ -71,17 +120,43 @@ func TestProductStruct(t *testing.T) {
 		ID:          1,
 		Name:        "Laptop",
 		Description: "Gaming laptop",
-		Price:       1500.50,
+		Price:       Money{Amount: 150050, Currency: "USD"},
 		Stock:       10,
 	}
-	
+
 	if product.ID != 1 {
 		t.Errorf("Product ID incorrecto: got %v want %v", product.ID, 1)
 	}
-	
-	if product.Price <= 0 {
+
+	if product.Price.Amount <= 0 {
 		t.Error("Product price debe ser mayor a 0")
 	}
-	
+
 	t.Log("✅ Test pasó - Estructura Product válida")
 }
+
+// Test 4: Los errores de contexto del DAO se traducen a 504/499
+func TestRespondDBError(t *testing.T) {
+	expired, cancelExpired := context.WithTimeout(context.Background(), 0)
+	defer cancelExpired()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"timeout", queryError(expired, errors.New("pq: canceling statement due to user request")), http.StatusGatewayTimeout},
+		{"cancelado", queryError(canceled, errors.New("pq: canceling statement due to user request")), StatusClientClosedRequest},
+		{"otro error", queryError(context.Background(), errors.New("pq: relation does not exist")), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		respondDBError(rr, fmt.Errorf("error al ejecutar SELECT ALL en DB: %w", tt.err), "probar")
+		if rr.Code != tt.want {
+			t.Errorf("%s: status incorrecto: got %v want %v", tt.name, rr.Code, tt.want)
+		}
+	}
+}
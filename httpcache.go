@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ====================================================================
+// CACHÉ HTTP (CDN Y NAVEGADORES)
+// Las lecturas del catálogo llevan Cache-Control (política por ruta, ver
+// HTTPCacheConfig), un ETag débil calculado del resultado y Last-Modified del
+// último cambio del catálogo. Con If-None-Match o If-Modified-Since vigentes se
+// responde 304 sin serializar el cuerpo.
+// ====================================================================
+
+// cacheControlDirectives: Directivas de respuesta admitidas en las políticas;
+// true si llevan un número de segundos.
+var cacheControlDirectives = map[string]bool{
+	"public": false, "private": false, "no-cache": false, "no-store": false,
+	"no-transform": false, "must-revalidate": false, "proxy-revalidate": false, "immutable": false,
+	"max-age": true, "s-maxage": true, "stale-while-revalidate": true, "stale-if-error": true,
+}
+
+// ValidateCacheControl revisa una política ("public, max-age=30"); "" no agrega cabecera.
+func ValidateCacheControl(policy string) error {
+	if policy == "" {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, directive := range strings.Split(policy, ",") {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(directive), "=")
+		name = strings.ToLower(name)
+		needsValue, known := cacheControlDirectives[name]
+		switch {
+		case !known:
+			return fmt.Errorf("directiva desconocida %q", name)
+		case needsValue != hasValue:
+			return fmt.Errorf("directiva %q mal escrita", directive)
+		case hasValue:
+			if seconds, err := strconv.Atoi(value); err != nil || seconds < 0 {
+				return fmt.Errorf("%s debe ser un número de segundos", name)
+			}
+		}
+		seen[name] = true
+	}
+	if seen["public"] && seen["private"] {
+		return fmt.Errorf("public y private son excluyentes")
+	}
+	return nil
+}
+
+// CachePolicy pone la política en las respuestas 200 y 304 (los errores no se
+// guardan en caché) y Vary: Authorization en las autenticadas, para que una caché
+// compartida no entregue la respuesta de un usuario a otro.
+func CachePolicy(policy string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "" {
+				w.Header().Add("Vary", "Authorization")
+			}
+			if policy != "" {
+				w = &cachePolicyWriter{ResponseWriter: w, policy: policy}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type cachePolicyWriter struct {
+	http.ResponseWriter
+	policy      string
+	wroteHeader bool
+}
+
+func (w *cachePolicyWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if (status == http.StatusOK || status == http.StatusNotModified) && w.Header().Get("Cache-Control") == "" {
+			w.Header().Set("Cache-Control", w.policy)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cachePolicyWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap permite a http.ResponseController llegar al writer original (Flush, deadlines).
+func (w *cachePolicyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ====================================================================
+// LAST-MODIFIED: reloj del catálogo
+// ====================================================================
+
+// CatalogClock: Momento del último cambio del catálogo visto por esta instancia.
+// Avanza con los eventos de product_changes (ProductChangeObserver), que publican
+// también las escrituras de variantes, stock, imágenes y categorías, y arranca en
+// el inicio del proceso, así nunca es anterior al cambio real. Un *CatalogClock
+// nil no emite Last-Modified.
+type CatalogClock struct {
+	mu       sync.Mutex
+	modified time.Time
+	now      func() time.Time
+}
+
+func NewCatalogClock() *CatalogClock {
+	return &CatalogClock{modified: time.Now().Truncate(time.Second), now: time.Now}
+}
+
+// LastModified se trunca a segundos, la resolución de las fechas HTTP.
+func (c *CatalogClock) LastModified() time.Time {
+	if c == nil {
+		return time.Time{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.modified
+}
+
+func (c *CatalogClock) touch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.modified = c.now().Truncate(time.Second)
+}
+
+func (c *CatalogClock) HandleEvent(ProductEvent) { c.touch() }
+
+// Reset: Tras reconectar LISTEN no se sabe qué cambió; se asume que todo.
+func (c *CatalogClock) Reset() { c.touch() }
+
+// ====================================================================
+// PETICIONES CONDICIONALES
+// ====================================================================
+
+// productsETag: ETag débil de la representación (versión de la API, productos ya
+// convertidos de moneda y con sus URLs). Depende solo del resultado: es el mismo
+// en todas las instancias y cambia con cualquier cambio visible, aunque su evento
+// de product_changes aún no haya llegado a esta instancia.
+func productsETag(r *http.Request, products ...Product) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "v%d|%d|", APIVersionFromRequest(r), len(products))
+	for _, p := range products {
+		fmt.Fprintf(h, "%d|%q|%q|%d|%s|%d|", p.ID, p.Name, p.Description, p.Price.Amount, p.Price.Currency, p.Stock)
+		for _, img := range p.Images {
+			fmt.Fprintf(h, "%d|%q|%q|%s|%d|%d|%d|", img.ID, img.URL, img.ThumbnailURL, img.ContentType, img.Width, img.Height, img.SizeBytes)
+		}
+		if p.TotalStock != nil {
+			fmt.Fprintf(h, "t%d|", *p.TotalStock)
+		}
+		if p.PriceRange != nil {
+			writeMoney(h, p.PriceRange.Min)
+			writeMoney(h, p.PriceRange.Max)
+		}
+		h.Write([]byte{'\n'})
+	}
+	return fmt.Sprintf(`W/"%016x"`, h.Sum64())
+}
+
+func writeMoney(h hash.Hash64, m Money) {
+	fmt.Fprintf(h, "%d%s|", m.Amount, m.Currency)
+}
+
+// checkNotModified pone ETag y Last-Modified y, si el cliente ya tiene esta
+// versión, responde 304 y devuelve true. If-None-Match tiene prioridad sobre
+// If-Modified-Since (RFC 9110 13.2.2). If-Modified-Since se ignora en las lecturas
+// que deben ir al primario: el reloj solo avanza cuando llega el NOTIFY.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		notModified = etagMatches(inm, etag)
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() && !mustReadPrimary(r) {
+		since, err := http.ParseTime(ims)
+		notModified = err == nil && !lastModified.After(since)
+	}
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return notModified
+}
+
+// etagMatches: Comparación débil (se ignora W/) contra una lista de If-None-Match.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
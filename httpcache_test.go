@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateCacheControl(t *testing.T) {
+	valid := []string{"", "public, max-age=30", "private, no-cache", "public, max-age=0, s-maxage=60, stale-while-revalidate=30", "no-store"}
+	for _, policy := range valid {
+		if err := ValidateCacheControl(policy); err != nil {
+			t.Errorf("%q: %v", policy, err)
+		}
+	}
+	invalid := []string{"publico", "max-age", "max-age=-1", "max-age=abc", "public=1", "public, private"}
+	for _, policy := range invalid {
+		if err := ValidateCacheControl(policy); err == nil {
+			t.Errorf("%q debía rechazarse", policy)
+		}
+	}
+}
+
+// newConditionalTestRouter: Router sin caché de lectura, para que cada GET vea las filas actuales.
+func newConditionalTestRouter(t *testing.T) (http.Handler, string, *fakeServer) {
+	t.Helper()
+	db, server := openFakeDB(t, "httpcache")
+	setLaptopStock(server, 3)
+
+	cfg := DefaultConfig()
+	cfg.JWT.Secret = testJWTSecret
+	cfg.Cache.Backend = "none"
+	router := setupRouter(NewDBCluster(db, nil, time.Second), NewProductEventBroker(cfg.Stream), newTestBlobStore(t), cfg)
+	token, err := GenerateToken(1, "user", testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router, token, server
+}
+
+func setLaptopStock(server *fakeServer, stock int64) {
+	server.SetRows(
+		[]string{"id", "name", "description", "price_minor", "currency", "stock", "images", "variant_count", "variant_stock", "min_price", "max_price"},
+		[]driver.Value{int64(1), "Laptop", "Portátil", int64(1999), "USD", stock, []byte("[]"), int64(0), int64(0), nil, nil},
+	)
+}
+
+func conditionalGet(router http.Handler, path, token string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// Test: Las lecturas llevan política, ETag y Last-Modified; la misma versión responde 304
+func TestConditionalGetProducts(t *testing.T) {
+	router, token, server := newConditionalTestRouter(t)
+
+	first := conditionalGet(router, "/api/v2/productos", token, nil)
+	if first.Code != http.StatusOK {
+		t.Fatalf("got %d %s", first.Code, first.Body.String())
+	}
+	etag, lastModified := first.Header().Get("ETag"), first.Header().Get("Last-Modified")
+	if !strings.HasPrefix(etag, `W/"`) || lastModified == "" {
+		t.Errorf("Faltan validadores: ETag %q, Last-Modified %q", etag, lastModified)
+	}
+	if got := first.Header().Get("Cache-Control"); got != DefaultConfig().HTTPCache.Products {
+		t.Errorf("Cache-Control: got %q", got)
+	}
+	if vary := first.Header().Values("Vary"); !slices.Contains(vary, "Authorization") {
+		t.Errorf("Vary debe incluir Authorization: got %q", vary)
+	}
+
+	// Misma versión: 304 sin cuerpo, con la política y el ETag
+	rr := conditionalGet(router, "/api/v2/productos", token, map[string]string{"If-None-Match": `"otro", ` + etag})
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Fatalf("If-None-Match: got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Cache-Control") == "" || rr.Header().Get("ETag") != etag {
+		t.Errorf("El 304 debe repetir Cache-Control y ETag: %v", rr.Header())
+	}
+
+	// El ETag depende de la versión de la API
+	if v1 := conditionalGet(router, "/api/v1/productos", token, nil); v1.Header().Get("ETag") == etag {
+		t.Error("v1 y v2 no deben compartir ETag")
+	}
+
+	// If-Modified-Since con la fecha recibida: 304, salvo en lecturas fuertes
+	if rr := conditionalGet(router, "/api/v2/productos", token, map[string]string{"If-Modified-Since": lastModified}); rr.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: got %d", rr.Code)
+	}
+	strong := map[string]string{"If-Modified-Since": lastModified, ReadConsistencyHeader: "strong"}
+	if rr := conditionalGet(router, "/api/v2/productos", token, strong); rr.Code != http.StatusOK {
+		t.Errorf("If-Modified-Since con lectura fuerte: got %d", rr.Code)
+	}
+
+	// Cambia el stock: el ETag viejo ya no vale y tiene prioridad sobre If-Modified-Since
+	setLaptopStock(server, 2)
+	both := map[string]string{"If-None-Match": etag, "If-Modified-Since": lastModified}
+	if rr := conditionalGet(router, "/api/v2/productos", token, both); rr.Code != http.StatusOK {
+		t.Errorf("Tras el cambio: got %d", rr.Code)
+	}
+
+	// Detalle: 304 con su propio ETag; los errores no llevan política de caché
+	detail := conditionalGet(router, "/api/v2/productos/1", token, nil)
+	if rr := conditionalGet(router, "/api/v2/productos/1", token, map[string]string{"If-None-Match": detail.Header().Get("ETag")}); rr.Code != http.StatusNotModified {
+		t.Errorf("Detalle: got %d", rr.Code)
+	}
+	server.SetRows(nil)
+	if rr := conditionalGet(router, "/api/v2/productos/1", token, nil); rr.Code != http.StatusNotFound || rr.Header().Get("Cache-Control") != "" {
+		t.Errorf("404: got %d con Cache-Control %q", rr.Code, rr.Header().Get("Cache-Control"))
+	}
+}
+
+// Test: El reloj del catálogo avanza con los eventos de product_changes
+func TestCatalogClock(t *testing.T) {
+	clock := NewCatalogClock()
+	now := clock.LastModified().Add(90 * time.Second)
+	clock.now = func() time.Time { return now.Add(500 * time.Millisecond) }
+
+	clock.HandleEvent(ProductEvent{ID: 1})
+	if got := clock.LastModified(); !got.Equal(now) {
+		t.Errorf("got %v want %v (truncado a segundos)", got, now)
+	}
+
+	// Los cambios de categorías (catalog.changed) también cambian las listas
+	now = now.Add(time.Minute)
+	clock.HandleEvent(ProductEvent{ID: 2, Type: CatalogChangedEvent})
+	if got := clock.LastModified(); !got.Equal(now) {
+		t.Errorf("catalog.changed: got %v want %v", got, now)
+	}
+
+	var none *CatalogClock
+	if !none.LastModified().IsZero() {
+		t.Error("Sin reloj no hay Last-Modified")
+	}
+}
+
+// Test: Las escrituras de variantes, stock, imágenes y categorías publican en
+// product_changes, así el reloj (y la caché) de todas las instancias avanza
+func TestCatalogWritesNotifyProductChanges(t *testing.T) {
+	ctx := context.Background()
+	writes := map[string]func(*sql.DB, *fakeServer) error{
+		"crear variante": func(db *sql.DB, server *fakeServer) error {
+			server.SetQueryRows("INSERT INTO product_variants", []string{"id", "price_minor", "currency"}, []driver.Value{int64(4), int64(1000), "USD"})
+			_, err := CreateVariant(ctx, db, ProductVariant{ProductID: 1, SKU: "TS-M"})
+			return err
+		},
+		"actualizar variante": func(db *sql.DB, server *fakeServer) error {
+			server.SetQueryRows("UPDATE product_variants", []string{"price_minor", "currency"}, []driver.Value{int64(1000), "USD"})
+			_, err := UpdateVariant(ctx, db, ProductVariant{ID: 4, ProductID: 1, SKU: "TS-M"})
+			return err
+		},
+		"eliminar variante": func(db *sql.DB, server *fakeServer) error {
+			return DeleteVariant(ctx, db, 1, 4)
+		},
+		"registrar imagen": func(db *sql.DB, server *fakeServer) error {
+			server.SetQueryRows("INSERT INTO product_images", []string{"id"}, []driver.Value{int64(7)})
+			_, err := CreateProductImage(ctx, db, 1, ProductImage{Key: "a.png"})
+			return err
+		},
+		"asignar categorías": func(db *sql.DB, server *fakeServer) error {
+			server.SetQueryRows("SELECT EXISTS", []string{"exists"}, []driver.Value{true})
+			return SetProductCategories(ctx, db, 1, []int{2})
+		},
+		"mover categoría": func(db *sql.DB, server *fakeServer) error {
+			return UpdateCategory(ctx, db, Category{ID: 2, Name: "Ropa", Slug: "ropa"})
+		},
+		"eliminar categoría": func(db *sql.DB, server *fakeServer) error {
+			server.SetQueryRows("SELECT EXISTS", []string{"exists"}, []driver.Value{false})
+			return DeleteCategory(ctx, db, 2)
+		},
+	}
+	for name, write := range writes {
+		t.Run(name, func(t *testing.T) {
+			db, server := openFakeDB(t, "catalogo")
+			server.SetRows(
+				[]string{"id", "name", "description", "price_minor", "currency", "stock", "images", "variant_count", "variant_stock", "min_price", "max_price"},
+				[]driver.Value{int64(1), "Camiseta", "", int64(1000), "USD", int64(0), []byte("[]"), int64(1), int64(5), int64(1000), int64(1000)},
+			)
+			if err := write(db, server); err != nil {
+				t.Fatal(err)
+			}
+			if n := countQueries(server.Queries(), "SELECT pg_notify"); n != 1 {
+				t.Errorf("Se esperaba 1 NOTIFY: got %d", n)
+			}
+		})
+	}
+}
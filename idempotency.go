@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ====================================================================
+// IDEMPOTENCIA (Idempotency-Key)
+// Un cliente que reintenta un POST con la misma cabecera Idempotency-Key
+// recibe la respuesta original (estado, cabeceras y cuerpo) en lugar de
+// ejecutar la operación otra vez. Las claves son por usuario (o IP si no hay
+// sesión) y se guardan con una huella de la petición para detectar reusos
+// con otro contenido.
+// ====================================================================
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotencyReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	// ErrIdempotencyInProgress: Otra petición con la misma clave aún no terminó (409).
+	ErrIdempotencyInProgress = errors.New("ya hay una petición en curso con esta Idempotency-Key")
+	// ErrIdempotencyMismatch: La clave ya se usó con otra petición (422).
+	ErrIdempotencyMismatch = errors.New("la Idempotency-Key ya se usó con una petición distinta")
+)
+
+// IdempotentResponse: Respuesta guardada para repetirla en los reintentos.
+type IdempotentResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// IdempotencyStore guarda el estado de cada clave. Begin reserva la clave (nil, nil)
+// o devuelve la respuesta ya guardada; Complete guarda la respuesta; Release libera
+// una clave reservada sin respuesta para que el cliente pueda reintentar.
+type IdempotencyStore interface {
+	Begin(ctx context.Context, scope, key, fingerprint string, now time.Time) (*IdempotentResponse, error)
+	Complete(ctx context.Context, scope, key string, resp IdempotentResponse) error
+	Release(ctx context.Context, scope, key string) error
+}
+
+// NewIdempotencyStore crea el backend configurado. postgres comparte las claves entre
+// instancias; memory solo sirve con una réplica de la API.
+func NewIdempotencyStore(cfg IdempotencyConfig, db *sql.DB) IdempotencyStore {
+	if cfg.Backend == "memory" {
+		return NewMemoryIdempotencyStore(cfg)
+	}
+	return NewPostgresIdempotencyStore(db, cfg)
+}
+
+// ====================================================================
+// BACKEND EN MEMORIA
+// ====================================================================
+
+type idempotencyEntry struct {
+	fingerprint string
+	response    *IdempotentResponse // nil = en curso
+	lockedAt    time.Time
+	expiresAt   time.Time
+}
+
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	cfg       IdempotencyConfig
+	lastSweep time.Time
+}
+
+func NewMemoryIdempotencyStore(cfg IdempotencyConfig) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{entries: make(map[string]*idempotencyEntry), cfg: cfg}
+}
+
+func (s *MemoryIdempotencyStore) Begin(ctx context.Context, scope, key, fingerprint string, now time.Time) (*IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+
+	id := scope + "\x00" + key
+	entry, ok := s.entries[id]
+	abandoned := ok && entry.response == nil && now.Sub(entry.lockedAt) >= time.Duration(s.cfg.LockTimeout)
+	if !ok || !now.Before(entry.expiresAt) || abandoned {
+		s.entries[id] = &idempotencyEntry{fingerprint: fingerprint, lockedAt: now, expiresAt: now.Add(time.Duration(s.cfg.TTL))}
+		return nil, nil
+	}
+	return entry.check(fingerprint)
+}
+
+// check decide qué hacer con una clave vigente que ya existe.
+func (e *idempotencyEntry) check(fingerprint string) (*IdempotentResponse, error) {
+	if e.fingerprint != fingerprint {
+		return nil, ErrIdempotencyMismatch
+	}
+	if e.response == nil {
+		return nil, ErrIdempotencyInProgress
+	}
+	return e.response, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, scope, key string, resp IdempotentResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[scope+"\x00"+key]; ok {
+		entry.response = &resp
+	}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, scope, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := scope + "\x00" + key
+	if entry, ok := s.entries[id]; ok && entry.response == nil {
+		delete(s.entries, id)
+	}
+	return nil
+}
+
+// sweep elimina periódicamente las claves vencidas.
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for id, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, id)
+		}
+	}
+}
+
+// ====================================================================
+// BACKEND POSTGRES (tabla idempotency_keys)
+// ====================================================================
+
+type PostgresIdempotencyStore struct {
+	DB  *sql.DB
+	cfg IdempotencyConfig
+}
+
+func NewPostgresIdempotencyStore(db *sql.DB, cfg IdempotencyConfig) *PostgresIdempotencyStore {
+	return &PostgresIdempotencyStore{DB: db, cfg: cfg}
+}
+
+func (s *PostgresIdempotencyStore) Begin(ctx context.Context, scope, key, fingerprint string, now time.Time) (*IdempotentResponse, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	// 1. Reservar la clave si es nueva, venció o quedó abandonada en curso
+	// (p. ej. el proceso se reinició a mitad de la petición)
+	var acquired bool
+	err := s.DB.QueryRowContext(ctx, `
+		INSERT INTO idempotency_keys (scope, key, fingerprint, locked_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (scope, key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, status_code = NULL, headers = NULL, body = NULL,
+			locked_at = EXCLUDED.locked_at, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= $4
+			OR (idempotency_keys.status_code IS NULL AND idempotency_keys.locked_at <= $6)
+		RETURNING true`,
+		scope, key, fingerprint, now, now.Add(time.Duration(s.cfg.TTL)), now.Add(-time.Duration(s.cfg.LockTimeout)),
+	).Scan(&acquired)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error al reservar Idempotency-Key: %w", queryError(ctx, err))
+	}
+
+	// 2. La clave existe y está vigente
+	entry := idempotencyEntry{}
+	var status sql.NullInt64
+	var headers, body []byte
+	err = s.DB.QueryRowContext(ctx, `
+		SELECT fingerprint, status_code, headers, body FROM idempotency_keys
+		WHERE scope = $1 AND key = $2`, scope, key,
+	).Scan(&entry.fingerprint, &status, &headers, &body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrIdempotencyInProgress // Se liberó justo ahora: que el cliente reintente
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar Idempotency-Key: %w", queryError(ctx, err))
+	}
+	if status.Valid {
+		entry.response = &IdempotentResponse{StatusCode: int(status.Int64), Body: body}
+		if err := json.Unmarshal(headers, &entry.response.Header); err != nil {
+			return nil, fmt.Errorf("cabeceras guardadas inválidas: %w", err)
+		}
+	}
+	return entry.check(fingerprint)
+}
+
+func (s *PostgresIdempotencyStore) Complete(ctx context.Context, scope, key string, resp IdempotentResponse) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	headers, err := json.Marshal(resp.Header)
+	if err != nil {
+		return fmt.Errorf("error al serializar cabeceras: %w", err)
+	}
+	_, err = s.DB.ExecContext(ctx, `
+		UPDATE idempotency_keys SET status_code = $3, headers = $4, body = $5
+		WHERE scope = $1 AND key = $2`,
+		scope, key, resp.StatusCode, string(headers), resp.Body,
+	)
+	if err != nil {
+		return fmt.Errorf("error al guardar respuesta idempotente: %w", queryError(ctx, err))
+	}
+	return nil
+}
+
+func (s *PostgresIdempotencyStore) Release(ctx context.Context, scope, key string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx,
+		`DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND status_code IS NULL`, scope, key)
+	if err != nil {
+		return fmt.Errorf("error al liberar Idempotency-Key: %w", queryError(ctx, err))
+	}
+	return nil
+}
+
+// PurgeExpiredIdempotencyKeys borra las claves vencidas y devuelve cuántas eliminó.
+func PurgeExpiredIdempotencyKeys(ctx context.Context, db *sql.DB) (int64, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("error al purgar Idempotency-Keys: %w", queryError(ctx, err))
+	}
+	return res.RowsAffected()
+}
+
+// RunIdempotencyPurger ejecuta PurgeExpiredIdempotencyKeys cada interval hasta que ctx se cancele.
+func RunIdempotencyPurger(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := PurgeExpiredIdempotencyKeys(ctx, db); err != nil && ctx.Err() == nil {
+			slog.Error("Idempotencia: error al purgar claves vencidas", "err", err)
+		}
+	}
+}
+
+// ====================================================================
+// MIDDLEWARE
+// ====================================================================
+
+// errIdempotencySpool: No se pudo preparar el archivo temporal del cuerpo (500).
+var errIdempotencySpool = errors.New("no se pudo guardar el cuerpo de la petición")
+
+// readRequestBody calcula la huella de la petición (método, ruta con query y cuerpo)
+// mientras lee el cuerpo, y devuelve una copia para el handler. Los multipart
+// (imágenes) se copian a un archivo temporal en lugar de quedar en memoria.
+func readRequestBody(r *http.Request) (string, io.ReadCloser, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		var buf bytes.Buffer
+		if _, err := io.Copy(io.MultiWriter(h, &buf), r.Body); err != nil {
+			return "", nil, err
+		}
+		return hex.EncodeToString(h.Sum(nil)), io.NopCloser(&buf), nil
+	}
+
+	f, err := os.CreateTemp("", "idempotency-*")
+	if err != nil {
+		slog.Error("Idempotencia: no se pudo guardar el cuerpo", "err", err)
+		return "", nil, errIdempotencySpool
+	}
+	body := tempFileBody{f}
+	if _, err := io.Copy(io.MultiWriter(h, f), r.Body); err != nil {
+		body.Close()
+		return "", nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		body.Close()
+		slog.Error("Idempotencia: no se pudo guardar el cuerpo", "err", err)
+		return "", nil, errIdempotencySpool
+	}
+	return hex.EncodeToString(h.Sum(nil)), body, nil
+}
+
+// tempFileBody borra el archivo temporal al cerrarse.
+type tempFileBody struct{ *os.File }
+
+func (b tempFileBody) Close() error {
+	b.File.Close()
+	return os.Remove(b.Name())
+}
+
+// validIdempotencyKey admite UUIDs y cualquier otro identificador ASCII visible.
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// responseCapture copia al cliente y a un buffer todo lo que escribe el handler.
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCapture) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(p)
+	return c.ResponseWriter.Write(p)
+}
+
+// transportHeaders describen cómo viajó el cuerpo, no el cuerpo guardado (que se
+// captura antes de comprimirlo): en la repetición las calculan otra vez
+// CompressResponses y el servidor, según la petición que llega.
+var transportHeaders = map[string]bool{"Content-Encoding": true, "Content-Length": true, "Vary": true}
+
+// changedHeaders devuelve las cabeceras que el handler agregó o modificó (no las que
+// ya habían puesto middlewares anteriores, como RateLimit-*).
+func changedHeaders(before, after http.Header) http.Header {
+	changed := http.Header{}
+	for name, values := range after {
+		if !transportHeaders[name] && !slicesEqual(before[name], values) {
+			changed[name] = append([]string(nil), values...)
+		}
+	}
+	return changed
+}
+
+func noStore(h http.Header) bool {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-store") {
+			return true
+		}
+	}
+	return false
+}
+
+// secretReplay: Lo que se guarda en lugar de una respuesta 2xx no-store (p. ej. la
+// clave de API recién creada). El secreto no queda en idempotency_keys, pero la
+// clave se completa: el reintento recibe 409 en vez de repetir la operación.
+func secretReplay(body []byte) IdempotentResponse {
+	msg := "La petición ya se completó; su respuesta contenía secretos y no se puede repetir"
+	var created struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if json.Unmarshal(body, &created) == nil && len(created.ID) > 0 {
+		msg += fmt.Sprintf(" (id=%s)", created.ID)
+	}
+	return IdempotentResponse{
+		StatusCode: http.StatusConflict,
+		Header: http.Header{
+			"Content-Type":           {"text/plain; charset=utf-8"},
+			"X-Content-Type-Options": {"nosniff"},
+			"Cache-Control":          {"no-store"},
+		},
+		Body: []byte(msg + "\n"),
+	}
+}
+
+func slicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// IdempotencyMiddleware aplica Idempotency-Key a los POST y PATCH. Debe ir después de
+// AuthMiddleware para que las claves sean por usuario. Las respuestas 5xx no se
+// guardan: la clave se libera para que el cliente pueda reintentar. De las 2xx
+// no-store se guarda solo un aviso (secretReplay); las demás no-store se liberan.
+// El cuerpo se lee antes que el handler, así que cfg.MaxBodyBytes lo limita aquí.
+func IdempotencyMiddleware(store IdempotencyStore, resolver *ClientIPResolver, cfg IdempotencyConfig) func(next http.Handler) http.Handler {
+	scopeOf := KeyByUser(resolver)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPatch) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !validIdempotencyKey(key) {
+				http.Error(w, fmt.Sprintf("%s debe tener entre 1 y %d caracteres ASCII visibles", IdempotencyKeyHeader, maxIdempotencyKeyLength), http.StatusBadRequest)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.MaxBodyBytes))
+
+			// 1. Leer el cuerpo (con límite) para la huella y devolverlo intacto al handler
+			fingerprint, body, err := readRequestBody(r)
+			var maxBytesErr *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxBytesErr):
+				http.Error(w, fmt.Sprintf("El cuerpo excede el máximo de %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+				return
+			case errors.Is(err, errIdempotencySpool):
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			case err != nil:
+				http.Error(w, "No se pudo leer el cuerpo de la petición", http.StatusBadRequest)
+				return
+			}
+			defer body.Close()
+			r.Body = body
+
+			// 2. Reservar la clave o repetir la respuesta guardada
+			scope := scopeOf(r)
+			saved, err := store.Begin(r.Context(), scope, key, fingerprint, time.Now())
+			switch {
+			case errors.Is(err, ErrIdempotencyInProgress):
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			case errors.Is(err, ErrIdempotencyMismatch):
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			case err != nil:
+				respondDBError(w, err, "verificar Idempotency-Key")
+				return
+			case saved != nil:
+				for name, values := range saved.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set(IdempotencyReplayedHeader, "true")
+				w.WriteHeader(saved.StatusCode)
+				w.Write(saved.Body)
+				return
+			}
+
+			// 3. Ejecutar y guardar la respuesta. Se usa un contexto sin cancelación para
+			// que un cliente que corta la conexión no deje la clave bloqueada.
+			storeCtx := context.WithoutCancel(r.Context())
+			before := w.Header().Clone()
+			capture := &responseCapture{ResponseWriter: w}
+			completed := false
+			defer func() {
+				if !completed {
+					if err := store.Release(storeCtx, scope, key); err != nil {
+						slog.Error("Idempotencia: no se pudo liberar la clave", "err", err)
+					}
+				}
+			}()
+
+			next.ServeHTTP(capture, r)
+
+			if capture.status == 0 || capture.status >= 500 {
+				return
+			}
+			resp := IdempotentResponse{StatusCode: capture.status, Header: changedHeaders(before, w.Header()), Body: capture.body.Bytes()}
+			// Las respuestas con Cache-Control: no-store llevan secretos que no deben
+			// quedar en idempotency_keys
+			if noStore(w.Header()) {
+				if capture.status >= 300 {
+					return
+				}
+				resp = secretReplay(capture.body.Bytes())
+			}
+			if err := store.Complete(storeCtx, scope, key, resp); err != nil {
+				slog.Error("Idempotencia: no se pudo guardar la respuesta", "err", err)
+				return
+			}
+			completed = true
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newIdempotencyTestHandler(store IdempotencyStore, status int, calls *int32) http.Handler {
+	resolver, _ := NewClientIPResolver(nil)
+	return IdempotencyMiddleware(store, resolver, testIdempotencyConfig())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(calls, 1)
+		w.Header().Set("Location", fmt.Sprintf("/orders/%d", n))
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"id":%d}`, n)
+	}))
+}
+
+func sendIdempotent(h http.Handler, method, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/orders", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func testIdempotencyConfig() IdempotencyConfig {
+	return IdempotencyConfig{Backend: "memory", TTL: Duration(time.Hour), LockTimeout: Duration(time.Minute), PurgeInterval: Duration(time.Hour), MaxBodyBytes: 1 << 10}
+}
+
+// Test: El reintento repite estado, cabeceras y cuerpo sin ejecutar el handler otra vez
+func TestIdempotencyReplay(t *testing.T) {
+	var calls int32
+	h := newIdempotencyTestHandler(NewMemoryIdempotencyStore(testIdempotencyConfig()), http.StatusCreated, &calls)
+
+	first := sendIdempotent(h, "POST", "clave-1", `{"a":1}`)
+	second := sendIdempotent(h, "POST", "clave-1", `{"a":1}`)
+
+	if calls != 1 {
+		t.Fatalf("El handler se ejecutó %d veces, se esperaba 1", calls)
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() || second.Header().Get("Location") != "/orders/1" {
+		t.Errorf("Respuesta repetida incorrecta: %d %s %v", second.Code, second.Body.String(), second.Header())
+	}
+	if second.Header().Get(IdempotencyReplayedHeader) != "true" || first.Header().Get(IdempotencyReplayedHeader) != "" {
+		t.Errorf("%s solo debe enviarse en la repetición", IdempotencyReplayedHeader)
+	}
+
+	// Sin clave, con otra clave o con un método idempotente se ejecuta normalmente
+	sendIdempotent(h, "POST", "", `{"a":1}`)
+	sendIdempotent(h, "POST", "clave-2", `{"a":1}`)
+	sendIdempotent(h, "PUT", "clave-1", `{"a":1}`)
+	if calls != 4 {
+		t.Errorf("Se esperaban 4 ejecuciones, got %d", calls)
+	}
+}
+
+// Test: Reusar una clave con otro cuerpo es 422; una clave inválida es 400
+func TestIdempotencyMismatchAndInvalidKey(t *testing.T) {
+	var calls int32
+	h := newIdempotencyTestHandler(NewMemoryIdempotencyStore(testIdempotencyConfig()), http.StatusCreated, &calls)
+
+	sendIdempotent(h, "POST", "clave", `{"a":1}`)
+	if rr := sendIdempotent(h, "POST", "clave", `{"a":2}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Cuerpo distinto: got %d want 422", rr.Code)
+	}
+	for _, key := range []string{"con espacio", "ñandú", strings.Repeat("x", maxIdempotencyKeyLength+1)} {
+		if rr := sendIdempotent(h, "POST", key, `{}`); rr.Code != http.StatusBadRequest {
+			t.Errorf("Clave %q: got %d want 400", key, rr.Code)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("El handler se ejecutó %d veces, se esperaba 1", calls)
+	}
+}
+
+// Test: Una petición concurrente con la misma clave recibe 409 mientras la primera sigue en curso
+func TestIdempotencyConcurrent(t *testing.T) {
+	store := NewMemoryIdempotencyStore(testIdempotencyConfig())
+	resolver, _ := NewClientIPResolver(nil)
+	started, release := make(chan struct{}), make(chan struct{})
+	h := IdempotencyMiddleware(store, resolver, testIdempotencyConfig())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- sendIdempotent(h, "POST", "clave", `{}`) }()
+	<-started
+
+	rr := sendIdempotent(h, "POST", "clave", `{}`)
+	if rr.Code != http.StatusConflict || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Petición concurrente: got %d want 409 con Retry-After", rr.Code)
+	}
+	close(release)
+	if first := <-done; first.Code != http.StatusCreated {
+		t.Errorf("Primera petición: got %d want 201", first.Code)
+	}
+}
+
+// Test: Los 5xx no se guardan, así que el reintento vuelve a ejecutar el handler
+func TestIdempotencyServerErrorReleasesKey(t *testing.T) {
+	var calls int32
+	h := newIdempotencyTestHandler(NewMemoryIdempotencyStore(testIdempotencyConfig()), http.StatusServiceUnavailable, &calls)
+
+	sendIdempotent(h, "POST", "clave", `{}`)
+	if rr := sendIdempotent(h, "POST", "clave", `{}`); rr.Header().Get(IdempotencyReplayedHeader) != "" {
+		t.Error("Una respuesta 5xx no debe repetirse")
+	}
+	if calls != 2 {
+		t.Errorf("El handler se ejecutó %d veces, se esperaban 2", calls)
+	}
+}
+
+// Test: Las claves vencen tras el TTL y las reservas abandonadas tras LockTimeout
+func TestMemoryIdempotencyStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryIdempotencyStore(testIdempotencyConfig())
+	now := time.Now()
+
+	if saved, err := store.Begin(ctx, "user:1", "k", "f1", now); saved != nil || err != nil {
+		t.Fatalf("Primera reserva: %v %v", saved, err)
+	}
+	if _, err := store.Begin(ctx, "user:1", "k", "f1", now.Add(30*time.Second)); err != ErrIdempotencyInProgress {
+		t.Errorf("Reserva en curso: got %v", err)
+	}
+	if _, err := store.Begin(ctx, "user:2", "k", "f1", now); err != nil {
+		t.Errorf("Las claves son por usuario: got %v", err)
+	}
+
+	// Reserva abandonada: se toma de nuevo
+	if saved, err := store.Begin(ctx, "user:1", "k", "f2", now.Add(2*time.Minute)); saved != nil || err != nil {
+		t.Fatalf("Reserva abandonada: %v %v", saved, err)
+	}
+	store.Complete(ctx, "user:1", "k", IdempotentResponse{StatusCode: http.StatusCreated})
+	if saved, err := store.Begin(ctx, "user:1", "k", "f2", now.Add(30*time.Minute)); err != nil || saved == nil || saved.StatusCode != http.StatusCreated {
+		t.Errorf("Respuesta guardada: %v %v", saved, err)
+	}
+
+	// Vencida: cualquier petición vuelve a ejecutarse
+	if saved, err := store.Begin(ctx, "user:1", "k", "f3", now.Add(3*time.Hour)); saved != nil || err != nil {
+		t.Errorf("Clave vencida: %v %v", saved, err)
+	}
+}
+
+// Test: En el router, las cabeceras RateLimit-* no forman parte de la respuesta guardada
+func TestIdempotencyOnRouter(t *testing.T) {
+	db, server := openFakeDB(t, "idempotency")
+	server.SetRows(nil)
+	cfg := DefaultConfig()
+	cfg.JWT.Secret = testJWTSecret
+	cfg.API.StrictResponses = true
+	cfg.Idempotency.Backend = "memory"
+	router := setupRouter(NewDBCluster(db, nil, time.Second), NewProductEventBroker(cfg.Stream), newTestBlobStore(t), cfg)
+	token, err := GenerateToken(1, "user", testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/orders", strings.NewReader(`{"items":[]}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(IdempotencyKeyHeader, "pedido-1")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	first, second := send(), send()
+	if first.Code != http.StatusBadRequest || second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Fatalf("Repetición: got %d/%d", first.Code, second.Code)
+	}
+	if second.Header().Get(IdempotencyReplayedHeader) != "true" {
+		t.Error("Falta la cabecera de repetición")
+	}
+	if first.Header().Get("RateLimit-Remaining") == second.Header().Get("RateLimit-Remaining") {
+		t.Error("RateLimit-Remaining debe reflejar la petición actual, no la guardada")
+	}
+}
+
+// Test: El cuerpo se lee con límite; los multipart llegan intactos al handler desde el
+// archivo temporal y la huella sigue distinguiendo su contenido
+func TestIdempotencyRequestBody(t *testing.T) {
+	store := NewMemoryIdempotencyStore(testIdempotencyConfig())
+	resolver, _ := NewClientIPResolver(nil)
+	var calls int32
+	h := IdempotencyMiddleware(store, resolver, testIdempotencyConfig())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	send := func(key, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/productos/1/imagenes", strings.NewReader(body))
+		req.Header.Set(IdempotencyKeyHeader, key)
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send("grande", "application/json", strings.Repeat("a", 2<<10)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Cuerpo excedido: got %d want 413", rr.Code)
+	}
+	if rr := send("grande", "multipart/form-data; boundary=x", strings.Repeat("a", 2<<10)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Multipart excedido: got %d want 413", rr.Code)
+	}
+	if calls != 0 {
+		t.Fatalf("El handler no debía ejecutarse: %d", calls)
+	}
+
+	const form = "--x\r\nContent-Disposition: form-data; name=\"imagen\"\r\n\r\nPNG\r\n--x--\r\n"
+	if rr := send("imagen", "multipart/form-data; boundary=x", form); rr.Code != http.StatusCreated || rr.Body.String() != form {
+		t.Errorf("Multipart: got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := send("imagen", "multipart/form-data; boundary=x", form); rr.Header().Get(IdempotencyReplayedHeader) != "true" {
+		t.Error("El reintento del multipart debía repetirse")
+	}
+	if rr := send("imagen", "multipart/form-data; boundary=x", strings.Replace(form, "PNG", "JPG", 1)); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Multipart distinto: got %d want 422", rr.Code)
+	}
+}
+
+// Test: Con compresión, se guarda el cuerpo sin comprimir y sin Content-Encoding, así
+// que un reintento sin Accept-Encoding recibe JSON plano
+func TestIdempotencyReplayWithCompression(t *testing.T) {
+	cfg := DefaultConfig().Compression
+	cfg.MinSize = 10
+	resolver, _ := NewClientIPResolver(nil)
+	h := CompressResponses(cfg)(IdempotencyMiddleware(NewMemoryIdempotencyStore(testIdempotencyConfig()), resolver, testIdempotencyConfig())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id":1,"name":"Laptop"}`)
+	})))
+	send := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/orders", strings.NewReader(`{}`))
+		req.Header.Set(IdempotencyKeyHeader, "clave")
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send("gzip"); rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Primera respuesta: Content-Encoding %q", rr.Header().Get("Content-Encoding"))
+	}
+	rr := send("")
+	if rr.Header().Get(IdempotencyReplayedHeader) != "true" || rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != `{"id":1,"name":"Laptop"}` {
+		t.Errorf("Repetición sin Accept-Encoding: %q %q", rr.Header().Get("Content-Encoding"), rr.Body.String())
+	}
+	if rr := send("gzip"); rr.Header().Get("Content-Encoding") != "gzip" || len(rr.Header().Values("Vary")) != 1 {
+		t.Errorf("Repetición con gzip: %q Vary %q", rr.Header().Get("Content-Encoding"), rr.Header().Values("Vary"))
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // Registra el decodificador GIF en image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // Registra el decodificador WebP en image.Decode
+)
+
+// ====================================================================
+// IMÁGENES DE PRODUCTOS
+// POST /productos/{id}/imagenes recibe un multipart con el campo "imagen".
+// El tipo se detecta por el contenido (no se confía en el Content-Type del
+// cliente), se genera una miniatura en Go puro y ambos archivos se guardan en
+// el BlobStore. La DB (product_images) solo guarda las claves.
+// ====================================================================
+
+// ImageFormField: Campo del formulario multipart con el archivo.
+const ImageFormField = "imagen"
+
+// Tipos aceptados (detectados con http.DetectContentType) y su extensión
+var allowedImageTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// ProductImage: Imagen de un producto. Las URLs se calculan al responder con el BlobStore.
+type ProductImage struct {
+	ID           int    `json:"id"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	ContentType  string `json:"content_type"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	SizeBytes    int    `json:"size_bytes"`
+	Key          string `json:"-"`
+	ThumbnailKey string `json:"-"`
+}
+
+// productImagesColumn agrega las imágenes de cada producto (alias p) como un array JSON,
+// así la lista de productos sigue siendo una sola consulta.
+const productImagesColumn = `COALESCE((
+		SELECT json_agg(json_build_object(
+			'id', i.id, 'key', i.key, 'thumbnail_key', i.thumbnail_key, 'content_type', i.content_type,
+			'width', i.width, 'height', i.height, 'size_bytes', i.size_bytes
+		) ORDER BY i.id)
+		FROM product_images i WHERE i.product_id = p.id
+	), '[]')`
+
+// decodeProductImages interpreta la columna productImagesColumn.
+func decodeProductImages(data []byte) ([]ProductImage, error) {
+	var rows []struct {
+		ID           int    `json:"id"`
+		Key          string `json:"key"`
+		ThumbnailKey string `json:"thumbnail_key"`
+		ContentType  string `json:"content_type"`
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+		SizeBytes    int    `json:"size_bytes"`
+	}
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, fmt.Errorf("error al leer imágenes: %w", err)
+	}
+
+	images := make([]ProductImage, 0, len(rows))
+	for _, row := range rows {
+		images = append(images, ProductImage{
+			ID:           row.ID,
+			ContentType:  row.ContentType,
+			Width:        row.Width,
+			Height:       row.Height,
+			SizeBytes:    row.SizeBytes,
+			Key:          row.Key,
+			ThumbnailKey: row.ThumbnailKey,
+		})
+	}
+	return images, nil
+}
+
+// withImageURLs completa las URLs públicas de las imágenes de cada producto.
+func withImageURLs(store BlobStore, products ...*Product) {
+	for _, p := range products {
+		for i := range p.Images {
+			p.Images[i].URL = store.URL(p.Images[i].Key)
+			p.Images[i].ThumbnailURL = store.URL(p.Images[i].ThumbnailKey)
+		}
+	}
+}
+
+// ====================================================================
+// PROCESAMIENTO
+// ====================================================================
+
+// Errores de validación de la imagen subida
+var (
+	ErrImageTooLarge       = errors.New("la imagen excede el tamaño máximo")
+	ErrImageUnsupported    = errors.New("formato no soportado: usa JPEG, PNG, GIF o WebP")
+	ErrImageTooManyPixels  = errors.New("la imagen excede las dimensiones máximas")
+	ErrImageMissingFormKey = errors.New(`falta el campo "` + ImageFormField + `" en el formulario`)
+)
+
+// processedImage: Original y miniatura listos para guardar.
+type processedImage struct {
+	Original      []byte
+	ContentType   string
+	Ext           string
+	Width, Height int
+	Thumbnail     []byte
+	ThumbnailType string
+	ThumbnailExt  string
+}
+
+// readImageUpload lee el campo ImageFormField del multipart sin pasar por disco,
+// cortando en cuanto se supera maxBytes.
+func readImageUpload(r *http.Request, maxBytes int) ([]byte, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, ErrImageMissingFormKey
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() != ImageFormField {
+			part.Close()
+			continue
+		}
+
+		data, err := io.ReadAll(io.LimitReader(part, int64(maxBytes)+1))
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxBytes {
+			return nil, ErrImageTooLarge
+		}
+		return data, nil
+	}
+}
+
+// processImage valida el contenido y genera la miniatura (lado mayor = thumbSize).
+func processImage(data []byte, maxDimension, thumbSize int) (*processedImage, error) {
+	// 1. Tipo real según los primeros bytes
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	ext, ok := allowedImageTypes[contentType]
+	if !ok {
+		return nil, ErrImageUnsupported
+	}
+
+	// 2. Dimensiones antes de decodificar todo (una imagen pequeña en bytes puede ocupar GBs en memoria)
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrImageUnsupported
+	}
+	if config.Width > maxDimension || config.Height > maxDimension {
+		return nil, ErrImageTooManyPixels
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrImageUnsupported
+	}
+
+	// 3. Miniatura conservando la proporción (nunca se agranda)
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	tw, th := w, h
+	if w > thumbSize || h > thumbSize {
+		if w >= h {
+			tw, th = thumbSize, max(1, h*thumbSize/w)
+		} else {
+			tw, th = max(1, w*thumbSize/h), thumbSize
+		}
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), src, bounds, draw.Over, nil)
+
+	// PNG/GIF pueden tener transparencia: su miniatura va en PNG; el resto en JPEG
+	var buf bytes.Buffer
+	thumbType, thumbExt := "image/jpeg", "jpg"
+	if contentType == "image/png" || contentType == "image/gif" {
+		thumbType, thumbExt = "image/png", "png"
+		err = png.Encode(&buf, thumb)
+	} else {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al codificar la miniatura: %w", err)
+	}
+
+	return &processedImage{
+		Original:      data,
+		ContentType:   contentType,
+		Ext:           ext,
+		Width:         w,
+		Height:        h,
+		Thumbnail:     buf.Bytes(),
+		ThumbnailType: thumbType,
+		ThumbnailExt:  thumbExt,
+	}, nil
+}
+
+// ====================================================================
+// DAO
+// ====================================================================
+
+// CreateProductImage registra la imagen. Devuelve sql.ErrNoRows si el producto no existe.
+func CreateProductImage(ctx context.Context, db *sql.DB, productID int, img ProductImage) (ProductImage, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return ProductImage{}, fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO product_images (product_id, key, thumbnail_key, content_type, width, height, size_bytes)
+		SELECT id, $2, $3, $4, $5, $6, $7 FROM products WHERE id = $1
+		RETURNING id`,
+		productID, img.Key, img.ThumbnailKey, img.ContentType, img.Width, img.Height, img.SizeBytes,
+	).Scan(&img.ID)
+	if err != nil {
+		return ProductImage{}, fmt.Errorf("error al registrar imagen: %w", queryError(ctx, err))
+	}
+
+	// Las imágenes forman parte del producto: cachés y clientes SSE deben enterarse
+	if err := notifyProductUpdated(ctx, tx, productID); err != nil {
+		return ProductImage{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return ProductImage{}, fmt.Errorf("error al confirmar imagen: %w", queryError(ctx, err))
+	}
+	return img, nil
+}
+
+// deleteBlobs borra los archivos sin fallar: un error solo deja un archivo
+// huérfano y no debe cambiar la respuesta.
+func deleteBlobs(ctx context.Context, store BlobStore, keys []string) {
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			slog.Warn("No se pudo eliminar el blob", "key", key, "err", err)
+		}
+	}
+}
+
+// ====================================================================
+// HANDLER
+// ====================================================================
+
+// newImageKey genera una clave única: productos/<id>/<aleatorio>.<ext>
+// (la miniatura usa la misma clave con el sufijo _thumb).
+func newImageKey(productID int, ext string) (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("productos/%d/%s.%s", productID, hex.EncodeToString(buf), ext), nil
+}
+
+// POST /productos/{id}/imagenes: Sube una imagen (multipart, campo "imagen")
+func UploadProductImageHandler(db *sql.DB, products *ProductCache, store BlobStore, cfg StorageConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		// 1. Leer el archivo con límite de tamaño (margen para las cabeceras del multipart)
+		r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.MaxUploadBytes)+64<<10)
+		data, err := readImageUpload(r, cfg.MaxUploadBytes)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.Is(err, ErrImageTooLarge) || errors.As(err, &maxBytesErr):
+			http.Error(w, fmt.Sprintf("La imagen excede el máximo de %d bytes", cfg.MaxUploadBytes), http.StatusRequestEntityTooLarge)
+			return
+		case err != nil:
+			http.Error(w, "Se esperaba multipart/form-data con el campo \""+ImageFormField+"\"", http.StatusBadRequest)
+			return
+		}
+
+		// 2. Validar contenido y generar miniatura
+		processed, err := processImage(data, cfg.MaxDimension, cfg.ThumbnailSize)
+		switch {
+		case errors.Is(err, ErrImageUnsupported):
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		case errors.Is(err, ErrImageTooManyPixels):
+			http.Error(w, fmt.Sprintf("La imagen excede %dx%d píxeles", cfg.MaxDimension, cfg.MaxDimension), http.StatusUnprocessableEntity)
+			return
+		case err != nil:
+			slog.Error("Error al procesar imagen", "product_id", id, "err", err)
+			http.Error(w, "Error interno del servidor", http.StatusInternalServerError)
+			return
+		}
+
+		// 3. Guardar original y miniatura
+		key, err := newImageKey(id, processed.Ext)
+		if err != nil {
+			http.Error(w, "Error interno del servidor", http.StatusInternalServerError)
+			return
+		}
+		thumbKey := strings.TrimSuffix(key, "."+processed.Ext) + "_thumb." + processed.ThumbnailExt
+
+		if err := store.Put(r.Context(), key, bytes.NewReader(processed.Original), int64(len(processed.Original)), processed.ContentType); err != nil {
+			slog.Error("Error al guardar imagen", "err", err)
+			http.Error(w, "No se pudo guardar la imagen", http.StatusBadGateway)
+			return
+		}
+		if err := store.Put(r.Context(), thumbKey, bytes.NewReader(processed.Thumbnail), int64(len(processed.Thumbnail)), processed.ThumbnailType); err != nil {
+			deleteBlobs(context.WithoutCancel(r.Context()), store, []string{key})
+			slog.Error("Error al guardar miniatura", "err", err)
+			http.Error(w, "No se pudo guardar la imagen", http.StatusBadGateway)
+			return
+		}
+
+		// 4. Registrar en la DB; si falla, no dejar archivos huérfanos
+		image, err := CreateProductImage(r.Context(), db, id, ProductImage{
+			Key:          key,
+			ThumbnailKey: thumbKey,
+			ContentType:  processed.ContentType,
+			Width:        processed.Width,
+			Height:       processed.Height,
+			SizeBytes:    len(processed.Original),
+		})
+		if err != nil {
+			deleteBlobs(context.WithoutCancel(r.Context()), store, []string{key, thumbKey})
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Producto no encontrado.", http.StatusNotFound)
+				return
+			}
+			respondDBError(w, err, "registrar imagen")
+			return
+		}
+		products.Invalidate(context.WithoutCancel(r.Context()), id)
+
+		image.URL = store.URL(image.Key)
+		image.ThumbnailURL = store.URL(image.ThumbnailKey)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(image)
+	}
+}
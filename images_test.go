@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newTestBlobStore(t *testing.T) *LocalBlobStore {
+	t.Helper()
+	store, err := NewLocalBlobStore(t.TempDir(), "/imagenes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, x%h, color.RGBA{R: 200, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// uploadImage envía data como el campo "imagen" al handler de subida.
+func uploadImage(t *testing.T, handler http.HandlerFunc, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile(ImageFormField, "foto.png")
+	part.Write(data)
+	form.Close()
+
+	r := chi.NewRouter()
+	r.Post("/productos/{id}/imagenes", handler)
+	req := httptest.NewRequest("POST", "/productos/1/imagenes", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
+
+// storedFiles lista los blobs guardados (sin temporales).
+func storedFiles(t *testing.T, store *LocalBlobStore) []string {
+	t.Helper()
+	var files []string
+	filepath.WalkDir(store.Dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(store.Dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files
+}
+
+// Test: La subida guarda original y miniatura y devuelve sus URLs
+func TestUploadProductImage(t *testing.T) {
+	db, server := openFakeDB(t, "images")
+	server.SetRows(
+		[]string{"id", "name", "description", "price_minor", "currency", "stock", "images", "variant_count", "variant_stock", "min_price", "max_price"},
+		[]driver.Value{int64(1), "Laptop", "", int64(1999), "USD", int64(3), []byte("[]"), int64(0), int64(0), nil, nil},
+	)
+	server.SetQueryRows("INSERT INTO product_images", []string{"id"}, []driver.Value{int64(7)})
+	store := newTestBlobStore(t)
+	cfg := DefaultConfig().Storage
+
+	rr := uploadImage(t, UploadProductImageHandler(db, nil, store, cfg), testPNG(t, 600, 300))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Se esperaba 201: got %d %s", rr.Code, rr.Body.String())
+	}
+
+	var image ProductImage
+	if err := json.Unmarshal(rr.Body.Bytes(), &image); err != nil {
+		t.Fatal(err)
+	}
+	if image.ID != 7 || image.ContentType != "image/png" || image.Width != 600 || image.Height != 300 {
+		t.Errorf("Imagen incorrecta: %+v", image)
+	}
+	if !strings.HasPrefix(image.URL, "/imagenes/productos/1/") || !strings.HasSuffix(image.ThumbnailURL, "_thumb.png") {
+		t.Errorf("URLs incorrectas: %q %q", image.URL, image.ThumbnailURL)
+	}
+
+	// La miniatura se sirve desde el store y respeta ThumbnailSize
+	rr = httptest.NewRecorder()
+	http.StripPrefix("/imagenes", store).ServeHTTP(rr, httptest.NewRequest("GET", image.ThumbnailURL, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET miniatura retornó %d", rr.Code)
+	}
+	thumb, err := png.DecodeConfig(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.Width != cfg.ThumbnailSize || thumb.Height != cfg.ThumbnailSize/2 {
+		t.Errorf("Miniatura de %dx%d, se esperaba %dx%d", thumb.Width, thumb.Height, cfg.ThumbnailSize, cfg.ThumbnailSize/2)
+	}
+}
+
+// Test: Tipo por contenido, límite de tamaño y producto inexistente
+func TestUploadProductImageRejects(t *testing.T) {
+	db, _ := openFakeDB(t, "images-rejects") // Sin filas: el producto no existe
+	store := newTestBlobStore(t)
+	cfg := DefaultConfig().Storage
+	cfg.MaxUploadBytes = 64 << 10
+	handler := UploadProductImageHandler(db, nil, store, cfg)
+
+	cases := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no es imagen", []byte("<html><script>alert(1)</script></html>"), http.StatusUnsupportedMediaType},
+		{"demasiado grande", bytes.Repeat([]byte{0xFF}, cfg.MaxUploadBytes+1), http.StatusRequestEntityTooLarge},
+		{"producto inexistente", testPNG(t, 10, 10), http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		if rr := uploadImage(t, handler, tc.data); rr.Code != tc.want {
+			t.Errorf("%s: got %d want %d (%s)", tc.name, rr.Code, tc.want, rr.Body.String())
+		}
+	}
+
+	// Si el registro en la DB falla no quedan archivos huérfanos
+	if files := storedFiles(t, store); len(files) != 0 {
+		t.Errorf("No deben quedar blobs: %v", files)
+	}
+}
+
+// Test: Las dimensiones se validan antes de decodificar la imagen completa
+func TestProcessImageMaxDimension(t *testing.T) {
+	if _, err := processImage(testPNG(t, 100, 20), 50, 16); err != ErrImageTooManyPixels {
+		t.Errorf("Se esperaba ErrImageTooManyPixels: got %v", err)
+	}
+	// Las imágenes pequeñas no se agrandan
+	processed, err := processImage(testPNG(t, 10, 20), 50, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb, _ := png.DecodeConfig(bytes.NewReader(processed.Thumbnail))
+	if thumb.Width != 10 || thumb.Height != 20 {
+		t.Errorf("Miniatura de %dx%d, se esperaba 10x20", thumb.Width, thumb.Height)
+	}
+}
+
+// Test: Las claves no pueden escapar del directorio del store
+func TestLocalBlobStoreRejectsTraversal(t *testing.T) {
+	store := newTestBlobStore(t)
+	ctx := context.Background()
+
+	for _, key := range []string{"../fuera.txt", "/etc/passwd", "a/../../b", "a//b", `a\b`} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q) debe fallar", key)
+		}
+	}
+
+	if err := store.Put(ctx, "productos/1/a.png", strings.NewReader("x"), 1, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := store.Get(ctx, "productos/1/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "x" {
+		t.Errorf("Contenido incorrecto: %q", data)
+	}
+
+	if err := store.Delete(ctx, "productos/1/a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "productos/1/a.png"); err != ErrBlobNotFound {
+		t.Errorf("Se esperaba ErrBlobNotFound: got %v", err)
+	}
+	// Borrar algo que ya no existe no es un error
+	if err := store.Delete(ctx, "productos/1/a.png"); err != nil {
+		t.Errorf("Delete repetido no debe fallar: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	store.ServeHTTP(rr, httptest.NewRequest("GET", "/productos/", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Los directorios no deben listarse: got %d", rr.Code)
+	}
+}
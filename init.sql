@@ -12,3 +12,232 @@ VALUES (
     '$2a$10$92IXUNpkjO0rOQ5byMi.Ye4oKoEa3Ro9llC/.og/at2.uheWG/igi',
     'admin'
 ) ON CONFLICT (username) DO NOTHING;
+
+-- Precios en unidades menores de la moneda (centavos para USD, yenes para JPY)
+CREATE TABLE IF NOT EXISTS products (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    price_minor BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL DEFAULT 'USD',
+    stock INTEGER NOT NULL DEFAULT 0,
+    creator_id INTEGER REFERENCES users(id),
+    CONSTRAINT products_price_minor_check CHECK (price_minor >= 0)
+);
+
+-- Árbol de categorías: parent_id NULL = categoría raíz.
+-- ON DELETE RESTRICT: no se puede borrar una categoría con subcategorías.
+CREATE TABLE IF NOT EXISTS categories (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    slug VARCHAR(100) UNIQUE NOT NULL,
+    parent_id INTEGER REFERENCES categories(id) ON DELETE RESTRICT,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CONSTRAINT categories_parent_not_self CHECK (parent_id <> id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_categories_parent_id ON categories (parent_id);
+
+-- Relación muchos-a-muchos productos <-> categorías
+CREATE TABLE IF NOT EXISTS product_categories (
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    category_id INTEGER NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+    PRIMARY KEY (product_id, category_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_product_categories_category_id ON product_categories (category_id);
+
+-- Variantes de productos (talla, color...): price_minor NULL = precio del producto
+CREATE TABLE IF NOT EXISTS product_variants (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    sku VARCHAR(64) NOT NULL,
+    attributes JSONB NOT NULL DEFAULT '{}',
+    price_minor BIGINT CHECK (price_minor >= 0),
+    stock INTEGER NOT NULL DEFAULT 0,
+    CONSTRAINT product_variants_sku_key UNIQUE (sku),
+    CONSTRAINT product_variants_attributes_key UNIQUE (product_id, attributes),
+    CONSTRAINT product_variants_stock_check CHECK (stock >= 0)
+);
+
+-- Migración de bases creadas con price NUMERIC(12, 2) (en USD): se pasa a unidades
+-- menores y se elimina price. Idempotente: en una base nueva no hace nada, y se
+-- puede volver a ejecutar sobre una ya migrada (psql -f init.sql).
+ALTER TABLE products ADD COLUMN IF NOT EXISTS price_minor BIGINT;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE product_variants ADD COLUMN IF NOT EXISTS price_minor BIGINT CHECK (price_minor >= 0);
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_schema = current_schema() AND table_name = 'products' AND column_name = 'price') THEN
+        UPDATE products SET price_minor = round(price * 100) WHERE price_minor IS NULL;
+        ALTER TABLE products DROP COLUMN price;
+    END IF;
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_schema = current_schema() AND table_name = 'product_variants' AND column_name = 'price') THEN
+        UPDATE product_variants SET price_minor = round(price * 100) WHERE price IS NOT NULL AND price_minor IS NULL;
+        ALTER TABLE product_variants DROP COLUMN price;
+    END IF;
+END $$;
+
+ALTER TABLE products ALTER COLUMN price_minor SET NOT NULL;
+-- Bases anteriores al CHECK: falla si queda algún precio negativo (hay que corregirlo antes)
+ALTER TABLE products DROP CONSTRAINT IF EXISTS products_price_minor_check;
+ALTER TABLE products ADD CONSTRAINT products_price_minor_check CHECK (price_minor >= 0);
+
+-- Precios de lista en otras monedas; si no hay, se convierte con exchange_rates
+CREATE TABLE IF NOT EXISTS product_prices (
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    currency CHAR(3) NOT NULL,
+    amount_minor BIGINT NOT NULL CHECK (amount_minor >= 0),
+    PRIMARY KEY (product_id, currency)
+);
+
+-- Tipos de cambio: 1 base = rate quote (el par inverso se deduce)
+CREATE TABLE IF NOT EXISTS exchange_rates (
+    base CHAR(3) NOT NULL,
+    quote CHAR(3) NOT NULL,
+    rate NUMERIC(20, 10) NOT NULL CHECK (rate > 0),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (base, quote)
+);
+
+-- Carritos: uno por usuario o, para invitados, identificado por guest_token (X-Cart-Token).
+-- Se borran (con sus ítems) al vencer expires_at.
+CREATE TABLE IF NOT EXISTS carts (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    guest_token VARCHAR(64) UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    CONSTRAINT carts_owner_check CHECK ((user_id IS NULL) <> (guest_token IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS idx_carts_expires_at ON carts (expires_at);
+
+CREATE TABLE IF NOT EXISTS cart_items (
+    id SERIAL PRIMARY KEY,
+    cart_id INTEGER NOT NULL REFERENCES carts(id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    variant_id INTEGER REFERENCES product_variants(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    added_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Un ítem por producto/variante en cada carrito (variant_id NULL cuenta como 0)
+CREATE UNIQUE INDEX IF NOT EXISTS cart_items_line_key ON cart_items (cart_id, product_id, COALESCE(variant_id, 0));
+
+-- Respuestas guardadas por Idempotency-Key (scope = usuario o IP). status_code NULL
+-- indica que la petición original sigue en curso.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope VARCHAR(128) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    fingerprint CHAR(64) NOT NULL,
+    status_code INTEGER,
+    headers JSONB,
+    body BYTEA,
+    locked_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys (expires_at);
+
+-- Pedidos. Los ítems guardan una copia de nombre, SKU y precio al momento de la compra;
+-- product_id/variant_id quedan en NULL si luego se borra el producto o la variante.
+CREATE TABLE IF NOT EXISTS orders (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'paid', 'shipped', 'delivered', 'cancelled')),
+    currency CHAR(3) NOT NULL,
+    total_minor BIGINT NOT NULL CHECK (total_minor >= 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders (user_id, id DESC);
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    product_id INTEGER REFERENCES products(id) ON DELETE SET NULL,
+    variant_id INTEGER REFERENCES product_variants(id) ON DELETE SET NULL,
+    sku VARCHAR(64) NOT NULL DEFAULT '',
+    name VARCHAR(255) NOT NULL,
+    unit_price_minor BIGINT NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    line_total_minor BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_items_order_id ON order_items (order_id);
+
+-- Imágenes de productos: los archivos viven en el BlobStore, aquí solo las claves
+CREATE TABLE IF NOT EXISTS product_images (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    key TEXT NOT NULL UNIQUE,
+    thumbnail_key TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    size_bytes INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_product_images_product_id ON product_images (product_id);
+
+-- Webhooks salientes (patrón outbox)
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id SERIAL PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT[] NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Outbox: se escribe en la misma transacción que el cambio del producto
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id BIGSERIAL PRIMARY KEY,
+    event_type VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Una entrega por evento y suscripción. status: pending | delivered | dead (dead-letter)
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    event_id BIGINT NOT NULL REFERENCES webhook_events(id) ON DELETE CASCADE,
+    subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_error TEXT,
+    last_status_code INTEGER,
+    delivered_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending
+    ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+
+-- Claves de API (clientes máquina a máquina). Solo se guarda el SHA-256 de la
+-- clave; prefix la identifica en los listados y en la búsqueda al autenticar
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(20) UNIQUE NOT NULL,
+    key_hash CHAR(64) NOT NULL,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    scopes TEXT[] NOT NULL,
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    created_by INTEGER NOT NULL, -- Admin que la creó (auditoría)
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- IDs de los eventos de GET /productos/stream (únicos entre instancias)
+CREATE SEQUENCE IF NOT EXISTS product_events_seq;
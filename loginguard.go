@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ====================================================================
+// PROTECCIÓN CONTRA FUERZA BRUTA EN /login
+// Los intentos fallidos se cuentan por usuario y por IP: al llegar al máximo, la
+// clave queda bloqueada durante LockoutDuration (o hasta que un admin la
+// desbloquee). La espera progresiva (cada fallo la duplica) se aplica al par
+// usuario+IP, así un fallo no hace esperar a los demás usuarios de esa IP.
+// ====================================================================
+
+// loginSweepInterval: Cada cuánto se recorren las claves para borrar las caducadas.
+const loginSweepInterval = time.Minute
+
+// loginAttempts: Historial de una clave ("user:<nombre>", "ip:<ip>" o el par).
+type loginAttempts struct {
+	failures    int
+	pending     int // Intentos reservados con Begin que aún no se cerraron
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// LoginGuard lleva la cuenta de intentos fallidos en memoria (por instancia).
+type LoginGuard struct {
+	mu        sync.Mutex
+	attempts  map[string]*loginAttempts
+	lastSweep time.Time
+	cfg       LoginConfig
+	Resolver  *ClientIPResolver
+}
+
+func NewLoginGuard(cfg LoginConfig, resolver *ClientIPResolver) *LoginGuard {
+	return &LoginGuard{
+		attempts: make(map[string]*loginAttempts),
+		cfg:      cfg,
+		Resolver: resolver,
+	}
+}
+
+// UserKey normaliza el usuario para que "Admin" y "admin" compartan contador.
+func UserKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+// IPKey construye la clave de una IP.
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// PairKey construye la clave de un usuario desde una IP (espera progresiva).
+func PairKey(username, ip string) string {
+	return UserKey(username) + "|" + IPKey(ip)
+}
+
+// LoginAttempt: Intento de login reservado con Begin. Debe cerrarse con Fail,
+// Succeed o Release para que deje de contar como pendiente; cerrarlo de nuevo no
+// hace nada, así Release sirve de defer.
+type LoginAttempt struct {
+	user, ip, pair string
+	closed         bool
+}
+
+// maxFailures devuelve el umbral de bloqueo: las IPs toleran más fallos porque
+// varios usuarios legítimos pueden compartir una (NAT, oficina).
+func (g *LoginGuard) maxFailures(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return g.cfg.MaxFailuresPerIP
+	}
+	return g.cfg.MaxFailures
+}
+
+// delay calcula la espera progresiva tras n fallos: base, 2×base, 4×base... hasta MaxDelay.
+func (g *LoginGuard) delay(failures int) time.Duration {
+	delay := time.Duration(g.cfg.BaseDelay)
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if delay >= time.Duration(g.cfg.MaxDelay) {
+			return time.Duration(g.cfg.MaxDelay)
+		}
+	}
+	return delay
+}
+
+// pendingWait: Espera indicada a quien intenta mientras otro intento suyo sigue en curso.
+func (g *LoginGuard) pendingWait() time.Duration {
+	return max(time.Duration(g.cfg.BaseDelay), time.Second)
+}
+
+// entry devuelve el historial vigente de key; los fallos antiguos caducan tras
+// LockoutDuration (salvo que haya intentos en curso). Debe llamarse con g.mu tomado.
+func (g *LoginGuard) entry(key string, now time.Time) *loginAttempts {
+	attempts, ok := g.attempts[key]
+	if !ok {
+		return nil
+	}
+	expired := now.Sub(attempts.lastFailure) > time.Duration(g.cfg.LockoutDuration)
+	if expired && !now.Before(attempts.lockedUntil) && attempts.pending == 0 {
+		delete(g.attempts, key)
+		return nil
+	}
+	return attempts
+}
+
+// sweep borra las claves caducadas como mucho una vez por loginSweepInterval: sin
+// esto, cada usuario o IP que falló una vez quedaría en memoria para siempre.
+// Debe llamarse con g.mu tomado.
+func (g *LoginGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < loginSweepInterval {
+		return
+	}
+	g.lastSweep = now
+	for key := range g.attempts {
+		g.entry(key, now)
+	}
+}
+
+// Begin comprueba y reserva el intento en una sola operación. Si el cliente debe
+// esperar devuelve wait > 0 (y locked si el usuario o la IP están bloqueados) y no
+// reserva nada. Si no, el intento cuenta como pendiente hasta cerrarlo: varios
+// intentos simultáneos no pasan todos el control antes de registrar el primer fallo.
+func (g *LoginGuard) Begin(now time.Time, username, ip string) (attempt *LoginAttempt, wait time.Duration, locked bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sweep(now)
+
+	attempt = &LoginAttempt{user: UserKey(username), ip: IPKey(ip), pair: PairKey(username, ip)}
+
+	// 1. Bloqueo del usuario o de la IP; los intentos en curso cuentan como posibles fallos
+	for _, key := range []string{attempt.user, attempt.ip} {
+		attempts := g.entry(key, now)
+		switch {
+		case attempts == nil:
+		case now.Before(attempts.lockedUntil):
+			locked = true
+			wait = max(wait, attempts.lockedUntil.Sub(now))
+		case attempts.failures+attempts.pending >= g.maxFailures(key):
+			wait = max(wait, g.pendingWait())
+		}
+	}
+
+	// 2. Espera progresiva del par; con un intento en curso se espera su resultado
+	if attempts := g.entry(attempt.pair, now); attempts != nil {
+		if nextAllowed := attempts.lastFailure.Add(g.delay(attempts.failures)); attempts.failures > 0 && now.Before(nextAllowed) {
+			wait = max(wait, nextAllowed.Sub(now))
+		}
+		if attempts.pending > 0 {
+			wait = max(wait, g.pendingWait())
+		}
+	}
+	if wait > 0 {
+		return nil, wait, locked
+	}
+
+	// 3. Reservar
+	for _, key := range []string{attempt.user, attempt.ip, attempt.pair} {
+		g.getOrCreate(key, now).pending++
+	}
+	return attempt, 0, false
+}
+
+// getOrCreate devuelve el historial de key, creándolo si no existe. Debe llamarse con g.mu tomado.
+func (g *LoginGuard) getOrCreate(key string, now time.Time) *loginAttempts {
+	attempts := g.entry(key, now)
+	if attempts == nil {
+		attempts = &loginAttempts{}
+		g.attempts[key] = attempts
+	}
+	return attempts
+}
+
+// release descuenta el intento pendiente de key. Debe llamarse con g.mu tomado.
+func (g *LoginGuard) release(key string, now time.Time) *loginAttempts {
+	attempts := g.getOrCreate(key, now)
+	if attempts.pending > 0 {
+		attempts.pending--
+	}
+	return attempts
+}
+
+// Fail cierra el intento como fallido. Devuelve las claves que acaban de quedar bloqueadas.
+func (g *LoginGuard) Fail(now time.Time, attempt *LoginAttempt) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if attempt.closed {
+		return nil
+	}
+	attempt.closed = true
+
+	var lockedKeys []string
+	for _, key := range []string{attempt.user, attempt.ip, attempt.pair} {
+		attempts := g.release(key, now)
+		attempts.failures++
+		attempts.lastFailure = now
+		if key == attempt.pair {
+			continue // El par solo lleva la espera progresiva
+		}
+		if attempts.failures >= g.maxFailures(key) && !now.Before(attempts.lockedUntil) {
+			attempts.lockedUntil = now.Add(time.Duration(g.cfg.LockoutDuration))
+			lockedKeys = append(lockedKeys, key)
+		}
+	}
+	return lockedKeys
+}
+
+// Succeed cierra el intento como exitoso: se borra el historial del usuario y del
+// par, no el de la IP, para que una cuenta propia no sirva para "resetear" los
+// intentos contra otras.
+func (g *LoginGuard) Succeed(now time.Time, attempt *LoginAttempt) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if attempt.closed {
+		return
+	}
+	attempt.closed = true
+	g.release(attempt.ip, now)
+	delete(g.attempts, attempt.user)
+	delete(g.attempts, attempt.pair)
+}
+
+// Release cierra el intento sin resultado (p. ej. la DB falló): no cuenta como fallo.
+func (g *LoginGuard) Release(now time.Time, attempt *LoginAttempt) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if attempt.closed {
+		return
+	}
+	attempt.closed = true
+	for _, key := range []string{attempt.user, attempt.ip, attempt.pair} {
+		g.release(key, now)
+	}
+}
+
+// Unlock desbloquea key manualmente, junto con la espera progresiva de sus pares
+// usuario+IP: si no, el siguiente intento desde esa IP seguiría esperando.
+// Devuelve false si no tenía historial.
+func (g *LoginGuard) Unlock(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.attempts[key]
+	for k := range g.attempts {
+		if k == key || strings.HasPrefix(k, key+"|") || strings.HasSuffix(k, "|"+key) {
+			g.clear(k)
+		}
+	}
+	return ok
+}
+
+// clear borra los fallos y el bloqueo de key pero conserva los intentos en curso:
+// siguen contando hasta que se cierren. Debe llamarse con g.mu tomado.
+func (g *LoginGuard) clear(key string) {
+	attempts := g.attempts[key]
+	if attempts.pending == 0 {
+		delete(g.attempts, key)
+		return
+	}
+	*attempts = loginAttempts{pending: attempts.pending}
+}
+
+// LoginLockout: Vista pública de una clave bloqueada.
+type LoginLockout struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Lockouts lista las claves bloqueadas en este momento.
+func (g *LoginGuard) Lockouts(now time.Time) []LoginLockout {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	lockouts := []LoginLockout{}
+	for key := range g.attempts {
+		attempts := g.entry(key, now)
+		if attempts != nil && now.Before(attempts.lockedUntil) {
+			lockouts = append(lockouts, LoginLockout{Key: key, Failures: attempts.failures, LockedUntil: attempts.lockedUntil})
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].Key < lockouts[j].Key })
+	return lockouts
+}
+
+// ====================================================================
+// ENDPOINTS DE ADMINISTRACIÓN
+// ====================================================================
+
+// GET /admin/bloqueos: Lista los usuarios e IPs bloqueados
+func ListLockoutsHandler(guard *LoginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(guard.Lockouts(time.Now()))
+	}
+}
+
+// POST /admin/usuarios/{username}/desbloquear: Desbloquea un usuario (y opcionalmente ?ip=)
+// con sus esperas por IP; los intentos en curso se siguen contando
+func UnlockUserHandler(guard *LoginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		adminID, _ := GetUserIDFromContext(r)
+
+		unlocked := guard.Unlock(UserKey(username))
+		if ip := r.URL.Query().Get("ip"); ip != "" {
+			unlocked = guard.Unlock(IPKey(ip)) || unlocked
+		}
+
+		if !unlocked {
+			http.Error(w, "El usuario no tiene intentos fallidos registrados", http.StatusNotFound)
+			return
+		}
+
+		LogSecurityEvent(r.Context(), SecurityEvent{
+			Type:     SecurityEventUnlock,
+			Username: username,
+			UserID:   adminID,
+			IP:       guard.Resolver.ClientIP(r),
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
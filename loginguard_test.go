@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newGuardForTest(maxFailures int) *LoginGuard {
+	resolver, _ := NewClientIPResolver(nil)
+	cfg := DefaultConfig().Login
+	cfg.MaxFailures = maxFailures
+	cfg.MaxFailuresPerIP = maxFailures * 4
+	cfg.BaseDelay = Duration(time.Second)
+	cfg.MaxDelay = Duration(4 * time.Second)
+	cfg.LockoutDuration = Duration(15 * time.Minute)
+	return NewLoginGuard(cfg, resolver)
+}
+
+// failLogin reserva y cierra como fallido un intento de username desde ip.
+func failLogin(t *testing.T, guard *LoginGuard, now time.Time, username, ip string) []string {
+	t.Helper()
+	attempt, wait, _ := guard.Begin(now, username, ip)
+	if wait > 0 {
+		t.Fatalf("%s desde %s: se esperaba poder intentar, espera %v", username, ip, wait)
+	}
+	return guard.Fail(now, attempt)
+}
+
+// Test: Cada fallo duplica la espera del par usuario+IP hasta MaxDelay; los demás
+// usuarios de la IP y el mismo usuario desde otra IP no esperan
+func TestLoginGuardProgressiveDelay(t *testing.T) {
+	guard := newGuardForTest(10)
+	now := time.Now()
+
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		failLogin(t, guard, now, "alice", "10.0.0.1")
+		if _, wait, _ := guard.Begin(now, "alice", "10.0.0.1"); wait != want {
+			t.Errorf("Fallo %d: espera incorrecta: got %v want %v", i+1, wait, want)
+		}
+		now = now.Add(want)
+	}
+
+	if attempt, wait, _ := guard.Begin(now, "bob", "10.0.0.1"); wait != 0 {
+		t.Errorf("Otro usuario de la misma IP no debe esperar: got %v", wait)
+	} else {
+		guard.Release(now, attempt)
+	}
+	if attempt, wait, _ := guard.Begin(now, "alice", "10.0.0.2"); wait != 0 {
+		t.Errorf("El usuario desde otra IP no debe esperar: got %v", wait)
+	} else {
+		guard.Release(now, attempt)
+	}
+}
+
+// Test: Un intento en curso cuenta hasta cerrarse: los simultáneos del mismo par
+// esperan y no superan entre todos el umbral de bloqueo
+func TestLoginGuardConcurrentAttempts(t *testing.T) {
+	guard := newGuardForTest(2)
+	now := time.Now()
+
+	first, wait, _ := guard.Begin(now, "alice", "10.0.0.1")
+	if wait != 0 {
+		t.Fatalf("Primer intento: espera %v", wait)
+	}
+	if _, wait, _ := guard.Begin(now, "alice", "10.0.0.1"); wait == 0 {
+		t.Error("Con un intento en curso el mismo par debe esperar")
+	}
+
+	// Desde otra IP se puede, pero solo hasta MaxFailures intentos en curso
+	second, wait, _ := guard.Begin(now, "alice", "10.0.0.2")
+	if wait != 0 {
+		t.Fatalf("Segundo intento desde otra IP: espera %v", wait)
+	}
+	if _, wait, _ := guard.Begin(now, "alice", "10.0.0.3"); wait == 0 {
+		t.Error("Los intentos en curso deben contar para el umbral del usuario")
+	}
+
+	// Cerrar un intento dos veces no descuenta otro
+	guard.Release(now, first)
+	guard.Release(now, first)
+	if _, wait, _ := guard.Begin(now, "alice", "10.0.0.3"); wait != 0 {
+		t.Errorf("Tras cerrar un intento se debe poder intentar: espera %v", wait)
+	}
+	guard.Succeed(now, second)
+}
+
+// Test: Tras N fallos la clave se bloquea hasta que un admin la desbloquea
+func TestLoginGuardLockoutAndUnlock(t *testing.T) {
+	guard := newGuardForTest(3)
+	now := time.Now()
+
+	var locked []string
+	for i := 0; i < 3; i++ {
+		locked = failLogin(t, guard, now, "Alice", fmt.Sprintf("10.0.0.%d", i))
+	}
+	if len(locked) != 1 || locked[0] != "user:alice" {
+		t.Fatalf("El 3er fallo debe bloquear user:alice, got %v", locked)
+	}
+
+	// Sigue bloqueada aunque pase la espera progresiva
+	if _, wait, isLocked := guard.Begin(now.Add(time.Minute), "ALICE", "10.0.0.9"); !isLocked || wait != 14*time.Minute {
+		t.Errorf("Se esperaba bloqueo de 14m restantes, got locked=%v wait=%v", isLocked, wait)
+	}
+	if lockouts := guard.Lockouts(now); len(lockouts) != 1 {
+		t.Errorf("Se esperaba 1 bloqueo listado, got %d", len(lockouts))
+	}
+
+	if !guard.Unlock(UserKey("alice")) {
+		t.Fatal("Unlock debe encontrar la clave")
+	}
+	if _, wait, isLocked := guard.Begin(now, "alice", "10.0.0.9"); isLocked || wait != 0 {
+		t.Error("Tras desbloquear se debe poder intentar de inmediato")
+	}
+}
+
+// Test: Tras desbloquear, el usuario entra de inmediato desde la IP de los fallos;
+// los intentos que estaban en curso siguen contando
+func TestLoginGuardUnlockClearsPairs(t *testing.T) {
+	guard := newGuardForTest(3)
+	now := time.Now()
+
+	for i := range 3 {
+		if i > 0 {
+			now = now.Add(guard.delay(i))
+		}
+		failLogin(t, guard, now, "alice", "10.0.0.1")
+	}
+	inFlight, wait, _ := guard.Begin(now, "alice", "10.0.0.2")
+	if wait == 0 {
+		t.Fatal("El usuario bloqueado no debe poder intentar")
+	}
+	if inFlight != nil {
+		t.Fatal("Begin no debe reservar si hay que esperar")
+	}
+
+	// Un intento de otro usuario desde la misma IP queda en curso durante el desbloqueo
+	pending, wait, _ := guard.Begin(now, "bob", "10.0.0.1")
+	if wait != 0 {
+		t.Fatalf("bob no debe esperar: %v", wait)
+	}
+	if !guard.Unlock(UserKey("alice")) || !guard.Unlock(IPKey("10.0.0.1")) {
+		t.Fatal("Unlock debe encontrar las claves")
+	}
+
+	attempt, wait, locked := guard.Begin(now, "alice", "10.0.0.1")
+	if locked || wait != 0 {
+		t.Fatalf("Tras desbloquear se debe poder intentar de inmediato desde la misma IP: locked=%v wait=%v", locked, wait)
+	}
+	guard.Succeed(now, attempt)
+
+	if attempts := guard.attempts[IPKey("10.0.0.1")]; attempts == nil || attempts.pending != 1 || attempts.failures != 0 {
+		t.Errorf("El desbloqueo debe borrar los fallos de la IP y conservar el intento en curso: %+v", attempts)
+	}
+	guard.Fail(now, pending)
+	if _, wait, _ := guard.Begin(now, "bob", "10.0.0.1"); wait != time.Second {
+		t.Errorf("El fallo en curso debe contar tras el desbloqueo: espera %v", wait)
+	}
+}
+
+// Test: Las claves caducadas se borran aunque no se vuelvan a consultar
+func TestLoginGuardSweep(t *testing.T) {
+	guard := newGuardForTest(3)
+	now := time.Now()
+	for i := 0; i < 50; i++ {
+		failLogin(t, guard, now, fmt.Sprintf("user%d", i), fmt.Sprintf("10.0.1.%d", i))
+	}
+	if n := len(guard.attempts); n != 150 {
+		t.Fatalf("Se esperaban 150 claves (usuario, IP y par), got %d", n)
+	}
+
+	later := now.Add(time.Duration(guard.cfg.LockoutDuration) + loginSweepInterval)
+	attempt, _, _ := guard.Begin(later, "otro", "10.0.2.1")
+	guard.Release(later, attempt)
+	if n := len(guard.attempts); n > 3 {
+		t.Errorf("Las claves caducadas deben borrarse: quedan %d", n)
+	}
+}
+
+// Test: El handler responde 401 a credenciales inválidas y 429 durante la espera
+func TestLoginHandlerBruteForceProtection(t *testing.T) {
+	db, _ := openFakeDB(t, "users") // Sin filas: todo usuario es inexistente
+	guard := newGuardForTest(5)
+	handler := LoginHandler(db, testJWTSecret, time.Hour, guard, DefaultConfig().Cart)
+
+	login := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(LoginRequest{Username: "nadie", Password: "incorrecta"})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/login", bytes.NewBuffer(body)))
+		return rr
+	}
+
+	if rr := login(); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Primer intento: got %d want 401", rr.Code)
+	}
+
+	rr := login()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Intento inmediato tras un fallo: got %d want 429", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After incorrecto: got %q", rr.Header().Get("Retry-After"))
+	}
+}
@@ -1,70 +1,263 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func setupDB() *sql.DB {
-	host := os.Getenv("POSTGRES_HOST")
-	port := os.Getenv("POSTGRES_PORT")
-	user := os.Getenv("POSTGRES_USER")
-	password := os.Getenv("POSTGRES_PASSWORD")
-	dbname := os.Getenv("POSTGRES_DB")
+func setupRouter(cluster *DBCluster, events *ProductEventBroker, store BlobStore, cfg Config) http.Handler {
+	db := cluster.Primary()
 
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
-
-	db, err := sql.Open("postgres", psqlInfo)
-	if err != nil {
-		log.Fatalf("Error al abrir la conexión a la DB: %v", err)
-	}
-	err = db.Ping()
-	if err != nil {
-		log.Fatalf("Error al hacer ping a la DB: %v", err)
-	}
-	log.Println("Conexión a la base de datos establecida exitosamente.")
-	return db
-}
-
-func setupRouter(db *sql.DB, jwtSecretKey string) http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Logger)
 	r.Use(MetricsMiddleware)
 
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"http://*", "https://*"},
+		AllowedOrigins:   cfg.CORS.AllowedOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "Content-Encoding", "X-CSRF-Token", ApiKeyHeader, "If-None-Match", "If-Modified-Since", CartTokenHeader, IdempotencyKeyHeader},
+		ExposedHeaders:   []string{"ETag", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After", "Deprecation", "Sunset", "Link", CartTokenHeader, IdempotencyReplayedHeader},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
+	// Compresión según Accept-Encoding; los cuerpos comprimidos se descomprimen
+	// antes de la validación, la idempotencia y los handlers
+	r.Use(CompressResponses(cfg.Compression))
+	r.Use(DecompressRequests(cfg.Compression))
+
+	// Rate limiting: /login por IP (fuerza bruta), /productos por usuario.
+	// Las políticas y proxies ya fueron validados en LoadConfig.
+	ipResolver, _ := NewClientIPResolver(cfg.RateLimit.TrustedProxies)
+	limiter := &RateLimiter{
+		Store:    NewMemoryRateLimitStore(),
+		Resolver: ipResolver,
+		Enabled:  cfg.RateLimit.Enabled,
+	}
+	loginPolicy, _ := ParseRateLimitPolicy("login", cfg.RateLimit.Login)
+	productsPolicy, _ := ParseRateLimitPolicy("productos", cfg.RateLimit.Products)
+
+	loginGuard := NewLoginGuard(cfg.Login, ipResolver)
+
+	// Idempotency-Key: después de la autenticación, para que las claves sean por usuario
+	idempotent := IdempotencyMiddleware(NewIdempotencyStore(cfg.Idempotency, db), ipResolver, cfg.Idempotency)
+
+	// Caché de lectura de productos; los NOTIFY de product_changes la invalidan
+	products := NewProductCache(cfg.Cache, db)
+	if products != nil {
+		events.Observe(products)
+	}
+	// Last-Modified de las lecturas del catálogo (ETag y Cache-Control en httpcache.go)
+	catalogClock := NewCatalogClock()
+	events.Observe(catalogClock)
+
+	// Claves de API: alternativa al JWT en los grupos con RequireScope
+	apiKeys := NewAPIKeyAuth(db, ipResolver, cfg.APIKeys)
+	auth := AuthMiddleware(cfg.JWT.Secret, apiKeys)
+
+	// Validación contra la especificación OpenAPI, que se genera de las rutas de abajo
+	docs := NewOpenAPIDocs(r)
+	validate := OpenAPIValidationMiddleware(docs, cfg.API)
+
+	// Rutas de la API: se definen una sola vez y se montan bajo cada versión
+	apiRoutes := func(r chi.Router) {
+		r.Group(func(r chi.Router) {
+			r.Use(limiter.PerIP(loginPolicy))
+			r.Use(validate)
+			r.Post("/login", LoginHandler(db, cfg.JWT.Secret, time.Duration(cfg.JWT.AccessTokenTTL), loginGuard, cfg.Cart))
+		})
+
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(AuthMiddleware(cfg.JWT.Secret, nil)) // Solo JWT: las claves de API no administran
+			r.Use(RequireRole(RoleAdmin))
+			r.Use(validate)
+			r.Use(idempotent)
+			r.Get("/bloqueos", ListLockoutsHandler(loginGuard))
+			r.Post("/usuarios/{username}/desbloquear", UnlockUserHandler(loginGuard))
+			r.Get("/claves-api", ListAPIKeysHandler(db))
+			r.Post("/claves-api", CreateAPIKeyHandler(db, cfg.APIKeys))
+			r.Get("/claves-api/{id}", GetAPIKeyHandler(db))
+			r.Delete("/claves-api/{id}", DeleteAPIKeyHandler(db))
+		})
+
+		r.Route("/productos", func(r chi.Router) {
+			r.Use(auth)
+			r.Use(RequireScope("/productos"))
+			r.Use(limiter.PerUser(productsPolicy))
+			r.Use(validate)
+			r.Use(idempotent)
+			r.Use(cluster.PinPrimaryAfterWrite)
+			r.Post("/", CreateProductHandler(db, products))
+			r.With(CachePolicy(cfg.HTTPCache.Products)).Get("/", GetProductsHandler(cluster, products, catalogClock, store))
+			r.Get("/stream", ProductStreamHandler(events, time.Duration(cfg.Stream.HeartbeatInterval)))
+			r.With(CachePolicy(cfg.HTTPCache.Product)).Get("/{id}", GetProductByIDHandler(cluster, products, catalogClock, store))
+			r.Put("/{id}", UpdateProductHandler(db, products))
+			r.Delete("/{id}", DeleteProductHandler(db, products, store))
+			r.Post("/{id}/imagenes", UploadProductImageHandler(db, products, store, cfg.Storage))
+			r.Get("/{id}/categorias", GetProductCategoriesHandler(cluster))
+			r.Put("/{id}/categorias", SetProductCategoriesHandler(db, products))
+			r.Get("/{id}/variantes", GetProductVariantsHandler(cluster))
+			r.Post("/{id}/variantes", CreateProductVariantHandler(db, products))
+			r.Get("/{id}/variantes/{variantID}", GetProductVariantHandler(cluster))
+			r.Put("/{id}/variantes/{variantID}", UpdateProductVariantHandler(db, products))
+			r.Delete("/{id}/variantes/{variantID}", DeleteProductVariantHandler(db, products))
+			r.Get("/{id}/precios", GetProductPricesHandler(cluster))
+			r.Put("/{id}/precios/{currency}", SetProductPriceHandler(db))
+			r.Delete("/{id}/precios/{currency}", DeleteProductPriceHandler(db))
+		})
+
+		// Variantes por SKU (consulta y ajuste de stock)
+		r.Route("/skus", func(r chi.Router) {
+			r.Use(auth)
+			r.Use(RequireScope("/skus"))
+			r.Use(limiter.PerUser(productsPolicy))
+			r.Use(validate)
+			r.Use(idempotent)
+			r.Use(cluster.PinPrimaryAfterWrite)
+			r.Get("/{sku}", GetSKUHandler(cluster))
+			r.Post("/{sku}/stock", AdjustSKUStockHandler(db, products))
+		})
+
+		// Carrito: del usuario autenticado o, sin token, del invitado (X-Cart-Token)
+		r.Route("/cart", func(r chi.Router) {
+			r.Use(OptionalAuthMiddleware(cfg.JWT.Secret))
+			r.Use(limiter.PerUser(productsPolicy))
+			r.Use(validate)
+			r.Use(idempotent)
+			r.Get("/", GetCartHandler(db))
+			r.Delete("/", ClearCartHandler(db))
+			r.Post("/items", AddCartItemHandler(db, cfg.Cart))
+			r.Put("/items/{itemID}", UpdateCartItemHandler(db, cfg.Cart))
+			r.Delete("/items/{itemID}", DeleteCartItemHandler(db, cfg.Cart))
+		})
+
+		// Pedidos: cada usuario ve los suyos; los admins ven y gestionan todos
+		r.Route("/orders", func(r chi.Router) {
+			r.Use(auth)
+			r.Use(RequireScope("/orders"))
+			r.Use(limiter.PerUser(productsPolicy))
+			r.Use(validate)
+			r.Use(idempotent)
+			r.Use(cluster.PinPrimaryAfterWrite)
+			r.Post("/", CreateOrderHandler(db))
+			r.Get("/", GetOrdersHandler(cluster))
+			r.Get("/{id}", GetOrderHandler(cluster))
+			r.Post("/{id}/status", UpdateOrderStatusHandler(db))
+		})
+
+		// Tipos de cambio para ?currency=: lectura para todos, escritura solo admin
+		r.Route("/tipos-cambio", func(r chi.Router) {
+			r.Use(auth)
+			r.Use(RequireScope("/tipos-cambio"))
+			r.Use(limiter.PerUser(productsPolicy))
+			r.Use(validate)
+			r.Use(idempotent)
+			r.Use(cluster.PinPrimaryAfterWrite)
+			r.Get("/", ListExchangeRatesHandler(cluster))
+
+			r.Group(func(r chi.Router) {
+				r.Use(RequireRole(RoleAdmin))
+				r.Put("/{base}/{quote}", SetExchangeRateHandler(db))
+				r.Delete("/{base}/{quote}", DeleteExchangeRateHandler(db))
+			})
+		})
+
+		r.Route("/webhooks", func(r chi.Router) {
+			r.Use(AuthMiddleware(cfg.JWT.Secret, nil)) // Solo JWT: las claves de API no administran
+			r.Use(RequireRole(RoleAdmin))
+			r.Use(validate)
+			r.Use(idempotent)
+			r.Get("/", ListWebhooksHandler(db))
+			r.Post("/", CreateWebhookHandler(db))
+			r.Get("/entregas", ListWebhookDeliveriesHandler(db))
+			r.Post("/entregas/{id}/reenviar", RedeliverWebhookHandler(db))
+			r.Get("/{id}", GetWebhookHandler(db))
+			r.Put("/{id}", UpdateWebhookHandler(db))
+			r.Delete("/{id}", DeleteWebhookHandler(db))
+		})
+
+		r.Route("/categorias", func(r chi.Router) {
+			r.Use(auth)
+			r.Use(RequireScope("/categorias"))
+			r.Use(limiter.PerUser(productsPolicy))
+			r.Use(validate)
+			r.Use(idempotent)
+			r.Use(cluster.PinPrimaryAfterWrite)
+			r.Get("/", GetCategoriesHandler(cluster))
+			r.Get("/{id}", GetCategoryHandler(cluster))
+			r.Get("/{id}/productos", GetCategoryProductCountsHandler(cluster))
+
+			// Escrituras: solo administradores
+			r.Group(func(r chi.Router) {
+				r.Use(RequireRole(RoleAdmin))
+				r.Post("/", CreateCategoryHandler(db))
+				r.Put("/{id}", UpdateCategoryHandler(db, products))
+				r.Delete("/{id}", DeleteCategoryHandler(db, products))
+			})
+		})
+	}
+
+	r.Route("/api/v1", func(r chi.Router) {
+		r.Use(WithAPIVersion(APIv1))
+		apiRoutes(r)
+	})
+
+	// v2: mismos handlers, precios en centavos (ver versioning.go)
+	r.Route("/api/v2", func(r chi.Router) {
+		r.Use(WithAPIVersion(APIv2))
+		apiRoutes(r)
+	})
+
+	// Rutas legacy en la raíz: alias de v1 con cabeceras Deprecation/Sunset/Link.
+	// Las fechas ya fueron validadas en LoadConfig.
+	deprecatedAt, _ := time.Parse(time.DateOnly, cfg.API.LegacyDeprecatedAt)
+	sunset, _ := time.Parse(time.DateOnly, cfg.API.LegacySunset)
 	r.Group(func(r chi.Router) {
-		r.Post("/login", LoginHandler(db, jwtSecretKey))
+		r.Use(WithAPIVersion(APIv1))
+		r.Use(DeprecatedRoutes("/api/v1", deprecatedAt, sunset))
+		apiRoutes(r)
 	})
 
-	r.Route("/productos", func(r chi.Router) {
-		r.Use(AuthMiddleware(jwtSecretKey))
-		r.Post("/", CreateProductHandler(db))
-		r.Get("/", GetProductsHandler(db))
-		r.Get("/{id}", GetProductByIDHandler(db))
-		r.Put("/{id}", UpdateProductHandler(db))
-		r.Delete("/{id}", DeleteProductHandler(db))
+	// Backend local: la propia API sirve las imágenes (públicas, sin JWT)
+	if local, ok := store.(*LocalBlobStore); ok && strings.HasPrefix(local.PublicURL, "/") {
+		r.Handle(local.PublicURL+"/*", http.StripPrefix(local.PublicURL, local))
+	}
+
+	// GraphQL: su contrato es el propio esquema (introspección), no /openapi.json.
+	// Sin PinPrimaryAfterWrite: las consultas también son POST; el handler fija
+	// el primario solo en las mutaciones.
+	r.Group(func(r chi.Router) {
+		r.Use(AuthMiddleware(cfg.JWT.Secret, nil)) // Solo JWT (los alcances de las claves son por ruta REST)
+		r.Use(limiter.PerUser(productsPolicy))
+		r.Use(idempotent)
+		graphQL := GraphQLHandler(cluster, store, cfg.GraphQL)
+		r.Get("/graphql", graphQL)
+		r.Post("/graphql", graphQL)
 	})
 
 	r.Handle("/metrics", promhttp.Handler())
+
+	// Especificación OpenAPI generada de las rutas anteriores y Swagger UI (públicas)
+	r.Get("/openapi.json", OpenAPIHandler(docs))
+	r.Get("/docs", APIDocsHandler())
+	r.Get("/docs/{asset}", APIDocsAssetHandler())
 	return r
 }
 
@@ -72,21 +265,132 @@ func main() {
 	// Carga el .env solo en desarrollo (en producción las vars ya están en el sistema)
 	_ = godotenv.Load()
 
-	jwtSecretKey := os.Getenv("JWT_SECRET")
-	if jwtSecretKey == "" {
-		log.Fatal("JWT_SECRET no está definido en las variables de entorno")
+	flags, err := parseFlags(os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
+
+	// El código de salida se decide aquí, después de que los defer de run
+	// cerraran el listener, las conexiones y la señal
+	if err := run(flags); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+// run arranca la API y bloquea hasta el apagado. Devuelve el error que impidió
+// arrancar o que detuvo alguno de los servidores.
+func run(flags configFlags) error {
+	cfg, err := LoadConfig(flags)
+	if flags.printConfig {
+		if printErr := PrintConfig(os.Stdout, cfg); printErr != nil {
+			return printErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("configuración inválida:\n%w", err)
+	}
+	if flags.printConfig {
+		return nil
+	}
+
+	level, _ := cfg.SlogLevel()
+	slog.SetLogLoggerLevel(level)
+	defaultQueryTimeout = time.Duration(cfg.Database.QueryTimeout)
+	exportQueryTimeout = time.Duration(cfg.Database.ExportTimeout)
+	defaultCurrency, _ = normalizeCurrency(cfg.Money.DefaultCurrency)
+	// Precalcular el hash de relleno para que el primer login de un usuario
+	// inexistente no tarde más que los demás
+	dummyPasswordHash()
+
+	// ctx se cancela al recibir SIGINT (Ctrl+C) o SIGTERM (Docker/Kubernetes)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := setupDB(ctx, cfg.Database)
+	if err != nil {
+		return fmt.Errorf("error al conectar con la DB: %w", err)
+	}
+	replicas, err := setupReplicas(cfg.Database)
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("error al configurar las réplicas: %w", err)
+	}
+	cluster := NewDBCluster(db, replicas, time.Duration(cfg.Database.ReadAfterWriteWindow))
+	// Las conexiones se cierran DESPUÉS de drenar las peticiones en vuelo
+	defer cluster.Close()
+	go cluster.StartHealthChecks(ctx, time.Duration(cfg.Database.ReplicaHealthInterval))
+
+	// Despachador de webhooks: se detiene con la señal de apagado
+	if cfg.Webhooks.Enabled {
+		go NewWebhookDispatcher(db, cfg.Webhooks).Run(ctx)
 	}
 
-	db := setupDB()
-	defer db.Close()
+	// Limpieza periódica de carritos vencidos
+	go RunCartPurger(ctx, db, time.Duration(cfg.Cart.PurgeInterval))
+	if cfg.Idempotency.Backend == "postgres" {
+		go RunIdempotencyPurger(ctx, db, time.Duration(cfg.Idempotency.PurgeInterval))
+	}
 
-	router := setupRouter(db, jwtSecretKey)
-	log.Println("Servidor escuchando en :8080...")
-	err := http.ListenAndServe(":8080", router)
+	// Stream de cambios: LISTEN en el primario; al apagar se desconectan los clientes SSE
+	events := NewProductEventBroker(cfg.Stream)
+	pgListener, err := StartProductChangesListener(ctx, cfg.Database.DSN(), events)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("error al iniciar el stream de productos: %w", err)
 	}
+	defer pgListener.Close()
+
+	// Almacenamiento de imágenes (disco local o S3/MinIO)
+	store, err := NewBlobStore(ctx, cfg.Storage)
+	if err != nil {
+		return fmt.Errorf("error al configurar el almacenamiento: %w", err)
+	}
+
+	// baseCtx solo se cancela si el drenado excede el plazo
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
+	router := setupRouter(cluster, events, store, cfg)
+	server := setupServer(baseCtx, router, cfg)
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("error al escuchar en %s: %w", server.Addr, err)
+	}
+
+	// gRPC en su propio puerto; se apaga con la misma señal que el HTTP.
+	// grpcErr se lee después de <-grpcDone
+	grpcDone := make(chan struct{})
+	var grpcErr error
+	if cfg.GRPC.Enabled {
+		grpcListener, err := net.Listen("tcp", cfg.GRPC.ListenAddr)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("error al escuchar en %s: %w", cfg.GRPC.ListenAddr, err)
+		}
+		grpcServer := NewGRPCServer(cluster, store, cfg.JWT.Secret)
+		slog.Info("Servidor gRPC escuchando", "addr", cfg.GRPC.ListenAddr)
+		go func() {
+			defer close(grpcDone)
+			if err := runGRPCServer(ctx, grpcServer, grpcListener, time.Duration(cfg.HTTP.ShutdownTimeout)); err != nil {
+				grpcErr = fmt.Errorf("error del servidor gRPC: %w", err)
+				stop()
+			}
+		}()
+	} else {
+		close(grpcDone)
+	}
+
+	slog.Info("Servidor escuchando", "addr", server.Addr)
+	err = runServer(ctx, server, listener, cancelBase, time.Duration(cfg.HTTP.ShutdownTimeout))
+	if err != nil {
+		err = fmt.Errorf("error del servidor: %w", err)
+	}
+	stop() // Si el HTTP terminó por un error, también se detiene gRPC
+	<-grpcDone
+	return errors.Join(err, grpcErr)
 }
+
 /*
  * CLASE: ENRUTAMIENTO PROFESIONAL (FASE 3 - CHI)
  *
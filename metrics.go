@@ -40,6 +40,59 @@ var httpRequestsInFlight = promauto.NewGauge(
 	},
 )
 
+// 4. Gauge: Estado de salud de cada réplica de lectura (1 = sana, 0 = fuera de servicio)
+var dbReplicaHealthy = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "db_replica_healthy",
+		Help: "Estado de salud de las réplicas de lectura de PostgreSQL",
+	},
+	[]string{"replica"},
+)
+
+// 5. Counter: Peticiones rechazadas por el rate limiter
+var rateLimitedTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "http_rate_limited_total",
+		Help: "Total de peticiones rechazadas con 429 por el rate limiter",
+	},
+	[]string{"policy"},
+)
+
+// 6. Counter: Eventos de seguridad (logins, bloqueos, desbloqueos)
+var securityEventsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "security_events_total",
+		Help: "Total de eventos de seguridad por tipo",
+	},
+	[]string{"type"},
+)
+
+// 7. Counter: Intentos de entrega de webhooks por resultado (delivered, retry, dead)
+var webhookDeliveriesTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "webhook_deliveries_total",
+		Help: "Total de intentos de entrega de webhooks por resultado",
+	},
+	[]string{"result"},
+)
+
+// 8. Gauge: Clientes conectados a GET /productos/stream
+var sseClientsConnected = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "sse_clients_connected",
+		Help: "Número de clientes conectados al stream de cambios de productos",
+	},
+)
+
+// 9. Counter: Lecturas de la caché de productos (entry: producto | lista; result: hit | miss | error)
+var cacheRequestsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "product_cache_requests_total",
+		Help: "Total de lecturas de la caché de productos por resultado",
+	},
+	[]string{"entry", "result"},
+)
+
 // ====================================================================
 // RESPONSE WRITER PERSONALIZADO
 // ====================================================================
@@ -55,6 +108,11 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap permite a http.ResponseController llegar al writer original (Flush, deadlines).
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // ====================================================================
 // MIDDLEWARE DE MÉTRICAS
 // ====================================================================
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ====================================================================
+// DINERO
+// Los importes se guardan como enteros en la unidad menor de la moneda
+// (centavos para USD, yenes para JPY) junto con su código ISO-4217, así
+// las sumas son exactas. En JSON el importe viaja como string decimal
+// ("19.99") para que ningún cliente lo convierta a float.
+// ====================================================================
+
+// defaultCurrency: Moneda de los productos que no indican una (configurable con DEFAULT_CURRENCY).
+var defaultCurrency = "USD"
+
+// currencyExponents: Decimales de cada moneda soportada (ISO-4217).
+var currencyExponents = map[string]int{
+	"USD": 2, "EUR": 2, "GBP": 2, "CHF": 2, "CAD": 2, "AUD": 2, "CNY": 2,
+	"MXN": 2, "ARS": 2, "BRL": 2, "COP": 2, "PEN": 2, "UYU": 2, "BOB": 2, "DOP": 2, "GTQ": 2,
+	"CLP": 0, "PYG": 0, "JPY": 0, "KRW": 0,
+	"KWD": 3, "BHD": 3,
+}
+
+var (
+	ErrUnknownCurrency = errors.New("moneda no soportada")
+	ErrInvalidAmount   = errors.New("importe inválido")
+)
+
+// Money: Importe exacto en unidades menores de Currency.
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// currencyExponent devuelve los decimales de la moneda o ErrUnknownCurrency.
+func currencyExponent(currency string) (int, error) {
+	exp, ok := currencyExponents[currency]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownCurrency, currency)
+	}
+	return exp, nil
+}
+
+// normalizeCurrency pasa el código a mayúsculas y comprueba que esté soportado.
+func normalizeCurrency(currency string) (string, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if _, err := currencyExponent(currency); err != nil {
+		return "", err
+	}
+	return currency, nil
+}
+
+// ParseMoney interpreta un decimal ("19.99", "1500", "-0.5") sin pasar por float.
+// Rechaza más decimales de los que admite la moneda.
+func ParseMoney(amount, currency string) (Money, error) {
+	currency, err := normalizeCurrency(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	exp, _ := currencyExponent(currency)
+
+	amount = strings.TrimSpace(amount)
+	negative := strings.HasPrefix(amount, "-")
+	digits := strings.TrimPrefix(amount, "-")
+	whole, fraction, hasPoint := strings.Cut(digits, ".")
+	if whole == "" || (hasPoint && fraction == "") || len(fraction) > exp || !isDigits(whole) || !isDigits(fraction) {
+		return Money{}, fmt.Errorf("%w %q para %s", ErrInvalidAmount, amount, currency)
+	}
+
+	minor, err := strconv.ParseInt(whole+fraction+strings.Repeat("0", exp-len(fraction)), 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("%w %q: %v", ErrInvalidAmount, amount, err)
+	}
+	if negative {
+		minor = -minor
+	}
+	return Money{Amount: minor, Currency: currency}, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String devuelve el importe como decimal con los decimales de la moneda ("19.99").
+func (m Money) String() string {
+	exp, err := currencyExponent(m.Currency)
+	if err != nil || exp == 0 {
+		return strconv.FormatInt(m.Amount, 10)
+	}
+
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	digits := fmt.Sprintf("%0*d", exp+1, amount)
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// Float64 aproxima el importe en unidades mayores. Solo para la representación
+// legacy de /api/v1; nunca para hacer cuentas.
+func (m Money) Float64() float64 {
+	f, _ := strconv.ParseFloat(m.String(), 64)
+	return f
+}
+
+// MarshalJSON: {"amount":"19.99","currency":"USD"}
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.String(), m.Currency})
+}
+
+// UnmarshalJSON acepta el importe como string ("19.99") o como número literal (19.99);
+// en ambos casos se lee el texto, nunca un float.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Amount   json.RawMessage `json:"amount"`
+		Currency string          `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	amount, err := decimalText(raw.Amount)
+	if err != nil {
+		return err
+	}
+	parsed, err := ParseMoney(amount, raw.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// decimalText extrae el texto de un importe JSON escrito como "19.99" o 19.99.
+func decimalText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", fmt.Errorf("%w: falta el importe", ErrInvalidAmount)
+	}
+	if raw[0] == '"' {
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidAmount, raw)
+	}
+	return n.String(), nil
+}
+
+// ====================================================================
+// CONVERSIÓN DE MONEDA
+// ====================================================================
+
+// ErrNoExchangeRate: No hay tipo de cambio entre las dos monedas.
+var ErrNoExchangeRate = errors.New("no hay tipo de cambio")
+
+// ExchangeRates: Tipos de cambio por par ("USD" -> "EUR" -> 0.92), 1 base = rate quote.
+type ExchangeRates map[string]map[string]*big.Rat
+
+// Set registra un tipo de cambio.
+func (rates ExchangeRates) Set(base, quote string, rate *big.Rat) {
+	if rates[base] == nil {
+		rates[base] = make(map[string]*big.Rat)
+	}
+	rates[base][quote] = rate
+}
+
+// rate busca el par directo y, si no existe, el inverso.
+func (rates ExchangeRates) rate(from, to string) (*big.Rat, bool) {
+	if from == to {
+		return big.NewRat(1, 1), true
+	}
+	if rate, ok := rates[from][to]; ok {
+		return rate, true
+	}
+	if rate, ok := rates[to][from]; ok && rate.Sign() > 0 {
+		return new(big.Rat).Inv(rate), true
+	}
+	return nil, false
+}
+
+// Convert convierte m a la moneda to, redondeando a la unidad menor (mitades hacia afuera).
+func (rates ExchangeRates) Convert(m Money, to string) (Money, error) {
+	if m.Currency == to {
+		return m, nil
+	}
+	rate, ok := rates.rate(m.Currency, to)
+	if !ok {
+		return Money{}, fmt.Errorf("%w %s → %s", ErrNoExchangeRate, m.Currency, to)
+	}
+	fromExp, err := currencyExponent(m.Currency)
+	if err != nil {
+		return Money{}, err
+	}
+	toExp, err := currencyExponent(to)
+	if err != nil {
+		return Money{}, err
+	}
+
+	// amount * rate * 10^(toExp - fromExp)
+	value := new(big.Rat).Mul(new(big.Rat).SetInt64(m.Amount), rate)
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(toExp-fromExp))), nil)
+	if toExp >= fromExp {
+		value.Mul(value, new(big.Rat).SetInt(scale))
+	} else {
+		value.Quo(value, new(big.Rat).SetInt(scale))
+	}
+	return Money{Amount: roundRat(value), Currency: to}, nil
+}
+
+// roundRat redondea al entero más cercano; las mitades se alejan de cero.
+func roundRat(r *big.Rat) int64 {
+	num, den := new(big.Int).Set(r.Num()), r.Denom()
+	negative := num.Sign() < 0
+	num.Abs(num)
+	quotient, remainder := new(big.Int).QuoRem(num, den, new(big.Int))
+	if remainder.Mul(remainder, big.NewInt(2)).Cmp(den) >= 0 {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+	if negative {
+		quotient.Neg(quotient)
+	}
+	return quotient.Int64()
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
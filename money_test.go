@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"testing"
+)
+
+// Test: Los importes se leen y escriben sin pasar por float
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		amount, currency string
+		want             Money
+		text             string
+	}{
+		{"19.99", "usd", Money{1999, "USD"}, "19.99"},
+		{"0.1", "EUR", Money{10, "EUR"}, "0.10"},
+		{"1500", "CLP", Money{1500, "CLP"}, "1500"},
+		{"-0.5", "USD", Money{-50, "USD"}, "-0.50"},
+		{"1.234", "KWD", Money{1234, "KWD"}, "1.234"},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.amount, tt.currency)
+		if err != nil {
+			t.Errorf("ParseMoney(%q, %q): %v", tt.amount, tt.currency, err)
+			continue
+		}
+		if got != tt.want || got.String() != tt.text {
+			t.Errorf("ParseMoney(%q, %q) = %+v (%s), want %+v (%s)", tt.amount, tt.currency, got, got, tt.want, tt.text)
+		}
+	}
+
+	for _, bad := range [][2]string{{"19.999", "USD"}, {"1.5", "JPY"}, {"1e3", "USD"}, {"", "USD"}, {"1.", "USD"}, {"10", "XXX"}} {
+		if _, err := ParseMoney(bad[0], bad[1]); err == nil {
+			t.Errorf("ParseMoney(%q, %q) debe fallar", bad[0], bad[1])
+		}
+	}
+}
+
+// Test: En JSON el importe viaja como string y acepta también un número literal
+func TestMoneyJSON(t *testing.T) {
+	data, err := json.Marshal(Money{Amount: 1999, Currency: "USD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"amount":"19.99","currency":"USD"}` {
+		t.Errorf("JSON incorrecto: %s", data)
+	}
+
+	for _, input := range []string{`{"amount":"0.30","currency":"USD"}`, `{"amount":0.30,"currency":"usd"}`} {
+		var m Money
+		if err := json.Unmarshal([]byte(input), &m); err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		if m != (Money{Amount: 30, Currency: "USD"}) {
+			t.Errorf("%s: got %+v", input, m)
+		}
+	}
+
+	var m Money
+	if err := json.Unmarshal([]byte(`{"amount":"0.305","currency":"USD"}`), &m); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("Se esperaba ErrInvalidAmount: got %v", err)
+	}
+}
+
+// Test: Los tipos de cambio son decimales planos que caben en NUMERIC(20, 10)
+func TestParseRate(t *testing.T) {
+	for _, valid := range []string{"0.92", "1", "149.5", "9999999999.9999999999", " 0.0001 "} {
+		if _, err := parseRate(valid); err != nil {
+			t.Errorf("%q: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"", "0", "0.0", "-1", "1/3", "1e400", "1e2", ".5", "1.", "12345678901", "0.12345678901", "Inf"} {
+		if _, err := parseRate(invalid); err == nil {
+			t.Errorf("%q debía rechazarse", invalid)
+		}
+	}
+}
+
+// Test: La conversión redondea a la unidad menor y usa el par inverso si hace falta
+func TestExchangeRatesConvert(t *testing.T) {
+	rates := make(ExchangeRates)
+	rates.Set("USD", "EUR", big.NewRat(92, 100))
+	rates.Set("USD", "JPY", big.NewRat(15025, 100))
+
+	tests := []struct {
+		from Money
+		to   string
+		want Money
+	}{
+		{Money{1999, "USD"}, "EUR", Money{1839, "EUR"}}, // 18.3908 -> 18.39
+		{Money{25, "USD"}, "EUR", Money{23, "EUR"}},     // 0.23
+		{Money{1999, "USD"}, "JPY", Money{3003, "JPY"}}, // 3003.4975 -> 3003
+		{Money{1000, "EUR"}, "USD", Money{1087, "USD"}}, // 10 / 0.92 = 10.8695...
+		{Money{150, "JPY"}, "USD", Money{100, "USD"}},   // 150 / 150.25 = 0.998...
+		{Money{500, "USD"}, "USD", Money{500, "USD"}},
+	}
+	for _, tt := range tests {
+		got, err := rates.Convert(tt.from, tt.to)
+		if err != nil {
+			t.Errorf("Convert(%+v, %s): %v", tt.from, tt.to, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Convert(%+v, %s) = %+v, want %+v", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	if _, err := rates.Convert(Money{100, "GBP"}, "EUR"); !errors.Is(err, ErrNoExchangeRate) {
+		t.Errorf("Se esperaba ErrNoExchangeRate: got %v", err)
+	}
+}
+
+// Test: Las mitades se redondean alejándose de cero
+func TestRoundRat(t *testing.T) {
+	tests := map[string]int64{"5/2": 3, "-5/2": -3, "7/3": 2, "-7/3": -2, "0": 0}
+	for in, want := range tests {
+		r, _ := new(big.Rat).SetString(in)
+		if got := roundRat(r); got != want {
+			t.Errorf("roundRat(%s) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+// Test: El precio de lista tiene prioridad sobre la conversión y el rango sigue al precio
+func TestLocalizeProduct(t *testing.T) {
+	rates := make(ExchangeRates)
+	rates.Set("USD", "EUR", big.NewRat(1, 2))
+
+	listed := Product{ID: 1, Price: Money{1999, "USD"}, PriceRange: &PriceRange{Money{1999, "USD"}, Money{1999, "USD"}}}
+	if err := localizeProduct(&listed, "EUR", map[int]int64{1: 1500}, rates); err != nil {
+		t.Fatal(err)
+	}
+	if listed.Price != (Money{1500, "EUR"}) || listed.PriceRange.Max != (Money{1500, "EUR"}) {
+		t.Errorf("Debe usarse el precio de lista: %+v %+v", listed.Price, listed.PriceRange)
+	}
+
+	withVariants := Product{ID: 2, Price: Money{1000, "USD"}, PriceRange: &PriceRange{Money{1000, "USD"}, Money{1250, "USD"}}, hasVariants: true}
+	if err := localizeProduct(&withVariants, "EUR", nil, rates); err != nil {
+		t.Fatal(err)
+	}
+	if withVariants.Price != (Money{500, "EUR"}) || withVariants.PriceRange.Max != (Money{625, "EUR"}) {
+		t.Errorf("Conversión incorrecta: %+v %+v", withVariants.Price, withVariants.PriceRange)
+	}
+
+	if err := localizeProduct(&Product{Price: Money{100, "USD"}}, "JPY", nil, rates); !errors.Is(err, ErrNoExchangeRate) {
+		t.Errorf("Se esperaba ErrNoExchangeRate: got %v", err)
+	}
+}
+
+// Test: Una moneda no soportada en ?currency= es 400
+func TestProductsUnknownCurrency(t *testing.T) {
+	router, token := newVersioningTestRouter(t)
+
+	for _, path := range []string{"/api/v2/productos?currency=XYZ", "/api/v2/productos/1?currency=12"} {
+		if rr := getWithToken(router, path, token); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d want 400", path, rr.Code)
+		}
+	}
+	// En la moneda del producto no hace falta convertir
+	if rr := getWithToken(router, "/api/v2/productos?currency=usd", token); rr.Code != http.StatusOK {
+		t.Errorf("currency=usd: got %d want 200 (%s)", rr.Code, rr.Body.String())
+	}
+}
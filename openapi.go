@@ -0,0 +1,717 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	swaggerFiles "github.com/swaggo/files/v2"
+)
+
+// ====================================================================
+// ESPECIFICACIÓN OPENAPI 3.1
+// Las rutas salen del router (chi.Walk) y los esquemas de los tipos Go por
+// reflexión (etiquetas json). Lo único escrito a mano es apiOperations: resumen,
+// parámetros de query y tipos de cuerpo de cada operación. Un test falla si una
+// ruta del router no tiene entrada aquí.
+// ====================================================================
+
+// apiAuth: Qué identidad exige una operación.
+type apiAuth int
+
+const (
+	authRequired apiAuth = iota // JWT obligatorio (AuthMiddleware)
+	authAdmin                   // JWT con rol admin (RequireRole)
+	authOptional                // JWT opcional (OptionalAuthMiddleware)
+	authNone                    // Pública
+)
+
+// apiParam: Parámetro de query o cabecera.
+type apiParam struct {
+	Name        string
+	Type        string // string, integer, boolean
+	Description string
+}
+
+// versioned: Cuerpo con representación distinta en v1 y v2 (ver versioning.go).
+type versioned struct {
+	V1, V2 any
+}
+
+// apiOperation describe una operación. Request y Response son valores del tipo Go
+// del cuerpo (solo importa el tipo); nil significa sin cuerpo.
+type apiOperation struct {
+	Summary             string
+	Tag                 string
+	Auth                apiAuth
+	Query               []apiParam
+	Headers             []apiParam
+	Request             any
+	RequestContentType  string   // Por defecto application/json
+	Required            []string // Campos obligatorios del cuerpo
+	Status              int      // Código de éxito; 0 = 200
+	Response            any
+	ResponseContentType string // Por defecto application/json
+	Errors              []int
+	Conditional         bool     // Admite If-None-Match / If-Modified-Since (304, ver httpcache.go)
+	AlternateFormats    []string // Otros tipos de la respuesta según Accept (ver productformats.go)
+}
+
+var (
+	currencyQuery = apiParam{"currency", "string", "Convierte los precios a esta moneda (ISO-4217)"}
+	cartToken     = apiParam{CartTokenHeader, "string", "Carrito de invitado (sin JWT)"}
+
+	productBody  = versioned{V1: ProductV1{}, V2: ProductV2{}}
+	productsBody = versioned{V1: []ProductV1{}, V2: []ProductV2{}}
+	variantBody  = versioned{V1: ProductVariantV1{}, V2: ProductVariantV2{}}
+	variantsBody = versioned{V1: []ProductVariantV1{}, V2: []ProductVariantV2{}}
+)
+
+// apiOperations: "MÉTODO /ruta" relativa al prefijo de versión, como en apiRoutes.
+var apiOperations = map[string]apiOperation{
+	// Autenticación y administración
+	"POST /login": {Summary: "Inicia sesión y devuelve un JWT", Tag: "Autenticación", Auth: authNone,
+		Headers: []apiParam{{CartTokenHeader, "string", "Carrito de invitado a fusionar con el del usuario"}},
+		Request: LoginRequest{}, Required: []string{"username", "password"}, Response: LogingResponse{},
+		Errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusTooManyRequests}},
+	"GET /admin/bloqueos": {Summary: "Lista usuarios e IPs bloqueados por intentos fallidos", Tag: "Administración", Auth: authAdmin,
+		Response: []LoginLockout{}},
+	"POST /admin/usuarios/{username}/desbloquear": {Summary: "Desbloquea un usuario", Tag: "Administración", Auth: authAdmin,
+		Query:  []apiParam{{"ip", "string", "Desbloquea también esta IP"}},
+		Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}},
+	"GET /admin/claves-api": {Summary: "Lista las claves de API (sin secretos)", Tag: "Administración", Auth: authAdmin,
+		Response: []APIKey{}},
+	"POST /admin/claves-api": {Summary: "Crea una clave de API; la respuesta es la única que la incluye", Tag: "Administración", Auth: authAdmin,
+		Request: APIKey{}, Required: []string{"name", "scopes"}, Status: http.StatusCreated, Response: APIKey{},
+		Errors: []int{http.StatusBadRequest}},
+	"GET /admin/claves-api/{id}": {Summary: "Obtiene una clave de API (sin secreto)", Tag: "Administración", Auth: authAdmin,
+		Response: APIKey{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /admin/claves-api/{id}": {Summary: "Revoca una clave de API", Tag: "Administración", Auth: authAdmin,
+		Status: http.StatusNoContent, Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+
+	// Productos
+	"POST /productos": {Summary: "Crea un producto", Tag: "Productos",
+		Request: productInput{}, Required: []string{"name"}, Status: http.StatusCreated, Response: productBody,
+		Errors: []int{http.StatusBadRequest}},
+	"GET /productos": {Summary: "Lista los productos", Tag: "Productos",
+		Query: []apiParam{
+			{"categoria", "string", "Slug de la categoría"},
+			{"include_descendants", "boolean", "Incluye los productos de las subcategorías"},
+			currencyQuery,
+		},
+		Response: productsBody, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusNotAcceptable, http.StatusUnprocessableEntity}, Conditional: true,
+		AlternateFormats: []string{mediaTypeNDJSON, mediaTypeCSV}},
+	"GET /productos/stream": {Summary: "Cambios de productos en tiempo real (SSE)", Tag: "Productos",
+		Query: []apiParam{
+			{"ids", "string", "IDs separados por coma"},
+			{"last_event_id", "integer", "Reanuda desde este evento (alternativa a Last-Event-ID)"},
+		},
+		Headers:  []apiParam{{"Last-Event-ID", "integer", "Último evento recibido"}},
+		Response: ProductEvent{}, ResponseContentType: "text/event-stream", Errors: []int{http.StatusBadRequest}},
+	"GET /productos/{id}": {Summary: "Obtiene un producto", Tag: "Productos",
+		Query:    []apiParam{currencyQuery},
+		Response: productBody, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity}, Conditional: true},
+	"PUT /productos/{id}": {Summary: "Actualiza un producto", Tag: "Productos",
+		Request: productInput{}, Required: []string{"name"}, Response: productBody,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /productos/{id}": {Summary: "Elimina un producto", Tag: "Productos",
+		Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}},
+	"POST /productos/{id}/imagenes": {Summary: "Sube una imagen (JPEG, PNG o WebP)", Tag: "Productos",
+		Request: imageUpload{}, RequestContentType: "multipart/form-data", Required: []string{ImageFormField},
+		Status: http.StatusCreated, Response: ProductImage{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType}},
+	"GET /productos/{id}/categorias": {Summary: "Categorías del producto", Tag: "Categorías",
+		Response: []Category{}, Errors: []int{http.StatusNotFound}},
+	"PUT /productos/{id}/categorias": {Summary: "Reemplaza las categorías del producto", Tag: "Categorías",
+		Request: ProductCategoriesRequest{}, Required: []string{"category_ids"}, Status: http.StatusNoContent,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+
+	// Variantes y SKU
+	"GET /productos/{id}/variantes": {Summary: "Variantes del producto", Tag: "Variantes",
+		Response: variantsBody, Errors: []int{http.StatusNotFound}},
+	"POST /productos/{id}/variantes": {Summary: "Crea una variante", Tag: "Variantes",
+		Request: variantInput{}, Required: []string{"sku"}, Status: http.StatusCreated, Response: variantBody,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict}},
+	"GET /productos/{id}/variantes/{variantID}": {Summary: "Obtiene una variante", Tag: "Variantes",
+		Response: variantBody, Errors: []int{http.StatusNotFound}},
+	"PUT /productos/{id}/variantes/{variantID}": {Summary: "Actualiza una variante", Tag: "Variantes",
+		Request: variantInput{}, Required: []string{"sku"}, Response: variantBody,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict}},
+	"DELETE /productos/{id}/variantes/{variantID}": {Summary: "Elimina una variante", Tag: "Variantes",
+		Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}},
+	"GET /skus/{sku}": {Summary: "Obtiene una variante por SKU", Tag: "Variantes",
+		Response: variantBody, Errors: []int{http.StatusNotFound}},
+	"POST /skus/{sku}/stock": {Summary: "Ajusta el stock de una variante", Tag: "Variantes",
+		Request: StockAdjustmentRequest{}, Required: []string{"delta"}, Response: variantBody,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict}},
+
+	// Precios y monedas
+	"GET /productos/{id}/precios": {Summary: "Precios de lista del producto", Tag: "Precios",
+		Response: []Money{}},
+	"PUT /productos/{id}/precios/{currency}": {Summary: "Fija el precio de lista en una moneda", Tag: "Precios",
+		Request: ProductPriceRequest{}, Required: []string{"amount"}, Response: Money{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /productos/{id}/precios/{currency}": {Summary: "Elimina el precio de lista en una moneda", Tag: "Precios",
+		Status: http.StatusNoContent, Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"GET /tipos-cambio": {Summary: "Lista los tipos de cambio", Tag: "Precios",
+		Response: []ExchangeRate{}},
+	"PUT /tipos-cambio/{base}/{quote}": {Summary: "Crea o actualiza un tipo de cambio", Tag: "Precios", Auth: authAdmin,
+		Request: ExchangeRateRequest{}, Required: []string{"rate"}, Response: ExchangeRate{},
+		Errors: []int{http.StatusBadRequest}},
+	"DELETE /tipos-cambio/{base}/{quote}": {Summary: "Elimina un tipo de cambio", Tag: "Precios", Auth: authAdmin,
+		Status: http.StatusNoContent, Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+
+	// Carrito
+	"GET /cart": {Summary: "Contenido del carrito", Tag: "Carrito", Auth: authOptional,
+		Query: []apiParam{currencyQuery}, Headers: []apiParam{cartToken},
+		Response: Cart{}, Errors: []int{http.StatusBadRequest, http.StatusUnprocessableEntity}},
+	"DELETE /cart": {Summary: "Vacía el carrito", Tag: "Carrito", Auth: authOptional,
+		Headers: []apiParam{cartToken}, Status: http.StatusNoContent},
+	"POST /cart/items": {Summary: "Agrega un producto al carrito", Tag: "Carrito", Auth: authOptional,
+		Query: []apiParam{currencyQuery}, Headers: []apiParam{cartToken},
+		Request: CartItemRequest{}, Required: []string{"product_id", "quantity"}, Response: Cart{},
+		Errors: []int{http.StatusBadRequest, http.StatusUnprocessableEntity}},
+	"PUT /cart/items/{itemID}": {Summary: "Cambia la cantidad de un ítem (0 lo quita)", Tag: "Carrito", Auth: authOptional,
+		Query: []apiParam{currencyQuery}, Headers: []apiParam{cartToken},
+		Request: CartItemRequest{}, Required: []string{"quantity"}, Response: Cart{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /cart/items/{itemID}": {Summary: "Quita un ítem del carrito", Tag: "Carrito", Auth: authOptional,
+		Headers: []apiParam{cartToken}, Status: http.StatusNoContent, Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+
+	// Pedidos
+	"POST /orders": {Summary: "Crea un pedido descontando el stock", Tag: "Pedidos",
+		Request: OrderRequest{}, Required: []string{"items"}, Status: http.StatusCreated, Response: Order{},
+		Errors: []int{http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity}},
+	"GET /orders": {Summary: "Lista los pedidos (todos si es admin)", Tag: "Pedidos",
+		Query: []apiParam{
+			{"status", "string", "Filtra por estado"},
+			{"user_id", "integer", "Filtra por usuario (solo admin)"},
+		},
+		Response: []Order{}, Errors: []int{http.StatusBadRequest}},
+	"GET /orders/{id}": {Summary: "Obtiene un pedido", Tag: "Pedidos",
+		Response: Order{}, Errors: []int{http.StatusNotFound}},
+	"POST /orders/{id}/status": {Summary: "Cambia el estado de un pedido", Tag: "Pedidos",
+		Request: OrderStatusRequest{}, Required: []string{"status"}, Response: Order{},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict}},
+
+	// Webhooks
+	"GET /webhooks": {Summary: "Lista las suscripciones", Tag: "Webhooks", Auth: authAdmin,
+		Response: []WebhookSubscription{}},
+	"POST /webhooks": {Summary: "Crea una suscripción", Tag: "Webhooks", Auth: authAdmin,
+		Request: WebhookSubscription{}, Required: []string{"url", "events"}, Status: http.StatusCreated, Response: WebhookSubscription{},
+		Errors: []int{http.StatusBadRequest}},
+	"GET /webhooks/entregas": {Summary: "Lista las entregas", Tag: "Webhooks", Auth: authAdmin,
+		Query:    []apiParam{{"estado", "string", "pending, delivered o dead"}},
+		Response: []WebhookDelivery{}, Errors: []int{http.StatusBadRequest}},
+	"POST /webhooks/entregas/{id}/reenviar": {Summary: "Reencola una entrega", Tag: "Webhooks", Auth: authAdmin,
+		Status: http.StatusAccepted, Errors: []int{http.StatusNotFound}},
+	"GET /webhooks/{id}": {Summary: "Obtiene una suscripción", Tag: "Webhooks", Auth: authAdmin,
+		Response: WebhookSubscription{}, Errors: []int{http.StatusNotFound}},
+	"PUT /webhooks/{id}": {Summary: "Actualiza una suscripción", Tag: "Webhooks", Auth: authAdmin,
+		Request: WebhookSubscription{}, Required: []string{"url", "events"}, Response: WebhookSubscription{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	"DELETE /webhooks/{id}": {Summary: "Elimina una suscripción", Tag: "Webhooks", Auth: authAdmin,
+		Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}},
+
+	// Categorías
+	"GET /categorias": {Summary: "Árbol completo de categorías", Tag: "Categorías",
+		Response: []CategoryNode{}},
+	"GET /categorias/{id}": {Summary: "Obtiene una categoría", Tag: "Categorías",
+		Response: Category{}, Errors: []int{http.StatusNotFound}},
+	"GET /categorias/{id}/productos": {Summary: "Conteo de productos de la categoría y sus descendientes", Tag: "Categorías",
+		Response: []CategoryCount{}, Errors: []int{http.StatusNotFound}},
+	"POST /categorias": {Summary: "Crea una categoría", Tag: "Categorías", Auth: authAdmin,
+		Request: Category{}, Required: []string{"name"}, Status: http.StatusCreated, Response: Category{},
+		Errors: []int{http.StatusBadRequest, http.StatusConflict}},
+	"PUT /categorias/{id}": {Summary: "Actualiza una categoría", Tag: "Categorías", Auth: authAdmin,
+		Request: Category{}, Required: []string{"name"}, Response: Category{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict}},
+	"DELETE /categorias/{id}": {Summary: "Elimina una categoría", Tag: "Categorías", Auth: authAdmin,
+		Status: http.StatusNoContent, Errors: []int{http.StatusNotFound, http.StatusConflict}},
+}
+
+// imageUpload: Formulario multipart de POST /productos/{id}/imagenes.
+type imageUpload struct {
+	Image []byte `json:"imagen"`
+}
+
+// apiPathParams: Tipo de cada parámetro de ruta de chi.
+var apiPathParams = map[string]string{
+	"id": "integer", "variantID": "integer", "itemID": "integer",
+	"sku": "string", "currency": "string", "base": "string", "quote": "string", "username": "string",
+}
+
+// apiVersionPrefixes: Prefijos con los que setupRouter monta apiRoutes.
+var apiVersionPrefixes = map[APIVersion]string{APIv1: "/api/v1", APIv2: "/api/v2"}
+
+// openAPIExcluded: Rutas del router que no forman parte de la API.
+var openAPIExcluded = map[string]bool{
+	"/metrics":      true,
+	"/openapi.json": true,
+	"/docs":         true,
+	"/docs/{asset}": true,
+	"/graphql":      true, // Se describe con su esquema GraphQL (introspección)
+}
+
+// ====================================================================
+// GENERACIÓN
+// ====================================================================
+
+// apiRoute: Ruta del router traducida a su operación.
+type apiRoute struct {
+	Method  string
+	Path    string // Ruta completa, sin "/" final
+	Key     string // Clave en apiOperations
+	Version APIVersion
+	Legacy  bool
+}
+
+// walkAPIRoutes recorre el router y devuelve las rutas de la API en orden estable.
+// Las montadas con comodín (p. ej. las imágenes locales) no son de la API.
+func walkAPIRoutes(routes chi.Routes) ([]apiRoute, error) {
+	var result []apiRoute
+	err := chi.Walk(routes, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if openAPIExcluded[route] || strings.HasSuffix(route, "/*") {
+			return nil
+		}
+		path := strings.TrimSuffix(route, "/")
+		r := apiRoute{Method: method, Path: path, Version: APIv1, Legacy: true}
+		rel := path
+		for v, prefix := range apiVersionPrefixes {
+			if strings.HasPrefix(path, prefix+"/") {
+				r.Version, r.Legacy, rel = v, false, strings.TrimPrefix(path, prefix)
+			}
+		}
+		r.Key = method + " " + rel
+		result = append(result, r)
+		return nil
+	})
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Path != result[j].Path {
+			return result[i].Path < result[j].Path
+		}
+		return result[i].Method < result[j].Method
+	})
+	return result, err
+}
+
+// undocumentedRoutes lista las rutas del router sin entrada en apiOperations.
+func undocumentedRoutes(routes chi.Routes) ([]string, error) {
+	all, err := walkAPIRoutes(routes)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, r := range all {
+		if _, ok := apiOperations[r.Key]; !ok {
+			missing = append(missing, r.Method+" "+r.Path)
+		}
+	}
+	return missing, nil
+}
+
+// BuildOpenAPISpec genera el documento OpenAPI 3.1 del router. Las rutas sin
+// entrada en apiOperations se omiten (el test TestOpenAPICoversAllRoutes lo impide).
+func BuildOpenAPISpec(routes chi.Routes) (map[string]any, error) {
+	all, err := walkAPIRoutes(routes)
+	if err != nil {
+		return nil, fmt.Errorf("error al recorrer las rutas: %w", err)
+	}
+
+	b := &schemaBuilder{components: map[string]any{}}
+	paths := map[string]map[string]any{}
+	for _, route := range all {
+		op, ok := apiOperations[route.Key]
+		if !ok {
+			continue
+		}
+		if paths[route.Path] == nil {
+			paths[route.Path] = map[string]any{}
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = b.operation(route, op)
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":       "Go API Chi - E-commerce",
+			"version":     "2.0.0",
+			"description": "Catálogo, carrito y pedidos. /api/v2 expresa los precios en unidades menores; las rutas sin prefijo son alias obsoletos de /api/v1.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": b.components,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKeyAuth": map[string]any{"type": "apiKey", "in": "header", "name": ApiKeyHeader,
+					"description": "Clave de API (también Authorization: ApiKey <clave>). Los requisitos indican el alcance que necesita."},
+			},
+		},
+	}, nil
+}
+
+// operation arma el Operation Object de una ruta.
+func (b *schemaBuilder) operation(route apiRoute, op apiOperation) map[string]any {
+	result := map[string]any{
+		"summary":     op.Summary,
+		"tags":        []string{op.Tag},
+		"operationId": operationID(route),
+	}
+	if route.Legacy {
+		result["deprecated"] = true
+	}
+
+	// 1. Identidad
+	switch op.Auth {
+	case authRequired, authAdmin:
+		result["security"] = []any{map[string]any{"bearerAuth": []string{}}}
+	case authOptional:
+		result["security"] = []any{map[string]any{}, map[string]any{"bearerAuth": []string{}}}
+	case authNone:
+		result["security"] = []any{}
+	}
+	if op.Auth == authAdmin {
+		result["description"] = "Solo administradores."
+	}
+	// Las rutas con alcance aceptan también una clave de API (ver apikeys.go)
+	var apiKeyScope string
+	if method, path, _ := strings.Cut(route.Key, " "); op.Auth == authRequired {
+		apiKeyScope = apiKeyScopeForRoute(method, path)
+	}
+	if apiKeyScope != "" {
+		result["security"] = append(result["security"].([]any), map[string]any{"apiKeyAuth": []string{apiKeyScope}})
+	}
+
+	// 2. Parámetros de ruta, query y cabeceras
+	var params []any
+	for _, segment := range strings.Split(route.Path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			name := strings.Trim(segment, "{}")
+			params = append(params, map[string]any{
+				"name": name, "in": "path", "required": true,
+				"schema": map[string]any{"type": apiPathParams[name]},
+			})
+		}
+	}
+	for _, p := range op.Query {
+		params = append(params, map[string]any{"name": p.Name, "in": "query", "description": p.Description, "schema": map[string]any{"type": p.Type}})
+	}
+	headers := op.Headers
+	if route.Method == http.MethodPost && op.Auth != authNone {
+		headers = append(headers, apiParam{IdempotencyKeyHeader, "string", "Reintentos seguros: repite la primera respuesta (ver Idempotencia)"})
+	}
+	if op.Conditional {
+		headers = append(headers,
+			apiParam{"If-None-Match", "string", "ETag de la copia del cliente; si coincide, 304"},
+			apiParam{"If-Modified-Since", "string", "Fecha HTTP; sin cambios desde entonces, 304"},
+		)
+	}
+	for _, p := range headers {
+		params = append(params, map[string]any{"name": p.Name, "in": "header", "description": p.Description, "schema": map[string]any{"type": p.Type}})
+	}
+	if len(params) > 0 {
+		result["parameters"] = params
+	}
+
+	// 3. Cuerpo de la petición
+	if op.Request != nil {
+		contentType := op.RequestContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		schema := b.inputSchema(reflect.TypeOf(forVersion(op.Request, route.Version)))
+		if len(op.Required) > 0 {
+			schema["required"] = op.Required
+		}
+		result["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{contentType: map[string]any{"schema": schema}},
+		}
+	}
+
+	// 4. Respuestas: la de éxito y los errores (texto plano, ver http.Error)
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	if op.Response != nil {
+		contentType := op.ResponseContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		content := map[string]any{contentType: map[string]any{"schema": b.schema(reflect.TypeOf(forVersion(op.Response, route.Version)))}}
+		// NDJSON y CSV se describen como texto: un objeto por línea, o una fila por producto
+		for _, format := range op.AlternateFormats {
+			content[format] = map[string]any{"schema": map[string]any{"type": "string"}}
+		}
+		success["content"] = content
+	}
+	responses := map[string]any{fmt.Sprint(status): success}
+	if op.Conditional {
+		responses[fmt.Sprint(http.StatusNotModified)] = map[string]any{"description": "Sin cambios desde la copia del cliente (sin cuerpo)"}
+	}
+
+	errorCodes := append([]int{}, op.Errors...)
+	switch op.Auth {
+	case authRequired:
+		errorCodes = append(errorCodes, http.StatusUnauthorized)
+		// Clave de API sin el alcance
+		if apiKeyScope != "" && !slices.Contains(errorCodes, http.StatusForbidden) {
+			errorCodes = append(errorCodes, http.StatusForbidden)
+		}
+	case authAdmin:
+		errorCodes = append(errorCodes, http.StatusUnauthorized, http.StatusForbidden)
+	}
+	errorCodes = append(errorCodes, http.StatusInternalServerError)
+	for _, code := range errorCodes {
+		responses[fmt.Sprint(code)] = map[string]any{
+			"description": http.StatusText(code),
+			"content":     map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}},
+		}
+	}
+	result["responses"] = responses
+	return result
+}
+
+// operationID: "post_api_v2_productos_id_variantes".
+func operationID(route apiRoute) string {
+	replacer := strings.NewReplacer("/", "_", "{", "", "}", "", "-", "_")
+	return strings.ToLower(route.Method) + replacer.Replace(route.Path)
+}
+
+// forVersion elige la representación de la versión si el cuerpo es versioned.
+func forVersion(body any, version APIVersion) any {
+	if v, ok := body.(versioned); ok {
+		if version == APIv2 {
+			return v.V2
+		}
+		return v.V1
+	}
+	return body
+}
+
+// ====================================================================
+// ESQUEMAS A PARTIR DE TIPOS GO
+// Respuestas: cada struct con nombre es un componente; los campos sin omitempty
+// son obligatorios y los punteros admiten null. Peticiones: esquemas en línea
+// sin campos obligatorios salvo los que indica la operación (apiOperation.Required).
+// ====================================================================
+
+type schemaBuilder struct {
+	components map[string]any
+}
+
+var (
+	moneyType   = reflect.TypeOf(Money{})
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+	bytesType   = reflect.TypeOf([]byte{})
+)
+
+// moneySchema: Money se serializa con MarshalJSON, no por sus campos.
+var moneySchema = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"amount":   map[string]any{"type": "string", "pattern": `^-?\d+(\.\d+)?$`, "examples": []string{"19.99"}},
+		"currency": map[string]any{"type": "string", "pattern": `^[A-Z]{3}$`, "examples": []string{"USD"}},
+	},
+	"required": []string{"amount", "currency"},
+}
+
+// schema devuelve el esquema de respuesta de t.
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	return b.build(t, false)
+}
+
+// inputSchema devuelve el esquema de petición de t.
+func (b *schemaBuilder) inputSchema(t reflect.Type) map[string]any {
+	return b.build(t, true)
+}
+
+func (b *schemaBuilder) build(t reflect.Type, input bool) map[string]any {
+	switch t {
+	case moneyType:
+		b.components["Money"] = moneySchema
+		return map[string]any{"$ref": "#/components/schemas/Money"}
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawJSONType:
+		// Importes y tipos de cambio: decimal como texto ("19.99") o número
+		return map[string]any{"type": []string{"string", "number", "null"}, "description": "Decimal, como texto o número"}
+	case bytesType:
+		return map[string]any{"type": "string", "format": "binary"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return nullable(b.build(t.Elem(), input))
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		elem := t.Elem()
+		if elem.Kind() == reflect.Pointer {
+			elem = elem.Elem() // []*CategoryNode nunca contiene null
+		}
+		return map[string]any{"type": "array", "items": b.build(elem, input)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.build(t.Elem(), input)}
+	case reflect.Struct:
+		if input {
+			return b.object(t, true)
+		}
+		if _, ok := b.components[t.Name()]; !ok {
+			b.components[t.Name()] = map[string]any{} // Reserva el nombre (tipos recursivos)
+			b.components[t.Name()] = b.object(t, false)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// object arma las propiedades de un struct según sus etiquetas json. Los structs
+// embebidos sin etiqueta aportan sus campos, como en encoding/json.
+func (b *schemaBuilder) object(t reflect.Type, input bool) map[string]any {
+	properties := map[string]any{}
+	var required []string
+
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" || (!field.IsExported() && !field.Anonymous) {
+				continue
+			}
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				collect(field.Type)
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = b.build(field.Type, input)
+			if !input && !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	collect(t)
+
+	result := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		result["required"] = required
+	}
+	return result
+}
+
+// nullable agrega null a los tipos admitidos por el esquema.
+func nullable(schema map[string]any) map[string]any {
+	if typ, ok := schema["type"].(string); ok {
+		result := map[string]any{}
+		for k, v := range schema {
+			result[k] = v
+		}
+		result["type"] = []string{typ, "null"}
+		return result
+	}
+	if _, ok := schema["type"]; ok {
+		return schema // Ya es una lista de tipos
+	}
+	return map[string]any{"anyOf": []any{schema, map[string]any{"type": "null"}}}
+}
+
+// ====================================================================
+// HANDLERS
+// ====================================================================
+
+// OpenAPIDocs genera la especificación (y su validador) la primera vez que se usa:
+// los middlewares se registran antes que las rutas, así que no puede hacerse en setupRouter.
+type OpenAPIDocs struct {
+	routes    chi.Routes
+	once      sync.Once
+	spec      []byte
+	validator *specValidator
+	err       error
+}
+
+func NewOpenAPIDocs(routes chi.Routes) *OpenAPIDocs {
+	return &OpenAPIDocs{routes: routes}
+}
+
+func (d *OpenAPIDocs) load() error {
+	d.once.Do(func() {
+		doc, err := BuildOpenAPISpec(d.routes)
+		if err == nil {
+			d.spec, err = json.Marshal(doc)
+		}
+		if err == nil {
+			d.validator, err = newSpecValidator(d.spec)
+		}
+		if err != nil {
+			d.err = err
+			slog.Error("Error al generar la especificación OpenAPI", "err", err)
+		}
+	})
+	return d.err
+}
+
+// GET /openapi.json: Especificación generada del router
+func OpenAPIHandler(docs *OpenAPIDocs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := docs.load(); err != nil {
+			http.Error(w, "Error interno del servidor", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(docs.spec)
+	}
+}
+
+//go:embed openapi.html
+var apiDocsPage []byte
+
+// GET /docs: Swagger UI sobre /openapi.json
+func APIDocsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(apiDocsPage)
+	}
+}
+
+// swaggerUIAssets: Archivos de Swagger UI que carga openapi.html. Vienen del módulo
+// github.com/swaggo/files/v2 (versión fijada en go.mod y verificada por go.sum), así
+// /docs no ejecuta código de un CDN.
+var swaggerUIAssets = map[string]bool{
+	"swagger-ui.css":       true,
+	"swagger-ui-bundle.js": true,
+}
+
+// GET /docs/{asset}: Estáticos de Swagger UI servidos por la propia API
+func APIDocsAssetHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		asset := chi.URLParam(r, "asset")
+		if !swaggerUIAssets[asset] {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFileFS(w, r, swaggerFiles.FS, asset)
+	}
+}
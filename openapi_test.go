@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newOpenAPITestRouter(t *testing.T) chi.Routes {
+	t.Helper()
+	db, _ := openFakeDB(t, "openapi")
+	cfg := DefaultConfig()
+	cfg.JWT.Secret = testJWTSecret
+	cfg.API.StrictResponses = true
+	return setupRouter(NewDBCluster(db, nil, time.Second), NewProductEventBroker(cfg.Stream), newTestBlobStore(t), cfg).(chi.Routes)
+}
+
+// Test: Toda ruta registrada en setupRouter tiene su entrada en apiOperations
+func TestOpenAPICoversAllRoutes(t *testing.T) {
+	routes := newOpenAPITestRouter(t)
+
+	missing, err := undocumentedRoutes(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, route := range missing {
+		t.Errorf("Ruta sin entrada en apiOperations (openapi.go): %s", route)
+	}
+
+	// Y al revés: no quedan entradas de rutas que ya no existen
+	all, err := walkAPIRoutes(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := map[string]bool{}
+	for _, r := range all {
+		used[r.Key] = true
+	}
+	for key := range apiOperations {
+		if !used[key] {
+			t.Errorf("Entrada de apiOperations sin ruta en el router: %s", key)
+		}
+	}
+}
+
+// Test: /openapi.json es un documento 3.1 con las rutas versionadas y los esquemas de los tipos Go
+func TestOpenAPIDocument(t *testing.T) {
+	routes := newOpenAPITestRouter(t)
+
+	rr := httptest.NewRecorder()
+	routes.(http.Handler).ServeHTTP(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /openapi.json: got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			Deprecated  bool             `json:"deprecated"`
+			Security    []map[string]any `json:"security"`
+			Parameters  []map[string]any `json:"parameters"`
+			RequestBody map[string]any   `json:"requestBody"`
+			Responses   map[string]struct {
+				Content map[string]struct {
+					Schema map[string]any `json:"schema"`
+				} `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]any `json:"properties"`
+				Required   []string       `json:"required"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.1.0" {
+		t.Errorf("openapi: got %q", doc.OpenAPI)
+	}
+
+	// v1 y v2 usan su propia representación del producto; la raíz es obsoleta
+	for path, schema := range map[string]string{
+		"/api/v1/productos/{id}": "#/components/schemas/ProductV1",
+		"/api/v2/productos/{id}": "#/components/schemas/ProductV2",
+	} {
+		got := doc.Paths[path]["get"].Responses["200"].Content["application/json"].Schema["$ref"]
+		if got != schema {
+			t.Errorf("%s: got %v want %s", path, got, schema)
+		}
+	}
+	if !doc.Paths["/productos/{id}"]["get"].Deprecated || doc.Paths["/api/v1/productos/{id}"]["get"].Deprecated {
+		t.Error("Solo las rutas sin prefijo deben estar marcadas como obsoletas")
+	}
+	if _, ok := doc.Components.Schemas["ProductV2"].Properties["price_cents"]; !ok {
+		t.Error("ProductV2 debe tener price_cents")
+	}
+	if req := doc.Components.Schemas["Order"].Required; !strings.Contains(strings.Join(req, ","), "total") {
+		t.Errorf("Order.required: %v", req)
+	}
+
+	// /login es pública y el resto exige JWT; los {id} son enteros
+	if login := doc.Paths["/api/v1/login"]["post"]; len(login.Security) != 0 || login.RequestBody == nil {
+		t.Errorf("POST /login: %+v", login)
+	}
+	// Las rutas con alcance aceptan además una clave de API; las de admin, no
+	if security := doc.Paths["/api/v2/skus/{sku}/stock"]["post"].Security; len(security) != 2 || fmt.Sprint(security[1]["apiKeyAuth"]) != "[stock:write]" {
+		t.Errorf("POST /skus/{sku}/stock: security %v", security)
+	}
+	if security := doc.Paths["/api/v2/categorias"]["post"].Security; len(security) != 1 {
+		t.Errorf("POST /categorias solo admite JWT: %v", security)
+	}
+	params := doc.Paths["/api/v1/orders/{id}"]["get"].Parameters
+	if len(params) != 1 || params[0]["in"] != "path" || params[0]["schema"].(map[string]any)["type"] != "integer" {
+		t.Errorf("Parámetro {id}: %v", params)
+	}
+
+	// Swagger UI
+	rr = httptest.NewRecorder()
+	routes.(http.Handler).ServeHTTP(rr, httptest.NewRequest("GET", "/docs", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "/openapi.json") {
+		t.Errorf("GET /docs: got %d", rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), "https://") {
+		t.Errorf("GET /docs no debe cargar recursos externos: %s", rr.Body.String())
+	}
+	for path, want := range map[string]int{
+		"/docs/swagger-ui-bundle.js": http.StatusOK,
+		"/docs/swagger-ui.css":       http.StatusOK,
+		"/docs/index.html":           http.StatusNotFound,
+	} {
+		rr = httptest.NewRecorder()
+		routes.(http.Handler).ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != want {
+			t.Errorf("GET %s: got %d want %d", path, rr.Code, want)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ====================================================================
+// VALIDACIÓN CONTRA LA ESPECIFICACIÓN OPENAPI
+// El mismo documento que se sirve en /openapi.json decide qué peticiones llegan a
+// los handlers: parámetros de ruta y query con el tipo correcto y cuerpos JSON que
+// cumplen su esquema. En modo estricto (tests/CI) también se validan las respuestas
+// 2xx, para detectar cuando un handler se aparta del contrato.
+// ====================================================================
+
+// specParam: Parámetro de ruta o query de una operación.
+type specParam struct {
+	Name string
+	In   string
+	Type string
+}
+
+// specOperation: Operación de la especificación lista para validar.
+type specOperation struct {
+	Segments     []string // "{id}" marca un parámetro
+	Literals     int      // Segmentos fijos: desempata /productos/stream frente a /productos/{id}
+	Params       []specParam
+	Body         map[string]any // Esquema del cuerpo JSON (nil = sin cuerpo JSON)
+	BodyRequired bool
+	Status       int            // Código de éxito documentado
+	Response     map[string]any // Esquema de la respuesta JSON de éxito (nil = otra cosa)
+}
+
+type specValidator struct {
+	operations map[string][]*specOperation // Por método
+	schemas    map[string]any              // components.schemas
+
+	mu       sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+// newSpecValidator prepara el validador a partir del documento JSON ya generado.
+func newSpecValidator(spec []byte) (*specValidator, error) {
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Parameters []struct {
+				Name   string         `json:"name"`
+				In     string         `json:"in"`
+				Schema map[string]any `json:"schema"`
+			} `json:"parameters"`
+			RequestBody *struct {
+				Required bool                                       `json:"required"`
+				Content  map[string]struct{ Schema map[string]any } `json:"content"`
+			} `json:"requestBody"`
+			Responses map[string]struct {
+				Content map[string]struct{ Schema map[string]any } `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("especificación inválida: %w", err)
+	}
+
+	v := &specValidator{
+		operations: map[string][]*specOperation{},
+		schemas:    doc.Components.Schemas,
+		patterns:   map[string]*regexp.Regexp{},
+	}
+	for path, methods := range doc.Paths {
+		for method, item := range methods {
+			op := &specOperation{Segments: strings.Split(path, "/")}
+			for _, segment := range op.Segments {
+				if !strings.HasPrefix(segment, "{") {
+					op.Literals++
+				}
+			}
+			for _, p := range item.Parameters {
+				if p.In == "path" || p.In == "query" {
+					typ, _ := p.Schema["type"].(string)
+					op.Params = append(op.Params, specParam{Name: p.Name, In: p.In, Type: typ})
+				}
+			}
+			if item.RequestBody != nil {
+				if content, ok := item.RequestBody.Content["application/json"]; ok {
+					op.Body, op.BodyRequired = content.Schema, item.RequestBody.Required
+				}
+			}
+			for code, response := range item.Responses {
+				if status, err := strconv.Atoi(code); err == nil && status >= 200 && status < 300 {
+					op.Status = status
+					if content, ok := response.Content["application/json"]; ok {
+						op.Response = content.Schema
+					}
+				}
+			}
+			method = strings.ToUpper(method)
+			v.operations[method] = append(v.operations[method], op)
+		}
+	}
+	return v, nil
+}
+
+// match busca la operación de la petición y devuelve también los parámetros de ruta.
+func (v *specValidator) match(method, path string) (*specOperation, map[string]string) {
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+
+	var best *specOperation
+	var bestParams map[string]string
+	for _, op := range v.operations[method] {
+		if len(op.Segments) != len(segments) || (best != nil && op.Literals <= best.Literals) {
+			continue
+		}
+		params := map[string]string{}
+		matched := true
+		for i, segment := range op.Segments {
+			if strings.HasPrefix(segment, "{") {
+				params[strings.Trim(segment, "{}")] = segments[i]
+			} else if segment != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			best, bestParams = op, params
+		}
+	}
+	return best, bestParams
+}
+
+// validateRequest revisa ruta, query y cuerpo. El cuerpo se vuelve a dejar en r.Body.
+func (v *specValidator) validateRequest(r *http.Request, op *specOperation, pathParams map[string]string) error {
+	// 1. Parámetros de ruta y query
+	query := r.URL.Query()
+	for _, p := range op.Params {
+		value := query.Get(p.Name)
+		if p.In == "path" {
+			value = pathParams[p.Name]
+		}
+		if value == "" {
+			continue
+		}
+		if err := checkParamType(value, p.Type); err != nil {
+			return fmt.Errorf("parámetro %s %q: %w", p.In, p.Name, err)
+		}
+	}
+
+	// 2. Cuerpo JSON
+	if op.Body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("no se pudo leer el cuerpo: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.BodyRequired {
+			return errors.New("falta el cuerpo JSON")
+		}
+		return nil
+	}
+	value, err := decodeJSONValue(body)
+	if err != nil {
+		return fmt.Errorf("JSON inválido: %w", err)
+	}
+	return v.validate(op.Body, value, "body")
+}
+
+func checkParamType(value, typ string) error {
+	switch typ {
+	case "integer":
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return errors.New("se esperaba un entero")
+		}
+	case "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return errors.New("se esperaba true o false")
+		}
+	}
+	return nil
+}
+
+// decodeJSONValue decodifica conservando los números como json.Number (enteros exactos).
+func decodeJSONValue(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("hay datos después del valor JSON")
+	}
+	return value, nil
+}
+
+// validate comprueba value contra el subconjunto de JSON Schema que genera
+// BuildOpenAPISpec: $ref, anyOf, type, properties, required, items,
+// additionalProperties y pattern.
+func (v *specValidator) validate(schema map[string]any, value any, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		target, _ := v.schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]any)
+		if target == nil {
+			return fmt.Errorf("%s: esquema desconocido %s", path, ref)
+		}
+		return v.validate(target, value, path)
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		var first error
+		for _, option := range anyOf {
+			sub, _ := option.(map[string]any)
+			err := v.validate(sub, value, path)
+			if err == nil {
+				return nil
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+
+	// 1. Tipo
+	if types := schemaTypes(schema["type"]); len(types) > 0 {
+		actual := jsonType(value)
+		if !typeAllowed(types, actual) {
+			return fmt.Errorf("%s: se esperaba %s, se recibió %s", path, strings.Join(types, " o "), actual)
+		}
+	}
+
+	// 2. Restricciones según el valor
+	switch value := value.(type) {
+	case string:
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := v.pattern(pattern)
+			if err != nil {
+				return err
+			}
+			if !re.MatchString(value) {
+				return fmt.Errorf("%s: %q no cumple el formato %s", path, value, pattern)
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range value {
+				if err := v.validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		if required, ok := schema["required"].([]any); ok {
+			for _, name := range required {
+				if _, present := value[name.(string)]; !present {
+					return fmt.Errorf("%s.%s: campo obligatorio", path, name)
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		additional, _ := schema["additionalProperties"].(map[string]any)
+		// Orden estable para que el error reportado sea siempre el mismo
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sub, ok := properties[name].(map[string]any)
+			if !ok {
+				sub = additional
+			}
+			if sub == nil {
+				continue // Propiedades no documentadas: se ignoran, como hace encoding/json
+			}
+			if err := v.validate(sub, value[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v *specValidator) pattern(expr string) (*regexp.Regexp, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if re, ok := v.patterns[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("patrón inválido en la especificación %q: %w", expr, err)
+	}
+	v.patterns[expr] = re
+	return re, nil
+}
+
+func schemaTypes(value any) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		types := make([]string, 0, len(value))
+		for _, t := range value {
+			if s, ok := t.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func jsonType(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if strings.ContainsAny(value.String(), ".eE") {
+			return "number"
+		}
+		return "integer"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// typeAllowed: un entero también es un "number".
+func typeAllowed(types []string, actual string) bool {
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// ====================================================================
+// MIDDLEWARE
+// ====================================================================
+
+// bufferedResponse retiene la respuesta para validarla antes de enviarla. Las que
+// no son JSON (NDJSON, CSV) pasan sin retener: el esquema solo describe el JSON y
+// retenerlas impediría el streaming.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	passthrough bool
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status != 0 {
+		return
+	}
+	b.status = status
+	mediaType, _, _ := mime.ParseMediaType(b.Header().Get("Content-Type"))
+	if status >= 200 && status < 300 && mediaType != "" && mediaType != "application/json" {
+		b.passthrough = true
+		b.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.WriteHeader(http.StatusOK)
+	}
+	if b.passthrough {
+		return b.ResponseWriter.Write(p)
+	}
+	return b.body.Write(p)
+}
+
+// Flush solo tiene efecto en las respuestas que pasan sin retener.
+func (b *bufferedResponse) Flush() {
+	if b.passthrough {
+		http.NewResponseController(b.ResponseWriter).Flush()
+	}
+}
+
+// checkResponse compara una respuesta 2xx con el código y el esquema documentados.
+func (v *specValidator) checkResponse(op *specOperation, status int, body []byte) error {
+	if status < 200 || status >= 300 {
+		return nil // Los errores son texto plano (http.Error)
+	}
+	if status != op.Status {
+		return fmt.Errorf("código %d no documentado (se esperaba %d)", status, op.Status)
+	}
+	if op.Response == nil {
+		return nil
+	}
+	value, err := decodeJSONValue(body)
+	if err != nil {
+		return fmt.Errorf("la respuesta no es JSON: %w", err)
+	}
+	return v.validate(op.Response, value, "response")
+}
+
+// OpenAPIValidationMiddleware valida las peticiones contra /openapi.json antes de llegar
+// al handler (400 con el detalle). Con cfg.StrictResponses también valida las respuestas
+// 2xx JSON y reemplaza las que no cumplen el contrato por un 500. Las rutas que no están
+// en la especificación pasan sin validar.
+func OpenAPIValidationMiddleware(docs *OpenAPIDocs, cfg APIConfig) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !cfg.ValidateRequests && !cfg.StrictResponses {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err := docs.load(); err != nil {
+				next.ServeHTTP(w, r) // Sin especificación no se bloquea la API
+				return
+			}
+			op, pathParams := docs.validator.match(r.Method, r.URL.Path)
+			if op == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// 1. Petición. El cuerpo JSON se lee entero para validarlo, así que se limita
+			// antes de leerlo
+			if cfg.ValidateRequests {
+				if op.Body != nil {
+					r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.MaxBodyBytes))
+				}
+				err := docs.validator.validateRequest(r, op, pathParams)
+				var maxBytesErr *http.MaxBytesError
+				switch {
+				case errors.As(err, &maxBytesErr):
+					http.Error(w, fmt.Sprintf("El cuerpo JSON excede el máximo de %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+					return
+				case err != nil:
+					http.Error(w, "Petición inválida: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if !cfg.StrictResponses || op.Response == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// 2. Respuesta (modo estricto): se retiene hasta validarla
+			buffered := &bufferedResponse{ResponseWriter: w}
+			next.ServeHTTP(buffered, r)
+			if buffered.passthrough {
+				return
+			}
+			if buffered.status == 0 {
+				buffered.status = http.StatusOK
+			}
+			if err := docs.validator.checkResponse(op, buffered.status, buffered.body.Bytes()); err != nil {
+				slog.Error("Respuesta fuera del contrato OpenAPI", "method", r.Method, "path", r.URL.Path, "err", err)
+				w.Header().Del("Content-Length")
+				http.Error(w, "Respuesta fuera del contrato OpenAPI: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(buffered.status)
+			w.Write(buffered.body.Bytes())
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test: Las peticiones que no cumplen la especificación no llegan al handler
+func TestOpenAPIRequestValidation(t *testing.T) {
+	router, token, server := newProductTestRouter(t)
+	server.SetRows(nil)
+
+	cases := []struct {
+		name, method, path, body, want string
+	}{
+		{"id no numérico", "GET", "/api/v1/orders/abc", "", `parámetro path "id"`},
+		{"booleano inválido", "GET", "/api/v1/productos?categoria=x&include_descendants=quizas", "", `parámetro query "include_descendants"`},
+		{"tipo incorrecto", "POST", "/api/v1/orders", `{"items":[{"product_id":"uno","quantity":1}]}`, "body.items[0].product_id: se esperaba integer"},
+		{"campo obligatorio", "POST", "/api/v2/skus/TS-1/stock", `{}`, "body.delta: campo obligatorio"},
+		{"decimal donde va entero", "POST", "/api/v1/cart/items", `{"product_id":1,"quantity":1.5}`, "body.quantity"},
+		{"sin cuerpo", "POST", "/api/v1/orders", "", "falta el cuerpo JSON"},
+		{"JSON inválido", "POST", "/api/v1/orders", `{"items":`, "JSON inválido"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), tc.want) {
+			t.Errorf("%s: got %d %q, want 400 con %q", tc.name, rr.Code, rr.Body.String(), tc.want)
+		}
+	}
+
+	// La validación va después de la autenticación: sin token sigue siendo 401
+	if rr := postWithToken(router, "/api/v1/orders", `{"items":"x"}`, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Sin token: got %d want 401", rr.Code)
+	}
+	// El cuerpo se lee con límite (API_MAX_BODY_BYTES): 413 sin leerlo entero
+	large := `{"items":[],"notes":"` + strings.Repeat("x", DefaultConfig().API.MaxBodyBytes) + `"}`
+	if rr := postWithToken(router, "/api/v1/orders", large, token); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Cuerpo excedido: got %d want 413", rr.Code)
+	}
+	// Los campos no documentados se ignoran, como en encoding/json
+	if rr := postWithToken(router, "/api/v1/login", `{"username":"ana","password":"x","extra":true}`, ""); rr.Code == http.StatusBadRequest {
+		t.Errorf("Campo extra: got 400 %s", rr.Body.String())
+	}
+}
+
+// Test: Las rutas fijas tienen prioridad sobre las que tienen parámetros
+func TestOpenAPIMatch(t *testing.T) {
+	docs := NewOpenAPIDocs(newOpenAPITestRouter(t))
+	if err := docs.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	op, params := docs.validator.match("GET", "/api/v1/productos/stream")
+	if op == nil || op.Response != nil || len(params) != 0 {
+		t.Errorf("/productos/stream debe resolver a la ruta SSE: %+v %v", op, params)
+	}
+	if op, params := docs.validator.match("GET", "/api/v1/productos/7"); op == nil || params["id"] != "7" {
+		t.Errorf("/productos/7: %+v %v", op, params)
+	}
+	if op, _ := docs.validator.match("GET", "/api/v1/productos/"); op == nil {
+		t.Error("La barra final debe ignorarse")
+	}
+	if op, _ := docs.validator.match("GET", "/no/existe"); op != nil {
+		t.Error("Una ruta desconocida no debe tener operación")
+	}
+}
+
+// Test: En modo estricto una respuesta que se aparta del contrato se convierte en 500
+func TestOpenAPIStrictResponses(t *testing.T) {
+	docs := NewOpenAPIDocs(newOpenAPITestRouter(t))
+	handlerWith := func(status int, body string) http.Handler {
+		return OpenAPIValidationMiddleware(docs, APIConfig{StrictResponses: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+	}
+	get := func(h http.Handler, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	valid := `{"id":1,"name":"Mouse","description":"","price_cents":1999,"price":{"amount":"19.99","currency":"USD"},"currency":"USD","stock":3}`
+	if rr := get(handlerWith(http.StatusOK, valid), "/api/v2/productos/1"); rr.Code != http.StatusOK || rr.Body.String() != valid {
+		t.Errorf("Respuesta válida: got %d %s", rr.Code, rr.Body.String())
+	}
+
+	cases := []struct {
+		name, path, body, want string
+		status                 int
+	}{
+		{"campo faltante", "/api/v2/productos/1", `{"id":1,"name":"Mouse"}`, "response.description: campo obligatorio", http.StatusOK},
+		{"representación de otra versión", "/api/v2/productos/1", `{"id":1,"name":"M","description":"","price":19.99,"currency":"USD","stock":3}`, "price_cents", http.StatusOK},
+		{"lista nula", "/api/v1/orders", `null`, "se esperaba array", http.StatusOK},
+		{"código no documentado", "/api/v1/productos/1", valid, "código 201 no documentado", http.StatusCreated},
+	}
+	for _, tc := range cases {
+		rr := get(handlerWith(tc.status, tc.body), tc.path)
+		if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), tc.want) {
+			t.Errorf("%s: got %d %q, want 500 con %q", tc.name, rr.Code, rr.Body.String(), tc.want)
+		}
+	}
+
+	// Los errores (texto plano) no se validan
+	if rr := get(handlerWith(http.StatusNotFound, "Producto no encontrado"), "/api/v1/productos/1"); rr.Code != http.StatusNotFound {
+		t.Errorf("Error 404: got %d", rr.Code)
+	}
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ====================================================================
+// PEDIDOS (CHECKOUT)
+// POST /orders valida los ítems contra el catálogo, bloquea las filas de
+// productos/variantes, descuenta el stock y guarda una copia del nombre y del
+// precio de cada ítem, todo en una transacción. Estados:
+//
+//	pending → paid → shipped → delivered
+//	pending/paid → cancelled (devuelve el stock)
+// ====================================================================
+
+// Estados de un pedido
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCancelled = "cancelled"
+)
+
+// orderStatuses: Todos los estados válidos.
+var orderStatuses = []string{OrderPending, OrderPaid, OrderShipped, OrderDelivered, OrderCancelled}
+
+// orderTransitions: Estados a los que se puede pasar desde cada estado.
+var orderTransitions = map[string][]string{
+	OrderPending: {OrderPaid, OrderCancelled},
+	OrderPaid:    {OrderShipped, OrderCancelled},
+	OrderShipped: {OrderDelivered},
+}
+
+// Límites de un pedido
+const (
+	maxOrderItems    = 100
+	maxOrderQuantity = 1000
+)
+
+// Errores de dominio que los handlers traducen a 404/409/422
+var (
+	ErrOrderNotFound          = errors.New("pedido no encontrado")
+	ErrOrderProductNotFound   = errors.New("producto no encontrado")
+	ErrOrderVariantRequired   = errors.New("el producto tiene variantes: indica variant_id")
+	ErrOrderInsufficientStock = errors.New("stock insuficiente")
+	ErrOrderInvalidTransition = errors.New("cambio de estado no permitido")
+)
+
+// Order: Pedido con sus ítems. Los importes están en Currency.
+type Order struct {
+	ID        int         `json:"id"`
+	UserID    int         `json:"user_id"`
+	Status    string      `json:"status"`
+	Total     Money       `json:"total"`
+	Items     []OrderItem `json:"items"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// OrderItem: Línea del pedido. Name, SKU y UnitPrice son una copia del catálogo al
+// momento de la compra; ProductID/VariantID quedan en null si luego se borran.
+type OrderItem struct {
+	ProductID *int   `json:"product_id"`
+	VariantID *int   `json:"variant_id,omitempty"`
+	SKU       string `json:"sku,omitempty"`
+	Name      string `json:"name"`
+	UnitPrice Money  `json:"unit_price"`
+	Quantity  int    `json:"quantity"`
+	LineTotal Money  `json:"line_total"`
+}
+
+// OrderRequest: Cuerpo de POST /orders.
+type OrderRequest struct {
+	Currency string             `json:"currency"` // Vacío = DEFAULT_CURRENCY
+	Items    []OrderItemRequest `json:"items"`
+}
+
+// OrderItemRequest: Producto (o variante) y cantidad a comprar.
+type OrderItemRequest struct {
+	ProductID int `json:"product_id"`
+	VariantID int `json:"variant_id"` // 0 = producto sin variantes
+	Quantity  int `json:"quantity"`
+}
+
+// OrderStatusRequest: Cuerpo de POST /orders/{id}/status.
+type OrderStatusRequest struct {
+	Status string `json:"status"`
+}
+
+// canTransition indica si un pedido puede pasar de from a to.
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+func isOrderStatus(status string) bool {
+	for _, s := range orderStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize valida el pedido, aplica la moneda por defecto y agrupa los ítems
+// repetidos. Los ítems quedan ordenados por producto y variante para que dos
+// pedidos concurrentes bloqueen las filas en el mismo orden (sin deadlocks).
+func (req *OrderRequest) normalize() error {
+	if req.Currency == "" {
+		req.Currency = defaultCurrency
+	}
+	currency, err := normalizeCurrency(req.Currency)
+	if err != nil {
+		return err
+	}
+	req.Currency = currency
+
+	if len(req.Items) == 0 {
+		return errors.New("el pedido debe tener al menos un ítem")
+	}
+	if len(req.Items) > maxOrderItems {
+		return fmt.Errorf("el pedido admite como máximo %d ítems", maxOrderItems)
+	}
+
+	type key struct{ product, variant int }
+	merged := make(map[key]int)
+	for _, item := range req.Items {
+		if item.ProductID <= 0 || item.VariantID < 0 {
+			return errors.New("cada ítem necesita un product_id válido")
+		}
+		if item.Quantity <= 0 {
+			return fmt.Errorf("cantidad inválida para el producto %d: debe ser mayor a 0", item.ProductID)
+		}
+		merged[key{item.ProductID, item.VariantID}] += item.Quantity
+	}
+
+	req.Items = req.Items[:0]
+	for k, quantity := range merged {
+		if quantity > maxOrderQuantity {
+			return fmt.Errorf("cantidad máxima por ítem: %d", maxOrderQuantity)
+		}
+		req.Items = append(req.Items, OrderItemRequest{ProductID: k.product, VariantID: k.variant, Quantity: quantity})
+	}
+	sort.Slice(req.Items, func(i, j int) bool {
+		a, b := req.Items[i], req.Items[j]
+		if a.ProductID != b.ProductID {
+			return a.ProductID < b.ProductID
+		}
+		return a.VariantID < b.VariantID
+	})
+	return nil
+}
+
+// ====================================================================
+// DAO
+// ====================================================================
+
+// reserveProduct bloquea el producto, descuenta quantity y devuelve la línea del pedido.
+// Los cambios de stock se notifican igual que un PUT /productos/{id}.
+func reserveProduct(ctx context.Context, tx *sql.Tx, pricer *catalogPricer, item OrderItemRequest) (OrderItem, error) {
+	var product Product
+	var hasVariants bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT id, name, description, price_minor, currency, stock,
+			EXISTS (SELECT 1 FROM product_variants WHERE product_id = products.id)
+		FROM products WHERE id = $1
+		FOR UPDATE`, item.ProductID,
+	).Scan(&product.ID, &product.Name, &product.Description, &product.Price.Amount, &product.Price.Currency, &product.Stock, &hasVariants)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OrderItem{}, fmt.Errorf("%w: %d", ErrOrderProductNotFound, item.ProductID)
+	}
+	if err != nil {
+		return OrderItem{}, fmt.Errorf("error al bloquear producto: %w", queryError(ctx, err))
+	}
+	if hasVariants {
+		return OrderItem{}, fmt.Errorf("%w (producto %d)", ErrOrderVariantRequired, item.ProductID)
+	}
+	if product.Stock < item.Quantity {
+		return OrderItem{}, fmt.Errorf("%w para %q: hay %d, se piden %d", ErrOrderInsufficientStock, product.Name, product.Stock, item.Quantity)
+	}
+
+	unitPrice, err := pricer.price(ctx, product.ID, product.Price, true)
+	if err != nil {
+		return OrderItem{}, err
+	}
+	if err := setProductStock(ctx, tx, product, product.Stock-item.Quantity); err != nil {
+		return OrderItem{}, err
+	}
+
+	id := product.ID
+	return OrderItem{ProductID: &id, Name: product.Name, UnitPrice: unitPrice, Quantity: item.Quantity}, nil
+}
+
+// reserveVariant bloquea la variante, descuenta quantity y devuelve la línea del pedido.
+func reserveVariant(ctx context.Context, tx *sql.Tx, pricer *catalogPricer, item OrderItemRequest) (OrderItem, error) {
+	var name, sku string
+	var stock int
+	var price sql.NullInt64
+	var catalog Money
+	err := tx.QueryRowContext(ctx, `
+		SELECT p.name, v.sku, v.stock, v.price_minor, p.price_minor, p.currency
+		FROM product_variants v
+		JOIN products p ON p.id = v.product_id
+		WHERE v.id = $1 AND v.product_id = $2
+		FOR UPDATE OF v`, item.VariantID, item.ProductID,
+	).Scan(&name, &sku, &stock, &price, &catalog.Amount, &catalog.Currency)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OrderItem{}, fmt.Errorf("%w: variante %d del producto %d", ErrOrderProductNotFound, item.VariantID, item.ProductID)
+	}
+	if err != nil {
+		return OrderItem{}, fmt.Errorf("error al bloquear variante: %w", queryError(ctx, err))
+	}
+	if stock < item.Quantity {
+		return OrderItem{}, fmt.Errorf("%w para %s: hay %d, se piden %d", ErrOrderInsufficientStock, sku, stock, item.Quantity)
+	}
+
+	// Una variante con precio propio no usa la lista de precios del producto
+	if price.Valid {
+		catalog.Amount = price.Int64
+	}
+	unitPrice, err := pricer.price(ctx, item.ProductID, catalog, !price.Valid)
+	if err != nil {
+		return OrderItem{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE product_variants SET stock = stock - $2 WHERE id = $1`, item.VariantID, item.Quantity); err != nil {
+		return OrderItem{}, fmt.Errorf("error al descontar stock: %w", queryError(ctx, err))
+	}
+	// El stock total del producto cambió: cachés y Last-Modified deben enterarse
+	if err := notifyProductUpdated(ctx, tx, item.ProductID); err != nil {
+		return OrderItem{}, err
+	}
+
+	productID, variantID := item.ProductID, item.VariantID
+	return OrderItem{ProductID: &productID, VariantID: &variantID, SKU: sku, Name: name, UnitPrice: unitPrice, Quantity: item.Quantity}, nil
+}
+
+// setProductStock guarda el nuevo stock de un producto ya bloqueado y encola los
+// mismos eventos que UpdateProduct (product.updated y, si se agotó, product.out_of_stock).
+func setProductStock(ctx context.Context, tx *sql.Tx, product Product, stock int) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE products SET stock = $2 WHERE id = $1`, product.ID, stock); err != nil {
+		return fmt.Errorf("error al actualizar stock: %w", queryError(ctx, err))
+	}
+	previousStock := product.Stock
+	product.Stock = stock
+
+	if err := EnqueueWebhookEvent(ctx, tx, WebhookEventProductUpdated, product); err != nil {
+		return err
+	}
+	if err := NotifyProductChange(ctx, tx, WebhookEventProductUpdated, product); err != nil {
+		return err
+	}
+	if previousStock > 0 && stock <= 0 {
+		return EnqueueWebhookEvent(ctx, tx, WebhookEventProductOutOfStock, product)
+	}
+	return nil
+}
+
+// CreateOrder reserva el stock de todos los ítems y guarda el pedido en estado pending.
+// Si algún ítem falla no se descuenta nada.
+func CreateOrder(ctx context.Context, db *sql.DB, userID int, req OrderRequest) (Order, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Order{}, fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	// 1. Bloquear, validar y descontar cada ítem (en orden de producto/variante)
+	pricer := &catalogPricer{db: db, q: tx, currency: req.Currency}
+	order := Order{UserID: userID, Status: OrderPending, Total: Money{Currency: req.Currency}}
+	for _, itemReq := range req.Items {
+		var item OrderItem
+		if itemReq.VariantID != 0 {
+			item, err = reserveVariant(ctx, tx, pricer, itemReq)
+		} else {
+			item, err = reserveProduct(ctx, tx, pricer, itemReq)
+		}
+		if err != nil {
+			return Order{}, err
+		}
+		item.LineTotal = Money{Amount: item.UnitPrice.Amount * int64(item.Quantity), Currency: req.Currency}
+		order.Total.Amount += item.LineTotal.Amount
+		order.Items = append(order.Items, item)
+	}
+
+	// 2. Guardar el pedido y sus ítems
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO orders (user_id, status, currency, total_minor)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, updated_at`,
+		userID, order.Status, order.Total.Currency, order.Total.Amount,
+	).Scan(&order.ID, &order.CreatedAt, &order.UpdatedAt)
+	if err != nil {
+		return Order{}, fmt.Errorf("error al crear pedido: %w", queryError(ctx, err))
+	}
+	for _, item := range order.Items {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO order_items (order_id, product_id, variant_id, sku, name, unit_price_minor, quantity, line_total_minor)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			order.ID, item.ProductID, item.VariantID, item.SKU, item.Name, item.UnitPrice.Amount, item.Quantity, item.LineTotal.Amount,
+		)
+		if err != nil {
+			return Order{}, fmt.Errorf("error al guardar ítems del pedido: %w", queryError(ctx, err))
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Order{}, fmt.Errorf("error al confirmar pedido: %w", queryError(ctx, err))
+	}
+	return order, nil
+}
+
+// OrderFilter: Filtros de GET /orders. UserID 0 = todos los usuarios (solo admin).
+type OrderFilter struct {
+	UserID int
+	Status string
+}
+
+const orderSelect = `SELECT id, user_id, status, currency, total_minor, created_at, updated_at FROM orders`
+
+func scanOrder(row rowScanner) (Order, error) {
+	var o Order
+	err := row.Scan(&o.ID, &o.UserID, &o.Status, &o.Total.Currency, &o.Total.Amount, &o.CreatedAt, &o.UpdatedAt)
+	o.Items = []OrderItem{}
+	return o, err
+}
+
+// GetOrders devuelve los últimos 100 pedidos que cumplen el filtro, con sus ítems.
+func GetOrders(ctx context.Context, db *sql.DB, filter OrderFilter) ([]Order, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, orderSelect+`
+		WHERE ($1 = 0 OR user_id = $1) AND ($2 = '' OR status = $2)
+		ORDER BY id DESC LIMIT 100`, filter.UserID, filter.Status)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar pedidos: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error al leer pedidos: %w", err)
+		}
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al leer pedidos: %w", queryError(ctx, err))
+	}
+
+	if err := loadOrderItems(ctx, db, orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// GetOrder devuelve un pedido con sus ítems o ErrOrderNotFound.
+func GetOrder(ctx context.Context, db *sql.DB, id int) (Order, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	o, err := scanOrder(db.QueryRowContext(ctx, orderSelect+` WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, ErrOrderNotFound
+	}
+	if err != nil {
+		return Order{}, fmt.Errorf("error al consultar pedido: %w", queryError(ctx, err))
+	}
+
+	orders := []Order{o}
+	if err := loadOrderItems(ctx, db, orders); err != nil {
+		return Order{}, err
+	}
+	return orders[0], nil
+}
+
+// loadOrderItems completa los ítems de orders con una sola consulta.
+func loadOrderItems(ctx context.Context, db *sql.DB, orders []Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(orders))
+	index := make(map[int]int, len(orders))
+	for i, o := range orders {
+		ids[i] = int64(o.ID)
+		index[o.ID] = i
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT order_id, product_id, variant_id, sku, name, unit_price_minor, quantity, line_total_minor
+		FROM order_items WHERE order_id = ANY($1) ORDER BY id`, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("error al consultar ítems: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID int
+		var productID, variantID sql.NullInt64
+		var item OrderItem
+		err := rows.Scan(&orderID, &productID, &variantID, &item.SKU, &item.Name,
+			&item.UnitPrice.Amount, &item.Quantity, &item.LineTotal.Amount)
+		if err != nil {
+			return fmt.Errorf("error al leer ítems: %w", err)
+		}
+		i, ok := index[orderID]
+		if !ok {
+			continue
+		}
+		if productID.Valid {
+			id := int(productID.Int64)
+			item.ProductID = &id
+		}
+		if variantID.Valid {
+			id := int(variantID.Int64)
+			item.VariantID = &id
+		}
+		item.UnitPrice.Currency = orders[i].Total.Currency
+		item.LineTotal.Currency = orders[i].Total.Currency
+		orders[i].Items = append(orders[i].Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error al leer ítems: %w", queryError(ctx, err))
+	}
+	return nil
+}
+
+// UpdateOrderStatus cambia el estado del pedido si la transición es válida. Con
+// userID distinto de 0 solo actúa sobre pedidos de ese usuario, y solo mientras estén
+// pending. Al cancelar se devuelve el stock de los ítems cuyo producto/variante aún existe.
+func UpdateOrderStatus(ctx context.Context, db *sql.DB, id, userID int, status string) (Order, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Order{}, fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	// 1. Bloquear el pedido y validar la transición
+	order, err := scanOrder(tx.QueryRowContext(ctx, orderSelect+`
+		WHERE id = $1 AND ($2 = 0 OR user_id = $2) FOR UPDATE`, id, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, ErrOrderNotFound
+	}
+	if err != nil {
+		return Order{}, fmt.Errorf("error al consultar pedido: %w", queryError(ctx, err))
+	}
+	if !canTransition(order.Status, status) {
+		return Order{}, fmt.Errorf("%w: %s → %s", ErrOrderInvalidTransition, order.Status, status)
+	}
+	if userID != 0 && order.Status != OrderPending {
+		return Order{}, fmt.Errorf("%w: el pedido ya está %s, solo un administrador puede cambiarlo", ErrOrderInvalidTransition, order.Status)
+	}
+
+	// 2. Devolver el stock al cancelar
+	if status == OrderCancelled {
+		if err := restoreOrderStock(ctx, tx, order.ID); err != nil {
+			return Order{}, err
+		}
+	}
+
+	// 3. Guardar el nuevo estado
+	err = tx.QueryRowContext(ctx,
+		`UPDATE orders SET status = $2, updated_at = NOW() WHERE id = $1 RETURNING updated_at`,
+		order.ID, status,
+	).Scan(&order.UpdatedAt)
+	if err != nil {
+		return Order{}, fmt.Errorf("error al actualizar pedido: %w", queryError(ctx, err))
+	}
+	if err := tx.Commit(); err != nil {
+		return Order{}, fmt.Errorf("error al confirmar pedido: %w", queryError(ctx, err))
+	}
+	order.Status = status
+
+	orders := []Order{order}
+	if err := loadOrderItems(ctx, db, orders); err != nil {
+		return Order{}, err
+	}
+	return orders[0], nil
+}
+
+// restoreOrderStock suma de vuelta las cantidades del pedido a productos y variantes.
+func restoreOrderStock(ctx context.Context, tx *sql.Tx, orderID int) error {
+	type line struct {
+		productID, variantID sql.NullInt64
+		quantity             int
+	}
+	var lines []line
+	err := func() error {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT product_id, variant_id, quantity FROM order_items
+			WHERE order_id = $1 ORDER BY product_id, variant_id`, orderID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var l line
+			if err := rows.Scan(&l.productID, &l.variantID, &l.quantity); err != nil {
+				return err
+			}
+			lines = append(lines, l)
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return fmt.Errorf("error al leer ítems del pedido: %w", queryError(ctx, err))
+	}
+
+	for _, l := range lines {
+		switch {
+		case l.variantID.Valid:
+			_, err := tx.ExecContext(ctx, `UPDATE product_variants SET stock = stock + $2 WHERE id = $1`, l.variantID.Int64, l.quantity)
+			if err != nil {
+				return fmt.Errorf("error al devolver stock: %w", queryError(ctx, err))
+			}
+			if l.productID.Valid {
+				if err := notifyProductUpdated(ctx, tx, int(l.productID.Int64)); err != nil {
+					return err
+				}
+			}
+		case l.productID.Valid:
+			var product Product
+			err := tx.QueryRowContext(ctx, `
+				SELECT id, name, description, price_minor, currency, stock
+				FROM products WHERE id = $1 FOR UPDATE`, l.productID.Int64,
+			).Scan(&product.ID, &product.Name, &product.Description, &product.Price.Amount, &product.Price.Currency, &product.Stock)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue // El producto se borró después del pedido
+			}
+			if err != nil {
+				return fmt.Errorf("error al bloquear producto: %w", queryError(ctx, err))
+			}
+			if err := setProductStock(ctx, tx, product, product.Stock+l.quantity); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ====================================================================
+// HANDLERS DE PEDIDOS
+// ====================================================================
+
+// respondOrderError traduce los errores de dominio; el resto va a respondDBError.
+func respondOrderError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		http.Error(w, "Pedido no encontrado", http.StatusNotFound)
+	case errors.Is(err, ErrOrderInsufficientStock), errors.Is(err, ErrOrderInvalidTransition):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrOrderProductNotFound), errors.Is(err, ErrOrderVariantRequired), errors.Is(err, ErrNoExchangeRate):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		respondDBError(w, err, action)
+	}
+}
+
+// orderScope: Los admins ven y gestionan todos los pedidos (0); el resto, solo los suyos.
+func orderScope(r *http.Request) (int, error) {
+	userID, err := GetUserIDFromContext(r)
+	if err != nil {
+		return 0, err
+	}
+	if GetRoleFromContext(r) == RoleAdmin {
+		return 0, nil
+	}
+	return userID, nil
+}
+
+func writeOrderJSON(w http.ResponseWriter, status int, order Order) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(order)
+}
+
+// POST /orders: Crea un pedido con el stock reservado
+func CreateOrderHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := GetUserIDFromContext(r)
+		if err != nil {
+			http.Error(w, "Acceso no autorizado: ID de usuario no disponible.", http.StatusUnauthorized)
+			return
+		}
+
+		var request OrderRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
+			return
+		}
+		if err := request.normalize(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		order, err := CreateOrder(r.Context(), db, userID, request)
+		if err != nil {
+			respondOrderError(w, err, "crear pedido")
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("%s/%d", r.URL.Path, order.ID))
+		writeOrderJSON(w, http.StatusCreated, order)
+	}
+}
+
+// GET /orders: Pedidos del usuario (todos si es admin). Filtros: ?status=, ?user_id= (admin)
+func GetOrdersHandler(cluster *DBCluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scope, err := orderScope(r)
+		if err != nil {
+			http.Error(w, "Acceso no autorizado: ID de usuario no disponible.", http.StatusUnauthorized)
+			return
+		}
+
+		filter := OrderFilter{UserID: scope, Status: r.URL.Query().Get("status")}
+		if filter.Status != "" && !isOrderStatus(filter.Status) {
+			http.Error(w, fmt.Sprintf("Estado inválido %q", filter.Status), http.StatusBadRequest)
+			return
+		}
+		if value := r.URL.Query().Get("user_id"); value != "" && scope == 0 {
+			if filter.UserID, err = strconv.Atoi(value); err != nil {
+				http.Error(w, "user_id debe ser un número entero válido.", http.StatusBadRequest)
+				return
+			}
+		}
+
+		orders, err := GetOrders(r.Context(), cluster.Reader(r), filter)
+		if err != nil {
+			respondDBError(w, err, "obtener pedidos")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(orders)
+	}
+}
+
+// GET /orders/{id}: Un pedido (404 si es de otro usuario y no eres admin)
+func GetOrderHandler(cluster *DBCluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+		scope, err := orderScope(r)
+		if err != nil {
+			http.Error(w, "Acceso no autorizado: ID de usuario no disponible.", http.StatusUnauthorized)
+			return
+		}
+
+		order, err := GetOrder(r.Context(), cluster.Reader(r), id)
+		if err == nil && scope != 0 && order.UserID != scope {
+			err = ErrOrderNotFound // No revelar que el pedido existe
+		}
+		if err != nil {
+			respondOrderError(w, err, "obtener pedido")
+			return
+		}
+		writeOrderJSON(w, http.StatusOK, order)
+	}
+}
+
+// POST /orders/{id}/status: Cambia el estado ({"status": "paid"}). Los admins pueden
+// hacer cualquier transición válida; el dueño del pedido solo cancelarlo mientras esté pending.
+func UpdateOrderStatusHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+		scope, err := orderScope(r)
+		if err != nil {
+			http.Error(w, "Acceso no autorizado: ID de usuario no disponible.", http.StatusUnauthorized)
+			return
+		}
+
+		var request OrderStatusRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
+			return
+		}
+
+		if !isOrderStatus(request.Status) {
+			http.Error(w, fmt.Sprintf("Estado inválido %q", request.Status), http.StatusBadRequest)
+			return
+		}
+		if scope != 0 && request.Status != OrderCancelled {
+			http.Error(w, "Solo un administrador puede cambiar el pedido a "+request.Status, http.StatusForbidden)
+			return
+		}
+
+		order, err := UpdateOrderStatus(r.Context(), db, id, scope, request.Status)
+		if err != nil {
+			respondOrderError(w, err, "actualizar pedido")
+			return
+		}
+		writeOrderJSON(w, http.StatusOK, order)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test: Los ítems repetidos se agrupan y quedan ordenados para bloquear sin deadlocks
+func TestOrderRequestNormalize(t *testing.T) {
+	req := OrderRequest{Items: []OrderItemRequest{
+		{ProductID: 5, Quantity: 1},
+		{ProductID: 2, VariantID: 9, Quantity: 2},
+		{ProductID: 5, Quantity: 3},
+		{ProductID: 2, Quantity: 1},
+	}}
+	if err := req.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	want := []OrderItemRequest{
+		{ProductID: 2, Quantity: 1},
+		{ProductID: 2, VariantID: 9, Quantity: 2},
+		{ProductID: 5, Quantity: 4},
+	}
+	if req.Currency != defaultCurrency || len(req.Items) != len(want) {
+		t.Fatalf("Pedido mal normalizado: %+v", req)
+	}
+	for i := range want {
+		if req.Items[i] != want[i] {
+			t.Errorf("Ítem %d: got %+v want %+v", i, req.Items[i], want[i])
+		}
+	}
+
+	invalid := []OrderRequest{
+		{},
+		{Currency: "XYZ", Items: []OrderItemRequest{{ProductID: 1, Quantity: 1}}},
+		{Items: []OrderItemRequest{{ProductID: 0, Quantity: 1}}},
+		{Items: []OrderItemRequest{{ProductID: 1, Quantity: 0}}},
+		{Items: []OrderItemRequest{{ProductID: 1, Quantity: maxOrderQuantity}, {ProductID: 1, Quantity: 1}}},
+	}
+	for _, req := range invalid {
+		if err := req.normalize(); err == nil {
+			t.Errorf("Se esperaba error para %+v", req)
+		}
+	}
+}
+
+// Test: Máquina de estados de los pedidos
+func TestOrderTransitions(t *testing.T) {
+	allowed := [][2]string{
+		{OrderPending, OrderPaid}, {OrderPending, OrderCancelled},
+		{OrderPaid, OrderShipped}, {OrderPaid, OrderCancelled},
+		{OrderShipped, OrderDelivered},
+	}
+	for _, tr := range allowed {
+		if !canTransition(tr[0], tr[1]) {
+			t.Errorf("%s → %s debe estar permitido", tr[0], tr[1])
+		}
+	}
+
+	forbidden := [][2]string{
+		{OrderPending, OrderShipped}, {OrderShipped, OrderCancelled},
+		{OrderDelivered, OrderCancelled}, {OrderCancelled, OrderPending}, {OrderPaid, OrderPending},
+	}
+	for _, tr := range forbidden {
+		if canTransition(tr[0], tr[1]) {
+			t.Errorf("%s → %s no debe estar permitido", tr[0], tr[1])
+		}
+	}
+}
+
+// Test: Validaciones de los endpoints de pedidos
+func TestOrderEndpoints(t *testing.T) {
+	router, token, server := newProductTestRouter(t)
+	server.SetRows(nil)
+
+	rr := getWithToken(router, "/api/v1/orders", token)
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("GET /orders sin pedidos: got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := getWithToken(router, "/api/v1/orders?status=perdido", token); rr.Code != http.StatusBadRequest {
+		t.Errorf("status inválido: got %d want 400", rr.Code)
+	}
+	if rr := getWithToken(router, "/api/v1/orders/7", token); rr.Code != http.StatusNotFound {
+		t.Errorf("GET /orders/7 inexistente: got %d want 404", rr.Code)
+	}
+
+	cases := []struct {
+		name, path, body string
+		want             int
+	}{
+		{"sin ítems", "/api/v1/orders", `{"items":[]}`, http.StatusBadRequest},
+		{"cantidad negativa", "/api/v1/orders", `{"items":[{"product_id":1,"quantity":-1}]}`, http.StatusBadRequest},
+		{"moneda desconocida", "/api/v1/orders", `{"currency":"ABC","items":[{"product_id":1,"quantity":1}]}`, http.StatusBadRequest},
+		{"producto inexistente", "/api/v1/orders", `{"items":[{"product_id":1,"quantity":1}]}`, http.StatusUnprocessableEntity},
+		{"estado inválido", "/api/v1/orders/1/status", `{"status":"perdido"}`, http.StatusBadRequest},
+		{"usuario marca pagado", "/api/v1/orders/1/status", `{"status":"paid"}`, http.StatusForbidden},
+		{"cancelar inexistente", "/api/v1/orders/1/status", `{"status":"cancelled"}`, http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		if rr := postWithToken(router, tc.path, tc.body, token); rr.Code != tc.want {
+			t.Errorf("%s: got %d want %d (%s)", tc.name, rr.Code, tc.want, rr.Body.String())
+		}
+	}
+}
+
+// Test: Los importes del pedido se serializan como Money
+func TestOrderJSON(t *testing.T) {
+	productID := 3
+	order := Order{ID: 1, Status: OrderPending, Total: Money{Amount: 3998, Currency: "USD"}, Items: []OrderItem{{
+		ProductID: &productID, Name: "Mouse", Quantity: 2,
+		UnitPrice: Money{Amount: 1999, Currency: "USD"}, LineTotal: Money{Amount: 3998, Currency: "USD"},
+	}}}
+	data, err := json.Marshal(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"total":{"amount":"39.98","currency":"USD"}`, `"unit_price":{"amount":"19.99","currency":"USD"}`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Falta %s en %s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "variant_id") {
+		t.Errorf("variant_id debe omitirse si no hay variante: %s", data)
+	}
+}
+
+// openOrderTestDB: DB falsa con el producto 1 (sin variantes, con stock unidades) y
+// la variante 9 del producto 2 (con variantStock unidades).
+func openOrderTestDB(t *testing.T, stock, variantStock int64) (*sql.DB, *fakeServer) {
+	t.Helper()
+	db, server := openFakeDB(t, "orders")
+	now := time.Now()
+
+	// Bloqueo de productos y variantes
+	server.SetQueryRows("EXISTS (SELECT 1 FROM product_variants",
+		[]string{"id", "name", "description", "price_minor", "currency", "stock", "exists"},
+		[]driver.Value{int64(1), "Mouse", "", int64(1999), "USD", stock, false})
+	server.SetQueryRows("FROM products WHERE id = $1 FOR UPDATE",
+		[]string{"id", "name", "description", "price_minor", "currency", "stock"},
+		[]driver.Value{int64(1), "Mouse", "", int64(1999), "USD", stock})
+	server.SetQueryRows("FOR UPDATE OF v",
+		[]string{"name", "sku", "stock", "price_minor", "price_minor", "currency"},
+		[]driver.Value{"Camiseta", "TS-ROJO-M", variantStock, nil, int64(1000), "USD"})
+
+	// Pedidos
+	server.SetQueryRows("INSERT INTO webhook_events", []string{"id"}, []driver.Value{int64(1)})
+	server.SetQueryRows("INSERT INTO orders", []string{"id", "created_at", "updated_at"}, []driver.Value{int64(10), now, now})
+	server.SetQueryRows("UPDATE orders", []string{"updated_at"}, []driver.Value{now})
+	server.SetQueryRows("FROM orders",
+		[]string{"id", "user_id", "status", "currency", "total_minor", "created_at", "updated_at"},
+		[]driver.Value{int64(10), int64(5), OrderPending, "USD", int64(4998), now, now})
+	server.SetQueryRows("SELECT product_id, variant_id, quantity FROM order_items",
+		[]string{"product_id", "variant_id", "quantity"},
+		[]driver.Value{int64(1), nil, int64(2)},
+		[]driver.Value{int64(2), int64(9), int64(1)})
+	server.SetQueryRows("order_id = ANY",
+		[]string{"order_id", "product_id", "variant_id", "sku", "name", "unit_price_minor", "quantity", "line_total_minor"})
+
+	// Relectura del producto para el NOTIFY
+	server.SetRows(
+		[]string{"id", "name", "description", "price_minor", "currency", "stock", "images", "variant_count", "variant_stock", "min_price", "max_price"},
+		[]driver.Value{int64(2), "Camiseta", "", int64(1000), "USD", int64(0), []byte("[]"), int64(1), variantStock, int64(1000), int64(1000)},
+	)
+	return db, server
+}
+
+// Test: Un pedido descuenta el stock de productos y variantes y notifica ambos cambios
+func TestCreateOrderReservesStock(t *testing.T) {
+	db, server := openOrderTestDB(t, 3, 5)
+
+	req := OrderRequest{Items: []OrderItemRequest{{ProductID: 1, Quantity: 2}, {ProductID: 2, VariantID: 9, Quantity: 1}}}
+	if err := req.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	order, err := CreateOrder(context.Background(), db, 5, req)
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	if order.ID != 10 || order.Status != OrderPending || order.Total != (Money{Amount: 4998, Currency: "USD"}) || len(order.Items) != 2 {
+		t.Errorf("Pedido incorrecto: %+v", order)
+	}
+
+	if got, want := server.Args("UPDATE products SET stock"), [][]driver.Value{{int64(1), int64(1)}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Stock del producto: got %v want %v", got, want)
+	}
+	if got, want := server.Args("UPDATE product_variants SET stock = stock -"), [][]driver.Value{{int64(9), int64(1)}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Stock de la variante: got %v want %v", got, want)
+	}
+	queries := server.Queries()
+	if n := countQueries(queries, "SELECT pg_notify"); n != 2 {
+		t.Errorf("Se esperaba un NOTIFY por producto y otro por variante: got %d", n)
+	}
+	if n := countQueries(queries, "INSERT INTO order_items"); n != 2 {
+		t.Errorf("Se esperaban 2 ítems guardados: got %d", n)
+	}
+}
+
+// Test: Pedir más de lo que hay no descuenta nada ni crea el pedido
+func TestCreateOrderRejectsOversell(t *testing.T) {
+	cases := []struct {
+		name string
+		item OrderItemRequest
+	}{
+		{"producto", OrderItemRequest{ProductID: 1, Quantity: 2}},
+		{"variante", OrderItemRequest{ProductID: 2, VariantID: 9, Quantity: 2}},
+	}
+	for _, tc := range cases {
+		db, server := openOrderTestDB(t, 1, 1)
+		req := OrderRequest{Items: []OrderItemRequest{tc.item}}
+		if err := req.normalize(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := CreateOrder(context.Background(), db, 5, req); !errors.Is(err, ErrOrderInsufficientStock) {
+			t.Errorf("%s: got %v want ErrOrderInsufficientStock", tc.name, err)
+		}
+		queries := server.Queries()
+		for _, prefix := range []string{"UPDATE", "INSERT INTO orders", "SELECT pg_notify"} {
+			if n := countQueries(queries, prefix); n != 0 {
+				t.Errorf("%s: no debe ejecutarse %s (got %d)", tc.name, prefix, n)
+			}
+		}
+	}
+}
+
+// Test: Cancelar devuelve el stock de productos y variantes y notifica ambos cambios
+func TestCancelOrderRestoresStock(t *testing.T) {
+	db, server := openOrderTestDB(t, 1, 4)
+
+	order, err := UpdateOrderStatus(context.Background(), db, 10, 5, OrderCancelled)
+	if err != nil {
+		t.Fatalf("UpdateOrderStatus: %v", err)
+	}
+	if order.Status != OrderCancelled {
+		t.Errorf("Estado: got %s want %s", order.Status, OrderCancelled)
+	}
+
+	if got, want := server.Args("UPDATE products SET stock"), [][]driver.Value{{int64(1), int64(3)}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Stock del producto: got %v want %v", got, want)
+	}
+	if got, want := server.Args("UPDATE product_variants SET stock = stock +"), [][]driver.Value{{int64(9), int64(1)}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Stock de la variante: got %v want %v", got, want)
+	}
+	if n := countQueries(server.Queries(), "SELECT pg_notify"); n != 2 {
+		t.Errorf("Se esperaba un NOTIFY por producto y otro por variante: got %d", n)
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// ====================================================================
+// LISTAS DE PRECIOS Y TIPOS DE CAMBIO
+// Cada producto tiene un precio en su moneda y, opcionalmente, precios fijos
+// en otras monedas (product_prices). GET /productos?currency=XXX usa el precio
+// de lista si existe y, si no, convierte con la tabla exchange_rates, que
+// administran los admins en /tipos-cambio.
+// ====================================================================
+
+var (
+	ErrProductPriceNotFound = errors.New("el producto no tiene precio en esa moneda")
+	ErrPriceProduct         = errors.New("el producto no existe")
+	ErrExchangeRateNotFound = errors.New("tipo de cambio no encontrado")
+)
+
+// ExchangeRate: 1 Base = Rate Quote. Rate es un decimal exacto en texto ("0.9215").
+type ExchangeRate struct {
+	Base      string    `json:"base"`
+	Quote     string    `json:"quote"`
+	Rate      string    `json:"rate"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// rateFormat: Decimal plano que cabe en NUMERIC(20, 10): hasta 10 dígitos enteros y
+// 10 decimales. big.Rat aceptaría también fracciones ("1/3") y exponentes ("1e400").
+var rateFormat = regexp.MustCompile(`^[0-9]{1,10}(\.[0-9]{1,10})?$`)
+
+// parseRate interpreta un tipo de cambio decimal positivo.
+func parseRate(value string) (*big.Rat, error) {
+	value = strings.TrimSpace(value)
+	rate, ok := new(big.Rat).SetString(value)
+	if !rateFormat.MatchString(value) || !ok || rate.Sign() <= 0 {
+		return nil, fmt.Errorf("tipo de cambio inválido %q: debe ser un decimal positivo con hasta 10 dígitos enteros y 10 decimales", value)
+	}
+	return rate, nil
+}
+
+// trimDecimal quita los ceros sobrantes de un NUMERIC ("0.9215000000" -> "0.9215").
+func trimDecimal(value string) string {
+	if !strings.Contains(value, ".") {
+		return value
+	}
+	return strings.TrimSuffix(strings.TrimRight(value, "0"), ".")
+}
+
+// ====================================================================
+// DAO
+// ====================================================================
+
+// GetProductCurrency devuelve la moneda del producto o sql.ErrNoRows.
+func GetProductCurrency(ctx context.Context, db *sql.DB, productID int) (string, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var currency string
+	err := db.QueryRowContext(ctx, `SELECT currency FROM products WHERE id = $1`, productID).Scan(&currency)
+	return currency, queryError(ctx, err)
+}
+
+// GetProductPrices devuelve los precios de lista del producto, por moneda.
+func GetProductPrices(ctx context.Context, db *sql.DB, productID int) ([]Money, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT amount_minor, currency FROM product_prices WHERE product_id = $1 ORDER BY currency`, productID)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar precios: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	prices := []Money{}
+	for rows.Next() {
+		var m Money
+		if err := rows.Scan(&m.Amount, &m.Currency); err != nil {
+			return nil, fmt.Errorf("error al leer precios: %w", err)
+		}
+		prices = append(prices, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al leer precios: %w", queryError(ctx, err))
+	}
+	return prices, nil
+}
+
+// SetProductPrice crea o reemplaza el precio de lista del producto en price.Currency.
+func SetProductPrice(ctx context.Context, db *sql.DB, productID int, price Money) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO product_prices (product_id, currency, amount_minor) VALUES ($1, $2, $3)
+		ON CONFLICT (product_id, currency) DO UPDATE SET amount_minor = EXCLUDED.amount_minor`,
+		productID, price.Currency, price.Amount,
+	)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+		return ErrPriceProduct
+	}
+	if err != nil {
+		return fmt.Errorf("error al guardar precio: %w", queryError(ctx, err))
+	}
+	return nil
+}
+
+// DeleteProductPrice elimina el precio de lista del producto en currency.
+func DeleteProductPrice(ctx context.Context, db *sql.DB, productID int, currency string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx,
+		`DELETE FROM product_prices WHERE product_id = $1 AND currency = $2`, productID, currency)
+	if err != nil {
+		return fmt.Errorf("error al eliminar precio: %w", queryError(ctx, err))
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrProductPriceNotFound
+	}
+	return nil
+}
+
+// GetExchangeRates devuelve todos los tipos de cambio.
+func GetExchangeRates(ctx context.Context, db *sql.DB) ([]ExchangeRate, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `SELECT base, quote, rate::text, updated_at FROM exchange_rates ORDER BY base, quote`)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar tipos de cambio: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	rates := []ExchangeRate{}
+	for rows.Next() {
+		var rate ExchangeRate
+		if err := rows.Scan(&rate.Base, &rate.Quote, &rate.Rate, &rate.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("error al leer tipos de cambio: %w", err)
+		}
+		rate.Rate = trimDecimal(rate.Rate)
+		rates = append(rates, rate)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al leer tipos de cambio: %w", queryError(ctx, err))
+	}
+	return rates, nil
+}
+
+// SetExchangeRate crea o actualiza el tipo de cambio base -> quote.
+func SetExchangeRate(ctx context.Context, db *sql.DB, rate ExchangeRate) (ExchangeRate, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO exchange_rates (base, quote, rate, updated_at) VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (base, quote) DO UPDATE SET rate = EXCLUDED.rate, updated_at = NOW()
+		RETURNING updated_at`,
+		rate.Base, rate.Quote, rate.Rate,
+	).Scan(&rate.UpdatedAt)
+	if err != nil {
+		return ExchangeRate{}, fmt.Errorf("error al guardar tipo de cambio: %w", queryError(ctx, err))
+	}
+	return rate, nil
+}
+
+// DeleteExchangeRate elimina el tipo de cambio base -> quote.
+func DeleteExchangeRate(ctx context.Context, db *sql.DB, base, quote string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM exchange_rates WHERE base = $1 AND quote = $2`, base, quote)
+	if err != nil {
+		return fmt.Errorf("error al eliminar tipo de cambio: %w", queryError(ctx, err))
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrExchangeRateNotFound
+	}
+	return nil
+}
+
+// loadExchangeRates lee la tabla completa (es pequeña) para convertir en memoria.
+func loadExchangeRates(ctx context.Context, db *sql.DB) (ExchangeRates, error) {
+	list, err := GetExchangeRates(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	rates := make(ExchangeRates)
+	for _, rate := range list {
+		value, err := parseRate(rate.Rate)
+		if err != nil {
+			return nil, fmt.Errorf("tipo de cambio %s/%s: %w", rate.Base, rate.Quote, err)
+		}
+		rates.Set(rate.Base, rate.Quote, value)
+	}
+	return rates, nil
+}
+
+// LocalizeProducts expresa los precios de products en currency. Usa el precio de
+// lista del producto en esa moneda si existe; si no (y para los precios propios de
+// las variantes) convierte con los tipos de cambio. Devuelve ErrNoExchangeRate si
+// falta algún par.
+func LocalizeProducts(ctx context.Context, db *sql.DB, products []Product, currency string) error {
+	ids := make([]int64, 0, len(products))
+	for _, p := range products {
+		if p.Price.Currency != currency {
+			ids = append(ids, int64(p.ID))
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// 1. Precios de lista en la moneda pedida
+	listPrices, err := loadListPrices(ctx, db, currency, ids)
+	if err != nil {
+		return err
+	}
+
+	// 2. Conversión
+	rates, err := loadExchangeRates(ctx, db)
+	if err != nil {
+		return err
+	}
+	for i := range products {
+		if err := localizeProduct(&products[i], currency, listPrices, rates); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadListPrices lee los precios de lista en currency de los productos ids; con
+// ids nil, los de todo el catálogo (para exportar sin conocer antes los IDs).
+func loadListPrices(ctx context.Context, db *sql.DB, currency string, ids []int64) (map[int]int64, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT product_id, amount_minor FROM product_prices WHERE currency = $1`
+	args := []any{currency}
+	if ids != nil {
+		query += ` AND product_id = ANY($2)`
+		args = append(args, pq.Array(ids))
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar precios de lista: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	listPrices := make(map[int]int64)
+	for rows.Next() {
+		var id int
+		var amount int64
+		if err := rows.Scan(&id, &amount); err != nil {
+			return nil, fmt.Errorf("error al leer precios de lista: %w", err)
+		}
+		listPrices[id] = amount
+	}
+	if err := rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+	return listPrices, nil
+}
+
+func localizeProduct(p *Product, currency string, listPrices map[int]int64, rates ExchangeRates) error {
+	if p.Price.Currency == currency {
+		return nil
+	}
+
+	amount, hasListPrice := listPrices[p.ID]
+	price := Money{Amount: amount, Currency: currency}
+	if !hasListPrice {
+		converted, err := rates.Convert(p.Price, currency)
+		if err != nil {
+			return err
+		}
+		price = converted
+	}
+
+	if p.PriceRange != nil {
+		if !p.hasVariants {
+			p.PriceRange = &PriceRange{Min: price, Max: price}
+		} else {
+			min, err := rates.Convert(p.PriceRange.Min, currency)
+			if err != nil {
+				return err
+			}
+			max, err := rates.Convert(p.PriceRange.Max, currency)
+			if err != nil {
+				return err
+			}
+			p.PriceRange = &PriceRange{Min: min, Max: max}
+		}
+	}
+	p.Price = price
+	return nil
+}
+
+// catalogPricer expresa precios del catálogo en una moneda (la de un pedido o un
+// carrito) con las mismas reglas que ?currency=. q es la conexión o transacción en
+// la que se leen los precios de lista; los tipos de cambio se leen una sola vez y
+// solo si hacen falta.
+type catalogPricer struct {
+	db       *sql.DB
+	q        dbExecutor
+	currency string
+	rates    ExchangeRates
+}
+
+// price convierte el precio de catálogo a la moneda del pricer. useList indica si el
+// precio es el del producto (y por tanto puede usarse su precio de lista).
+func (pr *catalogPricer) price(ctx context.Context, productID int, catalog Money, useList bool) (Money, error) {
+	if catalog.Currency == pr.currency {
+		return catalog, nil
+	}
+	if useList {
+		var amount int64
+		err := pr.q.QueryRowContext(ctx,
+			`SELECT amount_minor FROM product_prices WHERE product_id = $1 AND currency = $2`,
+			productID, pr.currency).Scan(&amount)
+		if err == nil {
+			return Money{Amount: amount, Currency: pr.currency}, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return Money{}, fmt.Errorf("error al consultar precio de lista: %w", queryError(ctx, err))
+		}
+	}
+	if pr.rates == nil {
+		rates, err := loadExchangeRates(ctx, pr.db)
+		if err != nil {
+			return Money{}, err
+		}
+		pr.rates = rates
+	}
+	return pr.rates.Convert(catalog, pr.currency)
+}
+
+// ====================================================================
+// HANDLERS
+// ====================================================================
+
+// requestedCurrency lee ?currency= (vacío = sin conversión); responde 400 si no está soportada.
+func requestedCurrency(w http.ResponseWriter, r *http.Request) (string, bool) {
+	value := r.URL.Query().Get("currency")
+	if value == "" {
+		return "", true
+	}
+	currency, err := normalizeCurrency(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return currency, true
+}
+
+// respondLocalizeError: falta de tipo de cambio = 422; el resto va a respondDBError.
+func respondLocalizeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNoExchangeRate) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	respondDBError(w, err, "convertir precios")
+}
+
+// parseCurrencyParam lee {currency} de la ruta; responde 400 si no está soportada.
+func parseCurrencyParam(w http.ResponseWriter, r *http.Request, name string) (string, bool) {
+	currency, err := normalizeCurrency(chi.URLParam(r, name))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return currency, true
+}
+
+// GET /productos/{id}/precios: Precios de lista del producto
+func GetProductPricesHandler(cluster *DBCluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		prices, err := GetProductPrices(r.Context(), cluster.Reader(r), id)
+		if err != nil {
+			respondDBError(w, err, "obtener precios")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(prices)
+	}
+}
+
+// ProductPriceRequest: Cuerpo de PUT /productos/{id}/precios/{currency}
+type ProductPriceRequest struct {
+	Amount json.RawMessage `json:"amount"` // "21.50" o 21.50
+}
+
+// PUT /productos/{id}/precios/{currency}: Fija el precio del producto en esa moneda
+func SetProductPriceHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+		currency, ok := parseCurrencyParam(w, r, "currency")
+		if !ok {
+			return
+		}
+
+		var request ProductPriceRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
+			return
+		}
+		amount, err := decimalText(request.Amount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		price, err := ParseMoney(amount, currency)
+		if err != nil || price.Amount < 0 {
+			http.Error(w, fmt.Sprintf("Importe inválido %q para %s", amount, currency), http.StatusBadRequest)
+			return
+		}
+
+		if err := SetProductPrice(r.Context(), db, id, price); err != nil {
+			if errors.Is(err, ErrPriceProduct) {
+				http.Error(w, "Producto no encontrado.", http.StatusNotFound)
+				return
+			}
+			respondDBError(w, err, "guardar precio")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(price)
+	}
+}
+
+// DELETE /productos/{id}/precios/{currency}: Quita el precio de lista (vuelve a convertirse)
+func DeleteProductPriceHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+		currency, ok := parseCurrencyParam(w, r, "currency")
+		if !ok {
+			return
+		}
+
+		err := DeleteProductPrice(r.Context(), db, id, currency)
+		if errors.Is(err, ErrProductPriceNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondDBError(w, err, "eliminar precio")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GET /tipos-cambio: Lista los tipos de cambio
+func ListExchangeRatesHandler(cluster *DBCluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rates, err := GetExchangeRates(r.Context(), cluster.Reader(r))
+		if err != nil {
+			respondDBError(w, err, "obtener tipos de cambio")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rates)
+	}
+}
+
+// ExchangeRateRequest: Cuerpo de PUT /tipos-cambio/{base}/{quote}
+type ExchangeRateRequest struct {
+	Rate json.RawMessage `json:"rate"` // "0.9215" o 0.9215
+}
+
+// PUT /tipos-cambio/{base}/{quote}: Crea o actualiza un tipo de cambio (solo admin)
+func SetExchangeRateHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		base, ok := parseCurrencyParam(w, r, "base")
+		if !ok {
+			return
+		}
+		quote, ok := parseCurrencyParam(w, r, "quote")
+		if !ok {
+			return
+		}
+		if base == quote {
+			http.Error(w, "La moneda base y la cotizada deben ser distintas", http.StatusBadRequest)
+			return
+		}
+
+		var request ExchangeRateRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
+			return
+		}
+		value, err := decimalText(request.Rate)
+		if err == nil {
+			_, err = parseRate(value)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rate, err := SetExchangeRate(r.Context(), db, ExchangeRate{Base: base, Quote: quote, Rate: value})
+		if err != nil {
+			respondDBError(w, err, "guardar tipo de cambio")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rate)
+	}
+}
+
+// DELETE /tipos-cambio/{base}/{quote}: Elimina un tipo de cambio (solo admin)
+func DeleteExchangeRateHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		base, ok := parseCurrencyParam(w, r, "base")
+		if !ok {
+			return
+		}
+		quote, ok := parseCurrencyParam(w, r, "quote")
+		if !ok {
+			return
+		}
+
+		err := DeleteExchangeRate(r.Context(), db, base, quote)
+		if errors.Is(err, ErrExchangeRateNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondDBError(w, err, "eliminar tipo de cambio")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ====================================================================
+// FORMATOS DE GET /productos (negociados con Accept)
+// JSON es el formato por defecto (con caché y ETag, ver handlers.go). NDJSON y
+// CSV se escriben a medida que PostgreSQL entrega las filas, sin juntar el
+// catálogo en memoria: sirven para exportaciones grandes.
+// ====================================================================
+
+const (
+	mediaTypeJSON   = "application/json"
+	mediaTypeNDJSON = "application/x-ndjson"
+	mediaTypeCSV    = "text/csv"
+)
+
+// productListFormats: El primero es el de por defecto (sin Accept o con */*).
+var productListFormats = []string{mediaTypeJSON, mediaTypeNDJSON, mediaTypeCSV}
+
+// streamFlushEvery: Filas entre cada Flush, para que el cliente reciba datos sin
+// esperar al final y sin un Flush (y un bloque comprimido) por fila.
+const streamFlushEvery = 100
+
+// productRowWriter escribe un producto en el formato elegido.
+type productRowWriter interface {
+	WriteProduct(p Product) error
+	Flush() error
+}
+
+type ndjsonProductWriter struct {
+	r   *http.Request
+	enc *json.Encoder
+}
+
+// WriteProduct: Una línea por producto, con la misma representación que el JSON.
+func (n *ndjsonProductWriter) WriteProduct(p Product) error {
+	return n.enc.Encode(versionedProduct(n.r, p))
+}
+
+func (n *ndjsonProductWriter) Flush() error { return nil }
+
+type csvProductWriter struct {
+	version APIVersion
+	w       *csv.Writer
+}
+
+// newCSVProductWriter escribe la fila de encabezados. En v1 los importes van en
+// decimal exacto ("19.99"), en v2 en unidades menores, como en el JSON.
+func newCSVProductWriter(w http.ResponseWriter, version APIVersion) (*csvProductWriter, error) {
+	c := &csvProductWriter{version: version, w: csv.NewWriter(w)}
+	header := []string{"id", "name", "description", "price", "currency", "stock", "total_stock", "min_price", "max_price"}
+	if version == APIv2 {
+		header = []string{"id", "name", "description", "price_cents", "currency", "stock", "total_stock", "min_price_cents", "max_price_cents"}
+	}
+	return c, c.w.Write(header)
+}
+
+func (c *csvProductWriter) WriteProduct(p Product) error {
+	amount := func(m Money) string {
+		if c.version == APIv2 {
+			return strconv.FormatInt(m.Amount, 10)
+		}
+		return m.String()
+	}
+	row := []string{strconv.Itoa(p.ID), csvText(p.Name), csvText(p.Description), amount(p.Price), p.Price.Currency, strconv.Itoa(p.Stock), "", "", ""}
+	if p.TotalStock != nil {
+		row[6] = strconv.Itoa(*p.TotalStock)
+	}
+	if p.PriceRange != nil {
+		row[7], row[8] = amount(p.PriceRange.Min), amount(p.PriceRange.Max)
+	}
+	return c.w.Write(row)
+}
+
+func (c *csvProductWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// csvText evita que una hoja de cálculo interprete el texto como fórmula
+// (inyección CSV): los valores que empiezan por =, +, -, @ o un control van con '.
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// streamProducts responde GET /productos en NDJSON o CSV. Los errores anteriores a
+// la primera fila se responden como siempre; después el estado ya se envió, así
+// que se corta la conexión para que el cliente no tome la respuesta por completa.
+func streamProducts(w http.ResponseWriter, r *http.Request, db *sql.DB, filter ProductFilter, currency string, store BlobStore, format string) {
+	ctx := r.Context()
+
+	// 1. Conversión de moneda: precios de lista de todo el catálogo y tipos de cambio,
+	// porque los IDs no se conocen hasta recorrer las filas
+	var listPrices map[int]int64
+	var rates ExchangeRates
+	if currency != "" {
+		var err error
+		if listPrices, err = loadListPrices(ctx, db, currency, nil); err != nil {
+			respondDBError(w, err, "obtener precios de lista")
+			return
+		}
+		if rates, err = loadExchangeRates(ctx, db); err != nil {
+			respondDBError(w, err, "obtener tipos de cambio")
+			return
+		}
+	}
+
+	// 2. Escritura fila a fila
+	started := false
+	var out productRowWriter
+	rows := 0
+	// fn escribe al cliente: un cliente lento alarga la consulta, de ahí DB_EXPORT_TIMEOUT
+	err := EachProduct(ctx, db, filter, exportQueryTimeout, func(p Product) error {
+		if currency != "" {
+			if err := localizeProduct(&p, currency, listPrices, rates); err != nil {
+				return err
+			}
+		}
+		withImageURLs(store, &p)
+
+		if !started {
+			started = true
+			var err error
+			if out, err = startProductStream(w, r, format); err != nil {
+				return err
+			}
+		}
+		if err := out.WriteProduct(p); err != nil {
+			return err
+		}
+		if rows++; rows%streamFlushEvery == 0 {
+			return flushProductStream(w, out)
+		}
+		return nil
+	})
+
+	// 3. Cierre o error
+	switch {
+	case err == nil && !started:
+		// Sin productos: NDJSON vacío o CSV con solo los encabezados
+		if out, err = startProductStream(w, r, format); err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			slog.Warn("Error al escribir la exportación", "format", format, "err", err)
+		}
+	case err == nil:
+		if err := out.Flush(); err != nil {
+			slog.Warn("Error al escribir la exportación", "format", format, "err", err)
+		}
+	case !started:
+		respondLocalizeError(w, err)
+	default:
+		// Si el cliente se fue no hace falta registrar el corte
+		if ctx.Err() == nil {
+			slog.Error("Exportación interrumpida", "format", format, "rows", rows, "err", err)
+		}
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func startProductStream(w http.ResponseWriter, r *http.Request, format string) (productRowWriter, error) {
+	if format == mediaTypeCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		return newCSVProductWriter(w, APIVersionFromRequest(r))
+	}
+	w.Header().Set("Content-Type", mediaTypeNDJSON)
+	return &ndjsonProductWriter{r: r, enc: json.NewEncoder(w)}, nil
+}
+
+// flushProductStream envía lo escrito hasta ahora. ErrNotSupported no es un error:
+// algunos writers intermedios no hacen streaming y entregan todo al final.
+func flushProductStream(w http.ResponseWriter, out productRowWriter) error {
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if err := http.NewResponseController(w).Flush(); err != nil && err != http.ErrNotSupported {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ====================================================================
+// STREAM DE CAMBIOS DEL CATÁLOGO (SERVER-SENT EVENTS)
+// Cada cambio de producto hace pg_notify('product_changes', ...) dentro de su
+// transacción. Cada instancia de la API escucha ese canal en el primario con
+// LISTEN, guarda los últimos eventos en un buffer acotado (para Last-Event-ID)
+// y los reparte a los clientes conectados a GET /productos/stream.
+// ====================================================================
+
+// ProductChangesChannel: Canal de LISTEN/NOTIFY de PostgreSQL.
+const ProductChangesChannel = "product_changes"
+
+// maxNotifyPayload: PostgreSQL rechaza payloads de NOTIFY de 8000 bytes o más.
+const maxNotifyPayload = 7900
+
+// ProductEvent: Cambio de un producto. ID viene de la secuencia product_events_seq,
+// así es único y creciente entre todas las instancias.
+type ProductEvent struct {
+	ID      int64   `json:"id"`
+	Type    string  `json:"type"` // product.created | product.updated | product.deleted | catalog.changed
+	Product Product `json:"product"`
+}
+
+// NotifyProductChange publica el cambio con pg_notify. Debe llamarse dentro de la
+// transacción del cambio: PostgreSQL solo entrega la notificación tras el COMMIT.
+func NotifyProductChange(ctx context.Context, tx *sql.Tx, eventType string, product Product) error {
+	data, err := json.Marshal(product)
+	if err != nil {
+		return fmt.Errorf("error al serializar producto: %w", err)
+	}
+	if len(data) > maxNotifyPayload {
+		// Una descripción enorme no debe hacer fallar la escritura: se envía sin ella
+		product.Description = ""
+		data, _ = json.Marshal(product)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		SELECT pg_notify($1, json_build_object(
+			'id', nextval('product_events_seq'), 'type', $2::text, 'product', $3::json
+		)::text)`,
+		ProductChangesChannel, eventType, string(data),
+	)
+	if err != nil {
+		return fmt.Errorf("error al notificar %s: %w", eventType, queryError(ctx, err))
+	}
+	return nil
+}
+
+// notifyProductUpdated relee el producto dentro de tx y publica product.updated.
+// Lo usan las escrituras que cambian lo que devuelve GET /productos/{id} sin
+// pasar por UpdateProduct: variantes, stock de variantes e imágenes.
+func notifyProductUpdated(ctx context.Context, tx *sql.Tx, productID int) error {
+	product, err := scanProduct(tx.QueryRowContext(ctx, productSelect+` WHERE p.id = $1`, productID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil // El producto ya no existe: no hay nada que refrescar
+	}
+	if err != nil {
+		return fmt.Errorf("error al releer producto: %w", queryError(ctx, err))
+	}
+	return NotifyProductChange(ctx, tx, WebhookEventProductUpdated, product)
+}
+
+// CatalogChangedEvent: Cambio que solo afecta a las listas (categorías). No se
+// envía a los clientes SSE; solo lo reciben los observadores (caché, Last-Modified).
+const CatalogChangedEvent = "catalog.changed"
+
+// NotifyCatalogChange publica CatalogChangedEvent dentro de tx (ver NotifyProductChange).
+func NotifyCatalogChange(ctx context.Context, tx *sql.Tx) error {
+	return NotifyProductChange(ctx, tx, CatalogChangedEvent, Product{})
+}
+
+// ====================================================================
+// BROKER: buffer de reanudación y reparto a suscriptores
+// ====================================================================
+
+// ProductEventBroker reparte los eventos recibidos por LISTEN a los clientes SSE.
+type ProductEventBroker struct {
+	mu           sync.Mutex
+	buffer       []ProductEvent // Últimos eventos, del más antiguo al más nuevo
+	bufferSize   int
+	clientBuffer int
+	subscribers  map[chan ProductEvent]struct{}
+	observers    []ProductChangeObserver
+	closed       bool
+}
+
+// ProductChangeObserver recibe los cambios que llegan por LISTEN (p. ej. la caché
+// de productos para invalidar). Reset se llama tras reconectar: pudo perderse algo.
+type ProductChangeObserver interface {
+	HandleEvent(event ProductEvent)
+	Reset()
+}
+
+func NewProductEventBroker(cfg StreamConfig) *ProductEventBroker {
+	return &ProductEventBroker{
+		bufferSize:   cfg.BufferSize,
+		clientBuffer: cfg.ClientBuffer,
+		subscribers:  make(map[chan ProductEvent]struct{}),
+	}
+}
+
+// Publish guarda el evento en el buffer y lo envía a los suscriptores. Un cliente
+// cuyo canal está lleno se desconecta (se cierra su canal): al reconectar con
+// Last-Event-ID recupera lo perdido desde el buffer, sin frenar a los demás.
+func (b *ProductEventBroker) Publish(event ProductEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	b.buffer = append(b.buffer, event)
+	if len(b.buffer) > b.bufferSize {
+		b.buffer = b.buffer[len(b.buffer)-b.bufferSize:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe registra un cliente. Si lastEventID > 0 devuelve los eventos posteriores
+// que sigan en el buffer; gap indica que algunos ya se descartaron y el cliente
+// debe recargar el catálogo completo.
+func (b *ProductEventBroker) Subscribe(lastEventID int64) (replay []ProductEvent, gap bool, events <-chan ProductEvent, unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan ProductEvent, b.clientBuffer)
+	if b.closed {
+		close(ch)
+		return nil, false, ch, func() {}
+	}
+	b.subscribers[ch] = struct{}{}
+
+	if lastEventID > 0 {
+		// Si el buffer ya no llega hasta lastEventID (o esta instancia acaba de
+		// arrancar) no se puede saber qué se perdió. Los IDs no son contiguos
+		// (un rollback consume valores de la secuencia), por eso se compara con <.
+		gap = len(b.buffer) == 0 || lastEventID < b.buffer[0].ID
+		for _, event := range b.buffer {
+			if event.ID > lastEventID {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	unsubscribe = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return replay, gap, ch, unsubscribe
+}
+
+// Observe registra un observador de los eventos recibidos por LISTEN.
+func (b *ProductEventBroker) Observe(observer ProductChangeObserver) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.observers = append(b.observers, observer)
+}
+
+// notifyObservers se llama sin b.mu tomado: los observadores pueden tardar (Redis).
+func (b *ProductEventBroker) notifyObservers(event *ProductEvent) {
+	b.mu.Lock()
+	observers := b.observers
+	b.mu.Unlock()
+	for _, observer := range observers {
+		if event == nil {
+			observer.Reset()
+		} else {
+			observer.HandleEvent(*event)
+		}
+	}
+}
+
+// Close desconecta a todos los clientes (al apagar el servidor).
+func (b *ProductEventBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Listen consume las notificaciones de PostgreSQL hasta que ctx se cancele.
+// pq.Listener reconecta solo; envía nil tras reconectar (pudo haber pérdidas).
+func (b *ProductEventBroker) Listen(ctx context.Context, notifications <-chan *pq.Notification) {
+	defer b.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-notifications:
+			if n == nil {
+				slog.Warn("Stream: conexión LISTEN restablecida, pueden haberse perdido eventos")
+				b.notifyObservers(nil)
+				continue
+			}
+			var event ProductEvent
+			if err := json.Unmarshal([]byte(n.Extra), &event); err != nil {
+				slog.Warn("Stream: notificación inválida", "channel", n.Channel, "err", err)
+				continue
+			}
+			if event.Type != CatalogChangedEvent {
+				b.Publish(event)
+			}
+			b.notifyObservers(&event)
+		}
+	}
+}
+
+// StartProductChangesListener abre la conexión LISTEN contra el primario.
+func StartProductChangesListener(ctx context.Context, dsn string, broker *ProductEventBroker) (*pq.Listener, error) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Error("Stream: error en la conexión LISTEN", "err", err)
+		}
+	})
+	if err := listener.Listen(ProductChangesChannel); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error al hacer LISTEN %s: %w", ProductChangesChannel, err)
+	}
+	go broker.Listen(ctx, listener.Notify)
+	return listener, nil
+}
+
+// ====================================================================
+// HANDLER SSE
+// ====================================================================
+
+// parseProductIDs interpreta ?ids=1,2,3 (vacío = todos los productos).
+func parseProductIDs(value string) (map[int]bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	ids := make(map[int]bool)
+	for _, part := range strings.Split(value, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("ID de producto inválido: %q", part)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// writeSSEEvent escribe un evento en formato text/event-stream.
+func writeSSEEvent(w http.ResponseWriter, r *http.Request, event ProductEvent) error {
+	data, err := json.Marshal(versionedProduct(r, event.Product))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// GET /productos/stream: Envía los cambios de productos en tiempo real (SSE).
+// - Last-Event-ID (o ?last_event_id=): reanuda desde el buffer; si hay hueco envía "resync".
+// - ?ids=1,2: solo esos productos.
+// - Cada HeartbeatInterval se envía un comentario para que los proxies no corten la conexión.
+func ProductStreamHandler(broker *ProductEventBroker, heartbeat time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 1. Parámetros
+		filter, err := parseProductIDs(r.URL.Query().Get("ids"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("last_event_id")
+		}
+		var lastEventID int64
+		if lastID != "" {
+			if lastEventID, err = strconv.ParseInt(lastID, 10, 64); err != nil {
+				http.Error(w, "Last-Event-ID inválido", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// 2. La conexión es larga: se quita el WriteTimeout del servidor para esta respuesta
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			slog.Debug("Stream: no se pudo quitar el write deadline", "err", err)
+		}
+
+		replay, gap, events, unsubscribe := broker.Subscribe(lastEventID)
+		defer unsubscribe()
+		sseClientsConnected.Inc()
+		defer sseClientsConnected.Dec()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // nginx: no bufferizar
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "retry: 3000\n\n")
+
+		// 3. Reanudación desde el buffer
+		if gap {
+			fmt.Fprint(w, "event: resync\ndata: {}\n\n")
+		}
+		send := func(event ProductEvent) error {
+			if filter != nil && !filter[event.Product.ID] {
+				return nil
+			}
+			return writeSSEEvent(w, r, event)
+		}
+		for _, event := range replay {
+			if err := send(event); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		// 4. Eventos en vivo y heartbeats
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return // Cliente lento o servidor apagándose: el navegador reconecta solo
+				}
+				if err := send(event); err != nil {
+					return
+				}
+			case <-ticker.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func newTestBroker(bufferSize, clientBuffer int) *ProductEventBroker {
+	return NewProductEventBroker(StreamConfig{BufferSize: bufferSize, ClientBuffer: clientBuffer})
+}
+
+func productEvent(id int64, productID int) ProductEvent {
+	return ProductEvent{ID: id, Type: WebhookEventProductUpdated, Product: Product{ID: productID, Name: "P", Stock: 1}}
+}
+
+// Test: Last-Event-ID reanuda desde el buffer y avisa si ya no alcanza
+func TestProductEventBrokerReplay(t *testing.T) {
+	broker := newTestBroker(3, 10)
+	for id := int64(1); id <= 5; id++ {
+		broker.Publish(productEvent(id, 1))
+	}
+
+	replay, gap, _, unsubscribe := broker.Subscribe(4)
+	defer unsubscribe()
+	if gap || len(replay) != 1 || replay[0].ID != 5 {
+		t.Errorf("Desde 4 se esperaba solo el 5 sin hueco: gap=%v replay=%v", gap, replay)
+	}
+
+	replay, gap, _, unsubscribe2 := broker.Subscribe(1)
+	defer unsubscribe2()
+	if !gap || len(replay) != 3 {
+		t.Errorf("Desde 1 se esperaba hueco y los 3 eventos del buffer: gap=%v replay=%v", gap, replay)
+	}
+}
+
+// Test: Un cliente que no consume se desconecta sin bloquear al resto
+func TestProductEventBrokerDropsSlowClients(t *testing.T) {
+	broker := newTestBroker(10, 1)
+	_, _, slow, _ := broker.Subscribe(0)
+	_, _, fast, unsubscribe := broker.Subscribe(0)
+	defer unsubscribe()
+
+	broker.Publish(productEvent(1, 1))
+	<-fast
+	broker.Publish(productEvent(2, 1))
+
+	<-slow // El primer evento sí entró en su cola
+	if _, ok := <-slow; ok {
+		t.Error("El canal del cliente lento debe cerrarse")
+	}
+	if event := <-fast; event.ID != 2 {
+		t.Errorf("El cliente rápido debe recibir el evento 2: got %d", event.ID)
+	}
+}
+
+// Test: Las notificaciones de PostgreSQL se publican en el broker
+func TestProductEventBrokerListen(t *testing.T) {
+	broker := newTestBroker(10, 10)
+	_, _, events, _ := broker.Subscribe(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	notifications := make(chan *pq.Notification, 1)
+	go broker.Listen(ctx, notifications)
+
+	notifications <- &pq.Notification{
+		Channel: ProductChangesChannel,
+		Extra:   `{"id":9,"type":"product.deleted","product":{"id":3,"name":"Mouse","description":"","price":{"amount":"10.00","currency":"USD"},"stock":0}}`,
+	}
+	event := <-events
+	if event.ID != 9 || event.Type != WebhookEventProductDeleted || event.Product.ID != 3 {
+		t.Errorf("Evento mal decodificado: %+v", event)
+	}
+
+	// catalog.changed solo llega a los observadores, no a los clientes
+	observer := recordingObserver{make(chan ProductEvent, 1), make(chan struct{}, 1)}
+	broker.Observe(observer)
+	notifications <- &pq.Notification{Channel: ProductChangesChannel, Extra: `{"id":10,"type":"catalog.changed","product":{}}`}
+	if got := <-observer.events; got.Type != CatalogChangedEvent {
+		t.Errorf("El observador debe recibir catalog.changed: %+v", got)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("catalog.changed no debe enviarse a los clientes: %+v", event)
+	default:
+	}
+
+	// Al cancelar se desconecta a los clientes
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("Al detener Listen los clientes deben desconectarse")
+	}
+}
+
+// Test: El endpoint SSE reanuda, filtra por IDs y envía heartbeats
+func TestProductStreamHandler(t *testing.T) {
+	broker := newTestBroker(10, 10)
+	broker.Publish(productEvent(1, 1))
+	broker.Publish(productEvent(2, 2))
+
+	server := httptest.NewServer(ProductStreamHandler(broker, 20*time.Millisecond))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"?ids=2,3", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type incorrecto: %q", got)
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	waitFor := func(want string) {
+		t.Helper()
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatalf("El stream terminó sin recibir %q", want)
+				}
+				if strings.HasPrefix(line, "id: 4") {
+					t.Fatal("El producto 4 no está en el filtro y no debe enviarse")
+				}
+				if line == want {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("No se recibió %q", want)
+			}
+		}
+	}
+
+	waitFor("id: 2") // Reanudación desde el buffer
+	broker.Publish(productEvent(3, 3))
+	broker.Publish(productEvent(4, 4))
+	broker.Publish(productEvent(5, 2))
+	waitFor("id: 3")
+	waitFor("id: 5")
+	waitFor(": heartbeat")
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ====================================================================
+// RATE LIMITING (Token Bucket)
+// Cada clave (IP o UserID) tiene un "cubo" con capacidad Burst que se rellena
+// a razón de Requests por Period. Cada petición consume un token; sin tokens → 429.
+// ====================================================================
+
+// RateLimitPolicy: Límite aplicado a un grupo de rutas.
+type RateLimitPolicy struct {
+	Name     string
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// ParseRateLimitPolicy interpreta el formato "<peticiones>/<periodo>", ej. "10/1m" o "100/1s".
+// El burst es igual al número de peticiones.
+func ParseRateLimitPolicy(name, value string) (RateLimitPolicy, error) {
+	requestsStr, periodStr, ok := strings.Cut(value, "/")
+	if !ok {
+		return RateLimitPolicy{}, fmt.Errorf("política %s inválida %q (formato: 10/1m)", name, value)
+	}
+	requests, err := strconv.Atoi(strings.TrimSpace(requestsStr))
+	if err != nil || requests <= 0 {
+		return RateLimitPolicy{}, fmt.Errorf("política %s: peticiones inválidas %q", name, requestsStr)
+	}
+	period, err := time.ParseDuration(strings.TrimSpace(periodStr))
+	if err != nil || period <= 0 {
+		return RateLimitPolicy{}, fmt.Errorf("política %s: periodo inválido %q", name, periodStr)
+	}
+	return RateLimitPolicy{Name: name, Requests: requests, Period: period, Burst: requests}, nil
+}
+
+// refillRate devuelve los tokens que se recuperan por segundo.
+func (p RateLimitPolicy) refillRate() float64 {
+	return float64(p.Requests) / p.Period.Seconds()
+}
+
+// RateLimitResult: Resultado de consumir un token.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	ResetAfter time.Duration // Tiempo hasta que el cubo esté lleno otra vez
+	RetryAfter time.Duration // Tiempo hasta el próximo token (solo si !Allowed)
+}
+
+// RateLimitStore: Backend del limitador. MemoryRateLimitStore sirve para una
+// sola instancia; para compartir límites entre réplicas basta con implementar
+// esta interfaz sobre un almacén compartido (Redis, Postgres, etc.).
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error)
+}
+
+// ====================================================================
+// BACKEND EN MEMORIA
+// ====================================================================
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+	period   time.Duration // Tiempo para rellenarse por completo
+}
+
+// MemoryRateLimitStore guarda los cubos en un mapa protegido por mutex.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+
+	rate := policy.refillRate()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(policy.Burst), lastSeen: now, period: policy.Period}
+		s.buckets[key] = bucket
+	}
+
+	// 1. Rellenar según el tiempo transcurrido
+	elapsed := now.Sub(bucket.lastSeen).Seconds()
+	bucket.tokens = math.Min(float64(policy.Burst), bucket.tokens+elapsed*rate)
+	bucket.lastSeen = now
+
+	result := RateLimitResult{Limit: policy.Burst}
+
+	// 2. Consumir un token si hay
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - bucket.tokens) / rate)
+	}
+
+	result.Remaining = int(bucket.tokens)
+	result.ResetAfter = secondsToDuration((float64(policy.Burst) - bucket.tokens) / rate)
+	return result, nil
+}
+
+// sweep elimina periódicamente los cubos inactivos (ya estarían llenos),
+// para que el mapa no crezca sin límite con IPs de paso.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.lastSeen) > bucket.period {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// ====================================================================
+// IDENTIFICACIÓN DEL CLIENTE
+// ====================================================================
+
+// ClientIPResolver obtiene la IP real del cliente. X-Forwarded-For solo se
+// respeta cuando la conexión viene de un proxy de confianza; si no, cualquier
+// cliente podría falsificar su IP y evadir el límite.
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+}
+
+// NewClientIPResolver recibe los proxies de confianza como CIDRs o IPs sueltas.
+func NewClientIPResolver(trustedProxies []string) (*ClientIPResolver, error) {
+	resolver := &ClientIPResolver{}
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy de confianza inválido %q: %w", proxy, err)
+		}
+		resolver.trusted = append(resolver.trusted, network)
+	}
+	return resolver, nil
+}
+
+func (c *ClientIPResolver) isTrusted(ip net.IP) bool {
+	for _, network := range c.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP recorre X-Forwarded-For de derecha a izquierda saltando proxies de
+// confianza; la primera IP que no lo es corresponde al cliente.
+func (c *ClientIPResolver) ClientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	remoteIP := net.ParseIP(remote)
+	if remoteIP == nil || !c.isTrusted(remoteIP) {
+		return remote
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		client = hop
+		if !c.isTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// RateLimitKeyFunc extrae la clave que identifica al cliente en una petición.
+type RateLimitKeyFunc func(r *http.Request) string
+
+// KeyByIP limita por IP del cliente.
+func KeyByIP(resolver *ClientIPResolver) RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		return "ip:" + resolver.ClientIP(r)
+	}
+}
+
+// KeyByUser limita por el UserID del JWT; si no hay identidad, usa la IP.
+// Debe montarse DESPUÉS de AuthMiddleware.
+func KeyByUser(resolver *ClientIPResolver) RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		if userID, err := GetUserIDFromContext(r); err == nil {
+			return "user:" + strconv.Itoa(userID)
+		}
+		return "ip:" + resolver.ClientIP(r)
+	}
+}
+
+// ====================================================================
+// MIDDLEWARE
+// ====================================================================
+
+// RateLimitMiddleware aplica policy a cada petición. Envía las cabeceras
+// RateLimit-* (draft IETF) y, al exceder el límite, 429 con Retry-After.
+// Si el backend falla, la petición se deja pasar (fail-open) para no tumbar la API.
+func RateLimitMiddleware(store RateLimitStore, policy RateLimitPolicy, keyFunc RateLimitKeyFunc) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := policy.Name + ":" + keyFunc(r)
+
+			result, err := store.Take(r.Context(), key, policy, time.Now())
+			if err != nil {
+				slog.Warn("Error del rate limiter, se permite la petición", "policy", policy.Name, "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Requests, ceilSeconds(policy.Period)))
+
+			if !result.Allowed {
+				rateLimitedTotal.WithLabelValues(policy.Name).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				http.Error(w, "Demasiadas peticiones, intenta más tarde", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ceilSeconds redondea hacia arriba (un Retry-After de 0 invitaría a reintentar de inmediato).
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// RateLimiter agrupa el backend y la resolución de IP compartidos por todas las políticas.
+type RateLimiter struct {
+	Store    RateLimitStore
+	Resolver *ClientIPResolver
+	Enabled  bool
+}
+
+// PerIP devuelve el middleware de policy con clave por IP del cliente.
+func (l *RateLimiter) PerIP(policy RateLimitPolicy) func(next http.Handler) http.Handler {
+	return l.middleware(policy, KeyByIP(l.Resolver))
+}
+
+// PerUser devuelve el middleware de policy con clave por UserID (o IP si no hay identidad).
+func (l *RateLimiter) PerUser(policy RateLimitPolicy) func(next http.Handler) http.Handler {
+	return l.middleware(policy, KeyByUser(l.Resolver))
+}
+
+func (l *RateLimiter) middleware(policy RateLimitPolicy, keyFunc RateLimitKeyFunc) func(next http.Handler) http.Handler {
+	if !l.Enabled {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return RateLimitMiddleware(l.Store, policy, keyFunc)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test: El token bucket rechaza al agotar el burst y se rellena con el tiempo
+func TestMemoryRateLimitStoreTokenBucket(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	policy, err := ParseRateLimitPolicy("login", "3/1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		result, _ := store.Take(context.Background(), "ip:1.2.3.4", policy, now)
+		if !result.Allowed {
+			t.Fatalf("La petición %d debe permitirse", i+1)
+		}
+	}
+
+	result, _ := store.Take(context.Background(), "ip:1.2.3.4", policy, now)
+	if result.Allowed {
+		t.Fatal("La 4ª petición debe rechazarse")
+	}
+	if result.RetryAfter != 20*time.Second {
+		t.Errorf("RetryAfter incorrecto: got %v want 20s", result.RetryAfter)
+	}
+
+	// Otra clave tiene su propio cubo
+	if result, _ := store.Take(context.Background(), "ip:5.6.7.8", policy, now); !result.Allowed {
+		t.Error("Una IP distinta no debe verse afectada")
+	}
+
+	// 20s después se recupera un token
+	if result, _ := store.Take(context.Background(), "ip:1.2.3.4", policy, now.Add(20*time.Second)); !result.Allowed {
+		t.Error("Tras 20s debe haber un token disponible")
+	}
+}
+
+// Test: El middleware envía las cabeceras RateLimit-* y responde 429 con Retry-After
+func TestRateLimitMiddlewareHeaders(t *testing.T) {
+	policy, _ := ParseRateLimitPolicy("login", "1/1m")
+	resolver, _ := NewClientIPResolver(nil)
+	handler := RateLimitMiddleware(NewMemoryRateLimitStore(), policy, KeyByIP(resolver))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+
+	first := httptest.NewRecorder()
+	handler.ServeHTTP(first, httptest.NewRequest("POST", "/login", nil))
+	if first.Code != http.StatusOK {
+		t.Fatalf("La primera petición debe pasar: got %d", first.Code)
+	}
+	if got := first.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("RateLimit-Remaining incorrecto: got %q", got)
+	}
+
+	second := httptest.NewRecorder()
+	handler.ServeHTTP(second, httptest.NewRequest("POST", "/login", nil))
+	if second.Code != http.StatusTooManyRequests {
+		t.Fatalf("La segunda petición debe recibir 429: got %d", second.Code)
+	}
+	if got := second.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After incorrecto: got %q want 60", got)
+	}
+}
+
+// Test: X-Forwarded-For solo se respeta si viene de un proxy de confianza
+func TestClientIPResolverTrustedProxies(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"sin proxy", "203.0.113.7:5000", "", "203.0.113.7"},
+		{"cliente falsifica XFF", "203.0.113.7:5000", "1.1.1.1", "203.0.113.7"},
+		{"detrás de proxy", "10.0.0.5:5000", "198.51.100.9", "198.51.100.9"},
+		{"cadena de proxies", "10.0.0.5:5000", "1.1.1.1, 198.51.100.9, 10.0.0.6", "198.51.100.9"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := resolver.ClientIP(req); got != tt.want {
+			t.Errorf("%s: got %q want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Test: Con KeyByUser cada UserID tiene su propio límite
+func TestKeyByUser(t *testing.T) {
+	resolver, _ := NewClientIPResolver(nil)
+	keyFunc := KeyByUser(resolver)
+
+	req := httptest.NewRequest("GET", "/productos", nil)
+	if got := keyFunc(req); got != "ip:192.0.2.1" {
+		t.Errorf("Sin identidad se debe usar la IP: got %q", got)
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), ContextKeyUserID, 42))
+	if got := keyFunc(req); got != "user:42" {
+		t.Errorf("Con identidad se debe usar el UserID: got %q", got)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ====================================================================
+// RÉPLICAS DE LECTURA
+// Las lecturas (GetProducts, GetProductByID) se reparten entre réplicas sanas
+// con round-robin. Escrituras y lecturas justo después de escribir van al primario.
+// ====================================================================
+
+// PrimaryPinCookie: Cookie que fija las lecturas al primario tras una escritura,
+// para que el cliente lea lo que acaba de escribir aunque la réplica tenga retraso.
+const PrimaryPinCookie = "db_pin_primary"
+
+// ReadConsistencyHeader: Con valor "strong", la petición lee del primario.
+const ReadConsistencyHeader = "X-Read-Consistency"
+
+// replicaNode: Una réplica y su último estado de salud conocido.
+type replicaNode struct {
+	name    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// ReplicaDB: Conexión a una réplica con un nombre legible para logs y métricas.
+type ReplicaDB struct {
+	Name string
+	DB   *sql.DB
+}
+
+// DBCluster agrupa el primario y sus réplicas de lectura.
+type DBCluster struct {
+	primary  *sql.DB
+	replicas []*replicaNode
+	next     atomic.Uint64
+	pinTTL   time.Duration
+}
+
+// NewDBCluster crea el clúster. Las réplicas empiezan como sanas; el primer
+// chequeo de salud corrige el estado de las que no respondan.
+func NewDBCluster(primary *sql.DB, replicas []ReplicaDB, pinTTL time.Duration) *DBCluster {
+	cluster := &DBCluster{primary: primary, pinTTL: pinTTL}
+	for _, replica := range replicas {
+		node := &replicaNode{name: replica.Name, db: replica.DB}
+		node.healthy.Store(true)
+		cluster.replicas = append(cluster.replicas, node)
+	}
+	return cluster
+}
+
+// Primary devuelve la conexión para escrituras.
+func (c *DBCluster) Primary() *sql.DB {
+	return c.primary
+}
+
+// Reader devuelve la conexión para una lectura: una réplica sana por round-robin,
+// o el primario si la petición está fijada o ninguna réplica está disponible.
+func (c *DBCluster) Reader(r *http.Request) *sql.DB {
+	return c.ReaderFor(mustReadPrimary(r))
+}
+
+// ReaderFor elige la conexión de lectura sin petición HTTP (gRPC): strong = primario.
+func (c *DBCluster) ReaderFor(strong bool) *sql.DB {
+	if len(c.replicas) == 0 || strong {
+		return c.primary
+	}
+
+	start := c.next.Add(1)
+	for i := range c.replicas {
+		node := c.replicas[(start+uint64(i))%uint64(len(c.replicas))]
+		if node.healthy.Load() {
+			return node.db
+		}
+	}
+	return c.primary
+}
+
+// mustReadPrimary indica si la petición pidió consistencia fuerte o viene de una escritura reciente.
+func mustReadPrimary(r *http.Request) bool {
+	if r.Header.Get(ReadConsistencyHeader) == "strong" {
+		return true
+	}
+	_, err := r.Cookie(PrimaryPinCookie)
+	return err == nil
+}
+
+// PinPrimaryAfterWrite es un middleware que, en cada escritura exitosa (2xx),
+// devuelve la cookie de fijación (y la cabecera equivalente) válida por pinTTL.
+// Una escritura rechazada no cambió nada: sus lecturas pueden seguir en réplicas.
+func (c *DBCluster) PinPrimaryAfterWrite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWriteMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pw := &pinPrimaryWriter{ResponseWriter: w, cluster: c}
+		next.ServeHTTP(pw, r)
+		if !pw.wroteHeader {
+			// El handler no escribió nada: net/http responderá 200
+			c.PinPrimary(w)
+		}
+	})
+}
+
+// pinPrimaryWriter agrega la cookie de fijación justo antes de enviar un estado 2xx.
+type pinPrimaryWriter struct {
+	http.ResponseWriter
+	cluster     *DBCluster
+	wroteHeader bool
+}
+
+func (w *pinPrimaryWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status >= 200 && status < 300 {
+			w.cluster.PinPrimary(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *pinPrimaryWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap permite a http.ResponseController llegar al writer original (Flush, deadlines).
+func (w *pinPrimaryWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// PinPrimary fija las próximas lecturas del cliente al primario durante pinTTL.
+// Lo usan las rutas donde el método no distingue lecturas de escrituras (/graphql).
+func (c *DBCluster) PinPrimary(w http.ResponseWriter) {
+	if len(c.replicas) == 0 {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     PrimaryPinCookie,
+		Value:    "1",
+		Path:     "/",
+		MaxAge:   int(math.Ceil(c.pinTTL.Seconds())), // Hacia arriba: 500ms no puede quedar en 0
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set(ReadConsistencyHeader, "strong")
+}
+
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// StartHealthChecks hace ping a cada réplica cada interval hasta que ctx se cancele.
+func (c *DBCluster) StartHealthChecks(ctx context.Context, interval time.Duration) {
+	if len(c.replicas) == 0 {
+		return
+	}
+
+	c.checkReplicas(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.checkReplicas(ctx)
+		}
+	}
+}
+
+// checkReplicas actualiza el estado de salud de todas las réplicas.
+func (c *DBCluster) checkReplicas(ctx context.Context) {
+	for _, node := range c.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, defaultQueryTimeout)
+		err := node.db.PingContext(pingCtx)
+		cancel()
+
+		healthy := err == nil
+		if node.healthy.Swap(healthy) != healthy {
+			if healthy {
+				slog.Info("Réplica disponible de nuevo", "replica", node.name)
+			} else {
+				slog.Warn("Réplica fuera de servicio", "replica", node.name, "err", err)
+			}
+		}
+		dbReplicaHealthy.WithLabelValues(node.name).Set(boolToFloat(healthy))
+	}
+}
+
+// Close cierra el primario y todas las réplicas.
+func (c *DBCluster) Close() error {
+	errs := []error{c.primary.Close()}
+	for _, node := range c.replicas {
+		errs = append(errs, node.db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestCluster crea un primario y dos réplicas sobre el driver falso.
+func newTestCluster(t *testing.T) (*DBCluster, *fakeServer, []*fakeServer) {
+	t.Helper()
+
+	primary, primaryServer := openFakeDB(t, "primary")
+	replica1, replica1Server := openFakeDB(t, "replica-1")
+	replica2, replica2Server := openFakeDB(t, "replica-2")
+
+	cluster := NewDBCluster(primary, []ReplicaDB{
+		{Name: "replica-1", DB: replica1},
+		{Name: "replica-2", DB: replica2},
+	}, 5*time.Second)
+
+	return cluster, primaryServer, []*fakeServer{replica1Server, replica2Server}
+}
+
+func getProducts(t *testing.T, cluster *DBCluster, req *http.Request) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	GetProductsHandler(cluster, nil, nil, newTestBlobStore(t)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /productos retornó %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// Test: Las lecturas se reparten entre réplicas con round-robin
+func TestReadsAreBalancedAcrossReplicas(t *testing.T) {
+	cluster, primary, replicas := newTestCluster(t)
+
+	for i := 0; i < 4; i++ {
+		getProducts(t, cluster, httptest.NewRequest("GET", "/productos", nil))
+	}
+
+	if n := len(primary.Queries()); n != 0 {
+		t.Errorf("El primario no debe recibir lecturas: got %d", n)
+	}
+	for i, replica := range replicas {
+		if n := len(replica.Queries()); n != 2 {
+			t.Errorf("replica-%d debe recibir 2 lecturas: got %d", i+1, n)
+		}
+	}
+}
+
+// Test: Tras una escritura, la cookie fija las lecturas al primario
+func TestReadAfterWriteIsPinnedToPrimary(t *testing.T) {
+	cluster, primary, replicas := newTestCluster(t)
+
+	// 1. La escritura devuelve la cookie de fijación
+	write := httptest.NewRecorder()
+	noop := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	cluster.PinPrimaryAfterWrite(noop).ServeHTTP(write, httptest.NewRequest("POST", "/productos", nil))
+
+	cookies := write.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != PrimaryPinCookie {
+		t.Fatalf("Se esperaba la cookie %s, got %v", PrimaryPinCookie, cookies)
+	}
+
+	// 2. La lectura siguiente con la cookie va al primario
+	req := httptest.NewRequest("GET", "/productos", nil)
+	req.AddCookie(cookies[0])
+	getProducts(t, cluster, req)
+
+	// 3. También con la cabecera de consistencia fuerte
+	req = httptest.NewRequest("GET", "/productos", nil)
+	req.Header.Set(ReadConsistencyHeader, "strong")
+	getProducts(t, cluster, req)
+
+	if n := len(primary.Queries()); n != 2 {
+		t.Errorf("El primario debe recibir las 2 lecturas fijadas: got %d", n)
+	}
+	for i, replica := range replicas {
+		if n := len(replica.Queries()); n != 0 {
+			t.Errorf("replica-%d no debe recibir lecturas fijadas: got %d", i+1, n)
+		}
+	}
+}
+
+// Test: Solo las escrituras exitosas fijan al primario, y un TTL de menos de un
+// segundo no se pierde al redondear
+func TestPinPrimaryOnlyOnSuccess(t *testing.T) {
+	cluster, _, _ := newTestCluster(t)
+	cluster.pinTTL = 500 * time.Millisecond
+
+	write := func(status int) *http.Response {
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+		cluster.PinPrimaryAfterWrite(handler).ServeHTTP(rr, httptest.NewRequest("POST", "/productos", nil))
+		return rr.Result()
+	}
+
+	for _, status := range []int{http.StatusBadRequest, http.StatusConflict, http.StatusInternalServerError} {
+		if res := write(status); len(res.Cookies()) != 0 || res.Header.Get(ReadConsistencyHeader) != "" {
+			t.Errorf("%d no debe fijar al primario: %v", status, res.Cookies())
+		}
+	}
+
+	cookies := write(http.StatusCreated).Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge != 1 {
+		t.Errorf("201 debe fijar al primario con Max-Age=1: got %v", cookies)
+	}
+}
+
+// Test: Una réplica caída sale de rotación; si caen todas, se lee del primario
+func TestUnhealthyReplicasAreSkipped(t *testing.T) {
+	cluster, primary, replicas := newTestCluster(t)
+
+	replicas[0].SetDown(true)
+	cluster.checkReplicas(context.Background())
+
+	for i := 0; i < 3; i++ {
+		getProducts(t, cluster, httptest.NewRequest("GET", "/productos", nil))
+	}
+	if n := len(replicas[1].Queries()); n != 3 {
+		t.Errorf("La réplica sana debe recibir todas las lecturas: got %d", n)
+	}
+
+	replicas[1].SetDown(true)
+	cluster.checkReplicas(context.Background())
+
+	getProducts(t, cluster, httptest.NewRequest("GET", "/productos", nil))
+	if n := len(primary.Queries()); n != 1 {
+		t.Errorf("Sin réplicas sanas se debe leer del primario: got %d", n)
+	}
+
+	// La réplica vuelve a rotación tras el siguiente chequeo
+	replicas[0].SetDown(false)
+	cluster.checkReplicas(context.Background())
+	getProducts(t, cluster, httptest.NewRequest("GET", "/productos", nil))
+	if n := len(replicas[0].Queries()); n != 1 {
+		t.Errorf("La réplica recuperada debe volver a recibir lecturas: got %d", n)
+	}
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"context" // Necesario para el contexto de la petición
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings" // Necesario para strings.HasPrefix
 	"time"
@@ -16,6 +17,11 @@ type ContextKey string
 
 const ContextKeyUserID ContextKey = "userID"
 
+const ContextKeyRole ContextKey = "role"
+
+// RoleAdmin: Rol con permisos de administración.
+const RoleAdmin = "admin"
+
 type Claims struct {
 	jwt.RegisteredClaims
 
@@ -23,8 +29,8 @@ type Claims struct {
 	Role   string `json:"role"`
 }
 
-func GenerateToken(UserID int, Role string, SecretKey string) (string, error) {
-	expirationTime := time.Now().Add(time.Hour * 1)
+func GenerateToken(UserID int, Role string, SecretKey string, TTL time.Duration) (string, error) {
+	expirationTime := time.Now().Add(TTL)
 
 	claims := Claims{
 		UserID: UserID,
@@ -43,10 +49,51 @@ func GenerateToken(UserID int, Role string, SecretKey string) (string, error) {
 	return tokenString, nil
 }
 
-func AuthMiddleware(SecretKey string) func(next http.Handler) http.Handler {
+// ParseAccessToken verifica la firma y la expiración del JWT y devuelve sus claims.
+// Lo usan AuthMiddleware (REST) y los interceptores de gRPC.
+func ParseAccessToken(tokenString, SecretKey string) (*Claims, error) {
+	tokenParsed, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		return []byte(SecretKey), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := tokenParsed.Claims.(*Claims)
+	if !ok || !tokenParsed.Valid {
+		return nil, fmt.Errorf("token inválido")
+	}
+	return claims, nil
+}
+
+// WithIdentity guarda el usuario y el rol del token en el contexto.
+func WithIdentity(ctx context.Context, claims *Claims) context.Context {
+	ctx = context.WithValue(ctx, ContextKeyUserID, claims.UserID)
+	return context.WithValue(ctx, ContextKeyRole, claims.Role)
+}
+
+// AuthMiddleware acepta un JWT (Authorization: Bearer) o, si apiKeys no es nil, una
+// clave de API (X-API-Key o Authorization: ApiKey, ver apikeys.go). Ambos dejan la
+// identidad en el contexto con las mismas claves (ContextKeyUserID, ContextKeyRole).
+func AuthMiddleware(SecretKey string, apiKeys *APIKeyAuth) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
+			if apiKeys != nil {
+				if key, ok := requestAPIKey(r); ok {
+					ctx, err := apiKeys.Authenticate(r, key)
+					if errors.Is(err, ErrAPIKeyInvalid) {
+						http.Error(w, "Unauthorized", http.StatusUnauthorized)
+						return
+					}
+					if err != nil {
+						respondDBError(w, err, "validar clave de API")
+						return
+					}
+					next.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+			}
+
 			authHeader := r.Header.Get("Authorization")
 
 			if authHeader == "" {
@@ -59,32 +106,15 @@ func AuthMiddleware(SecretKey string) func(next http.Handler) http.Handler {
 				return
 			}
 
-			tokenString := authHeader[7:]
-
-			tokenParsed, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-				return []byte(SecretKey), nil
-			})
-
+			claims, err := ParseAccessToken(authHeader[7:], SecretKey)
 			if err != nil {
 				// ⬇️ CORRECCIÓN: Se agrega el log para ver el error.
-				log.Printf("Error de verificación JWT: %v", err)
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			if !tokenParsed.Valid {
+				slog.Info("Error de verificación JWT", "err", err)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			claims, ok := tokenParsed.Claims.(*Claims)
-			if !ok {
-				http.Error(w, "Error interno de validación", http.StatusInternalServerError)
-				return
-			}
-
-			ctx := context.WithValue(r.Context(), ContextKeyUserID, claims.UserID)
-
+			ctx := WithIdentity(r.Context(), claims)
 			r = r.WithContext(ctx)
 
 			next.ServeHTTP(w, r)
@@ -92,6 +122,21 @@ func AuthMiddleware(SecretKey string) func(next http.Handler) http.Handler {
 	}
 }
 
+// OptionalAuthMiddleware autentica la petición solo si trae Authorization (un token
+// inválido sigue siendo 401); sin la cabecera la deja pasar como anónima. Solo JWT.
+func OptionalAuthMiddleware(SecretKey string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authenticated := AuthMiddleware(SecretKey, nil)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+}
+
 func GetUserIDFromContext(r *http.Request) (int, error) {
 	// 1. Obtener el valor del contexto usando la clave que definimos.
 	// r.Context() devuelve el contexto adjunto a la petición.
@@ -113,3 +158,23 @@ func GetUserIDFromContext(r *http.Request) (int, error) {
 	// 4. Devolver el UserID.
 	return userID, nil
 }
+
+// GetRoleFromContext devuelve el rol guardado por AuthMiddleware ("" si no hay).
+func GetRoleFromContext(r *http.Request) string {
+	role, _ := r.Context().Value(ContextKeyRole).(string)
+	return role
+}
+
+// RequireRole permite el paso solo a usuarios con el rol indicado (403 en otro caso).
+// Debe montarse DESPUÉS de AuthMiddleware.
+func RequireRole(role string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if GetRoleFromContext(r) != role {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
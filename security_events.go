@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+// ====================================================================
+// LOG DE EVENTOS DE SEGURIDAD
+// Una línea JSON por evento (logins, bloqueos, claves de API) en stdout,
+// separada del log de acceso para poder enviarla a un SIEM o filtrarla.
+// ====================================================================
+
+// Tipos de eventos de seguridad
+const (
+	SecurityEventLoginSuccess   = "login_success"
+	SecurityEventLoginFailure   = "login_failure"
+	SecurityEventLoginBlocked   = "login_blocked" // Intento rechazado por espera o bloqueo vigente
+	SecurityEventLockout        = "account_locked"
+	SecurityEventUnlock         = "account_unlocked"
+	SecurityEventAPIKeyCreated  = "api_key_created"
+	SecurityEventAPIKeyRevoked  = "api_key_revoked"
+	SecurityEventAPIKeyRejected = "api_key_rejected" // Clave inválida, vencida o revocada
+)
+
+// SecurityEvent: Datos de un evento. UserID es 0 si no aplica.
+type SecurityEvent struct {
+	Type     string
+	Username string
+	UserID   int
+	IP       string
+	Detail   string
+}
+
+var securityLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil)).With("log", "security")
+
+// LogSecurityEvent escribe el evento en el log de seguridad y lo cuenta en Prometheus.
+func LogSecurityEvent(ctx context.Context, event SecurityEvent) {
+	attrs := []slog.Attr{
+		slog.String("event", event.Type),
+		slog.String("username", event.Username),
+		slog.String("ip", event.IP),
+	}
+	if event.UserID != 0 {
+		attrs = append(attrs, slog.Int("user_id", event.UserID))
+	}
+	if event.Detail != "" {
+		attrs = append(attrs, slog.String("detail", event.Detail))
+	}
+
+	securityLogger.LogAttrs(ctx, slog.LevelInfo, "security_event", attrs...)
+	securityEventsTotal.WithLabelValues(event.Type).Inc()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ====================================================================
+// SERVIDOR HTTP (Timeouts + Apagado Ordenado)
+// ====================================================================
+
+// setupServer construye el http.Server con la dirección y timeouts de la configuración.
+// baseCtx es el contexto padre de TODAS las peticiones: al cancelarlo se cancelan
+// también las consultas a la DB que usan r.Context().
+func setupServer(baseCtx context.Context, handler http.Handler, cfg Config) *http.Server {
+	return &http.Server{
+		Addr:    cfg.ListenAddr,
+		Handler: handler,
+
+		// Protección contra clientes lentos (slowloris)
+		ReadHeaderTimeout: time.Duration(cfg.HTTP.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.HTTP.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.HTTP.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.HTTP.IdleTimeout),
+
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
+	}
+}
+
+// runServer atiende peticiones en listener hasta que ctx se cancela (SIGINT/SIGTERM)
+// o el servidor falla.
+//
+// Al cancelarse ctx:
+// 1. Deja de aceptar conexiones nuevas y espera a las peticiones en vuelo (Shutdown).
+// 2. Si shutdownTimeout vence, cancela baseCtx (abortando las consultas a la DB)
+// y cierra las conexiones restantes a la fuerza.
+func runServer(ctx context.Context, server *http.Server, listener net.Listener, cancelBase context.CancelFunc, shutdownTimeout time.Duration) error {
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serverErr:
+		// El servidor terminó sin que nadie pidiera el apagado
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+		slog.Info("Señal de apagado recibida, drenando peticiones", "timeout", shutdownTimeout)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Warn("Las peticiones no terminaron a tiempo, cancelando", "err", err)
+		cancelBase()
+		server.Close()
+		return err
+	}
+
+	slog.Info("Servidor detenido correctamente")
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Test: El apagado ordenado espera a que terminen las peticiones en vuelo
+func TestRunServerDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("ok"))
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("No se pudo abrir el listener: %v", err)
+	}
+
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+	server := setupServer(baseCtx, handler, DefaultConfig())
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runServer(ctx, server, listener, cancelBase, 5*time.Second)
+	}()
+
+	respCh := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			respCh <- "error: " + err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		respCh <- string(body)
+	}()
+
+	// Simular SIGTERM mientras la petición sigue en proceso
+	<-started
+	stop()
+
+	if body := <-respCh; body != "ok" {
+		t.Errorf("La petición en vuelo no se completó: got %q", body)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("runServer retornó error: %v", err)
+	}
+	if baseCtx.Err() != nil {
+		t.Error("baseCtx no debe cancelarse si el drenado termina a tiempo")
+	}
+}
+
+// Test: Si el drenado excede el plazo, se cancela el contexto de las peticiones
+func TestRunServerCancelsRequestsAfterTimeout(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		// Simula una consulta lenta que respeta r.Context()
+		<-r.Context().Done()
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("No se pudo abrir el listener: %v", err)
+	}
+
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+	server := setupServer(baseCtx, handler, DefaultConfig())
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runServer(ctx, server, listener, cancelBase, 50*time.Millisecond)
+	}()
+
+	go http.Get("http://" + listener.Addr().String())
+
+	<-started
+	stop()
+
+	if err := <-done; err == nil {
+		t.Error("runServer debe retornar error cuando el drenado excede el plazo")
+	}
+	if baseCtx.Err() == nil {
+		t.Error("baseCtx debe cancelarse cuando el drenado excede el plazo")
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// ====================================================================
+// VARIANTES DE PRODUCTO (SKU)
+// Un producto puede tener variantes (talla, color...) con SKU único, stock
+// propio y, opcionalmente, un precio distinto al del producto. Las lecturas de
+// productos agregan el stock total y el rango de precios de sus variantes.
+// ====================================================================
+
+// Errores de dominio que los handlers traducen a 404/409/400
+var (
+	ErrVariantNotFound          = errors.New("variante no encontrada")
+	ErrVariantSKUTaken          = errors.New("ya existe una variante con ese SKU")
+	ErrVariantDuplicate         = errors.New("el producto ya tiene una variante con esos atributos")
+	ErrVariantProduct           = errors.New("el producto no existe")
+	ErrVariantInsufficientStock = errors.New("stock insuficiente")
+)
+
+// maxVariantAttributes limita los atributos de una variante (talla, color, material...).
+const maxVariantAttributes = 10
+
+var skuPattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9._-]{0,63}$`)
+
+// ProductVariant: Variante de un producto. Price nil = usa el precio del producto
+// (siempre en la moneda del producto); EffectivePrice es el precio que se cobra.
+type ProductVariant struct {
+	ID             int               `json:"id"`
+	ProductID      int               `json:"product_id"`
+	SKU            string            `json:"sku"`
+	Attributes     map[string]string `json:"attributes"`
+	Price          *Money            `json:"price"`
+	Stock          int               `json:"stock"`
+	EffectivePrice Money             `json:"effective_price"`
+}
+
+// PriceRange: Precio mínimo y máximo entre las variantes de un producto.
+type PriceRange struct {
+	Min Money `json:"min"`
+	Max Money `json:"max"`
+}
+
+// normalizeSKU: Los SKU no distinguen mayúsculas ("ts-rojo-m" == "TS-ROJO-M").
+func normalizeSKU(sku string) string {
+	return strings.ToUpper(strings.TrimSpace(sku))
+}
+
+// normalize valida la variante y normaliza el SKU y los atributos.
+func (v *ProductVariant) normalize() error {
+	v.SKU = normalizeSKU(v.SKU)
+	if !skuPattern.MatchString(v.SKU) {
+		return fmt.Errorf("SKU inválido %q: letras, dígitos, '.', '_' o '-' (máximo 64)", v.SKU)
+	}
+	if v.Price != nil && v.Price.Amount < 0 {
+		return errors.New("el precio no puede ser negativo")
+	}
+	if v.Stock < 0 {
+		return errors.New("el stock no puede ser negativo")
+	}
+	if len(v.Attributes) > maxVariantAttributes {
+		return fmt.Errorf("máximo %d atributos por variante", maxVariantAttributes)
+	}
+
+	attributes := make(map[string]string, len(v.Attributes))
+	for key, value := range v.Attributes {
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		if key == "" || value == "" {
+			return errors.New("los atributos no pueden tener nombre o valor vacío")
+		}
+		attributes[key] = value
+	}
+	v.Attributes = attributes
+	return nil
+}
+
+// variantDBError traduce violaciones de constraints de PostgreSQL a errores de dominio.
+func variantDBError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505": // unique_violation
+			if pqErr.Constraint == "product_variants_attributes_key" {
+				return ErrVariantDuplicate
+			}
+			return ErrVariantSKUTaken
+		case "23503": // foreign_key_violation
+			return ErrVariantProduct
+		case "23514": // check_violation
+			if pqErr.Constraint == "product_variants_stock_check" {
+				return ErrVariantInsufficientStock
+			}
+		}
+	}
+	return err
+}
+
+// ====================================================================
+// RESUMEN DE VARIANTES EN LAS LECTURAS DE PRODUCTOS
+// ====================================================================
+
+// variantSummarySubquery resume las variantes del producto p (ver productSelect en dao.go).
+const variantSummarySubquery = `
+		SELECT COUNT(*) AS variant_count, COALESCE(SUM(v.stock), 0) AS variant_stock,
+			MIN(COALESCE(v.price_minor, p.price_minor)) AS min_price,
+			MAX(COALESCE(v.price_minor, p.price_minor)) AS max_price
+		FROM product_variants v WHERE v.product_id = p.id`
+
+type variantSummary struct {
+	Count    int
+	Stock    int
+	MinPrice sql.NullInt64
+	MaxPrice sql.NullInt64
+}
+
+// apply completa TotalStock y PriceRange. Sin variantes, el producto es su propia
+// única "variante": su stock y su precio.
+func (s variantSummary) apply(p *Product) {
+	totalStock := p.Stock
+	priceRange := PriceRange{Min: p.Price, Max: p.Price}
+	if s.Count > 0 {
+		totalStock = s.Stock
+		priceRange = PriceRange{
+			Min: Money{Amount: s.MinPrice.Int64, Currency: p.Price.Currency},
+			Max: Money{Amount: s.MaxPrice.Int64, Currency: p.Price.Currency},
+		}
+	}
+	p.TotalStock = &totalStock
+	p.PriceRange = &priceRange
+	p.hasVariants = s.Count > 0
+}
+
+// ====================================================================
+// DAO DE VARIANTES
+// ====================================================================
+
+// variantSelect lee variantes (alias v) con su precio efectivo.
+const variantSelect = `
+	SELECT v.id, v.product_id, v.sku, v.attributes, v.price_minor, v.stock,
+		COALESCE(v.price_minor, p.price_minor), p.currency
+	FROM product_variants v
+	JOIN products p ON p.id = v.product_id`
+
+func scanVariant(row rowScanner) (ProductVariant, error) {
+	var v ProductVariant
+	var attributes []byte
+	var price sql.NullInt64
+	err := row.Scan(&v.ID, &v.ProductID, &v.SKU, &attributes, &price, &v.Stock,
+		&v.EffectivePrice.Amount, &v.EffectivePrice.Currency)
+	if err != nil {
+		return ProductVariant{}, err
+	}
+	if err := json.Unmarshal(attributes, &v.Attributes); err != nil {
+		return ProductVariant{}, fmt.Errorf("atributos inválidos en la variante %d: %w", v.ID, err)
+	}
+	if price.Valid {
+		v.Price = &Money{Amount: price.Int64, Currency: v.EffectivePrice.Currency}
+	}
+	return v, nil
+}
+
+// variantPriceMinor: Valor de la columna price_minor (NULL = precio del producto).
+func variantPriceMinor(v ProductVariant) sql.NullInt64 {
+	if v.Price == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: v.Price.Amount, Valid: true}
+}
+
+// GetProductVariants devuelve las variantes de un producto ordenadas por SKU.
+func GetProductVariants(ctx context.Context, db *sql.DB, productID int) ([]ProductVariant, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, variantSelect+` WHERE v.product_id = $1 ORDER BY v.sku`, productID)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar variantes: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	variants := []ProductVariant{}
+	for rows.Next() {
+		v, err := scanVariant(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error al leer variantes: %w", err)
+		}
+		variants = append(variants, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al leer variantes: %w", queryError(ctx, err))
+	}
+	return variants, nil
+}
+
+// GetVariantsByProductIDs devuelve en una sola consulta las variantes de varios
+// productos, agrupadas por producto y ordenadas por SKU.
+func GetVariantsByProductIDs(ctx context.Context, db *sql.DB, productIDs []int) (map[int][]ProductVariant, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	ids := make([]int64, len(productIDs))
+	for i, id := range productIDs {
+		ids[i] = int64(id)
+	}
+	rows, err := db.QueryContext(ctx, variantSelect+` WHERE v.product_id = ANY($1) ORDER BY v.sku`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar variantes: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	variants := make(map[int][]ProductVariant, len(productIDs))
+	for rows.Next() {
+		v, err := scanVariant(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error al leer variantes: %w", err)
+		}
+		variants[v.ProductID] = append(variants[v.ProductID], v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al leer variantes: %w", queryError(ctx, err))
+	}
+	return variants, nil
+}
+
+func getVariant(ctx context.Context, db *sql.DB, where string, args ...any) (ProductVariant, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	v, err := scanVariant(db.QueryRowContext(ctx, variantSelect+` WHERE `+where, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ProductVariant{}, ErrVariantNotFound
+	}
+	if err != nil {
+		return ProductVariant{}, fmt.Errorf("error al consultar variante: %w", queryError(ctx, err))
+	}
+	return v, nil
+}
+
+// GetVariantByID devuelve una variante del producto o ErrVariantNotFound.
+func GetVariantByID(ctx context.Context, db *sql.DB, productID, variantID int) (ProductVariant, error) {
+	return getVariant(ctx, db, `v.id = $1 AND v.product_id = $2`, variantID, productID)
+}
+
+// GetVariantBySKU devuelve la variante con ese SKU o ErrVariantNotFound.
+func GetVariantBySKU(ctx context.Context, db *sql.DB, sku string) (ProductVariant, error) {
+	return getVariant(ctx, db, `v.sku = $1`, normalizeSKU(sku))
+}
+
+// CreateVariant inserta la variante y devuelve su ID y precio efectivo. Como
+// cambia el resumen del producto (stock total, rango de precios), publica
+// product.updated en product_changes.
+func CreateVariant(ctx context.Context, db *sql.DB, v ProductVariant) (ProductVariant, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	attributes, err := json.Marshal(v.Attributes)
+	if err != nil {
+		return ProductVariant{}, fmt.Errorf("error al serializar atributos: %w", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return ProductVariant{}, fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO product_variants (product_id, sku, attributes, price_minor, stock)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id,
+			COALESCE(price_minor, (SELECT price_minor FROM products WHERE id = $1)),
+			(SELECT currency FROM products WHERE id = $1)`,
+		v.ProductID, v.SKU, string(attributes), variantPriceMinor(v), v.Stock,
+	).Scan(&v.ID, &v.EffectivePrice.Amount, &v.EffectivePrice.Currency)
+	if err != nil {
+		return ProductVariant{}, fmt.Errorf("error al crear variante: %w", variantDBError(queryError(ctx, err)))
+	}
+	if err := commitVariantChange(ctx, tx, v.ProductID); err != nil {
+		return ProductVariant{}, err
+	}
+	return v, nil
+}
+
+// UpdateVariant reemplaza SKU, atributos, precio y stock de una variante del producto.
+func UpdateVariant(ctx context.Context, db *sql.DB, v ProductVariant) (ProductVariant, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	attributes, err := json.Marshal(v.Attributes)
+	if err != nil {
+		return ProductVariant{}, fmt.Errorf("error al serializar atributos: %w", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return ProductVariant{}, fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE product_variants v
+		SET sku = $3, attributes = $4, price_minor = $5, stock = $6
+		FROM products p
+		WHERE v.id = $1 AND v.product_id = $2 AND p.id = v.product_id
+		RETURNING COALESCE(v.price_minor, p.price_minor), p.currency`,
+		v.ID, v.ProductID, v.SKU, string(attributes), variantPriceMinor(v), v.Stock,
+	).Scan(&v.EffectivePrice.Amount, &v.EffectivePrice.Currency)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ProductVariant{}, ErrVariantNotFound
+	}
+	if err != nil {
+		return ProductVariant{}, fmt.Errorf("error al actualizar variante: %w", variantDBError(queryError(ctx, err)))
+	}
+	if err := commitVariantChange(ctx, tx, v.ProductID); err != nil {
+		return ProductVariant{}, err
+	}
+	return v, nil
+}
+
+// DeleteVariant elimina una variante del producto.
+func DeleteVariant(ctx context.Context, db *sql.DB, productID, variantID int) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM product_variants WHERE id = $1 AND product_id = $2`, variantID, productID)
+	if err != nil {
+		return fmt.Errorf("error al eliminar variante: %w", queryError(ctx, err))
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrVariantNotFound
+	}
+	return commitVariantChange(ctx, tx, productID)
+}
+
+// AdjustVariantStock suma delta (negativo para descontar) al stock de la variante
+// en una sola sentencia, así dos ajustes concurrentes no se pisan. Si el stock
+// quedaría negativo, el CHECK de la tabla lo rechaza: ErrVariantInsufficientStock.
+func AdjustVariantStock(ctx context.Context, db *sql.DB, sku string, delta int) (ProductVariant, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return ProductVariant{}, fmt.Errorf("error al iniciar transacción: %w", queryError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	v, err := scanVariant(tx.QueryRowContext(ctx, `
+		UPDATE product_variants v
+		SET stock = v.stock + $2
+		FROM products p
+		WHERE v.sku = $1 AND p.id = v.product_id
+		RETURNING v.id, v.product_id, v.sku, v.attributes, v.price_minor, v.stock,
+			COALESCE(v.price_minor, p.price_minor), p.currency`,
+		normalizeSKU(sku), delta,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ProductVariant{}, ErrVariantNotFound
+	}
+	if err != nil {
+		return ProductVariant{}, fmt.Errorf("error al ajustar stock: %w", variantDBError(queryError(ctx, err)))
+	}
+	if err := commitVariantChange(ctx, tx, v.ProductID); err != nil {
+		return ProductVariant{}, err
+	}
+	return v, nil
+}
+
+// commitVariantChange publica product.updated del producto de la variante y
+// confirma tx: cachés y Last-Modified de todas las instancias se enteran del cambio.
+func commitVariantChange(ctx context.Context, tx *sql.Tx, productID int) error {
+	if err := notifyProductUpdated(ctx, tx, productID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error al confirmar cambio de variante: %w", queryError(ctx, err))
+	}
+	return nil
+}
+
+// ====================================================================
+// HANDLERS DE VARIANTES
+// ====================================================================
+
+// respondVariantError traduce los errores de dominio; el resto va a respondDBError.
+func respondVariantError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, ErrVariantNotFound):
+		http.Error(w, "Variante no encontrada", http.StatusNotFound)
+	case errors.Is(err, ErrVariantProduct):
+		http.Error(w, "Producto no encontrado.", http.StatusNotFound)
+	case errors.Is(err, ErrVariantSKUTaken), errors.Is(err, ErrVariantDuplicate), errors.Is(err, ErrVariantInsufficientStock):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		respondDBError(w, err, action)
+	}
+}
+
+// parseVariantParams lee {id} (producto) y {variantID}; responde 400 si no son enteros.
+func parseVariantParams(w http.ResponseWriter, r *http.Request) (productID, variantID int, ok bool) {
+	if productID, ok = parseIDParam(w, r); !ok {
+		return 0, 0, false
+	}
+	variantID, err := strconv.Atoi(chi.URLParam(r, "variantID"))
+	if err != nil {
+		http.Error(w, "El ID de la variante debe ser un número entero válido.", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return productID, variantID, true
+}
+
+// decodeVariantRequest lee (según la versión de la API) y valida el cuerpo JSON de una
+// variante. El precio se interpreta en la moneda del producto.
+func decodeVariantRequest(w http.ResponseWriter, r *http.Request, db *sql.DB, productID int) (ProductVariant, bool) {
+	input, err := decodeVariant(r)
+	if err != nil {
+		http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
+		return ProductVariant{}, false
+	}
+
+	currency, err := GetProductCurrency(r.Context(), db, productID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondVariantError(w, ErrVariantProduct, "crear variante")
+		return ProductVariant{}, false
+	}
+	if err != nil {
+		respondDBError(w, err, "obtener moneda del producto")
+		return ProductVariant{}, false
+	}
+
+	variant, err := input.resolve(currency)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ProductVariant{}, false
+	}
+	if err := variant.normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ProductVariant{}, false
+	}
+	return variant, true
+}
+
+func writeVariantJSON(w http.ResponseWriter, r *http.Request, status int, v ProductVariant) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(versionedVariant(r, v))
+}
+
+// GET /productos/{id}/variantes: Variantes de un producto
+func GetProductVariantsHandler(cluster *DBCluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		variants, err := GetProductVariants(r.Context(), cluster.Reader(r), id)
+		if err != nil {
+			respondDBError(w, err, "obtener variantes")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versionedVariants(r, variants))
+	}
+}
+
+// GET /productos/{id}/variantes/{variantID}: Una variante
+func GetProductVariantHandler(cluster *DBCluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, variantID, ok := parseVariantParams(w, r)
+		if !ok {
+			return
+		}
+
+		variant, err := GetVariantByID(r.Context(), cluster.Reader(r), productID, variantID)
+		if err != nil {
+			respondVariantError(w, err, "obtener variante")
+			return
+		}
+		writeVariantJSON(w, r, http.StatusOK, variant)
+	}
+}
+
+// POST /productos/{id}/variantes: Crea una variante
+func CreateProductVariantHandler(db *sql.DB, products *ProductCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+		variant, ok := decodeVariantRequest(w, r, db, id)
+		if !ok {
+			return
+		}
+		variant.ProductID = id
+
+		created, err := CreateVariant(r.Context(), db, variant)
+		if err != nil {
+			respondVariantError(w, err, "crear variante")
+			return
+		}
+		products.Invalidate(context.WithoutCancel(r.Context()), id)
+		writeVariantJSON(w, r, http.StatusCreated, created)
+	}
+}
+
+// PUT /productos/{id}/variantes/{variantID}: Reemplaza una variante
+func UpdateProductVariantHandler(db *sql.DB, products *ProductCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, variantID, ok := parseVariantParams(w, r)
+		if !ok {
+			return
+		}
+		variant, ok := decodeVariantRequest(w, r, db, productID)
+		if !ok {
+			return
+		}
+		variant.ID, variant.ProductID = variantID, productID
+
+		updated, err := UpdateVariant(r.Context(), db, variant)
+		if err != nil {
+			respondVariantError(w, err, "actualizar variante")
+			return
+		}
+		products.Invalidate(context.WithoutCancel(r.Context()), productID)
+		writeVariantJSON(w, r, http.StatusOK, updated)
+	}
+}
+
+// DELETE /productos/{id}/variantes/{variantID}: Elimina una variante
+func DeleteProductVariantHandler(db *sql.DB, products *ProductCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, variantID, ok := parseVariantParams(w, r)
+		if !ok {
+			return
+		}
+
+		if err := DeleteVariant(r.Context(), db, productID, variantID); err != nil {
+			respondVariantError(w, err, "eliminar variante")
+			return
+		}
+		products.Invalidate(context.WithoutCancel(r.Context()), productID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GET /skus/{sku}: Busca una variante por SKU
+func GetSKUHandler(cluster *DBCluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		variant, err := GetVariantBySKU(r.Context(), cluster.Reader(r), chi.URLParam(r, "sku"))
+		if err != nil {
+			respondVariantError(w, err, "buscar SKU")
+			return
+		}
+		writeVariantJSON(w, r, http.StatusOK, variant)
+	}
+}
+
+// StockAdjustmentRequest: Cuerpo de POST /skus/{sku}/stock
+type StockAdjustmentRequest struct {
+	Delta int `json:"delta"` // Positivo = entrada de mercadería, negativo = salida
+}
+
+// POST /skus/{sku}/stock: Ajusta el stock de una variante ({"delta": -2})
+func AdjustSKUStockHandler(db *sql.DB, products *ProductCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request StockAdjustmentRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Delta == 0 {
+			http.Error(w, "Se esperaba {\"delta\": n} con n distinto de 0", http.StatusBadRequest)
+			return
+		}
+
+		variant, err := AdjustVariantStock(r.Context(), db, chi.URLParam(r, "sku"), request.Delta)
+		if err != nil {
+			respondVariantError(w, err, "ajustar stock")
+			return
+		}
+		products.Invalidate(context.WithoutCancel(r.Context()), variant.ProductID)
+		writeVariantJSON(w, r, http.StatusOK, variant)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func postWithToken(router http.Handler, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// Test: El SKU se normaliza y se rechazan valores inválidos
+func TestVariantNormalize(t *testing.T) {
+	v := ProductVariant{SKU: " ts-rojo-m ", Attributes: map[string]string{" Talla ": " M ", "color": "rojo"}, Stock: 3}
+	if err := v.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if v.SKU != "TS-ROJO-M" || v.Attributes["talla"] != "M" {
+		t.Errorf("Variante mal normalizada: %+v", v)
+	}
+
+	invalid := []ProductVariant{
+		{SKU: ""},
+		{SKU: "con espacio"},
+		{SKU: "A", Stock: -1},
+		{SKU: "A", Price: &Money{Amount: -1, Currency: "USD"}},
+		{SKU: "A", Attributes: map[string]string{"talla": " "}},
+	}
+	for _, v := range invalid {
+		if err := v.normalize(); err == nil {
+			t.Errorf("Se esperaba error para %+v", v)
+		}
+	}
+}
+
+// Test: Las violaciones de constraints se traducen a errores de dominio
+func TestVariantDBError(t *testing.T) {
+	tests := []struct {
+		err  *pq.Error
+		want error
+	}{
+		{&pq.Error{Code: "23505", Constraint: "product_variants_sku_key"}, ErrVariantSKUTaken},
+		{&pq.Error{Code: "23505", Constraint: "product_variants_attributes_key"}, ErrVariantDuplicate},
+		{&pq.Error{Code: "23503"}, ErrVariantProduct},
+		{&pq.Error{Code: "23514", Constraint: "product_variants_stock_check"}, ErrVariantInsufficientStock},
+	}
+	for _, tt := range tests {
+		if got := variantDBError(tt.err); !errors.Is(got, tt.want) {
+			t.Errorf("%s/%s: got %v want %v", tt.err.Code, tt.err.Constraint, got, tt.want)
+		}
+	}
+}
+
+// Test: Las respuestas de productos agregan stock total y rango de precios de las variantes
+func TestProductVariantSummary(t *testing.T) {
+	router, token, server := newProductTestRouter(t)
+
+	// Producto con variantes (una de ellas con precio propio)
+	server.SetRows(
+		[]string{"id", "name", "description", "price_minor", "currency", "stock", "images", "variant_count", "variant_stock", "min_price", "max_price"},
+		[]driver.Value{int64(1), "Camiseta", "", int64(1000), "USD", int64(0), []byte("[]"), int64(3), int64(12), int64(1000), int64(1250)},
+	)
+
+	var v1 map[string]any
+	rr := getWithToken(router, "/api/v1/productos/1", token)
+	if err := json.Unmarshal(rr.Body.Bytes(), &v1); err != nil {
+		t.Fatalf("Respuesta inválida: %s", rr.Body.String())
+	}
+	if v1["total_stock"] != float64(12) {
+		t.Errorf("total_stock incorrecto: got %v", v1["total_stock"])
+	}
+	priceRange, _ := v1["price_range"].(map[string]any)
+	if priceRange["min"] != 10.0 || priceRange["max"] != 12.5 {
+		t.Errorf("price_range incorrecto: got %v", v1["price_range"])
+	}
+
+	var v2 map[string]any
+	rr = getWithToken(router, "/api/v2/productos/1", token)
+	json.Unmarshal(rr.Body.Bytes(), &v2)
+	priceRange, _ = v2["price_range"].(map[string]any)
+	if priceRange["min_cents"] != float64(1000) || priceRange["max_cents"] != float64(1250) {
+		t.Errorf("price_range v2 incorrecto: got %v", v2["price_range"])
+	}
+}
+
+// Test: Sin variantes el producto es su propia variante
+func TestProductWithoutVariantsSummary(t *testing.T) {
+	router, token := newVersioningTestRouter(t)
+
+	var product ProductV1
+	rr := getWithToken(router, "/api/v1/productos/1", token)
+	if err := json.Unmarshal(rr.Body.Bytes(), &product); err != nil {
+		t.Fatalf("Respuesta inválida: %s", rr.Body.String())
+	}
+	if product.TotalStock == nil || *product.TotalStock != 3 {
+		t.Errorf("total_stock debe ser el stock del producto: got %v", product.TotalStock)
+	}
+	if product.PriceRange == nil || product.PriceRange.Min != 19.99 || product.PriceRange.Max != 19.99 {
+		t.Errorf("price_range debe ser el precio del producto: got %+v", product.PriceRange)
+	}
+}
+
+// Test: Un SKU inexistente es 404 y un ajuste sin delta es 400
+func TestSKUEndpoints(t *testing.T) {
+	router, token, server := newProductTestRouter(t)
+	server.SetRows(nil)
+
+	if rr := getWithToken(router, "/api/v1/skus/NO-EXISTE", token); rr.Code != http.StatusNotFound {
+		t.Errorf("GET /skus/NO-EXISTE: got %d want 404", rr.Code)
+	}
+
+	rr := postWithToken(router, "/api/v1/skus/TS-ROJO-M/stock", `{"delta":0}`, token)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("delta 0: got %d want 400", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "delta") {
+		t.Errorf("El error debe mencionar delta: %s", rr.Body.String())
+	}
+}
+
+// Test: Un ajuste de stock de una variante se ve en el siguiente GET del producto
+// (invalida la caché local y publica product.updated para las demás instancias)
+func TestAdjustSKUStockInvalidatesProductCache(t *testing.T) {
+	router, token, server := newProductTestRouter(t)
+	productColumns := []string{"id", "name", "description", "price_minor", "currency", "stock", "images", "variant_count", "variant_stock", "min_price", "max_price"}
+	server.SetRows(productColumns,
+		[]driver.Value{int64(1), "Camiseta", "", int64(1000), "USD", int64(0), []byte("[]"), int64(1), int64(5), int64(1000), int64(1000)},
+	)
+
+	totalStock := func() any {
+		var product map[string]any
+		rr := getWithToken(router, "/api/v1/productos/1", token)
+		if err := json.Unmarshal(rr.Body.Bytes(), &product); err != nil {
+			t.Fatalf("Respuesta inválida: %s", rr.Body.String())
+		}
+		return product["total_stock"]
+	}
+	if got := totalStock(); got != float64(5) {
+		t.Fatalf("total_stock inicial: got %v", got)
+	}
+
+	// La DB ya refleja el ajuste; la respuesta anterior sigue en la caché
+	server.SetRows(productColumns,
+		[]driver.Value{int64(1), "Camiseta", "", int64(1000), "USD", int64(0), []byte("[]"), int64(1), int64(3), int64(1000), int64(1000)},
+	)
+	server.SetQueryRows("UPDATE product_variants",
+		[]string{"id", "product_id", "sku", "attributes", "price_minor", "stock", "effective_price", "currency"},
+		[]driver.Value{int64(4), int64(1), "TS-ROJO-M", []byte(`{"talla":"M"}`), nil, int64(3), int64(1000), "USD"},
+	)
+	if rr := postWithToken(router, "/api/v1/skus/TS-ROJO-M/stock", `{"delta":-2}`, token); rr.Code != http.StatusOK {
+		t.Fatalf("Ajuste de stock: got %d %s", rr.Code, rr.Body.String())
+	}
+	if n := countQueries(server.Queries(), "SELECT pg_notify"); n != 1 {
+		t.Errorf("El ajuste debe publicar product.updated: %d NOTIFY", n)
+	}
+
+	if got := totalStock(); got != float64(3) {
+		t.Errorf("El GET siguiente debe ver el stock ajustado: got %v", got)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ====================================================================
+// VERSIONAMIENTO DE LA API
+// Las rutas se registran una sola vez y se montan bajo /api/v1 y /api/v2.
+// Los handlers son los mismos: solo cambia la representación JSON, que se
+// elige según la versión guardada en el contexto por WithAPIVersion.
+// ====================================================================
+
+// APIVersion: Versión de la API con la que se atiende una petición.
+type APIVersion int
+
+const (
+	APIv1 APIVersion = 1
+	APIv2 APIVersion = 2
+)
+
+const ContextKeyAPIVersion ContextKey = "apiVersion"
+
+// WithAPIVersion guarda la versión en el contexto de la petición.
+func WithAPIVersion(version APIVersion) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), ContextKeyAPIVersion, version)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// APIVersionFromRequest devuelve la versión de la petición (v1 si no se indicó).
+func APIVersionFromRequest(r *http.Request) APIVersion {
+	if version, ok := r.Context().Value(ContextKeyAPIVersion).(APIVersion); ok {
+		return version
+	}
+	return APIv1
+}
+
+// DeprecatedRoutes marca las rutas legacy (sin prefijo de versión) como obsoletas:
+// - Deprecation (RFC 9745): fecha desde la que están obsoletas.
+// - Sunset (RFC 8594): fecha a partir de la cual dejarán de existir.
+// - Link: la ruta equivalente bajo successorPrefix.
+func DeprecatedRoutes(successorPrefix string, deprecatedAt, sunset time.Time) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", deprecatedAt.Unix()))
+			w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			w.Header().Add("Link", fmt.Sprintf(`<%s%s>; rel="successor-version"`, successorPrefix, r.URL.Path))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ====================================================================
+// REPRESENTACIONES DE PRODUCTO POR VERSIÓN
+// Internamente los precios son Money (unidades menores + moneda).
+// - v1: precio decimal como número JSON (legacy) y "currency".
+// - v2: precio en unidades menores ("price_cents") y "currency".
+// ====================================================================
+
+// ProductV1: Representación de /api/v1 (y rutas legacy).
+type ProductV1 struct {
+	ID          int            `json:"id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Price       float64        `json:"price"`
+	Currency    string         `json:"currency"`
+	Stock       int            `json:"stock"`
+	Images      []ProductImage `json:"images,omitempty"`
+	TotalStock  *int           `json:"total_stock,omitempty"`
+	PriceRange  *PriceRangeV1  `json:"price_range,omitempty"`
+}
+
+// PriceRangeV1: Rango de precios decimal.
+type PriceRangeV1 struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// ProductV2: En v2 el precio viaja en unidades menores (entero) para evitar errores de
+// redondeo, y también como Money ({"amount": "19.99", "currency": "USD"}) para quien
+// prefiera el decimal exacto sin conocer los decimales de cada moneda.
+type ProductV2 struct {
+	ID          int            `json:"id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	PriceCents  int64          `json:"price_cents"`
+	Price       Money          `json:"price"`
+	Currency    string         `json:"currency"`
+	Stock       int            `json:"stock"`
+	Images      []ProductImage `json:"images,omitempty"`
+	TotalStock  *int           `json:"total_stock,omitempty"`
+	PriceRange  *PriceRangeV2  `json:"price_range,omitempty"`
+}
+
+// PriceRangeV2: Rango de precios en unidades menores y como Money.
+type PriceRangeV2 struct {
+	MinCents int64 `json:"min_cents"`
+	MaxCents int64 `json:"max_cents"`
+	Min      Money `json:"min"`
+	Max      Money `json:"max"`
+}
+
+func productToV1(p Product) ProductV1 {
+	v1 := ProductV1{
+		ID:          p.ID,
+		Name:        p.Name,
+		Description: p.Description,
+		Price:       p.Price.Float64(),
+		Currency:    p.Price.Currency,
+		Stock:       p.Stock,
+		Images:      p.Images,
+		TotalStock:  p.TotalStock,
+	}
+	if p.PriceRange != nil {
+		v1.PriceRange = &PriceRangeV1{Min: p.PriceRange.Min.Float64(), Max: p.PriceRange.Max.Float64()}
+	}
+	return v1
+}
+
+func productToV2(p Product) ProductV2 {
+	v2 := ProductV2{
+		ID:          p.ID,
+		Name:        p.Name,
+		Description: p.Description,
+		PriceCents:  p.Price.Amount,
+		Price:       p.Price,
+		Currency:    p.Price.Currency,
+		Stock:       p.Stock,
+		Images:      p.Images,
+		TotalStock:  p.TotalStock,
+	}
+	if p.PriceRange != nil {
+		v2.PriceRange = &PriceRangeV2{MinCents: p.PriceRange.Min.Amount, MaxCents: p.PriceRange.Max.Amount, Min: p.PriceRange.Min, Max: p.PriceRange.Max}
+	}
+	return v2
+}
+
+// versionedProduct devuelve la representación de p para la versión de la petición.
+func versionedProduct(r *http.Request, p Product) any {
+	if APIVersionFromRequest(r) == APIv2 {
+		return productToV2(p)
+	}
+	return productToV1(p)
+}
+
+// versionedProducts hace lo mismo que versionedProduct para una lista.
+func versionedProducts(r *http.Request, products []Product) any {
+	if APIVersionFromRequest(r) == APIv2 {
+		result := make([]ProductV2, 0, len(products))
+		for _, p := range products {
+			result = append(result, productToV2(p))
+		}
+		return result
+	}
+	result := make([]ProductV1, 0, len(products))
+	for _, p := range products {
+		result = append(result, productToV1(p))
+	}
+	return result
+}
+
+// productInput: Cuerpo de escritura de un producto en cualquier versión. En v1 el
+// precio puede ser número o string ("19.99"): se lee como texto, nunca como float.
+type productInput struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Price       json.RawMessage `json:"price"`       // v1
+	PriceCents  *int64          `json:"price_cents"` // v2
+	Currency    string          `json:"currency"`    // Vacío = DEFAULT_CURRENCY
+	Stock       int             `json:"stock"`
+}
+
+// decodeProduct lee el cuerpo JSON con la representación de la versión de la petición.
+func decodeProduct(r *http.Request) (Product, error) {
+	var input productInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return Product{}, err
+	}
+	if input.Currency == "" {
+		input.Currency = defaultCurrency
+	}
+	currency, err := normalizeCurrency(input.Currency)
+	if err != nil {
+		return Product{}, err
+	}
+
+	product := Product{Name: input.Name, Description: input.Description, Stock: input.Stock}
+	if APIVersionFromRequest(r) == APIv2 {
+		if input.PriceCents == nil {
+			return Product{}, fmt.Errorf("%w: falta price_cents", ErrInvalidAmount)
+		}
+		product.Price = Money{Amount: *input.PriceCents, Currency: currency}
+		return product, checkProductPrice(product.Price)
+	}
+
+	amount, err := decimalText(input.Price)
+	if err != nil {
+		return Product{}, err
+	}
+	if product.Price, err = ParseMoney(amount, currency); err != nil {
+		return Product{}, err
+	}
+	return product, checkProductPrice(product.Price)
+}
+
+// checkProductPrice: El precio base no puede ser negativo, como el de las variantes
+// y los precios de lista (CHECK products_price_minor_check).
+func checkProductPrice(price Money) error {
+	if price.Amount < 0 {
+		return fmt.Errorf("%w: el precio no puede ser negativo", ErrInvalidAmount)
+	}
+	return nil
+}
+
+// ====================================================================
+// REPRESENTACIONES DE VARIANTE POR VERSIÓN
+// ====================================================================
+
+// ProductVariantV1: Variante con precios decimales. Price nil = precio del producto.
+type ProductVariantV1 struct {
+	ID             int               `json:"id"`
+	ProductID      int               `json:"product_id"`
+	SKU            string            `json:"sku"`
+	Attributes     map[string]string `json:"attributes"`
+	Price          *float64          `json:"price"`
+	Currency       string            `json:"currency"`
+	Stock          int               `json:"stock"`
+	EffectivePrice float64           `json:"effective_price"`
+}
+
+// ProductVariantV2: Variante con precios en unidades menores. PriceCents nil = precio del producto.
+type ProductVariantV2 struct {
+	ID                  int               `json:"id"`
+	ProductID           int               `json:"product_id"`
+	SKU                 string            `json:"sku"`
+	Attributes          map[string]string `json:"attributes"`
+	PriceCents          *int64            `json:"price_cents"`
+	Currency            string            `json:"currency"`
+	Stock               int               `json:"stock"`
+	EffectivePriceCents int64             `json:"effective_price_cents"`
+}
+
+func variantToV1(v ProductVariant) ProductVariantV1 {
+	v1 := ProductVariantV1{
+		ID:             v.ID,
+		ProductID:      v.ProductID,
+		SKU:            v.SKU,
+		Attributes:     v.Attributes,
+		Currency:       v.EffectivePrice.Currency,
+		Stock:          v.Stock,
+		EffectivePrice: v.EffectivePrice.Float64(),
+	}
+	if v.Price != nil {
+		price := v.Price.Float64()
+		v1.Price = &price
+	}
+	return v1
+}
+
+func variantToV2(v ProductVariant) ProductVariantV2 {
+	v2 := ProductVariantV2{
+		ID:                  v.ID,
+		ProductID:           v.ProductID,
+		SKU:                 v.SKU,
+		Attributes:          v.Attributes,
+		Currency:            v.EffectivePrice.Currency,
+		Stock:               v.Stock,
+		EffectivePriceCents: v.EffectivePrice.Amount,
+	}
+	if v.Price != nil {
+		cents := v.Price.Amount
+		v2.PriceCents = &cents
+	}
+	return v2
+}
+
+// versionedVariant devuelve la representación de v para la versión de la petición.
+func versionedVariant(r *http.Request, v ProductVariant) any {
+	if APIVersionFromRequest(r) == APIv2 {
+		return variantToV2(v)
+	}
+	return variantToV1(v)
+}
+
+// versionedVariants hace lo mismo que versionedVariant para una lista.
+func versionedVariants(r *http.Request, variants []ProductVariant) any {
+	if APIVersionFromRequest(r) == APIv2 {
+		result := make([]ProductVariantV2, 0, len(variants))
+		for _, v := range variants {
+			result = append(result, variantToV2(v))
+		}
+		return result
+	}
+	result := make([]ProductVariantV1, 0, len(variants))
+	for _, v := range variants {
+		result = append(result, variantToV1(v))
+	}
+	return result
+}
+
+// variantInput: Cuerpo de escritura de una variante. El precio está en la moneda del
+// producto, que se conoce después de leer el cuerpo (ver resolve).
+type variantInput struct {
+	SKU        string            `json:"sku"`
+	Attributes map[string]string `json:"attributes"`
+	Stock      int               `json:"stock"`
+	Price      json.RawMessage   `json:"price"`       // v1: null/ausente = precio del producto
+	PriceCents *int64            `json:"price_cents"` // v2
+
+	version APIVersion
+}
+
+// decodeVariant lee el cuerpo JSON de una variante en la versión de la petición.
+func decodeVariant(r *http.Request) (variantInput, error) {
+	var input variantInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	input.version = APIVersionFromRequest(r)
+	return input, err
+}
+
+// resolve arma la variante con el precio expresado en currency (la moneda del producto).
+func (in variantInput) resolve(currency string) (ProductVariant, error) {
+	variant := ProductVariant{SKU: in.SKU, Attributes: in.Attributes, Stock: in.Stock}
+	switch {
+	case in.version == APIv2 && in.PriceCents != nil:
+		variant.Price = &Money{Amount: *in.PriceCents, Currency: currency}
+	case in.version != APIv2 && len(in.Price) > 0 && string(in.Price) != "null":
+		amount, err := decimalText(in.Price)
+		if err != nil {
+			return ProductVariant{}, err
+		}
+		price, err := ParseMoney(amount, currency)
+		if err != nil {
+			return ProductVariant{}, err
+		}
+		variant.Price = &price
+	}
+	return variant, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newVersioningTestRouter monta el router completo sobre la DB falsa con un producto.
+func newVersioningTestRouter(t *testing.T) (http.Handler, string) {
+	t.Helper()
+	router, token, _ := newProductTestRouter(t)
+	return router, token
+}
+
+// newProductTestRouter es newVersioningTestRouter pero también devuelve la DB falsa
+// para cambiar las filas que responde.
+func newProductTestRouter(t *testing.T) (http.Handler, string, *fakeServer) {
+	t.Helper()
+
+	db, server := openFakeDB(t, "versioning")
+	server.SetRows(
+		[]string{"id", "name", "description", "price_minor", "currency", "stock", "images", "variant_count", "variant_stock", "min_price", "max_price"},
+		[]driver.Value{int64(1), "Laptop", "Portátil", int64(1999), "USD", int64(3), []byte("[]"), int64(0), int64(0), nil, nil},
+	)
+
+	cfg := DefaultConfig()
+	cfg.JWT.Secret = testJWTSecret
+	cfg.API.StrictResponses = true
+	router := setupRouter(NewDBCluster(db, nil, time.Second), NewProductEventBroker(cfg.Stream), newTestBlobStore(t), cfg)
+
+	token, err := GenerateToken(1, "user", testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router, token, server
+}
+
+func getWithToken(router http.Handler, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// Test: Las rutas legacy anuncian su retiro; las versionadas no
+func TestLegacyRoutesAreDeprecated(t *testing.T) {
+	router, token := newVersioningTestRouter(t)
+
+	legacy := getWithToken(router, "/productos", token)
+	if legacy.Code != http.StatusOK {
+		t.Fatalf("GET /productos retornó %d: %s", legacy.Code, legacy.Body.String())
+	}
+	if got := legacy.Header().Get("Deprecation"); !strings.HasPrefix(got, "@") {
+		t.Errorf("Deprecation incorrecto: got %q", got)
+	}
+	if got := legacy.Header().Get("Sunset"); got != "Fri, 30 Apr 2027 00:00:00 GMT" {
+		t.Errorf("Sunset incorrecto: got %q", got)
+	}
+	if got := legacy.Header().Get("Link"); got != `</api/v1/productos>; rel="successor-version"` {
+		t.Errorf("Link incorrecto: got %q", got)
+	}
+
+	v1 := getWithToken(router, "/api/v1/productos", token)
+	if v1.Code != http.StatusOK {
+		t.Fatalf("GET /api/v1/productos retornó %d: %s", v1.Code, v1.Body.String())
+	}
+	if got := v1.Header().Get("Deprecation"); got != "" {
+		t.Errorf("/api/v1 no debe estar obsoleta: got %q", got)
+	}
+}
+
+// Test: v1 devuelve el precio decimal y v2 en centavos
+func TestProductRepresentationByVersion(t *testing.T) {
+	router, token := newVersioningTestRouter(t)
+
+	var v1 []map[string]any
+	rr := getWithToken(router, "/api/v1/productos", token)
+	if err := json.Unmarshal(rr.Body.Bytes(), &v1); err != nil || len(v1) != 1 {
+		t.Fatalf("Respuesta v1 inválida: %s", rr.Body.String())
+	}
+	if v1[0]["price"] != 19.99 {
+		t.Errorf("v1 debe devolver price decimal: got %v", v1[0]["price"])
+	}
+
+	var v2 []map[string]any
+	rr = getWithToken(router, "/api/v2/productos", token)
+	if err := json.Unmarshal(rr.Body.Bytes(), &v2); err != nil || len(v2) != 1 {
+		t.Fatalf("Respuesta v2 inválida: %s", rr.Body.String())
+	}
+	if v2[0]["price_cents"] != float64(1999) {
+		t.Errorf("v2 debe devolver price_cents: got %v", v2[0]["price_cents"])
+	}
+	if price, _ := v2[0]["price"].(map[string]any); price["amount"] != "19.99" || price["currency"] != "USD" {
+		t.Error("v2 debe incluir price como Money con el importe en texto")
+	}
+}
+
+// Test: En v2 el cuerpo de escritura se lee en centavos
+func TestDecodeProductV2(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/v2/productos", strings.NewReader(`{"name":"Mouse","price_cents":2550,"stock":1}`))
+	var product Product
+	var err error
+	WithAPIVersion(APIv2)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		product, err = decodeProduct(r)
+	})).ServeHTTP(httptest.NewRecorder(), req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Money{Amount: 2550, Currency: "USD"}); product.Price != want {
+		t.Errorf("Precio incorrecto: got %+v want %+v", product.Price, want)
+	}
+}
+
+// Test: Un precio base negativo se rechaza con 400 en ambas versiones
+func TestNegativeProductPriceRejected(t *testing.T) {
+	router, token, server := newProductTestRouter(t)
+
+	cases := []struct{ path, body string }{
+		{"/api/v1/productos", `{"name":"Mouse","price":-5,"stock":1}`},
+		{"/api/v2/productos", `{"name":"Mouse","price_cents":-500,"stock":1}`},
+	}
+	for _, tc := range cases {
+		if rr := postWithToken(router, tc.path, tc.body, token); rr.Code != http.StatusBadRequest {
+			t.Errorf("POST %s %s: got %d want 400", tc.path, tc.body, rr.Code)
+		}
+	}
+	if n := countQueries(server.Queries(), "INSERT INTO products"); n != 0 {
+		t.Errorf("No debe llegar a la DB: %d INSERT", n)
+	}
+
+	// El precio 0 sigue siendo válido
+	if rr := postWithToken(router, "/api/v2/productos", `{"name":"Regalo","price_cents":0,"stock":1}`, token); rr.Code == http.StatusBadRequest {
+		t.Errorf("Precio 0: got %d %s", rr.Code, rr.Body.String())
+	}
+}
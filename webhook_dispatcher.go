@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ====================================================================
+// DESPACHADOR DE WEBHOOKS
+// Revisa el outbox cada PollInterval, reclama un lote de entregas pendientes
+// (FOR UPDATE SKIP LOCKED, así varias instancias no envían lo mismo) y hace
+// POST a cada receptor. Los fallos se reintentan con backoff exponencial;
+// al agotar MaxAttempts la entrega pasa a "dead" (dead-letter).
+// ====================================================================
+
+// Cabeceras de cada envío
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature" // t=<unix>,v1=<hex HMAC-SHA256>
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookIDHeader        = "X-Webhook-ID" // ID del evento: igual en todos los reintentos (para deduplicar)
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// WebhookPayload: Cuerpo JSON que recibe el receptor.
+type WebhookPayload struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// pendingDelivery: Entrega reclamada por el despachador.
+type pendingDelivery struct {
+	ID       int64
+	Attempts int
+	URL      string
+	Secret   string
+	Payload  WebhookPayload
+}
+
+// SignWebhookPayload calcula la cabecera de firma: HMAC-SHA256 de "<timestamp>.<body>".
+// Incluir el timestamp permite al receptor rechazar reenvíos antiguos (replay).
+func SignWebhookPayload(secret string, timestamp time.Time, body []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature es la verificación que debe hacer el receptor: firma
+// correcta (comparación en tiempo constante) y timestamp dentro de tolerance.
+func VerifyWebhookSignature(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var ts, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			signature = value
+		}
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || signature == "" {
+		return errors.New("cabecera de firma mal formada")
+	}
+	timestamp := time.Unix(unix, 0)
+	if now.Sub(timestamp).Abs() > tolerance {
+		return errors.New("timestamp de la firma fuera de tolerancia")
+	}
+
+	expected := SignWebhookPayload(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte("t="+ts+",v1="+signature)) {
+		return errors.New("firma inválida")
+	}
+	return nil
+}
+
+// WebhookDispatcher envía las entregas pendientes del outbox.
+type WebhookDispatcher struct {
+	DB     *sql.DB
+	Client *http.Client
+	cfg    WebhookConfig
+	now    func() time.Time
+}
+
+func NewWebhookDispatcher(db *sql.DB, cfg WebhookConfig) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		DB: db,
+		Client: &http.Client{
+			Timeout: time.Duration(cfg.Timeout),
+			// Una redirección cuenta como fallo: la URL registrada debe ser la definitiva
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		cfg: cfg,
+		now: time.Now,
+	}
+}
+
+// backoff devuelve la espera antes del siguiente intento tras attempts fallos:
+// base, 2×base, 4×base... hasta MaxBackoff.
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	delay := time.Duration(d.cfg.BaseBackoff)
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= time.Duration(d.cfg.MaxBackoff) {
+			return time.Duration(d.cfg.MaxBackoff)
+		}
+	}
+	return delay
+}
+
+// Run procesa el outbox hasta que ctx se cancele (al apagar el servidor).
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(d.cfg.PollInterval))
+	defer ticker.Stop()
+
+	for {
+		if _, err := d.DispatchPending(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Webhooks: error al procesar el outbox", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DispatchPending envía un lote de entregas pendientes y devuelve cuántas procesó.
+func (d *WebhookDispatcher) DispatchPending(ctx context.Context) (int, error) {
+	deadline := d.now().Add(d.lease())
+	deliveries, err := d.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	processed := 0
+	for _, delivery := range deliveries {
+		// Si el próximo POST podría terminar después de vencer el lease, otra instancia
+		// podría reclamar la entrega y enviarla dos veces: el resto queda para cuando
+		// el lease venza
+		if deadline.Sub(d.now()) < time.Duration(d.cfg.Timeout) {
+			break
+		}
+		statusCode, sendErr := d.send(ctx, delivery)
+		if err := d.record(ctx, delivery, statusCode, sendErr); err != nil {
+			return processed, err
+		}
+		processed++
+	}
+	return processed, nil
+}
+
+// lease: Tiempo que quedan reservadas las entregas reclamadas. El lote se envía en
+// serie y cada POST puede tardar hasta Timeout; PollInterval da margen a los UPDATE.
+func (d *WebhookDispatcher) lease() time.Duration {
+	return time.Duration(d.cfg.BatchSize)*time.Duration(d.cfg.Timeout) + time.Duration(d.cfg.PollInterval)
+}
+
+// claim reserva hasta BatchSize entregas vencidas. Se les adelanta next_attempt_at
+// (lease) para que ninguna otra instancia las tome mientras se envían; si esta
+// instancia muere a mitad, se reintentan al vencer el lease.
+func (d *WebhookDispatcher) claim(ctx context.Context) ([]pendingDelivery, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := d.DB.QueryContext(ctx, `
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = NOW() + make_interval(secs => $2)
+		FROM webhook_subscriptions s, webhook_events e
+		WHERE d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		AND s.id = d.subscription_id AND e.id = d.event_id
+		RETURNING d.id, d.attempts, s.url, s.secret, e.id, e.event_type, e.payload, e.created_at`,
+		d.cfg.BatchSize, d.lease().Seconds(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error al reclamar entregas: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	var deliveries []pendingDelivery
+	for rows.Next() {
+		var p pendingDelivery
+		var payload []byte
+		err := rows.Scan(&p.ID, &p.Attempts, &p.URL, &p.Secret,
+			&p.Payload.ID, &p.Payload.Type, &payload, &p.Payload.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error al leer entrega: %w", err)
+		}
+		p.Payload.Data = payload
+		deliveries = append(deliveries, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al leer entregas: %w", queryError(ctx, err))
+	}
+	return deliveries, nil
+}
+
+// send hace el POST firmado. Devuelve el código HTTP (0 si no hubo respuesta)
+// y un error si la entrega no se considera exitosa (solo 2xx lo es).
+func (d *WebhookDispatcher) send(ctx context.Context, delivery pendingDelivery) (int, error) {
+	body, err := json.Marshal(delivery.Payload)
+	if err != nil {
+		return 0, fmt.Errorf("error al serializar payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("error al crear petición: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "api-chi-webhooks/1.0")
+	req.Header.Set(WebhookEventHeader, delivery.Payload.Type)
+	req.Header.Set(WebhookIDHeader, strconv.FormatInt(delivery.Payload.ID, 10))
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(delivery.Secret, time.Now(), body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // Permite reutilizar la conexión
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("el receptor respondió %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliveryOutcome: Estado en que queda una entrega tras un intento.
+type deliveryOutcome struct {
+	Status   string // WebhookDeliveryDelivered, WebhookDeliveryPending (reintento) o WebhookDeliveryDead
+	Attempts int
+	RetryIn  time.Duration // Espera hasta el próximo intento (solo si Status es pending)
+}
+
+// outcome decide el resultado del intento: entregada, reintento con backoff o dead-letter.
+func (d *WebhookDispatcher) outcome(delivery pendingDelivery, sendErr error) deliveryOutcome {
+	attempts := delivery.Attempts + 1
+	switch {
+	case sendErr == nil:
+		return deliveryOutcome{Status: WebhookDeliveryDelivered, Attempts: attempts}
+	case attempts >= d.cfg.MaxAttempts:
+		return deliveryOutcome{Status: WebhookDeliveryDead, Attempts: attempts}
+	default:
+		return deliveryOutcome{Status: WebhookDeliveryPending, Attempts: attempts, RetryIn: d.backoff(attempts)}
+	}
+}
+
+// record guarda el resultado del intento.
+func (d *WebhookDispatcher) record(ctx context.Context, delivery pendingDelivery, statusCode int, sendErr error) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result := d.outcome(delivery, sendErr)
+	code := sql.NullInt64{Int64: int64(statusCode), Valid: statusCode != 0}
+
+	var err error
+	switch result.Status {
+	case WebhookDeliveryDelivered:
+		webhookDeliveriesTotal.WithLabelValues(WebhookDeliveryDelivered).Inc()
+		_, err = d.DB.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET status = 'delivered', attempts = $2, last_status_code = $3, last_error = NULL, delivered_at = NOW()
+			WHERE id = $1`, delivery.ID, result.Attempts, code)
+
+	case WebhookDeliveryDead:
+		webhookDeliveriesTotal.WithLabelValues(WebhookDeliveryDead).Inc()
+		slog.Warn("Webhooks: entrega en dead-letter", "delivery_id", delivery.ID, "url", delivery.URL, "attempts", result.Attempts, "err", sendErr)
+		_, err = d.DB.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET status = 'dead', attempts = $2, last_status_code = $3, last_error = $4
+			WHERE id = $1`, delivery.ID, result.Attempts, code, sendErr.Error())
+
+	default:
+		webhookDeliveriesTotal.WithLabelValues("retry").Inc()
+		_, err = d.DB.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET attempts = $2, last_status_code = $3, last_error = $4, next_attempt_at = NOW() + make_interval(secs => $5)
+			WHERE id = $1`, delivery.ID, result.Attempts, code, sendErr.Error(), result.RetryIn.Seconds())
+	}
+
+	if err != nil {
+		return fmt.Errorf("error al registrar entrega %d: %w", delivery.ID, queryError(ctx, err))
+	}
+	return nil
+}
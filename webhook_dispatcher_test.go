@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// newTestDispatcher crea un despachador sobre la DB falsa con una entrega pendiente
+// hacia receiverURL que ya lleva attempts intentos fallidos.
+func newTestDispatcher(t *testing.T, receiverURL string, attempts int) *WebhookDispatcher {
+	t.Helper()
+
+	db, server := openFakeDB(t, "webhooks")
+	server.SetRows(
+		[]string{"id", "attempts", "url", "secret", "event_id", "event_type", "payload", "created_at"},
+		[]driver.Value{int64(7), int64(attempts), receiverURL, testWebhookSecret, int64(42),
+			WebhookEventProductUpdated, []byte(`{"id":1,"name":"Laptop","stock":0}`), time.Now()},
+	)
+
+	cfg := DefaultConfig().Webhooks
+	cfg.MaxAttempts = 3
+	return NewWebhookDispatcher(db, cfg)
+}
+
+// Test: El receptor recibe el payload firmado
+func TestWebhookDispatcherDeliversSignedPayload(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		received <- r
+	}))
+	defer receiver.Close()
+
+	dispatcher := newTestDispatcher(t, receiver.URL, 0)
+	n, err := dispatcher.DispatchPending(context.Background())
+	if err != nil || n != 1 {
+		t.Fatalf("Se esperaba 1 entrega: n=%d err=%v", n, err)
+	}
+
+	req := <-received
+	if err := VerifyWebhookSignature(testWebhookSecret, req.Header.Get(WebhookSignatureHeader), body, 5*time.Minute, time.Now()); err != nil {
+		t.Errorf("Firma inválida: %v", err)
+	}
+	if got := req.Header.Get(WebhookEventHeader); got != WebhookEventProductUpdated {
+		t.Errorf("%s incorrecto: got %q", WebhookEventHeader, got)
+	}
+	if got := req.Header.Get(WebhookIDHeader); got != "42" {
+		t.Errorf("%s incorrecto: got %q", WebhookIDHeader, got)
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ID != 42 || payload.Type != WebhookEventProductUpdated || !strings.Contains(string(payload.Data), `"Laptop"`) {
+		t.Errorf("Payload incorrecto: %s", body)
+	}
+}
+
+// Test: Un fallo se reintenta con backoff y al agotar los intentos pasa a dead-letter
+func TestWebhookDispatcherRetriesThenDeadLetters(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	dispatcher := newTestDispatcher(t, receiver.URL, 0)
+	delivery := pendingDelivery{ID: 7, URL: receiver.URL, Secret: testWebhookSecret}
+	statusCode, sendErr := dispatcher.send(context.Background(), delivery)
+	if statusCode != http.StatusInternalServerError || sendErr == nil {
+		t.Fatalf("Un 500 es un fallo: got %d %v", statusCode, sendErr)
+	}
+
+	// Primer fallo: se reprograma con backoff
+	if got := dispatcher.outcome(delivery, sendErr); got.Status != WebhookDeliveryPending || got.Attempts != 1 || got.RetryIn != dispatcher.backoff(1) {
+		t.Errorf("El primer fallo debe reprogramarse: %+v", got)
+	}
+	// Último intento permitido (MaxAttempts = 3): dead-letter
+	delivery.Attempts = 2
+	if got := dispatcher.outcome(delivery, sendErr); got.Status != WebhookDeliveryDead || got.Attempts != 3 {
+		t.Errorf("Al agotar los intentos la entrega debe ir a dead-letter: %+v", got)
+	}
+	if got := dispatcher.outcome(delivery, nil); got.Status != WebhookDeliveryDelivered {
+		t.Errorf("Un envío exitoso queda entregado: %+v", got)
+	}
+
+	// DispatchPending registra el fallo sin devolver error
+	if n, err := dispatcher.DispatchPending(context.Background()); n != 1 || err != nil {
+		t.Errorf("DispatchPending: n=%d err=%v", n, err)
+	}
+}
+
+// Test: El lease cubre el lote entero y no se empieza un envío que podría terminar
+// después de vencerlo (otra instancia ya podría haber reclamado la entrega)
+func TestWebhookDispatcherLease(t *testing.T) {
+	cfg := DefaultConfig().Webhooks
+	if lease := NewWebhookDispatcher(nil, cfg).lease(); lease < time.Duration(cfg.BatchSize)*time.Duration(cfg.Timeout) {
+		t.Errorf("El lease (%v) no cubre %d envíos de %v", lease, cfg.BatchSize, time.Duration(cfg.Timeout))
+	}
+
+	// Reloj falso: cada POST (con su UPDATE) tarda 1,5 × Timeout
+	var mu sync.Mutex
+	now := time.Now()
+	var received []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r.Header.Get(WebhookDeliveryHeader))
+		now = now.Add(3 * time.Duration(cfg.Timeout) / 2)
+	}))
+	defer receiver.Close()
+
+	db, server := openFakeDB(t, "webhooks")
+	var rows [][]driver.Value
+	for id := int64(1); id <= 3; id++ {
+		rows = append(rows, []driver.Value{id, int64(0), receiver.URL, testWebhookSecret, id, WebhookEventProductUpdated, []byte(`{}`), time.Now()})
+	}
+	server.SetRows([]string{"id", "attempts", "url", "secret", "event_id", "event_type", "payload", "created_at"}, rows...)
+
+	cfg.BatchSize = 3
+	cfg.PollInterval = Duration(time.Second)
+	dispatcher := NewWebhookDispatcher(db, cfg)
+	dispatcher.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	n, err := dispatcher.DispatchPending(context.Background())
+	if err != nil || n != 2 {
+		t.Fatalf("Se esperaban 2 envíos antes de vencer el lease: n=%d err=%v", n, err)
+	}
+	if len(received) != 2 || received[0] != "1" || received[1] != "2" {
+		t.Errorf("Entregas enviadas: %q", received)
+	}
+}
+
+// Test: El backoff se duplica en cada intento hasta MaxBackoff
+func TestWebhookBackoff(t *testing.T) {
+	dispatcher := NewWebhookDispatcher(nil, WebhookConfig{
+		BaseBackoff: Duration(30 * time.Second),
+		MaxBackoff:  Duration(3 * time.Minute),
+	})
+
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}
+	for i, w := range want {
+		if got := dispatcher.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d): got %v want %v", i+1, got, w)
+		}
+	}
+}
+
+// Test: La verificación rechaza cuerpos alterados, otro secreto y firmas antiguas
+func TestVerifyWebhookSignature(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"id":1}`)
+	header := SignWebhookPayload(testWebhookSecret, now, body)
+
+	if err := VerifyWebhookSignature(testWebhookSecret, header, body, time.Minute, now); err != nil {
+		t.Errorf("La firma válida debe aceptarse: %v", err)
+	}
+	if err := VerifyWebhookSignature(testWebhookSecret, header, []byte(`{"id":2}`), time.Minute, now); err == nil {
+		t.Error("Un cuerpo alterado debe rechazarse")
+	}
+	if err := VerifyWebhookSignature("otro-secreto", header, body, time.Minute, now); err == nil {
+		t.Error("Un secreto distinto debe rechazarse")
+	}
+	if err := VerifyWebhookSignature(testWebhookSecret, header, body, time.Minute, now.Add(10*time.Minute)); err == nil {
+		t.Error("Una firma antigua debe rechazarse")
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ====================================================================
+// WEBHOOKS SALIENTES
+// Patrón outbox: cada cambio de producto inserta su evento en webhook_events
+// y una entrega pendiente por suscripción en webhook_deliveries, dentro de la
+// misma transacción que el cambio. El WebhookDispatcher (webhook_dispatcher.go)
+// las envía después, así un evento nunca se pierde ni se envía sin commit.
+// ====================================================================
+
+// Tipos de eventos
+const (
+	WebhookEventProductCreated    = "product.created"
+	WebhookEventProductUpdated    = "product.updated"
+	WebhookEventProductDeleted    = "product.deleted"
+	WebhookEventProductOutOfStock = "product.out_of_stock" // El stock pasó de >0 a 0
+)
+
+var webhookEventTypes = []string{
+	WebhookEventProductCreated,
+	WebhookEventProductUpdated,
+	WebhookEventProductDeleted,
+	WebhookEventProductOutOfStock,
+}
+
+// Estados de una entrega
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryDead      = "dead" // Agotó los reintentos (dead-letter)
+)
+
+var (
+	ErrWebhookNotFound         = errors.New("suscripción no encontrada")
+	ErrWebhookDeliveryNotFound = errors.New("entrega no encontrada")
+)
+
+// WebhookSubscription: Receptor de eventos. Secret solo se devuelve al crearla.
+type WebhookSubscription struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery: Estado de la entrega de un evento a una suscripción.
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	EventID        int64      `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	SubscriptionID int        `json:"subscription_id"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastStatusCode *int       `json:"last_status_code,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// validate revisa la URL y los eventos de una suscripción.
+func (s *WebhookSubscription) validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url inválida %q: debe ser http(s)://host/...", s.URL)
+	}
+	if len(s.Events) == 0 {
+		return errors.New("events no puede estar vacío")
+	}
+	for _, event := range s.Events {
+		if !slices.Contains(webhookEventTypes, event) {
+			return fmt.Errorf("evento desconocido %q (válidos: %v)", event, webhookEventTypes)
+		}
+	}
+	return nil
+}
+
+// newWebhookSecret genera un secreto aleatorio de 32 bytes para firmar los envíos.
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("no se pudo generar el secreto: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(buf), nil
+}
+
+// ====================================================================
+// OUTBOX
+// ====================================================================
+
+// EnqueueWebhookEvent guarda el evento y crea una entrega pendiente por cada
+// suscripción activa interesada. Debe llamarse dentro de la transacción del cambio.
+func EnqueueWebhookEvent(ctx context.Context, tx *sql.Tx, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("error al serializar evento %s: %w", eventType, err)
+	}
+
+	var eventID int64
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO webhook_events (event_type, payload) VALUES ($1, $2) RETURNING id`,
+		eventType, payload,
+	).Scan(&eventID)
+	if err != nil {
+		return fmt.Errorf("error al guardar evento %s en el outbox: %w", eventType, queryError(ctx, err))
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (event_id, subscription_id)
+		SELECT $1, id FROM webhook_subscriptions WHERE active AND $2 = ANY(events)`,
+		eventID, eventType,
+	)
+	if err != nil {
+		return fmt.Errorf("error al encolar entregas de %s: %w", eventType, queryError(ctx, err))
+	}
+	return nil
+}
+
+// ====================================================================
+// DAO DE SUSCRIPCIONES Y ENTREGAS
+// ====================================================================
+
+const webhookSubscriptionColumns = `id, url, events, active, created_at`
+
+func scanWebhookSubscription(scanner interface{ Scan(...any) error }) (WebhookSubscription, error) {
+	var s WebhookSubscription
+	err := scanner.Scan(&s.ID, &s.URL, pq.Array(&s.Events), &s.Active, &s.CreatedAt)
+	return s, err
+}
+
+// GetWebhookSubscriptions lista las suscripciones (sin secretos).
+func GetWebhookSubscriptions(ctx context.Context, db *sql.DB) ([]WebhookSubscription, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `SELECT `+webhookSubscriptionColumns+` FROM webhook_subscriptions ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar suscripciones: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	subscriptions := []WebhookSubscription{}
+	for rows.Next() {
+		s, err := scanWebhookSubscription(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error al leer suscripción: %w", err)
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al leer suscripciones: %w", queryError(ctx, err))
+	}
+	return subscriptions, nil
+}
+
+// GetWebhookSubscription devuelve una suscripción (sin secreto) o ErrWebhookNotFound.
+func GetWebhookSubscription(ctx context.Context, db *sql.DB, id int) (WebhookSubscription, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	row := db.QueryRowContext(ctx, `SELECT `+webhookSubscriptionColumns+` FROM webhook_subscriptions WHERE id = $1`, id)
+	s, err := scanWebhookSubscription(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return WebhookSubscription{}, ErrWebhookNotFound
+	}
+	if err != nil {
+		return WebhookSubscription{}, fmt.Errorf("error al consultar suscripción: %w", queryError(ctx, err))
+	}
+	return s, nil
+}
+
+// CreateWebhookSubscription inserta la suscripción con un secreto nuevo si no trae uno.
+func CreateWebhookSubscription(ctx context.Context, db *sql.DB, s WebhookSubscription) (WebhookSubscription, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	if s.Secret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			return WebhookSubscription{}, err
+		}
+		s.Secret = secret
+	}
+
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO webhook_subscriptions (url, secret, events, active)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`,
+		s.URL, s.Secret, pq.Array(s.Events), s.Active,
+	).Scan(&s.ID, &s.CreatedAt)
+	if err != nil {
+		return WebhookSubscription{}, fmt.Errorf("error al crear suscripción: %w", queryError(ctx, err))
+	}
+	return s, nil
+}
+
+// UpdateWebhookSubscription cambia URL, eventos y estado. El secreto solo cambia si se envía uno.
+func UpdateWebhookSubscription(ctx context.Context, db *sql.DB, s WebhookSubscription) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `
+		UPDATE webhook_subscriptions
+		SET url = $2, events = $3, active = $4, secret = COALESCE(NULLIF($5, ''), secret)
+		WHERE id = $1`,
+		s.ID, s.URL, pq.Array(s.Events), s.Active, s.Secret,
+	)
+	if err != nil {
+		return fmt.Errorf("error al actualizar suscripción: %w", queryError(ctx, err))
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// DeleteWebhookSubscription elimina la suscripción y sus entregas.
+func DeleteWebhookSubscription(ctx context.Context, db *sql.DB, id int) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM webhook_subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error al eliminar suscripción: %w", queryError(ctx, err))
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// GetWebhookDeliveries lista las últimas entregas, opcionalmente filtradas por estado.
+func GetWebhookDeliveries(ctx context.Context, db *sql.DB, status string, limit int) ([]WebhookDelivery, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT d.id, d.event_id, e.event_type, d.subscription_id, d.status, d.attempts,
+		       d.next_attempt_at, COALESCE(d.last_error, ''), d.last_status_code, d.delivered_at, d.created_at
+		FROM webhook_deliveries d
+		JOIN webhook_events e ON e.id = d.event_id
+		WHERE $1 = '' OR d.status = $1
+		ORDER BY d.id DESC
+		LIMIT $2`, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error al consultar entregas: %w", queryError(ctx, err))
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var statusCode sql.NullInt64
+		var deliveredAt sql.NullTime
+		err := rows.Scan(&d.ID, &d.EventID, &d.EventType, &d.SubscriptionID, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.LastError, &statusCode, &deliveredAt, &d.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error al leer entrega: %w", err)
+		}
+		if statusCode.Valid {
+			code := int(statusCode.Int64)
+			d.LastStatusCode = &code
+		}
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error al leer entregas: %w", queryError(ctx, err))
+	}
+	return deliveries, nil
+}
+
+// RedeliverWebhook vuelve a poner una entrega en cola (típicamente una en dead-letter)
+// con el contador de intentos a cero.
+func RedeliverWebhook(ctx context.Context, db *sql.DB, deliveryID int64) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW(), last_error = NULL
+		WHERE id = $1`, deliveryID)
+	if err != nil {
+		return fmt.Errorf("error al reencolar entrega: %w", queryError(ctx, err))
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrWebhookDeliveryNotFound
+	}
+	return nil
+}
+
+// ====================================================================
+// HANDLERS (solo admin)
+// ====================================================================
+
+func respondWebhookError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, ErrWebhookNotFound):
+		http.Error(w, "Suscripción no encontrada", http.StatusNotFound)
+	case errors.Is(err, ErrWebhookDeliveryNotFound):
+		http.Error(w, "Entrega no encontrada", http.StatusNotFound)
+	default:
+		respondDBError(w, err, action)
+	}
+}
+
+// decodeWebhookSubscription lee y valida el cuerpo JSON. active vale true si se omite.
+func decodeWebhookSubscription(w http.ResponseWriter, r *http.Request) (WebhookSubscription, bool) {
+	subscription := WebhookSubscription{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		http.Error(w, "JSON inválido o campos faltantes", http.StatusBadRequest)
+		return WebhookSubscription{}, false
+	}
+	if err := subscription.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return WebhookSubscription{}, false
+	}
+	return subscription, true
+}
+
+// GET /webhooks: Lista las suscripciones
+func ListWebhooksHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subscriptions, err := GetWebhookSubscriptions(r.Context(), db)
+		if err != nil {
+			respondDBError(w, err, "listar webhooks")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subscriptions)
+	}
+}
+
+// GET /webhooks/{id}: Devuelve una suscripción
+func GetWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+		subscription, err := GetWebhookSubscription(r.Context(), db, id)
+		if err != nil {
+			respondWebhookError(w, err, "obtener webhook")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subscription)
+	}
+}
+
+// POST /webhooks: Crea una suscripción. La respuesta es la única que incluye el
+// secreto: lleva no-store, así ni las cachés ni Idempotency-Key lo guardan.
+func CreateWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subscription, ok := decodeWebhookSubscription(w, r)
+		if !ok {
+			return
+		}
+		created, err := CreateWebhookSubscription(r.Context(), db, subscription)
+		if err != nil {
+			respondDBError(w, err, "crear webhook")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+// PUT /webhooks/{id}: Actualiza una suscripción (secret opcional para rotarlo)
+func UpdateWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+		subscription, ok := decodeWebhookSubscription(w, r)
+		if !ok {
+			return
+		}
+		subscription.ID = id
+
+		if err := UpdateWebhookSubscription(r.Context(), db, subscription); err != nil {
+			respondWebhookError(w, err, "actualizar webhook")
+			return
+		}
+		// Tras rotar el secreto la respuesta no se guarda (ni se repite con Idempotency-Key)
+		if subscription.Secret != "" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		subscription.Secret = ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subscription)
+	}
+}
+
+// DELETE /webhooks/{id}: Elimina una suscripción
+func DeleteWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+		if err := DeleteWebhookSubscription(r.Context(), db, id); err != nil {
+			respondWebhookError(w, err, "eliminar webhook")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GET /webhooks/entregas?estado=dead: Últimas 100 entregas (dead-letter con estado=dead)
+func ListWebhookDeliveriesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := r.URL.Query().Get("estado")
+		if status != "" && status != WebhookDeliveryPending && status != WebhookDeliveryDelivered && status != WebhookDeliveryDead {
+			http.Error(w, "estado debe ser pending, delivered o dead", http.StatusBadRequest)
+			return
+		}
+		deliveries, err := GetWebhookDeliveries(r.Context(), db, status, 100)
+		if err != nil {
+			respondDBError(w, err, "listar entregas de webhooks")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deliveries)
+	}
+}
+
+// POST /webhooks/entregas/{id}/reenviar: Reencola una entrega (p. ej. desde dead-letter)
+func RedeliverWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseIDParam(w, r)
+		if !ok {
+			return
+		}
+		if err := RedeliverWebhook(r.Context(), db, int64(id)); err != nil {
+			respondWebhookError(w, err, "reenviar webhook")
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
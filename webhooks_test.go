@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test: El secreto del webhook recién creado no se guarda en cachés ni en
+// idempotency_keys, y el reintento con la misma Idempotency-Key no crea otro
+func TestCreateWebhookHandlerNoStore(t *testing.T) {
+	db, server := openFakeDB(t, "webhooks")
+	cfg := DefaultConfig()
+	cfg.JWT.Secret = testJWTSecret
+	cfg.Idempotency.Backend = "memory"
+	router := setupRouter(NewDBCluster(db, nil, time.Second), NewProductEventBroker(cfg.Stream), newTestBlobStore(t), cfg)
+	server.SetRows([]string{"id", "created_at"}, []driver.Value{int64(4), time.Now()})
+
+	admin, _ := GenerateToken(1, RoleAdmin, testJWTSecret, time.Hour)
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v2/webhooks", strings.NewReader(`{"url":"https://example.com/hook","events":["product.updated"],"active":true}`))
+		req.Header.Set("Authorization", "Bearer "+admin)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(IdempotencyKeyHeader, "webhook-1")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send()
+	var created WebhookSubscription
+	if rr.Code != http.StatusCreated || json.Unmarshal(rr.Body.Bytes(), &created) != nil || !strings.HasPrefix(created.Secret, "whsec_") {
+		t.Fatalf("got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Cache-Control") != "no-store" {
+		t.Error("La respuesta con el secreto no debe guardarse en caché")
+	}
+
+	rr = send()
+	if rr.Code != http.StatusConflict || strings.Contains(rr.Body.String(), created.Secret) || !strings.Contains(rr.Body.String(), "id=4") {
+		t.Errorf("Reintento: got %d %s", rr.Code, rr.Body.String())
+	}
+	if n := countQueries(server.Queries(), "INSERT INTO webhook_subscriptions"); n != 1 {
+		t.Errorf("El reintento no debe crear otra suscripción: %d INSERT", n)
+	}
+}